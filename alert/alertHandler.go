@@ -3,9 +3,7 @@ package alert
 import (
 	"encoding/json"
 
-	"fmt"
 	"io/ioutil"
-	"math/rand"
 	"net/http"
 
 	"strconv"
@@ -15,12 +13,12 @@ import (
 
 	alertModel "github.com/tmax-cloud/hypercloud-api-server/alert/model"
 
-	"github.com/oklog/ulid"
+	gmux "github.com/gorilla/mux"
 	k8sApiCaller "github.com/tmax-cloud/hypercloud-api-server/util/caller"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
-	"k8s.io/apiserver/pkg/apis/audit"
 	"k8s.io/client-go/rest"
 	restclient "k8s.io/client-go/rest"
 
@@ -48,8 +46,17 @@ func init() {
 	// // flag.Parse()
 	// // config, err = clientcmd.BuildConfigFromFlags("", *kubeconfig)
 
+	// the scheme does not need a cluster, so it is registered even when the config is not loaded
+	setScheme()
+
 	// If api-server on Pod, active this code.
 	config, err = restclient.InClusterConfig()
+	if err == restclient.ErrNotInCluster {
+		// only unit tests load this package outside of a cluster. main stops when caller.Clientset is nil,
+		// which is loaded from the same in-cluster config, so the server never runs with config nil
+		klog.Errorln(err)
+		return
+	}
 	if err != nil {
 		panic(err.Error())
 	}
@@ -65,7 +72,6 @@ func init() {
 		klog.Errorln(err)
 		panic(err)
 	}
-	setScheme()
 
 }
 
@@ -96,57 +102,36 @@ func Post(res http.ResponseWriter, req *http.Request) {
 	req.ParseForm()
 	body, err := ioutil.ReadAll(req.Body)
 	if err != nil {
-		panic(err)
+		klog.Errorln(err)
+		util.SetResponse(res, err.Error(), nil, http.StatusBadRequest)
+		return
 	}
 
-	fmt.Printf("Get Alert Boday : %s\n", string(body))
+	klog.V(3).Infoln("Alert body: " + string(body))
 	var v alertModel.Alertaudit
-	json.Unmarshal([]byte(string(body)), &v)
+	if err := json.Unmarshal(body, &v); err != nil {
+		util.SetResponse(res, err.Error(), nil, http.StatusBadRequest)
+		return
+	}
 
 	for i := 0; i < len(v.Alert); i++ {
 		if v.Alert[i] == '_' {
-			fmt.Printf("%s\n", v.Alert)
 			v.Resource = v.Alert[0:i]
 			v.Status = v.Alert[i+1 : len(v.Alert)]
 		}
 	}
-	name_gen := v.Name + genUlid()
-	klog.Infoln("status : %s\nresource : %s\nalert : %s\nnamespace : %s\nmessage : %s\nname : %s\n", v.Status, v.Resource, v.Alert, v.Namespace, v.Message, name_gen)
-
-	pop := &audit.Event{}
-
-	pop.Kind = "Event"
-	pop.APIVersion = "audit.k8s.io/v1"
-	pop.Stage = "ResponseComplete"
-	pop.Verb = "alert"
-
-	pop.ObjectRef = &audit.ObjectReference{
-		Resource:  v.Resource,
-		Namespace: v.Namespace,
-		Name:      name_gen,
-	}
-	// pop.ObjectRef.Resource = v.Resource
-	// pop.ObjectRef.Namespace = v.Namespace
-	// pop.ObjectRef.Name = v.Name
-	pop.ResponseStatus = &metav1.Status{
-		Status:  v.Status,
-		Message: v.Message,
-	}
-	//pbytes, _ := json.Marshal(pop)
-	//buff := bytes.NewBuffer(pbytes)
-	//resp, err := http.Post("172.22.6.21:api/webhook/audit/batch", "application/json", buff)
-	if err != nil {
-		panic(err)
-	}
-	//defer resp.Body.Close()
-	alertBody := &alertModel.Alert{
+	fingerprint := labelsFingerprint(map[string]string{"name": v.Name, "alert": v.Alert, "namespace": v.Namespace, "instance": v.Instance})
+	alertBody := alertModel.Alert{
 		TypeMeta: metav1.TypeMeta{
 			Kind:       "Alert",
 			APIVersion: "tmax.io/v1",
 		},
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      name_gen,
+			Name:      alertResourceName(v.Name, fingerprint),
 			Namespace: v.Namespace,
+			Labels: map[string]string{
+				LABEL_FINGERPRINT: fingerprint,
+			},
 		},
 		Spec: alertModel.AlertSpec{
 			Name:     v.Alert,
@@ -155,9 +140,85 @@ func Post(res http.ResponseWriter, req *http.Request) {
 			Kind:     v.Status,
 		},
 	}
-	k8sApiCaller.CreateAlert(*alertBody, v.Namespace)
+	klog.Infof("status : %s\nresource : %s\nalert : %s\nnamespace : %s\nmessage : %s\nname : %s\n", v.Status, v.Resource, v.Alert, v.Namespace, v.Message, alertBody.Name)
+
+	now := time.Now()
+	saved, _, err := fire(alertBody, now)
+	if err != nil {
+		klog.Errorln(err)
+		util.SetResponse(res, err.Error(), nil, http.StatusInternalServerError)
+		return
+	}
+	auditAlert(*saved, "alert", "", nil, now)
+	if stateOf(*saved, now) == STATE_FIRING {
+		Notify(*saved, STATE_FIRING)
+	}
+	util.SetResponse(res, "", saved, http.StatusOK)
+}
+
+// PostAction acknowledges, silences for duration, or resolves the alert with namespace and name.
+// The caller needs update on alerts in the namespace.
+func PostAction(res http.ResponseWriter, req *http.Request) {
+	action := gmux.Vars(req)["action"]
+	klog.Infoln("**** POST /alert/" + action)
+	queryParams := req.URL.Query()
+	userId := queryParams.Get(util.QUERY_PARAMETER_USER_ID)
+	userGroups := queryParams[util.QUERY_PARAMETER_USER_GROUP]
+	namespace := queryParams.Get(util.QUERY_PARAMETER_NAMESPACE)
+	name := queryParams.Get(util.QUERY_PARAMETER_NAME)
+
+	states := map[string]string{"ack": STATE_ACKNOWLEDGED, "silence": STATE_SILENCED, "resolve": STATE_RESOLVED}
+	state, ok := states[action]
+	if !ok {
+		util.SetResponse(res, "Action ["+action+"] is not supported", nil, http.StatusNotFound)
+		return
+	}
+	if userId == "" {
+		util.SetResponse(res, "UserId is empty", nil, http.StatusBadRequest)
+		return
+	}
+	if namespace == "" || name == "" {
+		util.SetResponse(res, "Namespace and name are required", nil, http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	var until time.Time
+	if state == STATE_SILENCED {
+		duration, err := time.ParseDuration(queryParams.Get("duration"))
+		if err != nil || duration <= 0 {
+			util.SetResponse(res, "Duration must be positive, e.g. 30m or 2h", nil, http.StatusBadRequest)
+			return
+		}
+		until = now.Add(duration)
+	}
 
+	sar, err := k8sApiCaller.CreateSubjectAccessReview(userId, userGroups, alertResource.Group, alertResource.Resource, namespace, name, "update")
+	if err != nil {
+		klog.Errorln(err)
+		util.SetResponse(res, "", nil, http.StatusInternalServerError)
+		return
+	}
+	if !sar.Status.Allowed {
+		util.SetResponse(res, "Not authorized", nil, http.StatusForbidden)
+		return
+	}
+
+	saved, err := changeState(namespace, name, state, userId, until, now)
+	if status, ok := err.(errors.APIStatus); ok {
+		util.SetResponse(res, err.Error(), nil, int(status.Status().Code))
+		return
+	} else if err != nil {
+		klog.Errorln(err)
+		util.SetResponse(res, err.Error(), nil, http.StatusInternalServerError)
+		return
+	}
+	auditAlert(*saved, action, userId, userGroups, now)
+	if state == STATE_RESOLVED {
+		Notify(*saved, STATE_RESOLVED)
+	}
+	util.SetResponse(res, "", saved, http.StatusOK)
 }
+
 func makeTimeRange(timeUnit string, startTime string, endTime string, query string) string {
 	var start int64
 	end := time.Now().Unix()
@@ -186,9 +247,3 @@ func makeTimeRange(timeUnit string, startTime string, endTime string, query stri
 	query += " where metering_time between '" + time.Unix(start, 0).Format("2006-01-02 15:04:05") + "' and '" + time.Unix(end, 0).Format("2006-01-02 15:04:05") + "'"
 	return query
 }
-func genUlid() string {
-	t := time.Now().UTC()
-	entropy := rand.New(rand.NewSource(t.UnixNano()))
-	id := ulid.MustNew(ulid.Timestamp(t), entropy)
-	return id.String()
-}
@@ -0,0 +1,72 @@
+package alert
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// SLACK_WEBHOOK_HOST is the only host slack receivers may post to.
+const SLACK_WEBHOOK_HOST = "hooks.slack.com"
+
+var errDeniedAddress = errors.New("address is not allowed for receivers")
+
+// internalNetworks are the networks receivers must not reach, besides loopback, link local (the cloud metadata
+// endpoints) and unspecified addresses. A receiver url is given by namespace users, so the api server must not
+// post to the cluster or the node network on their behalf.
+var internalNetworks = func() []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range []string{"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"} {
+		_, network, _ := net.ParseCIDR(cidr)
+		networks = append(networks, network)
+	}
+	return networks
+}()
+
+// deniedIP tells if ip is loopback, link local, unspecified, multicast or in internalNetworks.
+func deniedIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast() || ip.IsUnspecified() {
+		return true
+	}
+	for _, network := range internalNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// denyInternalAddress is the Control of the notification dialer. It checks the address after name resolution,
+// so a host resolving to an internal address, or a redirect to one, is refused as well.
+func denyInternalAddress(network string, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || deniedIP(ip) {
+		return errDeniedAddress
+	}
+	return nil
+}
+
+// newNotificationClient returns the http client of webhook and slack receivers, which only reaches public addresses.
+// It ignores the proxy environment, since the proxy itself is usually an internal address.
+func newNotificationClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 5 * time.Second,
+		Control: denyInternalAddress,
+	}
+	return &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 5 * time.Second,
+			MaxIdleConns:        16,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+}
@@ -0,0 +1,179 @@
+package alert
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	alertModel "github.com/tmax-cloud/hypercloud-api-server/alert/model"
+	"github.com/tmax-cloud/hypercloud-api-server/audit"
+	k8sApiCaller "github.com/tmax-cloud/hypercloud-api-server/util/caller"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	auditApi "k8s.io/apiserver/pkg/apis/audit"
+	"k8s.io/client-go/util/retry"
+)
+
+// The state of an Alert is in LABEL_STATUS, so alerts can be listed by state.
+// Who changed it and when are kept in annotations.
+const (
+	STATE_FIRING       = "firing"
+	STATE_ACKNOWLEDGED = "acknowledged"
+	STATE_SILENCED     = "silenced"
+	STATE_RESOLVED     = "resolved"
+
+	ANNOTATION_OCCURRENCES      = "alert.tmax.io/occurrences"
+	ANNOTATION_LAST_OCCURRED_AT = "alert.tmax.io/last-occurred-at"
+	ANNOTATION_ACKNOWLEDGED_BY  = "alert.tmax.io/acknowledged-by"
+	ANNOTATION_ACKNOWLEDGED_AT  = "alert.tmax.io/acknowledged-at"
+	ANNOTATION_SILENCED_BY      = "alert.tmax.io/silenced-by"
+	ANNOTATION_SILENCED_AT      = "alert.tmax.io/silenced-at"
+	ANNOTATION_SILENCED_UNTIL   = "alert.tmax.io/silenced-until"
+	ANNOTATION_RESOLVED_BY      = "alert.tmax.io/resolved-by"
+	ANNOTATION_RESOLVED_AT      = "alert.tmax.io/resolved-at"
+
+	// who resolves alerts on a resolved notification
+	ALERTMANAGER_USER = "alertmanager"
+)
+
+var alertResource = schema.GroupResource{Group: "tmax.io", Resource: "alerts"}
+
+// stateAnnotations are cleared when an alert fires again after it is resolved
+var stateAnnotations = []string{ANNOTATION_ACKNOWLEDGED_BY, ANNOTATION_ACKNOWLEDGED_AT, ANNOTATION_SILENCED_BY,
+	ANNOTATION_SILENCED_AT, ANNOTATION_SILENCED_UNTIL, ANNOTATION_RESOLVED_BY, ANNOTATION_RESOLVED_AT}
+
+// stateOf returns the state of alert at now. A silence ends by itself, and alerts created before states existed are firing.
+func stateOf(alert alertModel.Alert, now time.Time) string {
+	state := alert.Labels[LABEL_STATUS]
+	switch state {
+	case STATE_ACKNOWLEDGED, STATE_RESOLVED:
+		return state
+	case STATE_SILENCED:
+		until, err := time.Parse(time.RFC3339, alert.Annotations[ANNOTATION_SILENCED_UNTIL])
+		if err == nil && now.Before(until) {
+			return state
+		}
+	}
+	return STATE_FIRING
+}
+
+func setState(alert *alertModel.Alert, state string) {
+	if alert.Labels == nil {
+		alert.Labels = map[string]string{}
+	}
+	if alert.Annotations == nil {
+		alert.Annotations = map[string]string{}
+	}
+	alert.Labels[LABEL_STATUS] = state
+}
+
+// fire saves an occurrence of incoming, which is named after its fingerprint. The first occurrence creates the Alert.
+// Later ones count up, and fire the Alert again if it was resolved or its silence ended.
+// Acknowledged and silenced Alerts keep their state. It returns the saved Alert and the state it had before.
+func fire(incoming alertModel.Alert, now time.Time) (*alertModel.Alert, string, error) {
+	var saved alertModel.Alert
+	var before string
+	err := retry.OnError(retry.DefaultRetry, func(err error) bool {
+		return errors.IsConflict(err) || errors.IsAlreadyExists(err)
+	}, func() error {
+		existing, err := k8sApiCaller.GetAlertByName(incoming.Name, incoming.Namespace)
+		if errors.IsNotFound(err) {
+			saved = incoming
+			saved.Labels, saved.Annotations = map[string]string{}, map[string]string{}
+			for key, value := range incoming.Labels {
+				saved.Labels[key] = value
+			}
+			for key, value := range incoming.Annotations {
+				saved.Annotations[key] = value
+			}
+			setState(&saved, STATE_FIRING)
+			saved.Annotations[ANNOTATION_OCCURRENCES] = "1"
+			saved.Annotations[ANNOTATION_LAST_OCCURRED_AT] = now.Format(time.RFC3339)
+			before = ""
+			return k8sApiCaller.CreateAlert(saved, saved.Namespace)
+		} else if err != nil {
+			return err
+		}
+
+		saved = *existing
+		before = stateOf(saved, now)
+		setState(&saved, before)
+		count, _ := strconv.Atoi(saved.Annotations[ANNOTATION_OCCURRENCES])
+		saved.Spec = incoming.Spec
+		for key, value := range incoming.Annotations {
+			saved.Annotations[key] = value
+		}
+		saved.Annotations[ANNOTATION_OCCURRENCES] = strconv.Itoa(count + 1)
+		saved.Annotations[ANNOTATION_LAST_OCCURRED_AT] = now.Format(time.RFC3339)
+		if before == STATE_FIRING || before == STATE_RESOLVED {
+			setState(&saved, STATE_FIRING)
+			for _, key := range stateAnnotations {
+				delete(saved.Annotations, key)
+			}
+		}
+		return k8sApiCaller.UpdateAlert(saved, saved.Namespace)
+	})
+	return &saved, before, err
+}
+
+// changeState moves the alert to state on behalf of user. A silence lasts until until.
+// Resolved alerts only fire again, so no other change is allowed on them.
+func changeState(namespace string, name string, state string, user string, until time.Time, now time.Time) (*alertModel.Alert, error) {
+	var saved alertModel.Alert
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		existing, err := k8sApiCaller.GetAlertByName(name, namespace)
+		if err != nil {
+			return err
+		}
+		saved = *existing
+		if stateOf(saved, now) == STATE_RESOLVED {
+			return errors.NewConflict(alertResource, name, fmt.Errorf("alert is already resolved"))
+		}
+
+		setState(&saved, state)
+		timestamp := now.Format(time.RFC3339)
+		switch state {
+		case STATE_ACKNOWLEDGED:
+			saved.Annotations[ANNOTATION_ACKNOWLEDGED_BY] = user
+			saved.Annotations[ANNOTATION_ACKNOWLEDGED_AT] = timestamp
+		case STATE_SILENCED:
+			saved.Annotations[ANNOTATION_SILENCED_BY] = user
+			saved.Annotations[ANNOTATION_SILENCED_AT] = timestamp
+			saved.Annotations[ANNOTATION_SILENCED_UNTIL] = until.Format(time.RFC3339)
+		case STATE_RESOLVED:
+			saved.Annotations[ANNOTATION_RESOLVED_BY] = user
+			saved.Annotations[ANNOTATION_RESOLVED_AT] = timestamp
+		}
+		return k8sApiCaller.UpdateAlert(saved, namespace)
+	})
+	return &saved, err
+}
+
+// auditAlert writes a change of alert to the audit log. verb is alert for occurrences, and the action otherwise.
+func auditAlert(alert alertModel.Alert, verb string, user string, userGroups []string, now time.Time) {
+	audit.Enqueue(auditApi.Event{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "Event",
+			APIVersion: "audit.k8s.io/v1",
+		},
+		AuditID:        types.UID(uuid.New().String()),
+		Stage:          auditApi.StageResponseComplete,
+		Verb:           verb,
+		User:           authenticationv1.UserInfo{Username: user, Groups: userGroups},
+		StageTimestamp: metav1.NewMicroTime(now),
+		ObjectRef: &auditApi.ObjectReference{
+			Resource:  alert.Spec.Resource,
+			Namespace: alert.Namespace,
+			Name:      alert.Name,
+		},
+		ResponseStatus: &metav1.Status{
+			Status:  alert.Labels[LABEL_STATUS],
+			Message: alert.Spec.Message,
+			Reason:  metav1.StatusReason(alert.Spec.Kind),
+		},
+	})
+}
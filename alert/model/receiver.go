@@ -0,0 +1,33 @@
+package alert
+
+import "time"
+
+// Receiver is where the alerts of a namespace are sent.
+type Receiver struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	// Type is email, webhook or slack
+	Type string `json:"type"`
+	// To are the addresses of an email receiver
+	To []string `json:"to,omitempty"`
+	// Url is the endpoint of a webhook receiver, or the incoming webhook of a slack receiver
+	Url string `json:"url,omitempty"`
+	// Severities and Resources route alerts whose kind and resource are listed. Empty matches every alert.
+	Severities []string `json:"severities,omitempty"`
+	Resources  []string `json:"resources,omitempty"`
+	// RateLimit is the most notifications sent to the receiver in an hour. 0 means the default.
+	RateLimit int `json:"rateLimit,omitempty"`
+
+	CreatedBy string    `json:"createdBy,omitempty"`
+	CreatedAt time.Time `json:"createdAt,omitempty"`
+	UpdatedAt time.Time `json:"updatedAt,omitempty"`
+}
+
+// Notification is the body posted to webhook receivers.
+type Notification struct {
+	Version  string `json:"version"`
+	Receiver string `json:"receiver"`
+	// Status is firing or resolved
+	Status string `json:"status"`
+	Alert  Alert  `json:"alert"`
+}
@@ -0,0 +1,268 @@
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	alertModel "github.com/tmax-cloud/hypercloud-api-server/alert/model"
+	"github.com/tmax-cloud/hypercloud-api-server/util"
+	db "github.com/tmax-cloud/hypercloud-api-server/util/dataFactory"
+	"k8s.io/klog"
+)
+
+const (
+	// defines the templates subject, email and slack
+	NOTIFICATION_TEMPLATE = "alert-notification.html"
+
+	DEFAULT_RATE_LIMIT = 60
+	// a firing alert is sent to a receiver again only after repeatInterval
+	repeatInterval = 10 * time.Minute
+
+	notifyWorkers   = 4
+	notifyQueueSize = 1024
+	notifyAttempts  = 4
+	notifyBackoff   = 10 * time.Second
+)
+
+type notification struct {
+	receiver alertModel.Receiver
+	status   string
+	alert    alertModel.Alert
+	attempt  int
+}
+
+// notificationData is given to the templates.
+type notificationData struct {
+	Receiver    string
+	Status      string
+	Namespace   string
+	Name        string
+	AlertName   string
+	Severity    string
+	Resource    string
+	Message     string
+	Occurrences string
+	StartsAt    string
+	Time        string
+}
+
+// permanentError fails a notification without retries.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+var (
+	notifications = make(chan notification, notifyQueueSize)
+	httpClient    = newNotificationClient()
+
+	limiterMu sync.Mutex
+	// tokens of each receiver, refilled at RateLimit per hour
+	buckets = map[string]*bucket{}
+	// when a firing alert was last sent to a receiver
+	lastSent = map[string]time.Time{}
+)
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// InitNotification creates the receiver table and starts the workers that send notifications.
+func InitNotification() error {
+	if _, err := db.Dbpool.Exec(context.TODO(), RECEIVER_CREATE_QUERY); err != nil {
+		return err
+	}
+	for i := 0; i < notifyWorkers; i++ {
+		go notifyWorker()
+	}
+	return nil
+}
+
+// Notify sends alert to the receivers of its namespace that route it. status is firing or resolved.
+// Sending is asynchronous, with retries.
+func Notify(alert alertModel.Alert, status string) {
+	receivers, err := listReceivers(alert.Namespace)
+	if err != nil {
+		klog.Errorln("Receivers of ", alert.Namespace, " are unknown: ", err)
+		return
+	}
+	now := time.Now()
+	for _, receiver := range receivers {
+		if !routes(receiver, alert) || !allow(receiver, alert, status, now) {
+			continue
+		}
+		enqueue(notification{receiver: receiver, status: status, alert: alert})
+	}
+}
+
+func enqueue(n notification) {
+	select {
+	case notifications <- n:
+	default:
+		klog.Errorln("Notification queue is full. Alert ", n.alert.Namespace, "/", n.alert.Name, " is not sent to ", n.receiver.Name)
+	}
+}
+
+// allow applies the rate limit of receiver, and holds back a firing alert sent to it within repeatInterval.
+func allow(receiver alertModel.Receiver, alert alertModel.Alert, status string, now time.Time) bool {
+	limiterMu.Lock()
+	defer limiterMu.Unlock()
+
+	key := receiver.Namespace + "/" + receiver.Name
+	alertKey := key + "/" + alert.Name
+	if status == STATE_FIRING {
+		if sent, ok := lastSent[alertKey]; ok && now.Sub(sent) < repeatInterval {
+			return false
+		}
+	}
+
+	limit := float64(receiver.RateLimit)
+	if limit == 0 {
+		limit = DEFAULT_RATE_LIMIT
+	}
+	b, ok := buckets[key]
+	if !ok {
+		b = &bucket{tokens: limit, last: now}
+		buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Hours() * limit
+	if b.tokens > limit {
+		b.tokens = limit
+	}
+	b.last = now
+	if b.tokens < 1 {
+		klog.Infoln("Receiver ", key, " is rate limited. Alert ", alert.Namespace, "/", alert.Name, " is not sent")
+		return false
+	}
+	b.tokens--
+
+	if status == STATE_FIRING {
+		lastSent[alertKey] = now
+	} else {
+		delete(lastSent, alertKey)
+	}
+	if len(lastSent) > 10000 {
+		for k, sent := range lastSent {
+			if now.Sub(sent) >= repeatInterval {
+				delete(lastSent, k)
+			}
+		}
+	}
+	return true
+}
+
+func notifyWorker() {
+	for n := range notifications {
+		err := send(n)
+		if err == nil {
+			continue
+		}
+		n.attempt++
+		if _, permanent := err.(*permanentError); permanent || n.attempt >= notifyAttempts {
+			klog.Errorln("Alert ", n.alert.Namespace, "/", n.alert.Name, " is not sent to ", n.receiver.Name, ": ", err)
+			continue
+		}
+		backoff := notifyBackoff * time.Duration(1<<uint(n.attempt-1))
+		klog.Infoln("Alert ", n.alert.Namespace, "/", n.alert.Name, " is sent to ", n.receiver.Name, " again in ", backoff, ": ", err)
+		retried := n
+		time.AfterFunc(backoff, func() { enqueue(retried) })
+	}
+}
+
+func send(n notification) error {
+	switch n.receiver.Type {
+	case RECEIVER_TYPE_EMAIL:
+		subject, err := render("subject", n)
+		if err != nil {
+			return &permanentError{err}
+		}
+		body, err := render("email", n)
+		if err != nil {
+			return &permanentError{err}
+		}
+		return util.SendHtmlEmail(n.receiver.To, html.UnescapeString(strings.TrimSpace(subject)), body)
+	case RECEIVER_TYPE_SLACK:
+		text, err := render("slack", n)
+		if err != nil {
+			return &permanentError{err}
+		}
+		return post(n.receiver.Url, map[string]string{"text": slackEscape(html.UnescapeString(strings.TrimSpace(text)))})
+	case RECEIVER_TYPE_WEBHOOK:
+		return post(n.receiver.Url, alertModel.Notification{
+			Version:  "1",
+			Receiver: n.receiver.Name,
+			Status:   n.status,
+			Alert:    n.alert,
+		})
+	}
+	return &permanentError{fmt.Errorf("receiver type %s is not supported", n.receiver.Type)}
+}
+
+// render executes name of the template file, read on every use so operators can change it without a restart.
+func render(name string, n notification) (string, error) {
+	t, err := template.ParseFiles(util.HtmlHomePath + NOTIFICATION_TEMPLATE)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := t.ExecuteTemplate(&buf, name, notificationData{
+		Receiver:    n.receiver.Name,
+		Status:      n.status,
+		Namespace:   n.alert.Namespace,
+		Name:        n.alert.Name,
+		AlertName:   n.alert.Spec.Name,
+		Severity:    n.alert.Spec.Kind,
+		Resource:    n.alert.Spec.Resource,
+		Message:     n.alert.Spec.Message,
+		Occurrences: n.alert.Annotations[ANNOTATION_OCCURRENCES],
+		StartsAt:    n.alert.Annotations[ANNOTATION_STARTS_AT],
+		Time:        time.Now().Format(time.RFC3339),
+	}); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// slackEscape escapes the control characters of slack messages.
+func slackEscape(text string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(text)
+}
+
+func post(url string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return &permanentError{err}
+	}
+	resp, err := httpClient.Post(url, "application/json", bytes.NewReader(body))
+	if errors.Is(err, errDeniedAddress) {
+		return &permanentError{err}
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	err = fmt.Errorf("status %s: %s", strconv.Itoa(resp.StatusCode), string(respBody))
+	if resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusTooManyRequests {
+		return &permanentError{err}
+	}
+	return err
+}
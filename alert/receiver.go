@@ -0,0 +1,159 @@
+package alert
+
+import (
+	"context"
+	goerrors "errors"
+	"net"
+	"net/mail"
+	"net/url"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+	alertModel "github.com/tmax-cloud/hypercloud-api-server/alert/model"
+	"github.com/tmax-cloud/hypercloud-api-server/util"
+	db "github.com/tmax-cloud/hypercloud-api-server/util/dataFactory"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	RECEIVER_TYPE_EMAIL   = "email"
+	RECEIVER_TYPE_WEBHOOK = "webhook"
+	RECEIVER_TYPE_SLACK   = "slack"
+
+	RECEIVER_CREATE_QUERY = "create table if not exists alert_receiver (namespace varchar(253) not null, name varchar(63) not null, " +
+		"type varchar(16) not null, addresses text[], url text, severities text[], resources text[], rate_limit integer not null default 0, " +
+		"created_by varchar(255), created_at timestamp not null default now(), updated_at timestamp not null default now(), " +
+		"primary key (namespace, name))"
+	RECEIVER_SELECT_QUERY = "select namespace, name, type, addresses, url, severities, resources, rate_limit, created_by, created_at, updated_at " +
+		"from alert_receiver"
+	RECEIVER_INSERT_QUERY = "insert into alert_receiver (namespace, name, type, addresses, url, severities, resources, rate_limit, created_by) " +
+		"values ($1, $2, $3, $4, $5, $6, $7, $8, $9)"
+	RECEIVER_UPDATE_QUERY = "update alert_receiver set type = $3, addresses = $4, url = $5, severities = $6, resources = $7, rate_limit = $8, " +
+		"updated_at = now() where namespace = $1 and name = $2"
+	RECEIVER_DELETE_QUERY = "delete from alert_receiver where namespace = $1 and name = $2"
+)
+
+var errReceiverNotFound = goerrors.New("Receiver is not found")
+
+func validateReceiver(receiver alertModel.Receiver) error {
+	if errs := validation.IsDNS1123Label(receiver.Name); len(errs) > 0 {
+		return goerrors.New("Receiver name [" + receiver.Name + "] is invalid: " + strings.Join(errs, ", "))
+	}
+	if receiver.Namespace == "" {
+		return goerrors.New("Namespace is empty")
+	}
+	if receiver.RateLimit < 0 {
+		return goerrors.New("Receiver rateLimit must not be negative")
+	}
+	switch receiver.Type {
+	case RECEIVER_TYPE_EMAIL:
+		if len(receiver.To) == 0 {
+			return goerrors.New("Email receiver needs to")
+		}
+		for _, address := range receiver.To {
+			if _, err := mail.ParseAddress(address); err != nil {
+				return goerrors.New("Address [" + address + "] is invalid")
+			}
+		}
+	case RECEIVER_TYPE_WEBHOOK, RECEIVER_TYPE_SLACK:
+		u, err := url.Parse(receiver.Url)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return goerrors.New("Receiver url [" + receiver.Url + "] is invalid")
+		}
+		if receiver.Type == RECEIVER_TYPE_SLACK && (u.Scheme != "https" || u.Hostname() != SLACK_WEBHOOK_HOST) {
+			return goerrors.New("Slack receiver url must be an incoming webhook of https://" + SLACK_WEBHOOK_HOST)
+		}
+		// 이름은 보낼 때 dialer에서 확인하고, 여기서는 바로 알 수 있는 주소만 거름
+		if ip := net.ParseIP(u.Hostname()); (ip != nil && deniedIP(ip)) || strings.EqualFold(u.Hostname(), "localhost") {
+			return goerrors.New("Receiver url [" + receiver.Url + "] must not be an internal address")
+		}
+	default:
+		return goerrors.New("Receiver type must be email, webhook or slack")
+	}
+	return nil
+}
+
+func scanReceiver(scan func(dest ...interface{}) error) (alertModel.Receiver, error) {
+	var receiver alertModel.Receiver
+	var receiverUrl, createdBy *string
+	err := scan(&receiver.Namespace, &receiver.Name, &receiver.Type, &receiver.To, &receiverUrl, &receiver.Severities,
+		&receiver.Resources, &receiver.RateLimit, &createdBy, &receiver.CreatedAt, &receiver.UpdatedAt)
+	if err != nil {
+		return receiver, err
+	}
+	if receiverUrl != nil {
+		receiver.Url = *receiverUrl
+	}
+	if createdBy != nil {
+		receiver.CreatedBy = *createdBy
+	}
+	receiver.CreatedAt = util.WallClock(receiver.CreatedAt)
+	receiver.UpdatedAt = util.WallClock(receiver.UpdatedAt)
+	return receiver, nil
+}
+
+func listReceivers(namespace string) ([]alertModel.Receiver, error) {
+	rows, err := db.Dbpool.Query(context.TODO(), RECEIVER_SELECT_QUERY+" where namespace = $1 order by name", namespace)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	receivers := []alertModel.Receiver{}
+	for rows.Next() {
+		receiver, err := scanReceiver(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		receivers = append(receivers, receiver)
+	}
+	return receivers, rows.Err()
+}
+
+func getReceiver(namespace string, name string) (alertModel.Receiver, error) {
+	receiver, err := scanReceiver(db.Dbpool.QueryRow(context.TODO(), RECEIVER_SELECT_QUERY+" where namespace = $1 and name = $2", namespace, name).Scan)
+	if err == pgx.ErrNoRows {
+		return receiver, errReceiverNotFound
+	}
+	return receiver, err
+}
+
+func insertReceiver(receiver alertModel.Receiver) error {
+	_, err := db.Dbpool.Exec(context.TODO(), RECEIVER_INSERT_QUERY, receiver.Namespace, receiver.Name, receiver.Type, receiver.To,
+		receiver.Url, receiver.Severities, receiver.Resources, receiver.RateLimit, receiver.CreatedBy)
+	return err
+}
+
+func updateReceiver(receiver alertModel.Receiver) error {
+	tag, err := db.Dbpool.Exec(context.TODO(), RECEIVER_UPDATE_QUERY, receiver.Namespace, receiver.Name, receiver.Type, receiver.To,
+		receiver.Url, receiver.Severities, receiver.Resources, receiver.RateLimit)
+	if err == nil && tag.RowsAffected() == 0 {
+		return errReceiverNotFound
+	}
+	return err
+}
+
+func deleteReceiver(namespace string, name string) error {
+	tag, err := db.Dbpool.Exec(context.TODO(), RECEIVER_DELETE_QUERY, namespace, name)
+	if err == nil && tag.RowsAffected() == 0 {
+		return errReceiverNotFound
+	}
+	return err
+}
+
+// routes tells if alert goes to receiver, by its kind (severity) and resource.
+func routes(receiver alertModel.Receiver, alert alertModel.Alert) bool {
+	return matches(receiver.Severities, alert.Spec.Kind) && matches(receiver.Resources, alert.Spec.Resource)
+}
+
+func matches(values []string, value string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
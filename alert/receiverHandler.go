@@ -0,0 +1,150 @@
+package alert
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	alertModel "github.com/tmax-cloud/hypercloud-api-server/alert/model"
+	"github.com/tmax-cloud/hypercloud-api-server/util"
+	k8sApiCaller "github.com/tmax-cloud/hypercloud-api-server/util/caller"
+	"k8s.io/klog"
+)
+
+// GetReceiver returns the receivers of namespace, or one receiver with name.
+func GetReceiver(res http.ResponseWriter, req *http.Request) {
+	klog.Infoln("**** GET /alert/receiver")
+	queryParams := req.URL.Query()
+	namespace := queryParams.Get(util.QUERY_PARAMETER_NAMESPACE)
+	name := queryParams.Get(util.QUERY_PARAMETER_NAME)
+	if !canAccessReceiver(res, req, namespace, "get") {
+		return
+	}
+
+	if name != "" {
+		receiver, err := getReceiver(namespace, name)
+		if err != nil {
+			setReceiverError(res, err)
+			return
+		}
+		util.SetResponse(res, "", receiver, http.StatusOK)
+		return
+	}
+	receivers, err := listReceivers(namespace)
+	if err != nil {
+		setReceiverError(res, err)
+		return
+	}
+	util.SetResponse(res, "", receivers, http.StatusOK)
+}
+
+// PostReceiver creates the receiver in the body.
+func PostReceiver(res http.ResponseWriter, req *http.Request) {
+	klog.Infoln("**** POST /alert/receiver")
+	receiver, ok := readReceiver(res, req)
+	if !ok || !canAccessReceiver(res, req, receiver.Namespace, "update") {
+		return
+	}
+	receiver.CreatedBy = req.URL.Query().Get(util.QUERY_PARAMETER_USER_ID)
+
+	if _, err := getReceiver(receiver.Namespace, receiver.Name); err == nil {
+		util.SetResponse(res, "Receiver ["+receiver.Name+"] already exists", nil, http.StatusConflict)
+		return
+	}
+	if err := insertReceiver(receiver); err != nil {
+		setReceiverError(res, err)
+		return
+	}
+	util.SetResponse(res, "", receiver, http.StatusCreated)
+}
+
+// PutReceiver replaces the receiver with the name and namespace in the body.
+func PutReceiver(res http.ResponseWriter, req *http.Request) {
+	klog.Infoln("**** PUT /alert/receiver")
+	receiver, ok := readReceiver(res, req)
+	if !ok || !canAccessReceiver(res, req, receiver.Namespace, "update") {
+		return
+	}
+	if err := updateReceiver(receiver); err != nil {
+		setReceiverError(res, err)
+		return
+	}
+	util.SetResponse(res, "", receiver, http.StatusOK)
+}
+
+func DeleteReceiver(res http.ResponseWriter, req *http.Request) {
+	klog.Infoln("**** DELETE /alert/receiver")
+	queryParams := req.URL.Query()
+	namespace := queryParams.Get(util.QUERY_PARAMETER_NAMESPACE)
+	name := queryParams.Get(util.QUERY_PARAMETER_NAME)
+	if name == "" {
+		util.SetResponse(res, "Name is empty", nil, http.StatusBadRequest)
+		return
+	}
+	if !canAccessReceiver(res, req, namespace, "update") {
+		return
+	}
+	if err := deleteReceiver(namespace, name); err != nil {
+		setReceiverError(res, err)
+		return
+	}
+	util.SetResponse(res, "", nil, http.StatusOK)
+}
+
+func readReceiver(res http.ResponseWriter, req *http.Request) (alertModel.Receiver, bool) {
+	var receiver alertModel.Receiver
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		klog.Errorln(err)
+		util.SetResponse(res, err.Error(), nil, http.StatusBadRequest)
+		return receiver, false
+	}
+	if err := json.Unmarshal(body, &receiver); err != nil {
+		util.SetResponse(res, err.Error(), nil, http.StatusBadRequest)
+		return receiver, false
+	}
+	if err := validateReceiver(receiver); err != nil {
+		util.SetResponse(res, err.Error(), nil, http.StatusBadRequest)
+		return receiver, false
+	}
+	return receiver, true
+}
+
+// canAccessReceiver checks verb on the namespace itself, so users who own a namespace manage its receivers.
+func canAccessReceiver(res http.ResponseWriter, req *http.Request, namespace string, verb string) bool {
+	queryParams := req.URL.Query()
+	userId := queryParams.Get(util.QUERY_PARAMETER_USER_ID)
+	userGroups := queryParams[util.QUERY_PARAMETER_USER_GROUP]
+
+	if userId == "" {
+		msg := "UserId is empty."
+		klog.Infoln(msg)
+		util.SetResponse(res, msg, nil, http.StatusBadRequest)
+		return false
+	}
+	if namespace == "" {
+		util.SetResponse(res, "Namespace is empty", nil, http.StatusBadRequest)
+		return false
+	}
+
+	sar, err := k8sApiCaller.CreateSubjectAccessReview(userId, userGroups, "", "namespaces", namespace, namespace, verb)
+	if err != nil {
+		klog.Errorln(err)
+		util.SetResponse(res, "", nil, http.StatusInternalServerError)
+		return false
+	}
+	if !sar.Status.Allowed {
+		util.SetResponse(res, "Not authorized", nil, http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func setReceiverError(res http.ResponseWriter, err error) {
+	if err == errReceiverNotFound {
+		util.SetResponse(res, err.Error(), nil, http.StatusNotFound)
+		return
+	}
+	klog.Errorln(err)
+	util.SetResponse(res, err.Error(), nil, http.StatusInternalServerError)
+}
@@ -0,0 +1,217 @@
+package alert
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	alertModel "github.com/tmax-cloud/hypercloud-api-server/alert/model"
+	"github.com/tmax-cloud/hypercloud-api-server/util"
+	k8sApiCaller "github.com/tmax-cloud/hypercloud-api-server/util/caller"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+)
+
+const (
+	LABEL_FINGERPRINT = "alert.tmax.io/fingerprint"
+	LABEL_STATUS      = "alert.tmax.io/status"
+
+	ANNOTATION_STARTS_AT     = "alert.tmax.io/starts-at"
+	ANNOTATION_GROUP_KEY     = "alert.tmax.io/group-key"
+	ANNOTATION_GENERATOR_URL = "alert.tmax.io/generator-url"
+)
+
+var invalidNameChars = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// WebhookTokenFile holds the bearer token Alertmanager must send to /alert/webhook,
+// set by the credentials_file of the http_config of the webhook receiver.
+var WebhookTokenFile string
+
+// PostWebhook receives the Alertmanager webhook. An alert is kept in one Alert named after its fingerprint,
+// so a new firing counts up and the resolved notification resolves it instead of adding more.
+// Alertmanager retries the whole message on 5xx, which is safe since repeated notifications are ignored.
+func PostWebhook(res http.ResponseWriter, req *http.Request) {
+	klog.Infoln("**** POST /alert/webhook")
+	if !isAlertmanager(res, req) {
+		return
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		klog.Errorln(err)
+		util.SetResponse(res, err.Error(), nil, http.StatusBadRequest)
+		return
+	}
+	var message alertModel.WebhookMessage
+	if err := json.Unmarshal(body, &message); err != nil {
+		util.SetResponse(res, err.Error(), nil, http.StatusBadRequest)
+		return
+	}
+	if message.Version != "4" {
+		util.SetResponse(res, "Webhook version ["+message.Version+"] is not supported", nil, http.StatusBadRequest)
+		return
+	}
+
+	failed := 0
+	for _, webhookAlert := range message.Alerts {
+		if err := receiveAlert(message, webhookAlert); err != nil {
+			klog.Errorln("Alert [", webhookAlert.Labels["alertname"], "] is not saved: ", err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		util.SetResponse(res, "Some alerts are not saved", nil, http.StatusInternalServerError)
+		return
+	}
+	util.SetResponse(res, "", nil, http.StatusOK)
+}
+
+// isAlertmanager checks the bearer token of the webhook against WebhookTokenFile.
+// Without the token file every webhook is rejected, since anyone could create Alerts otherwise.
+func isAlertmanager(res http.ResponseWriter, req *http.Request) bool {
+	if WebhookTokenFile == "" {
+		klog.Errorln("Alert webhook is rejected since alertWebhookTokenFile is not set")
+		util.SetResponse(res, "Webhook token is not configured", nil, http.StatusUnauthorized)
+		return false
+	}
+	token, err := ioutil.ReadFile(WebhookTokenFile)
+	if err != nil {
+		klog.Errorln(err)
+		util.SetResponse(res, "", nil, http.StatusInternalServerError)
+		return false
+	}
+	expected := "Bearer " + strings.TrimSpace(string(token))
+	if subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), []byte(expected)) != 1 {
+		util.SetResponse(res, "Not authorized", nil, http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+func receiveAlert(message alertModel.WebhookMessage, webhookAlert alertModel.WebhookAlert) error {
+	labels := webhookAlert.Labels
+	namespace := labels["namespace"]
+	if namespace == "" {
+		// cluster scoped alerts
+		namespace = util.HYPERCLOUD_SYSTEM_NAMESPACE
+	}
+	fingerprint := webhookAlert.Fingerprint
+	if fingerprint == "" {
+		fingerprint = labelsFingerprint(labels)
+	}
+	resource, kind := splitAlertName(labels["alertname"])
+	if labels["resource"] != "" {
+		resource = labels["resource"]
+	}
+	if labels["severity"] != "" {
+		kind = labels["severity"]
+	}
+
+	alert := alertModel.Alert{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "Alert",
+			APIVersion: "tmax.io/v1",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      alertResourceName(labels["alertname"], fingerprint),
+			Namespace: namespace,
+			Labels: map[string]string{
+				LABEL_FINGERPRINT: fingerprint,
+			},
+			Annotations: map[string]string{
+				ANNOTATION_STARTS_AT:     webhookAlert.StartsAt.Format(time.RFC3339),
+				ANNOTATION_GROUP_KEY:     message.GroupKey,
+				ANNOTATION_GENERATOR_URL: webhookAlert.GeneratorURL,
+			},
+		},
+		Spec: alertModel.AlertSpec{
+			Name:     labels["alertname"],
+			Message:  alertMessage(webhookAlert.Annotations),
+			Resource: resource,
+			Kind:     kind,
+		},
+	}
+	now := time.Now()
+
+	if webhookAlert.Status == alertModel.WEBHOOK_STATUS_RESOLVED {
+		resolved, err := changeState(namespace, alert.Name, STATE_RESOLVED, ALERTMANAGER_USER, time.Time{}, now)
+		if errors.IsNotFound(err) || errors.IsConflict(err) {
+			// nothing to close, e.g. the alert fired before this receiver was configured, or it is resolved already
+			klog.Infoln("Resolved alert ", namespace, "/", alert.Name, " has no open Alert")
+			return nil
+		} else if err != nil {
+			return err
+		}
+		auditAlert(*resolved, "resolve", ALERTMANAGER_USER, nil, now)
+		Notify(*resolved, STATE_RESOLVED)
+		return nil
+	}
+
+	existing, err := k8sApiCaller.GetAlertByName(alert.Name, namespace)
+	if err == nil && existing.Annotations[ANNOTATION_STARTS_AT] == alert.Annotations[ANNOTATION_STARTS_AT] &&
+		stateOf(*existing, now) != STATE_RESOLVED {
+		// Alertmanager repeats the notification of an alert that keeps firing
+		return nil
+	} else if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	fired, _, err := fire(alert, now)
+	if err != nil {
+		return err
+	}
+	auditAlert(*fired, "alert", ALERTMANAGER_USER, nil, now)
+	if stateOf(*fired, now) == STATE_FIRING {
+		Notify(*fired, STATE_FIRING)
+	}
+	return nil
+}
+
+// splitAlertName reads <resource>_<kind> names of the legacy alert rules.
+func splitAlertName(alertName string) (string, string) {
+	if i := strings.Index(alertName, "_"); i >= 0 {
+		return alertName[:i], alertName[i+1:]
+	}
+	return alertName, ""
+}
+
+func alertMessage(annotations map[string]string) string {
+	for _, key := range []string{"message", "description", "summary"} {
+		if annotations[key] != "" {
+			return annotations[key]
+		}
+	}
+	return ""
+}
+
+// labelsFingerprint stands in for the fingerprint that Alertmanager before 0.19 does not send.
+func labelsFingerprint(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	hash := sha256.New()
+	for _, name := range names {
+		hash.Write([]byte(name + "\xff" + labels[name] + "\xff"))
+	}
+	return hex.EncodeToString(hash.Sum(nil))[:16]
+}
+
+// alertResourceName is a DNS-1123 subdomain made of the alert name and the fingerprint.
+func alertResourceName(alertName string, fingerprint string) string {
+	name := strings.Trim(invalidNameChars.ReplaceAllString(strings.ToLower(alertName), "-"), "-")
+	if len(name) > 200 {
+		name = strings.TrimRight(name[:200], "-")
+	}
+	if name == "" {
+		name = "alert"
+	}
+	return name + "-" + invalidNameChars.ReplaceAllString(strings.ToLower(fingerprint), "")
+}
@@ -7,6 +7,7 @@ import (
 	_ "github.com/go-sql-driver/mysql"
 	auditDataFactory "github.com/tmax-cloud/hypercloud-api-server/util/dataFactory/audit"
 	"k8s.io/apiserver/pkg/apis/audit"
+	"k8s.io/klog"
 )
 
 var EventBuffer buffer
@@ -61,15 +62,16 @@ func (b *buffer) run() {
 				b.wg.Add(1)
 				go func() {
 					defer b.wg.Done()
-					auditDataFactory.Insert(eventList.Items)
+					if err := auditDataFactory.Store.Insert(eventList.Items); err != nil {
+						klog.Error(err)
+						Spool.spill(eventList.Items)
+					}
 				}()
 
 				b.wg.Add(1)
 				go func() {
 					defer b.wg.Done()
-					if len(hub.clients) > 0 {
-						hub.broadcast <- eventList
-					}
+					hub.publish(eventList)
 				}()
 				b.wg.Wait()
 			}
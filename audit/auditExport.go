@@ -0,0 +1,171 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/tmax-cloud/hypercloud-api-server/util"
+	auditDataFactory "github.com/tmax-cloud/hypercloud-api-server/util/dataFactory/audit"
+	"k8s.io/apiserver/pkg/apis/audit"
+	"k8s.io/klog"
+)
+
+const (
+	EXPORT_FORMAT_CSV       = "csv"
+	EXPORT_FORMAT_NDJSON    = "ndjson"
+	EXPORT_FORMAT_EVENTLIST = "eventlist"
+
+	// the response is flushed to the client every exportFlushSize events
+	exportFlushSize = 500
+)
+
+var exportCsvHeader = []string{"id", "username", "useragent", "namespace", "apigroup", "apiversion", "resource", "name",
+	"stage", "stagetimestamp", "verb", "code", "status", "reason", "message"}
+
+// ExportAudit streams every event matching the same filter as GetAudit. limit and offset are ignored.
+func ExportAudit(res http.ResponseWriter, req *http.Request) {
+	format := req.URL.Query().Get("format")
+	if format == "" {
+		format = EXPORT_FORMAT_NDJSON
+	}
+
+	var contentType string
+	switch format {
+	case EXPORT_FORMAT_CSV:
+		contentType = "text/csv"
+	case EXPORT_FORMAT_NDJSON:
+		contentType = "application/x-ndjson"
+	case EXPORT_FORMAT_EVENTLIST:
+		contentType = "application/json"
+	default:
+		util.SetResponse(res, "Format must be one of csv, ndjson, eventlist", nil, http.StatusBadRequest)
+		return
+	}
+
+	filter, ok := authorizedFilter(res, req)
+	if !ok {
+		return
+	}
+
+	fileName := "audit-" + time.Now().Format("20060102150405") + "." + format
+	if format == EXPORT_FORMAT_EVENTLIST {
+		fileName = "audit-" + time.Now().Format("20060102150405") + ".json"
+	}
+	res.Header().Set("Content-Type", contentType)
+	res.Header().Set("Content-Disposition", "attachment; filename=\""+fileName+"\"")
+	res.WriteHeader(http.StatusOK)
+
+	w := bufio.NewWriter(res)
+	flusher, _ := res.(http.Flusher)
+	flush := func() error {
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	}
+
+	var write func(audit.Event) error
+	var finish func() error
+	switch format {
+	case EXPORT_FORMAT_CSV:
+		cw := csv.NewWriter(w)
+		if err := cw.Write(exportCsvHeader); err != nil {
+			klog.Error(err)
+			return
+		}
+		write = func(event audit.Event) error {
+			cw.Write(toCsvRecord(event))
+			return cw.Error()
+		}
+		finish = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+	case EXPORT_FORMAT_NDJSON:
+		enc := json.NewEncoder(w)
+		write = func(event audit.Event) error {
+			return enc.Encode(event)
+		}
+		finish = func() error { return nil }
+	case EXPORT_FORMAT_EVENTLIST:
+		// items are written one by one, so the list itself is never held in memory
+		if _, err := w.WriteString(`{"kind":"EventList","apiVersion":"audit.k8s.io/v1","metadata":{},"items":[`); err != nil {
+			klog.Error(err)
+			return
+		}
+		first := true
+		write = func(event audit.Event) error {
+			if !first {
+				if err := w.WriteByte(','); err != nil {
+					return err
+				}
+			}
+			first = false
+			b, err := json.Marshal(event)
+			if err != nil {
+				return err
+			}
+			_, err = w.Write(b)
+			return err
+		}
+		finish = func() error {
+			_, err := w.WriteString("]}\n")
+			return err
+		}
+	}
+
+	count := 0
+	err := auditDataFactory.Store.Stream(filter, func(event audit.Event) error {
+		if err := write(event); err != nil {
+			return err
+		}
+		count++
+		if count%exportFlushSize == 0 {
+			return flush()
+		}
+		return nil
+	})
+	if err == nil {
+		err = finish()
+	}
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		// the status code has already been sent, so the client sees a truncated file
+		klog.Errorln("Audit export is aborted after ", count, " events: ", err)
+		return
+	}
+	klog.Infoln("Audit export finished: ", count, " events")
+}
+
+func toCsvRecord(event audit.Event) []string {
+	record := make([]string, len(exportCsvHeader))
+	record[0] = string(event.AuditID)
+	record[1] = event.User.Username
+	record[2] = event.UserAgent
+	if event.ObjectRef != nil {
+		record[3] = event.ObjectRef.Namespace
+		record[4] = event.ObjectRef.APIGroup
+		record[5] = event.ObjectRef.APIVersion
+		record[6] = event.ObjectRef.Resource
+		record[7] = event.ObjectRef.Name
+	}
+	record[8] = string(event.Stage)
+	record[9] = event.StageTimestamp.Time.Format(time.RFC3339Nano)
+	record[10] = event.Verb
+	if event.ResponseStatus != nil {
+		record[11] = strconv.Itoa(int(event.ResponseStatus.Code))
+		record[12] = event.ResponseStatus.Status
+		record[13] = string(event.ResponseStatus.Reason)
+		record[14] = event.ResponseStatus.Message
+	}
+	return record
+}
@@ -2,9 +2,11 @@ package audit
 
 import (
 	"encoding/json"
-	"fmt"
+	"errors"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -13,6 +15,7 @@ import (
 	"github.com/tmax-cloud/hypercloud-api-server/util"
 	"github.com/tmax-cloud/hypercloud-api-server/util/caller"
 	auditDataFactory "github.com/tmax-cloud/hypercloud-api-server/util/dataFactory/audit"
+	"github.com/tmax-cloud/hypercloud-api-server/util/dataFactory/query"
 	corev1 "k8s.io/api/core/v1"
 	types "k8s.io/apimachinery/pkg/types"
 	"k8s.io/apiserver/pkg/apis/audit"
@@ -32,9 +35,13 @@ type urlParam struct {
 	Code          string               `json:"code"`
 	Verb          string               `json:"verb"`
 	Status        string               `json:"status"`
+	User          string               `json:"user"`
 	Sort          []string             `json:"sort"`
 	Key           []string             `json:"key"`
 	Value         string               `json:"value"`
+	// resume point of a websocket or event stream
+	Since       string `json:"since"`
+	LastAuditId string `json:"lastAuditId"`
 }
 
 type response struct {
@@ -58,6 +65,14 @@ func ListAuditResource(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
+// GetSpoolStatus reports how many audit events were spilled to disk, replayed and dropped. Only admins can read it.
+func GetSpoolStatus(w http.ResponseWriter, r *http.Request) {
+	if !caller.IsAdmin(w, r) {
+		return
+	}
+	util.SetResponse(w, "", Spool.status(), http.StatusOK)
+}
+
 func UpdateAuditResource() {
 	klog.Infoln("Update Audit resource list")
 	caller.UpdateAuditResourceList()
@@ -89,10 +104,11 @@ func AddAudit(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	auditDataFactory.Insert(eventList.Items)
-	if len(hub.clients) > 0 {
-		hub.broadcast <- eventList
+	if err := auditDataFactory.Store.Insert(eventList.Items); err != nil {
+		klog.Error(err)
+		Spool.spill(eventList.Items)
 	}
+	hub.publish(eventList)
 	util.SetResponse(w, "", nil, http.StatusOK)
 }
 
@@ -122,11 +138,7 @@ func AddAuditBatch(w http.ResponseWriter, r *http.Request) {
 		event.StageTimestamp.Time = time.Now()
 	}
 
-	if len(EventBuffer.Buffer) < BufferSize {
-		EventBuffer.Buffer <- event
-	} else {
-		klog.Error("event is dropped.")
-	}
+	Enqueue(event)
 	util.SetResponse(w, "", nil, http.StatusOK)
 }
 
@@ -140,26 +152,17 @@ func MemberSuggestions(res http.ResponseWriter, r *http.Request) {
 	}
 	search := r.URL.Query().Get("search")
 
-	var b strings.Builder
-	b.WriteString("select username, count(*) from audit where 1=1 ")
-
+	var username string
 	if sarResult, err := caller.CreateSubjectAccessReview(userId, nil, "", "namespaces", "", "", "list"); err != nil {
 		klog.Errorln(err)
 	} else if sarResult.Status.Allowed == false {
-		b.WriteString("and username = '")
-		b.WriteString(userId)
-		b.WriteString("' ")
+		username = userId
 	}
-	b.WriteString("and username like '")
-	b.WriteString(search)
-	if search != "" {
-		b.WriteString("%' group by username order by count desc limit 5")
-	} else {
-		b.WriteString("' group by username order by count desc limit 5")
+	memberList, err := auditDataFactory.Store.MemberSuggestions(search, username)
+	if err != nil {
+		util.SetResponse(res, err.Error(), nil, http.StatusInternalServerError)
+		return
 	}
-	query := b.String()
-	klog.Info("query: ", query)
-	memberList, _ := auditDataFactory.GetMemberList(query)
 
 	memberListResponse := MemberListResponse{
 		MemberList: memberList,
@@ -170,6 +173,78 @@ func MemberSuggestions(res http.ResponseWriter, r *http.Request) {
 }
 
 func GetAudit(res http.ResponseWriter, req *http.Request) {
+	filter, ok := authorizedFilter(res, req)
+	if !ok {
+		return
+	}
+	if err := auditDataFactory.CheckPage(filter); err != nil {
+		util.SetResponse(res, err.Error(), nil, http.StatusBadRequest)
+		return
+	}
+	eventList, err := auditDataFactory.Store.Query(filter)
+	if err != nil {
+		util.SetResponse(res, err.Error(), nil, http.StatusInternalServerError)
+		return
+	}
+	count, err := auditDataFactory.Store.Count(filter)
+	if err != nil {
+		util.SetResponse(res, err.Error(), nil, http.StatusInternalServerError)
+		return
+	}
+
+	response := response{
+		EventList: eventList,
+		RowsCount: count,
+	}
+
+	util.SetResponse(res, "", response, http.StatusOK)
+}
+
+// GetAuditStats counts events grouped by groupBy (verb, resource, username, namespace, code, time),
+// with the same filters and namespace restriction as GetAudit.
+func GetAuditStats(res http.ResponseWriter, req *http.Request) {
+	queryParams := req.URL.Query()
+
+	groupBy := []string{}
+	for _, param := range queryParams["groupBy"] {
+		for _, group := range strings.Split(param, ",") {
+			if !util.Contains(auditDataFactory.StatGroups, group) {
+				util.SetResponse(res, "GroupBy must be one of "+strings.Join(auditDataFactory.StatGroups, ", "), nil, http.StatusBadRequest)
+				return
+			}
+			if !util.Contains(groupBy, group) {
+				groupBy = append(groupBy, group)
+			}
+		}
+	}
+	if len(groupBy) == 0 {
+		util.SetResponse(res, "GroupBy is empty.", nil, http.StatusBadRequest)
+		return
+	}
+	interval := queryParams.Get("interval")
+	if interval == "" {
+		interval = "hour"
+	}
+	if !util.Contains(auditDataFactory.StatIntervals, interval) {
+		util.SetResponse(res, "Interval must be one of "+strings.Join(auditDataFactory.StatIntervals, ", "), nil, http.StatusBadRequest)
+		return
+	}
+
+	filter, ok := authorizedFilter(res, req)
+	if !ok {
+		return
+	}
+	buckets, err := auditDataFactory.Store.Stats(filter, groupBy, interval)
+	if err != nil {
+		util.SetResponse(res, err.Error(), nil, http.StatusInternalServerError)
+		return
+	}
+	util.SetResponse(res, "", buckets, http.StatusOK)
+}
+
+// authorizedFilter makes the audit filter of a request, allowing non-admin users only their own namespaces.
+// If it returns false, the response has already been written.
+func authorizedFilter(res http.ResponseWriter, req *http.Request) (auditDataFactory.Filter, bool) {
 	var nsList corev1.NamespaceList
 	queryParams := req.URL.Query()
 	userId := queryParams.Get(util.QUERY_PARAMETER_USER_ID)
@@ -179,7 +254,7 @@ func GetAudit(res http.ResponseWriter, req *http.Request) {
 		msg := "UserId is empty."
 		klog.Infoln(msg)
 		util.SetResponse(res, msg, nil, http.StatusBadRequest)
-		return
+		return auditDataFactory.Filter{}, false
 	}
 
 	// ns get줘도 감사기록은 안보이게..
@@ -187,19 +262,19 @@ func GetAudit(res http.ResponseWriter, req *http.Request) {
 	if err != nil {
 		klog.Errorln(err)
 		util.SetResponse(res, "", nil, http.StatusInternalServerError)
-		return
+		return auditDataFactory.Filter{}, false
 	}
 
 	if !nsListSAR.Status.Allowed {
 		if queryParams.Get("namespace") == "" {
 			util.SetResponse(res, "Non-admin users should select namespace.", nil, http.StatusBadRequest)
-			return
+			return auditDataFactory.Filter{}, false
 		}
 		tmp := []string{}
 		// list ns w/ labelselector
 		if nsList = caller.GetAccessibleNS(userId, "", userGroups); len(nsList.Items) == 0 {
 			util.SetResponse(res, "no ns", nil, http.StatusOK)
-			return
+			return auditDataFactory.Filter{}, false
 		}
 		for _, item := range nsList.Items {
 			if item.Annotations["owner"] == userId {
@@ -208,7 +283,7 @@ func GetAudit(res http.ResponseWriter, req *http.Request) {
 		}
 		if !util.Contains(tmp, queryParams.Get("namespace")) {
 			util.SetResponse(res, "Not authorized", nil, http.StatusForbidden)
-			return
+			return auditDataFactory.Filter{}, false
 		}
 	}
 
@@ -227,215 +302,180 @@ func GetAudit(res http.ResponseWriter, req *http.Request) {
 	urlParam.StartTime = queryParams.Get("startTime")
 	urlParam.EndTime = queryParams.Get("endTime")
 	urlParam.Status = queryParams.Get("status")
+	urlParam.User = queryParams.Get("user")
 	urlParam.NamespaceList = nsList
 
-	query := queryBuilder(urlParam)
-	eventList, count := auditDataFactory.Get(query)
-
-	response := response{
-		EventList: eventList,
-		RowsCount: count,
+	filter, err := makeFilter(urlParam)
+	if err != nil {
+		util.SetResponse(res, err.Error(), nil, http.StatusBadRequest)
+		return auditDataFactory.Filter{}, false
 	}
-
-	util.SetResponse(res, "", response, http.StatusOK)
+	return filter, true
 }
 
+// GetAuditBodyByJson searches stored request/response bodies.
+// Conditions are given as filter=<request|response>.<path><op><value>, e.g. filter=request.spec.replicas=3
 func GetAuditBodyByJson(res http.ResponseWriter, req *http.Request) {
-	var nsList corev1.NamespaceList
 	queryParams := req.URL.Query()
-
-	key := queryParams[util.QUERY_PARAMETER_KEY]
-	value := queryParams.Get(util.QUERY_PARAMETER_VALUE)
 	userId := queryParams.Get(util.QUERY_PARAMETER_USER_ID)
 	userGroups := queryParams[util.QUERY_PARAMETER_USER_GROUP]
 
-	if len(key) == 0 || value == "" {
-		msg := "key or value is empty."
+	if userId == "" {
+		msg := "UserId is empty."
 		klog.Infoln(msg)
 		util.SetResponse(res, msg, nil, http.StatusBadRequest)
 		return
 	}
 
-	// admin 권한 체크
-	nsListSAR, err := caller.CreateSubjectAccessReview(userId, userGroups, "", "namespaces", "", "", "list")
+	jsonFilter, err := makeJsonFilter(queryParams)
+	if err != nil {
+		util.SetResponse(res, err.Error(), nil, http.StatusBadRequest)
+		return
+	}
+
+	allNamespaces, nsList, err := visibleNamespaces(userId, userGroups)
 	if err != nil {
 		klog.Errorln(err)
 		util.SetResponse(res, "", nil, http.StatusInternalServerError)
 		return
 	}
-
-	// admin이 아니라면...
-	if !nsListSAR.Status.Allowed {
-		if queryParams.Get("namespace") == "" {
-			util.SetResponse(res, "Non-admin users should select namespace.", nil, http.StatusBadRequest)
+	namespace := queryParams.Get(util.QUERY_PARAMETER_NAMESPACE)
+	if namespace != "" {
+		if !allNamespaces && !util.Contains(nsList, namespace) {
+			util.SetResponse(res, "Not authorized", nil, http.StatusForbidden)
 			return
 		}
-		tmp := []string{}
-		// list ns w/ labelselector
-		if nsList = caller.GetAccessibleNS(userId, "", userGroups); len(nsList.Items) == 0 {
+		jsonFilter.Namespaces = []string{namespace}
+	} else if !allNamespaces {
+		if len(nsList) == 0 {
 			util.SetResponse(res, "no ns", nil, http.StatusOK)
 			return
 		}
-		for _, item := range nsList.Items {
-			if item.Annotations["owner"] == userId {
-				tmp = append(tmp, item.Name)
-			}
-		}
-		if !util.Contains(tmp, queryParams.Get("namespace")) {
-			util.SetResponse(res, "Not authorized", nil, http.StatusForbidden)
-			return
-		}
+		jsonFilter.Namespaces = nsList
 	}
-	urlParam := urlParam{}
-	urlParam.Key = queryParams["key"]
-	urlParam.Value = queryParams.Get("value")
-	jquery := queryBuilderJson(urlParam)
 
-	claimList := auditDataFactory.GetByJson(jquery)
-
-	// response := auditDataFactory.ClaimListResponse{
-	// 	Claims:    claimList,
-	// 	RowsCount: count,
-	// }
+	claimList, err := auditDataFactory.Store.BodyByJson(jsonFilter)
+	if err != nil {
+		util.SetResponse(res, err.Error(), nil, http.StatusInternalServerError)
+		return
+	}
 
 	util.SetResponse(res, "", claimList, http.StatusOK)
-
 }
 
-func queryBuilder(param urlParam) string {
-	// search := param.Search
-	// userId := param.UserId
-	namespace := param.Namespace
-	resource := param.Resource
-	startTime := param.StartTime
-	endTime := param.EndTime
-	limit := param.Limit
-	offset := param.Offset
-	code := param.Code
-	verb := param.Verb
-	sort := param.Sort
-	status := param.Status
-	// nsList := param.NamespaceList
-
-	var b strings.Builder
-	b.WriteString("select *, count(*) over() as full_count from audit where 1=1 ")
-
-	// if startTime != "" && endTime != "" {
-	// 	b.WriteString("and stagetimestamp between to_timestamp(")
-	// 	b.WriteString(startTime)
-	// 	b.WriteString(") and to_timestamp(")
-	// 	b.WriteString(endTime)
-	// 	b.WriteString(")")
-	// }
-
-	////////////////////////////////////////////////////////////////////////////////////////
-	// b.WriteString(") as sub where 1=1 ")
-
-	// if search != "" {
-	// 	parsedSearch := strings.Replace(search, "_", "\\_", -1)
-	// 	b.WriteString("and username like '")
-	// 	b.WriteString(parsedSearch)
-	// 	b.WriteString("%' ")
-	// }
-
-	if startTime != "" && endTime != "" {
-		b.WriteString("and stagetimestamp between to_timestamp(")
-		b.WriteString(startTime)
-		b.WriteString(") and to_timestamp(")
-		b.WriteString(endTime)
-		b.WriteString(") ")
+// visibleNamespaces returns the namespaces whose audit records the user can see.
+// Users who can list namespaces see every namespace, others only the namespaces they own.
+func visibleNamespaces(userId string, userGroups []string) (bool, []string, error) {
+	nsListSAR, err := caller.CreateSubjectAccessReview(userId, userGroups, "", "namespaces", "", "", "list")
+	if err != nil {
+		return false, nil, err
 	}
-
-	if namespace != "" {
-		b.WriteString("and namespace = '")
-		b.WriteString(namespace)
-		b.WriteString("' ")
+	if nsListSAR.Status.Allowed {
+		return true, nil, nil
 	}
 
-	if resource != "" {
-		b.WriteString("and resource = '")
-		b.WriteString(resource)
-		b.WriteString("' ")
+	nsList := []string{}
+	for _, item := range caller.GetAccessibleNS(userId, "", userGroups).Items {
+		if item.Annotations["owner"] == userId {
+			nsList = append(nsList, item.Name)
+		}
 	}
+	return false, nsList, nil
+}
 
-	if status != "" {
-		b.WriteString("and status = '")
-		b.WriteString(status)
-		b.WriteString("' ")
-	}
+const (
+	maxJsonConditions = 10
+	maxJsonPathDepth  = 16
+	maxJsonValueLen   = 256
+)
 
-	if verb != "" {
-		b.WriteString("and verb = '")
-		b.WriteString(verb)
-		b.WriteString("' ")
+// makeJsonFilter parses filter conditions. Each path segment may only contain letters, digits, '_', '-' and '/',
+// and is passed to the backend as a query argument, never as part of the statement.
+// The legacy key/value parameters are read as a condition on the request body.
+func makeJsonFilter(queryParams url.Values) (auditDataFactory.JsonFilter, error) {
+	jsonFilter := auditDataFactory.JsonFilter{}
+	var err error
+	if jsonFilter.Limit, jsonFilter.Offset, err = query.ParsePage(queryParams.Get(util.QUERY_PARAMETER_LIMIT), queryParams.Get(util.QUERY_PARAMETER_OFFSET)); err != nil {
+		return jsonFilter, err
 	}
 
-	if code != "" {
-		codeNum, _ := strconv.ParseInt(code, 10, 32)
-		lowerBound := (codeNum / 100) * 100
-		upperBound := lowerBound + 99
-		b.WriteString("and code between '")
-		b.WriteString(fmt.Sprintf("%v", lowerBound))
-		b.WriteString("' and '")
-		b.WriteString(fmt.Sprintf("%v '", upperBound))
+	filters := queryParams["filter"]
+	if key := queryParams[util.QUERY_PARAMETER_KEY]; len(key) != 0 && !(len(key) == 1 && key[0] == "_all") {
+		filters = append(filters, auditDataFactory.BODY_SIDE_REQUEST+"."+strings.Join(key, ".")+"="+queryParams.Get(util.QUERY_PARAMETER_VALUE))
 	}
-
-	if sort != nil && len(sort) > 0 {
-		b.WriteString("order by ")
-		for _, s := range sort {
-			order := " asc, "
-			if string(s[0]) == "-" {
-				order = " desc, "
-				s = s[1:]
-			}
-			b.WriteString(s)
-			b.WriteString(order)
-		}
-		b.WriteString("stagetimestamp desc ")
-	} else {
-		b.WriteString("order by stagetimestamp desc ")
+	if len(filters) > maxJsonConditions {
+		return jsonFilter, errors.New("Too many filter conditions (max " + strconv.Itoa(maxJsonConditions) + ")")
 	}
 
-	if limit != "" {
-		b.WriteString("limit ")
-		b.WriteString(limit)
-		b.WriteString(" ")
-	} else {
-		b.WriteString("limit 100 ")
-	}
+	for _, f := range filters {
+		cond := auditDataFactory.JsonCondition{Op: auditDataFactory.JSON_OP_EXISTS}
+		path := f
+		if i := strings.Index(f, "!="); i >= 0 {
+			path, cond.Op, cond.Value = f[:i], auditDataFactory.JSON_OP_NOT_EQUAL, f[i+2:]
+		} else if i := strings.Index(f, "="); i >= 0 {
+			path, cond.Op, cond.Value = f[:i], auditDataFactory.JSON_OP_EQUAL, f[i+1:]
+		}
+		if len(cond.Value) > maxJsonValueLen {
+			return jsonFilter, errors.New("Filter value is too long (max " + strconv.Itoa(maxJsonValueLen) + ")")
+		}
 
-	if offset != "" {
-		b.WriteString("offset ")
-		b.WriteString(offset)
-		b.WriteString(" ")
-	} else {
-		b.WriteString("offset 0 ")
+		segments := strings.Split(path, ".")
+		if segments[0] != auditDataFactory.BODY_SIDE_REQUEST && segments[0] != auditDataFactory.BODY_SIDE_RESPONSE {
+			return jsonFilter, errors.New("Filter [" + f + "] must start with request. or response.")
+		}
+		cond.Side, cond.Path = segments[0], segments[1:]
+		if len(cond.Path) == 0 || len(cond.Path) > maxJsonPathDepth {
+			return jsonFilter, errors.New("Filter [" + f + "] must have 1 to " + strconv.Itoa(maxJsonPathDepth) + " path segments")
+		}
+		for _, segment := range cond.Path {
+			if !jsonPathSegment.MatchString(segment) {
+				return jsonFilter, errors.New("Filter [" + f + "] has an invalid path segment")
+			}
+		}
+		jsonFilter.Conditions = append(jsonFilter.Conditions, cond)
 	}
-	query := b.String()
-
-	klog.Info("query: ", query)
-	return query
+	return jsonFilter, nil
 }
 
-func queryBuilderJson(param urlParam) string {
-	key := param.Key
-	value := param.Value
+var jsonPathSegment = regexp.MustCompile(`^[A-Za-z0-9_\-/]+$`)
 
-	if len(key) == 1 && key[0] == "_all" {
-		// return all rows
-		return "select * from audit_body"
+// makeFilter validates url parameters and converts them into a backend independent filter.
+func makeFilter(param urlParam) (auditDataFactory.Filter, error) {
+	filter := auditDataFactory.Filter{
+		Namespace: param.Namespace,
+		Resource:  param.Resource,
+		Status:    param.Status,
+		Verb:      param.Verb,
+		Username:  param.User,
 	}
 
-	jquery := "select * from audit_body where body "
+	if param.StartTime != "" && param.EndTime != "" {
+		startTime, err := strconv.ParseInt(param.StartTime, 10, 64)
+		if err != nil {
+			return filter, errors.New("StartTime must be a unix timestamp")
+		}
+		endTime, err := strconv.ParseInt(param.EndTime, 10, 64)
+		if err != nil {
+			return filter, errors.New("EndTime must be a unix timestamp")
+		}
+		filter.StartTime = time.Unix(startTime, 0)
+		filter.EndTime = time.Unix(endTime, 0)
+	}
 
-	for i, k := range key {
-		if i == len(key)-1 { // if last key
-			jquery += "->> '" + k + "' "
-		} else {
-			jquery += "-> '" + k + "' "
+	if param.Code != "" {
+		codeNum, err := strconv.ParseInt(param.Code, 10, 32)
+		if err != nil {
+			return filter, errors.New("Code must be a number")
 		}
+		filter.CodeClass = int32((codeNum / 100) * 100)
 	}
-	jquery += "= '" + value + "' "
 
-	return jquery
+	var err error
+	if filter.Sort, err = query.ParseSort(param.Sort, auditDataFactory.SortColumns); err != nil {
+		return filter, err
+	}
+	if filter.Limit, filter.Offset, err = query.ParsePage(param.Limit, param.Offset); err != nil {
+		return filter, err
+	}
+	return filter, nil
 }
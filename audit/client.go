@@ -5,12 +5,21 @@
 package audit
 
 import (
-	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/tmax-cloud/hypercloud-api-server/util"
+	"github.com/tmax-cloud/hypercloud-api-server/util/caller"
 	auditDataFactory "github.com/tmax-cloud/hypercloud-api-server/util/dataFactory/audit"
+	"github.com/tmax-cloud/hypercloud-api-server/util/dataFactory/query"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apiserver/pkg/apis/audit"
 	"k8s.io/klog"
 )
@@ -22,34 +31,194 @@ func init() {
 
 const (
 	// Time allowed to write a message to the peer.
-	// writeWait = 10 * time.Second
+	writeWait = 10 * time.Second
 
 	// Time allowed to read the next pong message from the peer.
-	// pongWait = 10 * time.Second
+	pongWait = 60 * time.Second
+
+	// Send pings to peer with this period. Must be less than pongWait.
+	pingPeriod = (pongWait * 9) / 10
 
 	// Maximum message size allowed from peer.
-	maxMessageSize = 512
+	maxMessageSize = 4096
+
+	// Events replayed from the DB are sent in lists of this size.
+	replayBatchSize = 100
+
+	// At most this many events are replayed at once, the client can resume again from the last one.
+	maxReplayEvents = 10000
 )
 
 var (
-	newline = []byte{'\n'}
-	space   = []byte{' '}
+	// Set by flags in main.go
+	// AllowedOrigins is a comma separated list of origins allowed to open the websocket.
+	// If empty, only same origin requests are allowed.
+	AllowedOrigins string
 )
 
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
+	CheckOrigin:     checkOrigin,
 }
 var hub *Hub
 
+// Client is a subscriber of the hub, connected with a websocket or an event stream.
 type Client struct {
 	hub *Hub
 
+	// conn is nil for event stream clients
 	conn *websocket.Conn
 
+	// emit writes a message to the peer in the format of the transport
+	emit func(message interface{}) error
+
+	// caller and the namespaces whose events the caller can see, fixed on connect
+	userId        string
+	allNamespaces bool
+	namespaces    []string
+
+	// cond is written by readPump and read by the hub
+	mu   sync.RWMutex
 	cond urlParam
 
 	send chan audit.EventList
+
+	// replies to the peer's requests, written by writePump only
+	reply chan interface{}
+
+	// replay requests from readPump
+	replay chan resumePoint
+
+	// closed when writePump exits
+	done chan struct{}
+
+	// set by the hub when send was full and events had to be skipped. The hub sends nothing more
+	// while lagging, and the writer replays from resume, the last event queued before the first skip.
+	lagMu   sync.Mutex
+	lagging bool
+	resume  resumePoint
+
+	// last event the hub put in send, only used by the hub
+	queued resumePoint
+}
+
+// resumePoint is the last event a client has seen.
+type resumePoint struct {
+	Since   time.Time
+	AuditID types.UID
+}
+
+type wsError struct {
+	Error string `json:"error"`
+}
+
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range strings.Split(AllowedOrigins, ",") {
+		if allowed = strings.TrimSpace(allowed); allowed != "" && (allowed == "*" || allowed == origin) {
+			return true
+		}
+	}
+	// fall back to the same origin check of gorilla
+	return strings.HasSuffix(origin, "://"+r.Host)
+}
+
+func (c *Client) condition() urlParam {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cond
+}
+
+// setCondition checks that the caller can see the requested namespace before using cond.
+func (c *Client) setCondition(cond urlParam) error {
+	if !c.allNamespaces && cond.Namespace != "" && !util.Contains(c.namespaces, cond.Namespace) {
+		return errors.New("Not authorized")
+	}
+	c.mu.Lock()
+	c.cond = cond
+	c.mu.Unlock()
+	return nil
+}
+
+// visible reports whether an event may be sent to the client.
+func (c *Client) visible(event audit.Event) bool {
+	if c.allNamespaces {
+		return true
+	}
+	return event.ObjectRef != nil && util.Contains(c.namespaces, event.ObjectRef.Namespace)
+}
+
+// filter converts the current condition into a store filter restricted to the visible namespaces.
+func (c *Client) filter() (auditDataFactory.Filter, error) {
+	filter, err := makeFilter(c.condition())
+	if err != nil {
+		return filter, err
+	}
+	if !c.allNamespaces && filter.Namespace == "" {
+		filter.Namespaces = c.namespaces
+	}
+	return filter, nil
+}
+
+// parseSince accepts a unix timestamp or an RFC3339 time.
+func parseSince(since string) (time.Time, error) {
+	if unix, err := strconv.ParseInt(since, 10, 64); err == nil {
+		return time.Unix(unix, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, since)
+	if err != nil {
+		return t, errors.New("Since must be a unix timestamp or an RFC3339 time")
+	}
+	return t, nil
+}
+
+// handle answers a condition from the peer, either with the first page of matching events
+// or by replaying every event after the resume point.
+func (c *Client) handle(cond urlParam) {
+	if err := c.setCondition(cond); err != nil {
+		c.respond(wsError{Error: err.Error()})
+		return
+	}
+
+	if cond.Since != "" {
+		since, err := parseSince(cond.Since)
+		if err != nil {
+			c.respond(wsError{Error: err.Error()})
+			return
+		}
+		select {
+		case c.replay <- resumePoint{Since: since, AuditID: types.UID(cond.LastAuditId)}:
+		case <-c.done:
+		}
+		return
+	}
+
+	filter, err := c.filter()
+	if err == nil {
+		err = auditDataFactory.CheckPage(filter)
+	}
+	if err != nil {
+		c.respond(wsError{Error: err.Error()})
+		return
+	}
+	eventList, err := auditDataFactory.Store.Query(filter)
+	if err != nil {
+		klog.Error(err)
+		c.respond(wsError{Error: err.Error()})
+		return
+	}
+	c.respond(eventList)
+}
+
+func (c *Client) respond(message interface{}) {
+	select {
+	case c.reply <- message:
+	case <-c.done:
+	}
 }
 
 func (c *Client) readPump() {
@@ -57,66 +226,252 @@ func (c *Client) readPump() {
 		c.hub.unregister <- c
 		c.conn.Close()
 	}()
-	// c.conn.SetReadLimit(maxMessageSize)
-	// c.conn.SetReadDeadline(time.Now().Add(pongWait))
-	// c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
+	c.conn.SetReadLimit(maxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
 	for {
-		err := c.conn.ReadJSON(&c.cond)
+		var cond urlParam
+		err := c.conn.ReadJSON(&cond)
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				klog.Info(err)
 			}
 			break
 		}
+		c.handle(cond)
+		// a query may take a while, do not count it against the peer
+		c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	}
+}
+
+func (c *Client) writeJSON(message interface{}) error {
+	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return c.conn.WriteJSON(message)
+}
 
-		query := queryBuilder(c.cond)
-		eventList, _ := auditDataFactory.Get(query)
+func (c *Client) write(message interface{}) error {
+	return c.emit(message)
+}
 
-		respMsg, err := json.Marshal(eventList)
+// lastEvent returns the resume point after the last event of eventList.
+func lastEvent(eventList audit.EventList) resumePoint {
+	last := eventList.Items[len(eventList.Items)-1]
+	return resumePoint{Since: last.StageTimestamp.Time, AuditID: last.AuditID}
+}
 
-		c.conn.WriteMessage(websocket.TextMessage, respMsg)
-		if err != nil {
-			klog.Error(err)
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+// skip is called by the hub when send is full. Only the first skip records the resume point,
+// the events after it are all replayed.
+func (c *Client) skip() {
+	c.lagMu.Lock()
+	defer c.lagMu.Unlock()
+	if !c.lagging {
+		c.lagging = true
+		c.resume = c.queued
+	}
+}
+
+func (c *Client) isLagging() bool {
+	c.lagMu.Lock()
+	defer c.lagMu.Unlock()
+	return c.lagging
+}
+
+// catchUp returns the resume point and lets the hub send again, if events were skipped.
+func (c *Client) catchUp() (resumePoint, bool) {
+	c.lagMu.Lock()
+	defer c.lagMu.Unlock()
+	if !c.lagging {
+		return resumePoint{}, false
+	}
+	c.lagging = false
+	return c.resume, true
+}
+
+// replayFrom sends the stored events after point in order of time.
+func (c *Client) replayFrom(point resumePoint) error {
+	filter, err := c.filter()
+	if err != nil {
+		return c.write(wsError{Error: err.Error()})
+	}
+	filter.StartTime = point.Since
+	filter.EndTime = time.Now()
+	filter.Sort = []query.Order{{Column: "stagetimestamp"}}
+
+	eventList := newEventList()
+	count := 0
+	err = auditDataFactory.Store.Stream(filter, func(event audit.Event) error {
+		// the store filters by seconds, skip what the peer has already seen
+		if event.StageTimestamp.Time.Before(point.Since) || event.AuditID == point.AuditID {
+			return nil
+		}
+		eventList.Items = append(eventList.Items, event)
+		count++
+		if len(eventList.Items) >= replayBatchSize {
+			if err := c.write(eventList); err != nil {
+				return err
 			}
-			break
+			eventList = newEventList()
 		}
+		if count >= maxReplayEvents {
+			return errReplayLimit
+		}
+		return nil
+	})
+	if err != nil && err != errReplayLimit {
+		return err
+	}
+	if len(eventList.Items) > 0 {
+		return c.write(eventList)
 	}
+	return nil
+}
+
+var errReplayLimit = errors.New("replay limit is reached")
+
+func newEventList() audit.EventList {
+	eventList := audit.EventList{}
+	eventList.Kind = "EventList"
+	eventList.APIVersion = "audit.k8s.io/v1"
+	return eventList
+}
+
+// deliver writes events from the hub. If the hub skipped events while send was full,
+// they are fetched from the DB once the backlog, which ends at the resume point, is written.
+func (c *Client) deliver(message audit.EventList) error {
+	if err := c.write(message); err != nil {
+		return err
+	}
+	if len(c.send) == 0 {
+		if point, ok := c.catchUp(); ok {
+			return c.replayFrom(point)
+		}
+	}
+	return nil
 }
 
 func (c *Client) writePump() {
+	ticker := time.NewTicker(pingPeriod)
 	defer func() {
+		ticker.Stop()
+		close(c.done)
 		c.conn.Close()
 	}()
 	for {
 		select {
 		case message, ok := <-c.send:
-			// c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if !ok {
 				// The hub closed the channel.
+				c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
 				return
 			}
-			t, err := json.Marshal(message)
-			if err != nil {
+			if err := c.deliver(message); err != nil {
+				klog.Info(err)
+				return
+			}
+		case message := <-c.reply:
+			if err := c.write(message); err != nil {
 				klog.Info(err)
 				return
 			}
-			c.conn.WriteMessage(websocket.TextMessage, t)
+		case point := <-c.replay:
+			if err := c.replayFrom(point); err != nil {
+				klog.Info(err)
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
 		}
 	}
 }
 
+// bearerToken reads the token from the Authorization header, or from the token parameter
+// since browsers can not set headers on a websocket request.
+func bearerToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return r.URL.Query().Get("token")
+}
+
+// newClient authenticates the caller and finds the namespaces the caller can see.
+// If it returns false, the response has already been written.
+func newClient(w http.ResponseWriter, r *http.Request) (*Client, bool) {
+	token := bearerToken(r)
+	if token == "" {
+		util.SetResponse(w, "Token is empty.", nil, http.StatusUnauthorized)
+		return nil, false
+	}
+	user, err := caller.CreateTokenReview(token)
+	if err != nil {
+		klog.Info(err)
+		util.SetResponse(w, "Unauthorized", nil, http.StatusUnauthorized)
+		return nil, false
+	}
+	allNamespaces, namespaces, err := visibleNamespaces(user.Username, user.Groups)
+	if err != nil {
+		klog.Errorln(err)
+		util.SetResponse(w, "", nil, http.StatusInternalServerError)
+		return nil, false
+	}
+
+	return &Client{
+		hub:           hub,
+		userId:        user.Username,
+		allNamespaces: allNamespaces,
+		namespaces:    namespaces,
+		send:          make(chan audit.EventList, 256),
+		reply:         make(chan interface{}),
+		replay:        make(chan resumePoint, 1),
+		done:          make(chan struct{}),
+		queued:        resumePoint{Since: time.Now()},
+	}, true
+}
+
+// condFromQuery reads a condition and resume point given as url parameters.
+func condFromQuery(queryParams url.Values) urlParam {
+	return urlParam{
+		Namespace:   queryParams.Get(util.QUERY_PARAMETER_NAMESPACE),
+		Resource:    queryParams.Get(util.QUERY_PARAMETER_RESOURCE),
+		Code:        queryParams.Get(util.QUERY_PARAMETER_CODE),
+		Verb:        queryParams.Get("verb"),
+		Status:      queryParams.Get("status"),
+		User:        queryParams.Get("user"),
+		Since:       queryParams.Get("since"),
+		LastAuditId: queryParams.Get("lastAuditId"),
+	}
+}
+
+// ServeWss authenticates the caller with a bearer token and streams the audit events of the namespaces
+// the caller can see. The peer sends a condition (urlParam) as JSON; with since and lastAuditId,
+// the events after that point are replayed from the DB first.
 func ServeWss(w http.ResponseWriter, r *http.Request) {
-	upgrader.CheckOrigin = func(r *http.Request) bool { return true }
+	client, ok := newClient(w, r)
+	if !ok {
+		return
+	}
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println(err)
 		return
 	}
-	client := &Client{hub: hub, conn: conn, send: make(chan audit.EventList, 256)}
+	client.conn = conn
+	client.emit = client.writeJSON
 	client.hub.register <- client
 
 	go client.writePump()
+
+	// the condition and resume point can also be given as url parameters when reconnecting
+	cond := condFromQuery(r.URL.Query())
+	if cond.Since != "" {
+		go client.handle(cond)
+	} else if err := client.setCondition(cond); err != nil {
+		client.respond(wsError{Error: err.Error()})
+	}
+
 	go client.readPump()
 }
@@ -4,7 +4,6 @@ import (
 	"strconv"
 
 	"k8s.io/apiserver/pkg/apis/audit"
-	"k8s.io/klog"
 )
 
 type Hub struct {
@@ -38,13 +37,18 @@ func (h *Hub) run() {
 			}
 		case eventList := <-h.broadcast:
 			for client := range h.clients {
-				message := filter(eventList, client.cond)
+				// a lagging client gets the events from the DB, sending them here too would duplicate them
+				if client.isLagging() {
+					continue
+				}
+				message := filter(eventList, client)
 				if len(message.Items) != 0 {
 					select {
 					case client.send <- message:
+						client.queued = lastEvent(message)
 					default:
-						close(client.send)
-						delete(h.clients, client)
+						// a slow client is not dropped, it replays the skipped events from the DB once it catches up
+						client.skip()
 					}
 				}
 			}
@@ -52,30 +56,30 @@ func (h *Hub) run() {
 	}
 }
 
-func filter(eventList audit.EventList, cond urlParam) audit.EventList {
-	out := audit.EventList{}
-	out.Kind = "EventList"
-	out.APIVersion = "audit.k8s.io/v1"
-	code64, _ := strconv.ParseInt(cond.Code, 10, 32)
+// publish hands events to the hub. It only waits for the hub loop, never for clients.
+func (h *Hub) publish(eventList audit.EventList) {
+	h.broadcast <- eventList
+}
 
-	klog.Info("NS cond:", cond.Namespace)
-	klog.Info("RS cond:", cond.Resource)
-	klog.Info("Code cond:", cond.Code)
+func filter(eventList audit.EventList, client *Client) audit.EventList {
+	out := newEventList()
+	cond := client.condition()
+	code64, _ := strconv.ParseInt(cond.Code, 10, 32)
+	// the class of the code, as the store filters it (404 matches 400~499)
+	codeClass := int32((code64 / 100) * 100)
 
 	for _, data := range eventList.Items {
-		ns := cond.Namespace == "" || (data.ObjectRef.Namespace == cond.Namespace)
-		rs := cond.Resource == "" || (data.ObjectRef.Resource == cond.Resource)
-		code := cond.Code == "" || ((data.ResponseStatus.Code/100)*100 == int32(code64))
-
-		klog.Info("data.ObjectRef.Namespace:", data.ObjectRef.Namespace)
-		klog.Info("data.ObjectRef.Resource:", data.ObjectRef.Resource)
-		klog.Info("data.ResponseStatus.Code:", data.ResponseStatus.Code)
-
-		klog.Info("NS:", ns)
-		klog.Info("RS:", rs)
-		klog.Info("Code:", code)
+		if !client.visible(data) {
+			continue
+		}
+		ns := cond.Namespace == "" || (data.ObjectRef != nil && data.ObjectRef.Namespace == cond.Namespace)
+		rs := cond.Resource == "" || (data.ObjectRef != nil && data.ObjectRef.Resource == cond.Resource)
+		code := cond.Code == "" || (data.ResponseStatus != nil && (data.ResponseStatus.Code/100)*100 == codeClass)
+		verb := cond.Verb == "" || data.Verb == cond.Verb
+		status := cond.Status == "" || (data.ResponseStatus != nil && data.ResponseStatus.Status == cond.Status)
+		user := cond.User == "" || data.User.Username == cond.User
 
-		if ns && rs && code {
+		if ns && rs && code && verb && status && user {
 			out.Items = append(out.Items, data)
 		}
 	}
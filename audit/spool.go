@@ -0,0 +1,323 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	auditDataFactory "github.com/tmax-cloud/hypercloud-api-server/util/dataFactory/audit"
+	"k8s.io/apiserver/pkg/apis/audit"
+	"k8s.io/klog"
+)
+
+// Events that could not be written to the audit store are appended to a write-ahead log
+// under ./logs and replayed in order once the store is reachable again.
+const (
+	spoolDir         string        = "./logs/audit-spool"
+	spoolSuffix      string        = ".wal"
+	spoolMaxBytes    int64         = 512 * 1024 * 1024
+	spoolSegmentSize int64         = 4 * 1024 * 1024
+	spoolReplayBatch int           = 256
+	spoolReplayWait  time.Duration = time.Second * 30
+)
+
+var Spool = newSpool()
+
+type spool struct {
+	mu sync.Mutex
+
+	dir      string
+	maxBytes int64
+
+	// segment currently being appended to
+	current     *os.File
+	currentSize int64
+	// total bytes of every segment on disk
+	size   int64
+	loaded bool
+	// whether the store accepted the last replay. While it does not, the current segment is kept open,
+	// so a store that is down does not leave a segment per replay tick.
+	replayFailed bool
+
+	dropped  uint64
+	spilled  uint64
+	replayed uint64
+}
+
+type SpoolStatus struct {
+	Dropped  uint64 `json:"dropped"`
+	Spilled  uint64 `json:"spilled"`
+	Replayed uint64 `json:"replayed"`
+	Buffered int    `json:"buffered"`
+	Segments int    `json:"segments"`
+	Bytes    int64  `json:"bytes"`
+}
+
+func newSpool() *spool {
+	return &spool{
+		dir:      spoolDir,
+		maxBytes: spoolMaxBytes,
+	}
+}
+
+// Enqueue hands an event to the batch buffer without blocking.
+// If the buffer is full, the event is written to the spool instead.
+func Enqueue(event audit.Event) {
+	select {
+	case EventBuffer.Buffer <- event:
+	default:
+		Spool.spill([]audit.Event{event})
+	}
+}
+
+// load picks up segments left over from a previous run. Must be called with mu held.
+func (s *spool) load() error {
+	if s.loaded {
+		return nil
+	}
+	if err := os.MkdirAll(s.dir, os.ModePerm); err != nil {
+		return err
+	}
+	segments, err := s.segments()
+	if err != nil {
+		return err
+	}
+	s.size = 0
+	for _, seg := range segments {
+		if info, err := os.Stat(seg); err == nil {
+			s.size += info.Size()
+		}
+	}
+	s.loaded = true
+	return nil
+}
+
+// segments returns segment file paths, oldest first.
+func (s *spool) segments() ([]string, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []string
+	for _, f := range files {
+		if !f.IsDir() && strings.HasSuffix(f.Name(), spoolSuffix) {
+			segments = append(segments, filepath.Join(s.dir, f.Name()))
+		}
+	}
+	// segment names are UnixNano timestamps of the same width, so lexical order is creation order
+	sort.Strings(segments)
+	return segments, nil
+}
+
+// spill appends events to the current segment and syncs it to disk.
+// Events beyond maxBytes are dropped and counted.
+func (s *spool) spill(events []audit.Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		klog.Errorln("Failed to open audit spool: ", err)
+		atomic.AddUint64(&s.dropped, uint64(len(events)))
+		return
+	}
+
+	var written int
+	for _, event := range events {
+		line, err := json.Marshal(event)
+		if err != nil {
+			klog.Error(err)
+			atomic.AddUint64(&s.dropped, 1)
+			continue
+		}
+		line = append(line, '\n')
+		if s.size+int64(len(line)) > s.maxBytes {
+			atomic.AddUint64(&s.dropped, 1)
+			continue
+		}
+		if s.current == nil || s.currentSize >= spoolSegmentSize {
+			if err := s.rotate(); err != nil {
+				klog.Errorln("Failed to create audit spool segment: ", err)
+				atomic.AddUint64(&s.dropped, 1)
+				continue
+			}
+		}
+		n, err := s.current.Write(line)
+		s.currentSize += int64(n)
+		s.size += int64(n)
+		if err != nil {
+			klog.Error(err)
+			atomic.AddUint64(&s.dropped, 1)
+			continue
+		}
+		written++
+	}
+
+	if s.current != nil {
+		if err := s.current.Sync(); err != nil {
+			klog.Error(err)
+		}
+	}
+	atomic.AddUint64(&s.spilled, uint64(written))
+	if written < len(events) {
+		klog.Errorln(len(events)-written, " audit events are dropped.")
+	}
+}
+
+// rotate closes the current segment and opens a new one. Must be called with mu held.
+func (s *spool) rotate() error {
+	s.closeCurrent()
+	name := filepath.Join(s.dir, strconv.FormatInt(time.Now().UnixNano(), 10)+spoolSuffix)
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	s.current = f
+	s.currentSize = 0
+	return nil
+}
+
+func (s *spool) closeCurrent() {
+	if s.current != nil {
+		if err := s.current.Close(); err != nil {
+			klog.Error(err)
+		}
+		s.current = nil
+		s.currentSize = 0
+	}
+}
+
+// replay sends spooled events to the store, oldest segment first.
+// It stops at the first failure so the order of events is kept.
+func (s *spool) replay() {
+	s.mu.Lock()
+	if err := s.load(); err != nil {
+		s.mu.Unlock()
+		klog.Errorln("Failed to open audit spool: ", err)
+		return
+	}
+	// new spills go to a fresh segment while the closed ones are replayed
+	if !s.replayFailed {
+		s.closeCurrent()
+	}
+	segments, err := s.segments()
+	var current string
+	if s.current != nil {
+		current = s.current.Name()
+	}
+	s.mu.Unlock()
+	if err != nil {
+		klog.Error(err)
+		return
+	}
+
+	failed := false
+	defer func() {
+		s.mu.Lock()
+		s.replayFailed = failed
+		s.mu.Unlock()
+	}()
+	for _, seg := range segments {
+		if seg == current {
+			continue
+		}
+		info, err := os.Stat(seg)
+		if err != nil {
+			continue
+		}
+		if err := s.replaySegment(seg); err != nil {
+			klog.Errorln("Failed to replay audit spool segment ", seg, ": ", err)
+			failed = true
+			return
+		}
+		s.mu.Lock()
+		if err := os.Remove(seg); err != nil {
+			klog.Error(err)
+		} else {
+			s.size -= info.Size()
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *spool) replaySegment(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var events []audit.Event
+	flush := func() error {
+		if len(events) == 0 {
+			return nil
+		}
+		if err := auditDataFactory.Store.Insert(events); err != nil {
+			return err
+		}
+		atomic.AddUint64(&s.replayed, uint64(len(events)))
+		events = nil
+		return nil
+	}
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), int(spoolSegmentSize))
+	for scanner.Scan() {
+		var event audit.Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			// a torn write at the end of a segment can not be recovered
+			klog.Errorln("Skip broken audit spool record: ", err)
+			atomic.AddUint64(&s.dropped, 1)
+			continue
+		}
+		events = append(events, event)
+		if len(events) >= spoolReplayBatch {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return flush()
+}
+
+// StartReplay replays the spool periodically. Call it once the audit store is initialized.
+func StartReplay() {
+	Spool.runReplay()
+}
+
+func (s *spool) runReplay() {
+	go func() {
+		ticker := time.NewTicker(spoolReplayWait)
+		defer ticker.Stop()
+		for range ticker.C {
+			s.replay()
+		}
+	}()
+}
+
+func (s *spool) status() SpoolStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := SpoolStatus{
+		Dropped:  atomic.LoadUint64(&s.dropped),
+		Spilled:  atomic.LoadUint64(&s.spilled),
+		Replayed: atomic.LoadUint64(&s.replayed),
+		Buffered: len(EventBuffer.Buffer),
+		Bytes:    s.size,
+	}
+	if segments, err := s.segments(); err == nil {
+		status.Segments = len(segments)
+	}
+	return status
+}
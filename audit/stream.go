@@ -0,0 +1,153 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tmax-cloud/hypercloud-api-server/util"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apiserver/pkg/apis/audit"
+	"k8s.io/klog"
+)
+
+// Comment lines are sent this often so proxies do not close an idle stream.
+const streamKeepAlive = 15 * time.Second
+
+// eventId encodes the resume point of an event as "<unix nano>/<auditID>".
+func eventId(event audit.Event) string {
+	return strconv.FormatInt(event.StageTimestamp.Time.UnixNano(), 10) + "/" + string(event.AuditID)
+}
+
+func parseEventId(id string) (resumePoint, error) {
+	parts := strings.SplitN(id, "/", 2)
+	nano, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || len(parts) != 2 {
+		return resumePoint{}, errors.New("Last-Event-ID [" + id + "] is not an audit event id")
+	}
+	return resumePoint{Since: time.Unix(0, nano), AuditID: types.UID(parts[1])}, nil
+}
+
+// ServeStream sends audit events as Server-Sent Events, with the same authentication, authorization and
+// filters as ServeWss. A client resumes with the Last-Event-ID header (or lastEventId parameter),
+// or with since and lastAuditId.
+func ServeStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		util.SetResponse(w, "Streaming is not supported", nil, http.StatusInternalServerError)
+		return
+	}
+
+	queryParams := r.URL.Query()
+	cond := condFromQuery(queryParams)
+	var resume *resumePoint
+	lastEventId := r.Header.Get("Last-Event-ID")
+	if lastEventId == "" {
+		lastEventId = queryParams.Get("lastEventId")
+	}
+	if lastEventId != "" {
+		point, err := parseEventId(lastEventId)
+		if err != nil {
+			util.SetResponse(w, err.Error(), nil, http.StatusBadRequest)
+			return
+		}
+		resume = &point
+	} else if cond.Since != "" {
+		since, err := parseSince(cond.Since)
+		if err != nil {
+			util.SetResponse(w, err.Error(), nil, http.StatusBadRequest)
+			return
+		}
+		resume = &resumePoint{Since: since, AuditID: types.UID(cond.LastAuditId)}
+	}
+
+	client, ok := newClient(w, r)
+	if !ok {
+		return
+	}
+	if err := client.setCondition(cond); err != nil {
+		util.SetResponse(w, err.Error(), nil, http.StatusForbidden)
+		return
+	}
+	if _, err := client.filter(); err != nil {
+		util.SetResponse(w, err.Error(), nil, http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// disable response buffering of nginx
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	bw := bufio.NewWriter(w)
+	client.emit = func(message interface{}) error {
+		switch m := message.(type) {
+		case audit.EventList:
+			for _, event := range m.Items {
+				data, err := json.Marshal(event)
+				if err != nil {
+					return err
+				}
+				bw.WriteString("id: " + eventId(event) + "\nevent: audit\ndata: ")
+				bw.Write(data)
+				bw.WriteString("\n\n")
+			}
+		default:
+			data, err := json.Marshal(m)
+			if err != nil {
+				return err
+			}
+			bw.WriteString("event: error\ndata: ")
+			bw.Write(data)
+			bw.WriteString("\n\n")
+		}
+		if err := bw.Flush(); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+
+	client.hub.register <- client
+	defer func() {
+		client.hub.unregister <- client
+		close(client.done)
+	}()
+
+	// events published while replaying wait in send
+	if resume != nil {
+		if err := client.replayFrom(*resume); err != nil {
+			klog.Info(err)
+			return
+		}
+	}
+
+	ticker := time.NewTicker(streamKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case message, ok := <-client.send:
+			if !ok {
+				return
+			}
+			if err := client.deliver(message); err != nil {
+				klog.Info(err)
+				return
+			}
+		case <-ticker.C:
+			bw.WriteString(": keepalive\n\n")
+			if err := bw.Flush(); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
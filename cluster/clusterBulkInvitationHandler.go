@@ -0,0 +1,389 @@
+package cluster
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	gmux "github.com/gorilla/mux"
+	util "github.com/tmax-cloud/hypercloud-api-server/util"
+	caller "github.com/tmax-cloud/hypercloud-api-server/util/caller"
+	clusterDataFactory "github.com/tmax-cloud/hypercloud-api-server/util/dataFactory/cluster"
+	"k8s.io/klog"
+)
+
+const (
+	QUERY_PARAMETER_DRY_RUN = "dryRun"
+
+	BULK_INVITATION_MAX_ROWS = 500
+	// far more than BULK_INVITATION_MAX_ROWS rows take, so a large body is refused before it is decoded
+	BULK_INVITATION_MAX_BYTES = 1 << 20
+
+	BULK_RESULT_INVITED = "invited"
+	BULK_RESULT_PENDING = "pending"
+	BULK_RESULT_SKIPPED = "skipped"
+	BULK_RESULT_VALID   = "valid"
+	BULK_RESULT_FAILED  = "failed"
+
+	invitationMailQueueSize = 1024
+	invitationMailAttempts  = 4
+	invitationMailBackoff   = 30 * time.Second
+)
+
+// BulkInvitation is a row of a bulk invitation, a JSON object or a CSV record of attribute, member, role, name and namespaces.
+// In CSV, namespaces are separated by ";".
+type BulkInvitation struct {
+	// Attribute is user or group
+	Attribute string `json:"attribute"`
+	Member    string `json:"member"`
+	Role      string `json:"role"`
+	Name      string `json:"name,omitempty"`
+	// Namespaces are the remote namespaces Role is bound in. Empty binds it in the whole remote cluster.
+	Namespaces []string `json:"namespaces,omitempty"`
+
+	// row is the position in the body, the CSV record number including the header
+	row int
+}
+
+// BulkInvitationResult reports what happened to a row. Row counts from 1, as the record number of the uploaded CSV file.
+type BulkInvitationResult struct {
+	Row       int    `json:"row"`
+	Attribute string `json:"attribute"`
+	Member    string `json:"member"`
+	Role      string `json:"role"`
+	// Namespaces are the remote namespaces Role is bound in
+	Namespaces []string `json:"namespaces,omitempty"`
+	// Result is invited (group), pending (user mailed an invitation), valid (dry run), skipped or failed
+	Result  string `json:"result"`
+	Message string `json:"message,omitempty"`
+}
+
+// invitationMail is a queued mail. clusterMember is the pending row as read after it was saved,
+// so a retry can tell if the invitation was removed or re-sent in the meantime.
+type invitationMail struct {
+	clusterMember util.ClusterMemberInfo
+	userId        string
+	attempt       int
+}
+
+var (
+	invitationMails      = make(chan invitationMail, invitationMailQueueSize)
+	invitationMailWorker sync.Once
+)
+
+// BulkInvite invites the users and groups in the body, a JSON list of BulkInvitation or CSV when Content-Type is text/csv.
+// Each row is checked against the members of the cluster and the rows before it, and the response reports every row.
+// Users are mailed asynchronously. With dryRun=true rows are only checked.
+func BulkInvite(res http.ResponseWriter, req *http.Request) {
+	queryParams := req.URL.Query()
+	userId := queryParams.Get(QUERY_PARAMETER_USER_ID)
+	userGroups := queryParams[util.QUERY_PARAMETER_USER_GROUP]
+	dryRun := queryParams.Get(QUERY_PARAMETER_DRY_RUN) == "true"
+	vars := gmux.Vars(req)
+	cluster := vars["clustermanager"]
+	namespace := vars["namespace"]
+
+	if err := util.StringParameterException(userGroups, userId, cluster, namespace); err != nil {
+		klog.Errorln(err)
+		util.SetResponse(res, err.Error(), nil, http.StatusBadRequest)
+		return
+	}
+
+	invitations, err := readBulkInvitations(res, req)
+	if err != nil {
+		klog.Errorln(err)
+		util.SetResponse(res, err.Error(), nil, http.StatusBadRequest)
+		return
+	}
+
+	// cluster ready 인지 확인
+	clm, err := caller.GetCluster(userId, userGroups, cluster, namespace)
+	if err != nil {
+		util.SetResponse(res, err.Error(), nil, http.StatusInternalServerError)
+		return
+	}
+	if !clm.Status.Ready || clm.Status.Phase == "Deleting" {
+		msg := "Cannot invite member to cluster in deleting phase or not ready status"
+		klog.Infoln(msg)
+		util.SetResponse(res, msg, nil, http.StatusBadRequest)
+		return
+	}
+
+	unlock, err := lockCluster(namespace, cluster)
+	if err != nil {
+		klog.Errorln(err)
+		util.SetResponse(res, err.Error(), nil, http.StatusInternalServerError)
+		return
+	}
+	defer unlock()
+
+	clusterMemberList, err := clusterDataFactory.ListClusterMember(cluster, namespace)
+	if err != nil {
+		klog.Errorln(err)
+		util.SetResponse(res, err.Error(), nil, http.StatusInternalServerError)
+		return
+	}
+
+	// 초대할 권한이 있는지 확인
+	var clusterOwner string
+	status := map[string]string{}
+	for _, val := range clusterMemberList {
+		if val.Status == "owner" {
+			clusterOwner = val.MemberId
+		}
+		status[val.Attribute+"/"+val.MemberId] = val.Status
+	}
+	if userId != clusterOwner {
+		msg := "Request user [ " + userId + " ]is not a cluster owner [ " + clusterOwner + " ]"
+		klog.Infoln(msg)
+		util.SetResponse(res, msg, nil, http.StatusBadRequest)
+		return
+	}
+
+	sarResult, err := caller.CreateSubjectAccessReview(userId, userGroups, util.CLUSTER_API_GROUP, "clustermanagers", namespace, cluster, "update")
+	if err != nil {
+		klog.Errorln(err)
+		util.SetResponse(res, err.Error(), nil, http.StatusInternalServerError)
+		return
+	}
+	if !sarResult.Status.Allowed {
+		msg := " User [ " + userId + " ] is not a owner of cluster or owner role is deleted."
+		klog.Infoln(msg)
+		util.SetResponse(res, msg, nil, http.StatusBadRequest)
+		return
+	}
+
+	results := []BulkInvitationResult{}
+	succeeded := 0
+	for _, invitation := range invitations {
+		result := BulkInvitationResult{
+			Row:       invitation.row,
+			Attribute: invitation.Attribute,
+			Member:    invitation.Member,
+			Role:      invitation.Role,
+		}
+		if msg := checkBulkInvitation(invitation, status); msg != "" {
+			result.Result = BULK_RESULT_SKIPPED
+			result.Message = msg
+			results = append(results, result)
+			continue
+		}
+		remoteRole, remoteNamespaces, err := validateRemoteRole(invitation.Role, invitation.Namespaces)
+		if err != nil {
+			result.Result = BULK_RESULT_SKIPPED
+			result.Message = err.Error()
+			results = append(results, result)
+			continue
+		}
+		result.Role = remoteRole
+		result.Namespaces = remoteNamespaces
+		// 같은 요청 안의 중복도 거르도록 표시
+		status[invitation.Attribute+"/"+invitation.Member] = "requested"
+
+		clusterMember := util.ClusterMemberInfo{
+			Namespace:        namespace,
+			Cluster:          cluster,
+			MemberId:         invitation.Member,
+			MemberName:       invitation.Name,
+			Attribute:        invitation.Attribute,
+			Role:             remoteRole,
+			RemoteNamespaces: remoteNamespaces,
+		}
+		switch {
+		case dryRun:
+			result.Result = BULK_RESULT_VALID
+		case invitation.Attribute == "group":
+			clusterMember.Status = "invited"
+			if err := addGroup(clm, clusterMember); err != nil {
+				result.Result = BULK_RESULT_FAILED
+				result.Message = err.Error()
+			} else {
+				result.Result = BULK_RESULT_INVITED
+			}
+		default:
+			clusterMember.Status = "pending"
+			if err := clusterDataFactory.Insert(clusterMember); err != nil {
+				result.Result = BULK_RESULT_FAILED
+				result.Message = err.Error()
+			} else {
+				result.Result = BULK_RESULT_PENDING
+				if pendingUser, err := clusterDataFactory.GetPendingUser(clusterMember); err == nil && pendingUser.Status != "" {
+					clusterMember = *pendingUser
+				}
+				enqueueInvitationMail(invitationMail{clusterMember: clusterMember, userId: userId})
+			}
+		}
+		if result.Result != BULK_RESULT_FAILED {
+			succeeded++
+		}
+		results = append(results, result)
+	}
+
+	msg := strconv.Itoa(succeeded) + " of " + strconv.Itoa(len(invitations)) + " members are invited to cluster [" + cluster + "]"
+	if dryRun {
+		msg = strconv.Itoa(succeeded) + " of " + strconv.Itoa(len(invitations)) + " members can be invited to cluster [" + cluster + "]"
+	}
+	klog.Infoln(msg)
+	util.SetResponse(res, msg, results, http.StatusOK)
+}
+
+func readBulkInvitations(res http.ResponseWriter, req *http.Request) ([]BulkInvitation, error) {
+	body := http.MaxBytesReader(res, req.Body, BULK_INVITATION_MAX_BYTES)
+	invitations := []BulkInvitation{}
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "text/csv") {
+		r := csv.NewReader(body)
+		r.FieldsPerRecord = -1
+		r.TrimLeadingSpace = true
+		row := 0
+		for {
+			record, err := r.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			row++
+			// header
+			if len(invitations) == 0 && strings.EqualFold(record[0], "attribute") {
+				continue
+			}
+			if len(record) < 3 {
+				return nil, errors.New("CSV record must be attribute, member, role and optional name and namespaces: " + strings.Join(record, ","))
+			}
+			invitation := BulkInvitation{Attribute: record[0], Member: record[1], Role: record[2], row: row}
+			if len(record) > 3 {
+				invitation.Name = record[3]
+			}
+			if len(record) > 4 && record[4] != "" {
+				invitation.Namespaces = strings.Split(record[4], ";")
+			}
+			invitations = append(invitations, invitation)
+			if len(invitations) > BULK_INVITATION_MAX_ROWS {
+				break
+			}
+		}
+	} else {
+		if err := json.NewDecoder(body).Decode(&invitations); err != nil {
+			return nil, err
+		}
+		for i := range invitations {
+			invitations[i].row = i + 1
+		}
+	}
+
+	if len(invitations) == 0 {
+		return nil, errors.New("No member to invite")
+	}
+	if len(invitations) > BULK_INVITATION_MAX_ROWS {
+		return nil, errors.New("At most " + strconv.Itoa(BULK_INVITATION_MAX_ROWS) + " members can be invited at once")
+	}
+	for i := range invitations {
+		invitations[i].Attribute = strings.ToLower(strings.TrimSpace(invitations[i].Attribute))
+		invitations[i].Member = strings.TrimSpace(invitations[i].Member)
+		invitations[i].Role = strings.TrimSpace(invitations[i].Role)
+		invitations[i].Name = strings.TrimSpace(invitations[i].Name)
+	}
+	return invitations, nil
+}
+
+// checkBulkInvitation returns why invitation cannot be invited, or empty. status has the status of each attribute/member.
+func checkBulkInvitation(invitation BulkInvitation, status map[string]string) string {
+	if invitation.Attribute != "user" && invitation.Attribute != "group" {
+		return "Attribute must be user or group"
+	}
+	if invitation.Member == "" {
+		return "Member is empty"
+	}
+	if !validMemberId(invitation.Attribute, invitation.Member) {
+		if invitation.Attribute == "user" {
+			return "Member must be an email or a user name"
+		}
+		return "Member must be a group name"
+	}
+	switch status[invitation.Attribute+"/"+invitation.Member] {
+	case "":
+		return ""
+	case "requested":
+		return "Member is duplicated in the request"
+	case "expired":
+		return "Invitation for member is expired. Re-send it instead"
+	}
+	return "Member is already invited in cluster"
+}
+
+var (
+	userEmailPattern  = regexp.MustCompile(`^[A-Za-z0-9._%+-]+@[A-Za-z0-9-]+(\.[A-Za-z0-9-]+)+$`)
+	memberNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+)
+
+// validMemberId tells if member is an email or a user name for users, or a group name for groups.
+// Rows come from an uploaded file, so anything else is refused before it reaches the database or a role binding.
+func validMemberId(attribute string, member string) bool {
+	if len(member) > 255 {
+		return false
+	}
+	if attribute == "user" && userEmailPattern.MatchString(member) {
+		return true
+	}
+	return memberNamePattern.MatchString(member)
+}
+
+// enqueueInvitationMail sends an invitation mail in the background, retried with backoff.
+// A user whose mail fails on every attempt stays pending, and the owner can re-send the invitation.
+func enqueueInvitationMail(mail invitationMail) {
+	invitationMailWorker.Do(func() {
+		go sendInvitationMails()
+	})
+	select {
+	case invitationMails <- mail:
+	default:
+		klog.Errorln("Invitation mail queue is full. Invitation for user [" + mail.clusterMember.MemberId + "] is not sent")
+	}
+}
+
+func sendInvitationMails() {
+	for mail := range invitationMails {
+		// 그 사이 취소되거나 owner가 다시 보낸 초대는 보내지 않음. 다시 보내면 token이 바뀌므로 덮어쓰면 안됨
+		if mail.attempt > 0 && !stillPending(mail.clusterMember) {
+			klog.Infoln("Invitation for user [" + mail.clusterMember.MemberId + "] is removed or sent again. Retry is canceled")
+			continue
+		}
+		err := sendInvitation(mail.clusterMember, mail.userId)
+		if err == nil {
+			continue
+		}
+		mail.attempt++
+		if mail.attempt >= invitationMailAttempts {
+			klog.Errorln("Invitation for user [" + mail.clusterMember.MemberId + "] is not sent: " + err.Error())
+			continue
+		}
+		backoff := invitationMailBackoff * time.Duration(1<<uint(mail.attempt-1))
+		klog.Infoln("Invitation for user [" + mail.clusterMember.MemberId + "] is sent again in " + backoff.String() + ": " + err.Error())
+		retried := mail
+		time.AfterFunc(backoff, func() { enqueueInvitationMail(retried) })
+	}
+}
+
+// stillPending tells if the invitation of clusterMember is the same pending row, neither removed nor re-sent.
+// An error counts as pending, so the retry is not lost.
+func stillPending(clusterMember util.ClusterMemberInfo) bool {
+	pendingUser, err := clusterDataFactory.GetPendingUser(clusterMember)
+	if err != nil {
+		return true
+	}
+	if pendingUser.Status == "" {
+		return false
+	}
+	if clusterMember.Id == 0 {
+		return true
+	}
+	return pendingUser.Id == clusterMember.Id && pendingUser.UpdatedTime.Equal(clusterMember.UpdatedTime)
+}
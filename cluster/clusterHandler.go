@@ -135,6 +135,9 @@ func InsertCLM(res http.ResponseWriter, req *http.Request) {
 	util.SetResponse(res, msg, nil, http.StatusOK)
 }
 
+// DeleteCLM deletes the members of a clustermanager from db.
+//
+// Deprecated: RunMemberController deletes them when the clustermanager is deleted.
 func DeleteCLM(res http.ResponseWriter, req *http.Request) {
 	// queryParams := req.URL.Query()
 	vars := gmux.Vars(req)
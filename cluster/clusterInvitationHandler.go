@@ -2,17 +2,20 @@ package cluster
 
 // "encoding/json"
 import (
-	"fmt"
 	"net/http"
+	"net/url"
 	"os"
 	"strings"
+	"time"
 
+	"github.com/google/uuid"
 	gmux "github.com/gorilla/mux"
 	util "github.com/tmax-cloud/hypercloud-api-server/util"
 
 	// caller "github.com/tmax-cloud/hypercloud-api-server/util/caller"
 	caller "github.com/tmax-cloud/hypercloud-api-server/util/caller"
 	clusterDataFactory "github.com/tmax-cloud/hypercloud-api-server/util/dataFactory/cluster"
+	clusterv1alpha1 "github.com/tmax-cloud/hypercloud-multi-operator/apis/cluster/v1alpha1"
 	"k8s.io/klog"
 	// "encoding/json"
 )
@@ -39,11 +42,18 @@ func InviteUser(res http.ResponseWriter, req *http.Request) {
 		util.SetResponse(res, err.Error(), nil, http.StatusBadRequest)
 		return
 	}
+	remoteRole, remoteNamespaces, err := validateRemoteRole(remoteRole, queryParams[QUERY_PARAMETER_REMOTE_NAMESPACE])
+	if err != nil {
+		klog.Infoln(err)
+		util.SetResponse(res, err.Error(), nil, http.StatusBadRequest)
+		return
+	}
 
 	clusterMember := util.ClusterMemberInfo{}
 	clusterMember.Namespace = namespace
 	clusterMember.Cluster = cluster
 	clusterMember.Role = remoteRole
+	clusterMember.RemoteNamespaces = remoteNamespaces
 	clusterMember.MemberId = memberId
 	clusterMember.MemberName = memberName
 	clusterMember.Attribute = "user"
@@ -62,6 +72,14 @@ func InviteUser(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	unlock, err := lockCluster(namespace, cluster)
+	if err != nil {
+		klog.Errorln(err)
+		util.SetResponse(res, err.Error(), nil, http.StatusInternalServerError)
+		return
+	}
+	defer unlock()
+
 	clusterMemberList, err := clusterDataFactory.ListAllClusterUser(clusterMember.Cluster, clusterMember.Namespace)
 	if err != nil {
 		klog.Errorln(err)
@@ -72,10 +90,13 @@ func InviteUser(res http.ResponseWriter, req *http.Request) {
 	// 초대할 권한이 있는지 확인
 	var clusterOwner string
 	var existUser []string
+	var expiredUser []string
 	for _, val := range clusterMemberList {
 		if val.Status == "owner" {
 			clusterOwner = val.MemberId
 			existUser = append(existUser, val.MemberId)
+		} else if val.Status == "expired" {
+			expiredUser = append(expiredUser, val.MemberId)
 		} else {
 			existUser = append(existUser, val.MemberId)
 		}
@@ -93,6 +114,12 @@ func InviteUser(res http.ResponseWriter, req *http.Request) {
 		util.SetResponse(res, msg, nil, http.StatusBadRequest)
 		return
 	}
+	if util.Contains(expiredUser, memberId) {
+		msg := "Invitation for member is expired. Re-send it instead"
+		klog.Infoln(msg)
+		util.SetResponse(res, msg, nil, http.StatusBadRequest)
+		return
+	}
 
 	sarResult, err := caller.CreateSubjectAccessReview(userId, userGroups, util.CLUSTER_API_GROUP, "clustermanagers", namespace, cluster, "update")
 	if err != nil {
@@ -108,10 +135,6 @@ func InviteUser(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	// create Token
-	// token, err := util.CreateToken(clusterMember)
-	// klog.Info("token = \n" + token)
-
 	// insert db
 	if err := clusterDataFactory.Insert(clusterMember); err != nil {
 		klog.Errorln(err)
@@ -119,6 +142,32 @@ func InviteUser(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if err := sendInvitation(clusterMember, userId); err != nil {
+		klog.Errorln(err)
+		util.SetResponse(res, err.Error(), nil, http.StatusInternalServerError)
+		if err := clusterDataFactory.Delete(clusterMember); err != nil {
+			klog.Errorln(err)
+			util.SetResponse(res, err.Error(), nil, http.StatusInternalServerError)
+		}
+		return
+	}
+
+	msg := "User is invited successfully"
+	klog.Infoln(msg)
+	util.SetResponse(res, msg, nil, http.StatusOK)
+}
+
+// sendInvitation mails clusterMember a link with a new single use token, which replaces the tokens sent before.
+func sendInvitation(clusterMember util.ClusterMemberInfo, userId string) error {
+	tokenId := uuid.New().String()
+	token, err := util.CreateToken(clusterMember, tokenId)
+	if err != nil {
+		return err
+	}
+	if err := clusterDataFactory.SaveInvitation(clusterMember, tokenId, time.Now().Add(util.ParsedTokenExpiredDate)); err != nil {
+		return err
+	}
+
 	// consoleService, err := caller.GetConsoleService("console-system", "console")
 	// ConsoleLB := consoleService.Status.LoadBalancer.Ingress[0].IP
 	// if err != nil {
@@ -128,46 +177,132 @@ func InviteUser(res http.ResponseWriter, req *http.Request) {
 	//consoleIngress, err := caller.GetConsoleIngress("api-gateway-system", "console")
 	ConsoleDomain := os.Getenv("CONSOLE_SUBDOMAIN") + "." + os.Getenv("HC_DOMAIN")
 
-	var b strings.Builder
-	b.WriteString(LINK)
-	// for _, userGroup := range userGroups {
-	// 	b.WriteString("&userGroup=")
-	// 	b.WriteString(userGroup)
-	// }
-
-	to := []string{memberId}
+	to := []string{clusterMember.MemberId}
 	from := "no-reply-tc@tmax.co.kr"
-	subject := userId + "(이)가 당신을 " + cluster + " cluster에 초대하였습니다."
+	subject := userId + "(이)가 당신을 " + clusterMember.Cluster + " cluster에 초대하였습니다."
 	bodyParameter := map[string]string{}
-	bodyParameter["@@LINK@@"] = b.String()
-	fmt.Println("#########################" + bodyParameter["@@LINK@@"])
-	bodyParameter["@@LINK@@"] = "https://" + ConsoleDomain + "/k8s/ns/" + namespace + "/clustermanagers/" + cluster + "/access/accept"
-	bodyParameter["@@CLUSTER_NAME@@"] = cluster
+	bodyParameter["@@LINK@@"] = "https://" + ConsoleDomain + "/k8s/ns/" + clusterMember.Namespace + "/clustermanagers/" + clusterMember.Cluster +
+		"/access/accept?token=" + url.QueryEscape(token)
+	bodyParameter["@@CLUSTER_NAME@@"] = clusterMember.Cluster
 	bodyParameter["@@VALID_TIME@@"] = util.ValidTime
 	bodyParameter["@@OWNER_EMAIL@@"] = userId
-	bodyParameter["@@MEMBER_EMAIL@@"] = memberId
+	bodyParameter["@@MEMBER_EMAIL@@"] = clusterMember.MemberId
 	bodyParameter["@@OWNER_NAME@@"] = userId
 	bodyParameter["@@CONSOLE_LB@@"] = ConsoleDomain
 	bodyParameter["@@NAMESPACE@@"] = clusterMember.Namespace
 	bodyParameter["@@MEMBER_ID@@"] = clusterMember.MemberId
-	// bodyParameter["@@TOKEN@@"] = token
-	bodyParameter["@@ROLE@@"] = remoteRole
+	bodyParameter["@@TOKEN@@"] = token
+	bodyParameter["@@ROLE@@"] = clusterMember.Role
+	if len(clusterMember.RemoteNamespaces) > 0 {
+		bodyParameter["@@ROLE@@"] = clusterMember.Role + " (namespace: " + strings.Join(clusterMember.RemoteNamespaces, ", ") + ")"
+	}
+
+	return util.SendEmail(from, to, subject, bodyParameter)
+}
 
-	if err := util.SendEmail(from, to, subject, bodyParameter); err != nil {
+// ResendInvitation sends a pending or expired invitation again with a new token. Only the cluster owner can re-send.
+func ResendInvitation(res http.ResponseWriter, req *http.Request) {
+	queryParams := req.URL.Query()
+	userId := queryParams.Get(QUERY_PARAMETER_USER_ID)
+	userGroups := queryParams[util.QUERY_PARAMETER_USER_GROUP]
+	vars := gmux.Vars(req)
+	cluster := vars["clustermanager"]
+	memberId := vars["member"]
+	namespace := vars["namespace"]
+
+	if err := util.StringParameterException(userGroups, userId, cluster, memberId, namespace); err != nil {
 		klog.Errorln(err)
+		util.SetResponse(res, err.Error(), nil, http.StatusBadRequest)
+		return
+	}
+
+	clm, err := caller.GetCluster(userId, userGroups, cluster, namespace)
+	if err != nil {
 		util.SetResponse(res, err.Error(), nil, http.StatusInternalServerError)
-		if err := clusterDataFactory.Delete(clusterMember); err != nil {
-			klog.Errorln(err)
-			util.SetResponse(res, err.Error(), nil, http.StatusInternalServerError)
+		return
+	}
+	if !clm.Status.Ready || clm.Status.Phase == "Deleting" {
+		msg := "Cannot invite member to cluster in deleting phase or not ready status"
+		klog.Infoln(msg)
+		util.SetResponse(res, msg, nil, http.StatusBadRequest)
+		return
+	}
+
+	// 수락, 일괄 초대와 같은 row를 바꾸므로 같은 lock 아래에서 처리
+	unlock, err := lockCluster(namespace, cluster)
+	if err != nil {
+		klog.Errorln(err)
+		util.SetResponse(res, err.Error(), nil, http.StatusInternalServerError)
+		return
+	}
+	defer unlock()
+
+	clusterMemberList, err := clusterDataFactory.ListAllClusterUser(cluster, namespace)
+	if err != nil {
+		klog.Errorln(err)
+		util.SetResponse(res, err.Error(), nil, http.StatusInternalServerError)
+		return
+	}
+	var clusterOwner string
+	for _, val := range clusterMemberList {
+		if val.Status == "owner" {
+			clusterOwner = val.MemberId
 		}
+	}
+	if userId != clusterOwner {
+		msg := "Request user [ " + userId + " ]is not a cluster owner [ " + clusterOwner + " ]"
+		klog.Infoln(msg)
+		util.SetResponse(res, msg, nil, http.StatusBadRequest)
 		return
 	}
 
-	msg := "User is invited successfully"
+	clusterMember := util.ClusterMemberInfo{}
+	clusterMember.Namespace = namespace
+	clusterMember.Cluster = cluster
+	clusterMember.MemberId = memberId
+	clusterMember.Attribute = "user"
+	invitation, err := clusterDataFactory.GetInvitation(clusterMember)
+	if err != nil {
+		klog.Errorln(err)
+		util.SetResponse(res, err.Error(), nil, http.StatusInternalServerError)
+		return
+	}
+	if invitation.Status == "" {
+		msg := "Invitation for user [" + memberId + "] to cluster [" + cluster + "] is not exist"
+		klog.Infoln(msg)
+		util.SetResponse(res, msg, nil, http.StatusNotFound)
+		return
+	}
+
+	if err := clusterDataFactory.Resend(*invitation); err != nil {
+		klog.Errorln(err)
+		util.SetResponse(res, err.Error(), nil, http.StatusInternalServerError)
+		return
+	}
+	if err := sendInvitation(*invitation, userId); err != nil {
+		klog.Errorln(err)
+		util.SetResponse(res, err.Error(), nil, http.StatusInternalServerError)
+		return
+	}
+
+	msg := "Invitation for user [" + memberId + "] is sent again"
 	klog.Infoln(msg)
 	util.SetResponse(res, msg, nil, http.StatusOK)
 }
 
+// ExpireInvitationJob marks user invitations pending for longer than the token lifetime as expired.
+// The owner can re-send them.
+func ExpireInvitationJob() {
+	expired, err := clusterDataFactory.ExpireInvitations(time.Now().Add(-util.ParsedTokenExpiredDate))
+	if err != nil {
+		klog.Errorln(err)
+		return
+	}
+	if expired > 0 {
+		klog.Infof("%d invitations are expired", expired)
+	}
+}
+
 func InviteGroup(res http.ResponseWriter, req *http.Request) {
 	queryParams := req.URL.Query()
 	userId := queryParams.Get(QUERY_PARAMETER_USER_ID)
@@ -184,11 +319,18 @@ func InviteGroup(res http.ResponseWriter, req *http.Request) {
 		util.SetResponse(res, err.Error(), nil, http.StatusBadRequest)
 		return
 	}
+	remoteRole, remoteNamespaces, err := validateRemoteRole(remoteRole, queryParams[QUERY_PARAMETER_REMOTE_NAMESPACE])
+	if err != nil {
+		klog.Infoln(err)
+		util.SetResponse(res, err.Error(), nil, http.StatusBadRequest)
+		return
+	}
 
 	clusterMember := util.ClusterMemberInfo{}
 	clusterMember.Namespace = namespace
 	clusterMember.Cluster = cluster
 	clusterMember.Role = remoteRole
+	clusterMember.RemoteNamespaces = remoteNamespaces
 	clusterMember.MemberId = memberId
 	clusterMember.Attribute = "group"
 	clusterMember.Status = "invited"
@@ -206,6 +348,14 @@ func InviteGroup(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	unlock, err := lockCluster(namespace, cluster)
+	if err != nil {
+		klog.Errorln(err)
+		util.SetResponse(res, err.Error(), nil, http.StatusInternalServerError)
+		return
+	}
+	defer unlock()
+
 	// 클러스터에 속한 group들과 소유자(owner)반환
 	clusterMemberList, err := clusterDataFactory.ListClusterOwnerAndGroupMember(clusterMember.Cluster, clusterMember.Namespace)
 	if err != nil {
@@ -240,24 +390,7 @@ func InviteGroup(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	// insert db
-	if err := clusterDataFactory.Insert(clusterMember); err != nil {
-		klog.Errorln(err)
-		util.SetResponse(res, err.Error(), nil, http.StatusInternalServerError)
-		return
-	}
-
-	if err := caller.CreateNSGetRole(clm, clusterMember.MemberId, clusterMember.Attribute); err != nil {
-		util.SetResponse(res, err.Error(), nil, http.StatusInternalServerError)
-		return
-	}
-
-	if err := caller.CreateCLMRole(clm, clusterMember.MemberId, clusterMember.Attribute); err != nil {
-		util.SetResponse(res, err.Error(), nil, http.StatusInternalServerError)
-		return
-	}
-
-	if err := caller.CreateRoleInRemote(clm, clusterMember.MemberId, remoteRole, clusterMember.Attribute); err != nil {
+	if err := addGroup(clm, clusterMember); err != nil {
 		util.SetResponse(res, err.Error(), nil, http.StatusInternalServerError)
 		return
 	}
@@ -267,6 +400,34 @@ func InviteGroup(res http.ResponseWriter, req *http.Request) {
 	util.SetResponse(res, msg, nil, http.StatusOK)
 }
 
+// addGroup gives the group in clusterMember its roles and inserts it as an invited member.
+func addGroup(clm *clusterv1alpha1.ClusterManager, clusterMember util.ClusterMemberInfo) error {
+	// role 생성 후 insert db
+	return runSteps(
+		step{
+			name: "create namespace get role",
+			do:   func() error { return caller.CreateNSGetRole(clm, clusterMember.MemberId, clusterMember.Attribute) },
+			undo: func() error { return caller.DeleteNSGetRole(clm, clusterMember.MemberId, clusterMember.Attribute) },
+		},
+		step{
+			name: "create clustermanager role",
+			do:   func() error { return caller.CreateCLMRole(clm, clusterMember.MemberId, clusterMember.Attribute) },
+			undo: func() error { return caller.DeleteCLMRole(clm, clusterMember.MemberId, clusterMember.Attribute) },
+		},
+		step{
+			name: "create remote role",
+			do: func() error {
+				return ensureRoleInRemote(clm, clusterMember.MemberId, clusterMember.Role, clusterMember.Attribute, clusterMember.RemoteNamespaces)
+			},
+			undo: func() error { return caller.RemoveRoleFromRemote(clm, clusterMember.MemberId, clusterMember.Attribute) },
+		},
+		step{
+			name: "insert member",
+			do:   func() error { return clusterDataFactory.Insert(clusterMember) },
+		},
+	)
+}
+
 func AcceptInvitation(res http.ResponseWriter, req *http.Request) {
 	queryParams := req.URL.Query()
 	userId := queryParams.Get(QUERY_PARAMETER_USER_ID)
@@ -296,11 +457,12 @@ func AcceptInvitation(res http.ResponseWriter, req *http.Request) {
 	clusterMember.Attribute = "user"
 
 	// token validation
-	// if _, err := util.TokenValid(req, clusterMember); err != nil {
-	// 	klog.Errorln(err)
-	// 	util.SetResponse(res, err.Error(), nil, http.StatusBadRequest)
-	// 	return
-	// }
+	tokenId, err := util.TokenValid(req, clusterMember)
+	if err != nil {
+		klog.Errorln(err)
+		util.SetResponse(res, err.Error(), nil, http.StatusBadRequest)
+		return
+	}
 	// 해당 클러스터에 사용자 있는지 조회
 	// res 없다면,,,  거절당한거 (timeout인거는 token에서 거를꺼고.. )
 	// 있는데 상태가 invited면 이미 있네
@@ -345,25 +507,47 @@ func AcceptInvitation(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	// db에 status 변경해주고 pending --> invited로..
-	if err := clusterDataFactory.UpdateStatus(pendingUser); err != nil {
+	unlock, err := lockCluster(namespace, cluster)
+	if err != nil {
 		klog.Errorln(err)
 		util.SetResponse(res, err.Error(), nil, http.StatusInternalServerError)
 		return
 	}
-
-	// role 생성해 주면 될 듯
-	if err := caller.CreateNSGetRole(clm, userId, pendingUser.Attribute); err != nil {
-		util.SetResponse(res, err.Error(), nil, http.StatusInternalServerError)
-		return
-	}
-
-	if err := caller.CreateCLMRole(clm, userId, pendingUser.Attribute); err != nil {
-		util.SetResponse(res, err.Error(), nil, http.StatusInternalServerError)
-		return
-	}
-
-	if err := caller.CreateRoleInRemote(clm, userId, pendingUser.Role, clusterMember.Attribute); err != nil {
+	defer unlock()
+
+	if !useInvitation(res, clusterMember, tokenId) {
+		return
+	}
+
+	// role 생성 후 db에 status 변경 pending --> invited
+	// ns get rolebinding은 db에 남은 클러스터를 보고 삭제하므로 db 변경을 마지막에 한다
+	if err := runSteps(
+		step{
+			name: "create namespace get role",
+			do:   func() error { return caller.CreateNSGetRole(clm, userId, pendingUser.Attribute) },
+			undo: func() error { return caller.DeleteNSGetRole(clm, userId, pendingUser.Attribute) },
+		},
+		step{
+			name: "create clustermanager role",
+			do:   func() error { return caller.CreateCLMRole(clm, userId, pendingUser.Attribute) },
+			undo: func() error { return caller.DeleteCLMRole(clm, userId, pendingUser.Attribute) },
+		},
+		step{
+			name: "create remote role",
+			do: func() error {
+				return ensureRoleInRemote(clm, userId, pendingUser.Role, pendingUser.Attribute, pendingUser.RemoteNamespaces)
+			},
+			undo: func() error { return caller.RemoveRoleFromRemote(clm, userId, pendingUser.Attribute) },
+		},
+		step{
+			name: "update member status",
+			do:   func() error { return clusterDataFactory.UpdateStatus(pendingUser) },
+		},
+	); err != nil {
+		// 실패한 경우 같은 링크로 다시 수락할 수 있도록 token 복구. 링크의 유효기간은 token 자체에서 검사한다
+		if err := clusterDataFactory.SaveInvitation(clusterMember, tokenId, time.Now().Add(util.ParsedTokenExpiredDate)); err != nil {
+			klog.Errorln(err)
+		}
 		util.SetResponse(res, err.Error(), nil, http.StatusInternalServerError)
 		return
 	}
@@ -376,6 +560,23 @@ func AcceptInvitation(res http.ResponseWriter, req *http.Request) {
 	util.SetResponse(res, msg, nil, http.StatusOK)
 }
 
+// useInvitation consumes the token of the invitation, so a link works once and only until it expires.
+func useInvitation(res http.ResponseWriter, clusterMember util.ClusterMemberInfo, tokenId string) bool {
+	used, err := clusterDataFactory.UseInvitation(clusterMember, tokenId)
+	if err != nil {
+		klog.Errorln(err)
+		util.SetResponse(res, err.Error(), nil, http.StatusInternalServerError)
+		return false
+	}
+	if !used {
+		msg := "Invitation for user [" + clusterMember.MemberId + "] is expired, used or sent again"
+		klog.Infoln(msg)
+		util.SetResponse(res, msg, nil, http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
 func DeclineInvitation(res http.ResponseWriter, req *http.Request) {
 	queryParams := req.URL.Query()
 	userId := queryParams.Get(QUERY_PARAMETER_USER_ID)
@@ -400,11 +601,12 @@ func DeclineInvitation(res http.ResponseWriter, req *http.Request) {
 	clusterMember.Status = "pending"
 
 	// token validation
-	// if _, err := util.TokenValid(req, clusterMember); err != nil {
-	// 	klog.Errorln(err)
-	// 	util.SetResponse(res, err.Error(), nil, http.StatusBadRequest)
-	// 	return
-	// }
+	tokenId, err := util.TokenValid(req, clusterMember)
+	if err != nil {
+		klog.Errorln(err)
+		util.SetResponse(res, err.Error(), nil, http.StatusBadRequest)
+		return
+	}
 
 	pendingUser, err := clusterDataFactory.GetPendingUser(clusterMember)
 	if err != nil {
@@ -432,6 +634,9 @@ func DeclineInvitation(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if !useInvitation(res, clusterMember, tokenId) {
+		return
+	}
 	if err := clusterDataFactory.Delete(clusterMember); err != nil {
 		klog.Errorln(err)
 		util.SetResponse(res, err.Error(), nil, http.StatusInternalServerError)
@@ -481,7 +686,7 @@ func ListInvitation(res http.ResponseWriter, req *http.Request) {
 	for _, val := range clusterMemberList {
 		if val.Status == "owner" {
 			clusterOwner = val.MemberId
-		} else if val.Status == "pending" {
+		} else if val.Status == "pending" || val.Status == "expired" {
 			pendingUser = append(pendingUser, val)
 		}
 	}
@@ -0,0 +1,229 @@
+package cluster
+
+import (
+	"strings"
+	"time"
+
+	util "github.com/tmax-cloud/hypercloud-api-server/util"
+	caller "github.com/tmax-cloud/hypercloud-api-server/util/caller"
+	clusterDataFactory "github.com/tmax-cloud/hypercloud-api-server/util/dataFactory/cluster"
+	clusterv1alpha1 "github.com/tmax-cloud/hypercloud-multi-operator/apis/cluster/v1alpha1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog"
+)
+
+const (
+	// informer의 resync마다 모든 클러스터를 다시 맞춘다
+	memberResyncPeriod = 10 * time.Minute
+	memberWorkers      = 2
+)
+
+// RunMemberController makes the rolebindings in the hub and the remote cluster of every ready clustermanager
+// match the members in db, and deletes the members of deleted clustermanagers from db. It runs until stopCh is closed.
+func RunMemberController(stopCh <-chan struct{}) {
+	queue := workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "clustermember")
+	defer queue.ShutDown()
+
+	informer := caller.NewClusterManagerInformer(memberResyncPeriod)
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			enqueueClusterManager(queue, obj)
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			enqueueClusterManager(queue, newObj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			enqueueClusterManager(queue, obj)
+		},
+	})
+	go informer.Run(stopCh)
+	if !cache.WaitForCacheSync(stopCh, informer.HasSynced) {
+		klog.Errorln("Cache of clustermanager is not synced")
+		return
+	}
+
+	// 서버가 내려가 있는 동안 삭제된 클러스터의 멤버도 정리
+	clusterList, err := clusterDataFactory.ListAllClusters()
+	if err != nil {
+		klog.Errorln(err)
+	}
+	for _, cluster := range clusterList {
+		queue.Add(cluster.Namespace + "/" + cluster.Name)
+	}
+
+	for i := 0; i < memberWorkers; i++ {
+		go func() {
+			for processClusterManager(queue, informer.GetIndexer()) {
+			}
+		}()
+	}
+	klog.Infoln("Cluster member controller is started")
+	<-stopCh
+}
+
+func enqueueClusterManager(queue workqueue.RateLimitingInterface, obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		klog.Errorln(err)
+		return
+	}
+	queue.Add(key)
+}
+
+// processClusterManager reconciles a clustermanager from queue. It returns false when queue is shut down.
+func processClusterManager(queue workqueue.RateLimitingInterface, indexer cache.Indexer) bool {
+	item, shutdown := queue.Get()
+	if shutdown {
+		return false
+	}
+	defer queue.Done(item)
+
+	key := item.(string)
+	if err := syncClusterManager(key, indexer); err != nil {
+		klog.Errorln("Members of cluster [" + key + "] are not reconciled: " + err.Error())
+		queue.AddRateLimited(key)
+		return true
+	}
+	queue.Forget(key)
+	return true
+}
+
+func syncClusterManager(key string, indexer cache.Indexer) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+	obj, exists, err := indexer.GetByKey(key)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		// hub의 role은 ownerReference로 같이 삭제되고, remote cluster는 사라졌으므로 db만 정리
+		unlock, err := lockCluster(namespace, name)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+		klog.Infoln("Cluster [" + key + "] is deleted. delete its members")
+		return clusterDataFactory.DeleteALL(namespace, name)
+	}
+
+	clm := obj.(*clusterv1alpha1.ClusterManager)
+	if !clm.Status.Ready || clm.Status.Phase == "Deleting" || clm.DeletionTimestamp != nil {
+		return nil
+	}
+	return reconcileMembers(clm)
+}
+
+func reconcileMembers(clm *clusterv1alpha1.ClusterManager) error {
+	unlock, err := lockCluster(clm.Namespace, clm.Name)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	clusterMemberList, err := clusterDataFactory.ListClusterMemberWithOutPending(clm.Name, clm.Namespace)
+	if err != nil {
+		return err
+	}
+	// owner의 role은 operator가 관리하므로 지우지 않기만 한다
+	known := map[string]bool{}
+	members := []util.ClusterMemberInfo{}
+	for _, val := range clusterMemberList {
+		known[val.Attribute+"/"+val.MemberId] = true
+		if val.Status == "invited" {
+			members = append(members, val)
+		}
+	}
+
+	// db에 있는 멤버의 rolebinding 생성
+	for _, member := range members {
+		if exist, err := caller.ExistNSGetRole(clm, member.MemberId, member.Attribute); err != nil {
+			return err
+		} else if !exist {
+			klog.Infoln(member.Attribute + " [" + member.MemberId + "] has no namespace get rolebinding. create")
+			if err := caller.CreateNSGetRole(clm, member.MemberId, member.Attribute); err != nil {
+				return err
+			}
+		}
+
+		if exist, err := caller.ExistCLMRole(clm, member.MemberId, member.Attribute); err != nil {
+			return err
+		} else if !exist {
+			klog.Infoln(member.Attribute + " [" + member.MemberId + "] has no clustermanager rolebinding of cluster [" + clm.Name + "]. create")
+			if err := caller.CreateCLMRole(clm, member.MemberId, member.Attribute); err != nil {
+				return err
+			}
+		}
+
+		// 정규화 전에 저장된 cluster-admin은 remote에서 admin으로 읽히므로 같게 비교
+		role := normalizeRemoteRole(member.Role, member.RemoteNamespaces)
+		if remoteRole, remoteNamespaces, err := caller.GetRoleInRemote(clm, member.MemberId, member.Attribute); err != nil {
+			return err
+		} else if remoteRole != role || !sameNamespaces(remoteNamespaces, member.RemoteNamespaces) {
+			klog.Infoln(member.Attribute + " [" + member.MemberId + "] has remote role [" + remoteRole + "] in namespaces [" + strings.Join(remoteNamespaces, ", ") +
+				"] instead of [" + role + "] in namespaces [" + strings.Join(member.RemoteNamespaces, ", ") + "] in cluster [" + clm.Name + "]. replace")
+			if err := ensureRoleInRemote(clm, member.MemberId, member.Role, member.Attribute, member.RemoteNamespaces); err != nil {
+				return err
+			}
+		}
+	}
+
+	// db에 없는 멤버의 rolebinding 삭제
+	roleBindings, err := caller.ListCLMRoleBindings(clm)
+	if err != nil {
+		return err
+	}
+	for _, roleBinding := range roleBindings {
+		attribute, subject := memberOf(roleBinding.Subjects)
+		if subject == "" || known[attribute+"/"+subject] {
+			continue
+		}
+		klog.Infoln(attribute + " [" + subject + "] is not a member of cluster [" + clm.Name + "]. delete clustermanager rolebinding")
+		if err := caller.DeleteCLMRole(clm, subject, attribute); err != nil {
+			return err
+		}
+		if err := caller.DeleteNSGetRole(clm, subject, attribute); err != nil {
+			return err
+		}
+	}
+
+	remoteClusterRoleBindings, remoteRoleBindings, err := caller.ListRoleBindingsInRemote(clm)
+	if err != nil {
+		return err
+	}
+	remoteSubjects := [][]rbacv1.Subject{}
+	for _, clusterRoleBinding := range remoteClusterRoleBindings {
+		remoteSubjects = append(remoteSubjects, clusterRoleBinding.Subjects)
+	}
+	for _, roleBinding := range remoteRoleBindings {
+		remoteSubjects = append(remoteSubjects, roleBinding.Subjects)
+	}
+	// 한 번에 모든 namespace에서 삭제되므로 subject마다 한 번만 삭제
+	removed := map[string]bool{}
+	for _, subjects := range remoteSubjects {
+		attribute, subject := memberOf(subjects)
+		if subject == "" || known[attribute+"/"+subject] || removed[attribute+"/"+subject] {
+			continue
+		}
+		klog.Infoln(attribute + " [" + subject + "] is not a member of cluster [" + clm.Name + "]. remove remote rolebinding")
+		if err := caller.RemoveRoleFromRemote(clm, subject, attribute); err != nil {
+			return err
+		}
+		removed[attribute+"/"+subject] = true
+	}
+	return nil
+}
+
+// memberOf returns the attribute and the id of the member a rolebinding is created for.
+func memberOf(subjects []rbacv1.Subject) (string, string) {
+	if len(subjects) == 0 {
+		return "", ""
+	}
+	if subjects[0].Kind == "User" {
+		return "user", subjects[0].Name
+	}
+	return "group", subjects[0].Name
+}
@@ -3,6 +3,7 @@ package cluster
 // "encoding/json"
 import (
 	"net/http"
+	"strings"
 
 	gmux "github.com/gorilla/mux"
 	util "github.com/tmax-cloud/hypercloud-api-server/util"
@@ -172,6 +173,14 @@ func RemoveMember(res http.ResponseWriter, req *http.Request) {
 	clusterMember.Attribute = attribute
 	clusterMember.Status = "invited"
 
+	unlock, err := lockCluster(namespace, cluster)
+	if err != nil {
+		klog.Errorln(err)
+		util.SetResponse(res, err.Error(), nil, http.StatusInternalServerError)
+		return
+	}
+	defer unlock()
+
 	clusterMemberList, err := clusterDataFactory.ListClusterMember(clusterMember.Cluster, clusterMember.Namespace)
 	if err != nil {
 		klog.Errorln(err)
@@ -186,6 +195,12 @@ func RemoveMember(res http.ResponseWriter, req *http.Request) {
 			clusterOwner = val.MemberId
 		} else {
 			existMember = append(existMember, val.MemberId)
+			if val.MemberId == memberId && val.Attribute == attribute {
+				clusterMember.MemberName = val.MemberName
+				clusterMember.Role = val.Role
+				clusterMember.Status = val.Status
+				clusterMember.RemoteNamespaces = val.RemoteNamespaces
+			}
 		}
 	}
 
@@ -203,23 +218,34 @@ func RemoveMember(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	// db에서 삭제
-	if err := clusterDataFactory.Delete(clusterMember); err != nil {
-		klog.Errorln(err)
-		util.SetResponse(res, err.Error(), nil, http.StatusInternalServerError)
-		return
-	}
-
-	// role 삭제
-	if err := caller.RemoveRoleFromRemote(clm, memberId, attribute); err != nil {
-		util.SetResponse(res, err.Error(), nil, http.StatusInternalServerError)
-		return
-	}
-	if err := caller.DeleteCLMRole(clm, memberId, attribute); err != nil {
-		util.SetResponse(res, err.Error(), nil, http.StatusInternalServerError)
-		return
-	}
-	if err := caller.DeleteNSGetRole(clm, memberId, attribute); err != nil {
+	// role 삭제 후 db에서 삭제
+	// ns get rolebinding은 db에 남은 클러스터를 보고 삭제하므로 db에서 삭제한 다음에 삭제한다
+	// 수락하지 않은 사용자는 복구할 role이 없음
+	invited := clusterMember.Status == "invited"
+	if err := runSteps(
+		step{
+			name: "remove remote role",
+			do:   func() error { return caller.RemoveRoleFromRemote(clm, memberId, attribute) },
+			undo: undoIf(invited, func() error {
+				return ensureRoleInRemote(clm, memberId, clusterMember.Role, attribute, clusterMember.RemoteNamespaces)
+			}),
+		},
+		step{
+			name: "delete clustermanager role",
+			do:   func() error { return caller.DeleteCLMRole(clm, memberId, attribute) },
+			undo: undoIf(invited, func() error { return caller.CreateCLMRole(clm, memberId, attribute) }),
+		},
+		step{
+			name: "delete member",
+			do:   func() error { return clusterDataFactory.Delete(clusterMember) },
+			undo: func() error { return clusterDataFactory.Insert(clusterMember) },
+		},
+		step{
+			name: "delete namespace get role",
+			do:   func() error { return caller.DeleteNSGetRole(clm, memberId, attribute) },
+			undo: undoIf(invited, func() error { return caller.CreateNSGetRole(clm, memberId, attribute) }),
+		},
+	); err != nil {
 		util.SetResponse(res, err.Error(), nil, http.StatusInternalServerError)
 		return
 	}
@@ -245,6 +271,12 @@ func UpdateMemberRole(res http.ResponseWriter, req *http.Request) {
 		util.SetResponse(res, err.Error(), nil, http.StatusBadRequest)
 		return
 	}
+	remoteRole, remoteNamespaces, err := validateRemoteRole(remoteRole, queryParams[QUERY_PARAMETER_REMOTE_NAMESPACE])
+	if err != nil {
+		klog.Infoln(err)
+		util.SetResponse(res, err.Error(), nil, http.StatusBadRequest)
+		return
+	}
 
 	clm, err := caller.GetCluster(userId, userGroups, cluster, namespace)
 	if err != nil {
@@ -263,9 +295,18 @@ func UpdateMemberRole(res http.ResponseWriter, req *http.Request) {
 	clusterMember.Cluster = cluster
 	clusterMember.MemberId = memberId
 	clusterMember.Role = remoteRole
+	clusterMember.RemoteNamespaces = remoteNamespaces
 	clusterMember.Attribute = attribute
 	clusterMember.Status = "invited"
 
+	unlock, err := lockCluster(namespace, cluster)
+	if err != nil {
+		klog.Errorln(err)
+		util.SetResponse(res, err.Error(), nil, http.StatusInternalServerError)
+		return
+	}
+	defer unlock()
+
 	clusterMemberList, err := clusterDataFactory.ListClusterMember(clusterMember.Cluster, clusterMember.Namespace)
 	if err != nil {
 		klog.Errorln(err)
@@ -275,11 +316,16 @@ func UpdateMemberRole(res http.ResponseWriter, req *http.Request) {
 
 	var clusterOwner string
 	var existMember []string
+	previous := clusterMember
 	for _, val := range clusterMemberList {
 		if val.Status == "owner" {
 			clusterOwner = val.MemberId
 		} else {
 			existMember = append(existMember, val.MemberId)
+			if val.MemberId == memberId && val.Attribute == attribute {
+				previous.Role = val.Role
+				previous.RemoteNamespaces = val.RemoteNamespaces
+			}
 		}
 	}
 
@@ -297,24 +343,28 @@ func UpdateMemberRole(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	// db에서 role update
-	if err := clusterDataFactory.UpdateRole(clusterMember); err != nil {
-		klog.Errorln(err)
-		util.SetResponse(res, err.Error(), nil, http.StatusInternalServerError)
-		return
-	}
-
-	// role 삭제 후 재 생성
-	if err := caller.RemoveRoleFromRemote(clm, memberId, attribute); err != nil {
-		util.SetResponse(res, err.Error(), nil, http.StatusInternalServerError)
-		return
-	}
-
-	if err := caller.CreateRoleInRemote(clm, memberId, remoteRole, clusterMember.Attribute); err != nil {
+	// db에서 role update 후 remote role 교체
+	if err := runSteps(
+		step{
+			name: "update member role",
+			do:   func() error { return clusterDataFactory.UpdateRole(clusterMember) },
+			undo: func() error { return clusterDataFactory.UpdateRole(previous) },
+		},
+		step{
+			name: "replace remote role",
+			do:   func() error { return ensureRoleInRemote(clm, memberId, remoteRole, attribute, remoteNamespaces) },
+			undo: func() error {
+				return ensureRoleInRemote(clm, memberId, previous.Role, attribute, previous.RemoteNamespaces)
+			},
+		},
+	); err != nil {
 		util.SetResponse(res, err.Error(), nil, http.StatusInternalServerError)
 		return
 	}
 	msg := attribute + " [" + memberId + "] role is updated to [" + remoteRole + "] in cluster [" + clm.Name + "]"
+	if len(remoteNamespaces) > 0 {
+		msg = attribute + " [" + memberId + "] role is updated to [" + remoteRole + "] in namespaces [" + strings.Join(remoteNamespaces, ", ") + "] of cluster [" + clm.Name + "]"
+	}
 	klog.Infoln(msg)
 	util.SetResponse(res, msg, nil, http.StatusOK)
 }
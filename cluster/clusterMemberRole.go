@@ -0,0 +1,73 @@
+package cluster
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/validation/path"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// Remote role templates, the default ClusterRoles of kubernetes. Any other remoteRole is a custom ClusterRole of the remote cluster.
+// A role is bound in the whole remote cluster, or in the remote namespaces given by remoteNamespace.
+// admin of the whole cluster is bound to cluster-admin, so cluster-admin of the whole cluster is stored as admin.
+const (
+	REMOTE_ROLE_VIEW  = "view"
+	REMOTE_ROLE_EDIT  = "edit"
+	REMOTE_ROLE_ADMIN = "admin"
+
+	QUERY_PARAMETER_REMOTE_NAMESPACE = "remoteNamespace"
+)
+
+// validateRemoteRole checks remoteRole and remoteNamespaces. It returns the role normalized by normalizeRemoteRole,
+// and the namespaces trimmed, sorted and without duplicates.
+func validateRemoteRole(remoteRole string, remoteNamespaces []string) (string, []string, error) {
+	if remoteRole == "" {
+		return "", nil, errors.New("Remote role is empty")
+	}
+	if errs := path.IsValidPathSegmentName(remoteRole); len(errs) > 0 {
+		return "", nil, errors.New("Remote role [" + remoteRole + "] is invalid: " + strings.Join(errs, ", "))
+	}
+
+	namespaces := []string{}
+	seen := map[string]bool{}
+	for _, remoteNamespace := range remoteNamespaces {
+		remoteNamespace = strings.TrimSpace(remoteNamespace)
+		if remoteNamespace == "" || seen[remoteNamespace] {
+			continue
+		}
+		if errs := validation.IsDNS1123Label(remoteNamespace); len(errs) > 0 {
+			return "", nil, errors.New("Remote namespace [" + remoteNamespace + "] is invalid: " + strings.Join(errs, ", "))
+		}
+		seen[remoteNamespace] = true
+		namespaces = append(namespaces, remoteNamespace)
+	}
+	sort.Strings(namespaces)
+	if len(namespaces) == 0 {
+		return normalizeRemoteRole(remoteRole, nil), nil, nil
+	}
+	return normalizeRemoteRole(remoteRole, namespaces), namespaces, nil
+}
+
+// normalizeRemoteRole returns remoteRole as GetRoleInRemote reads it back from the remote cluster.
+// cluster-admin of the whole cluster is bound the same as admin, and read back as admin.
+func normalizeRemoteRole(remoteRole string, remoteNamespaces []string) string {
+	if remoteRole == "cluster-admin" && len(remoteNamespaces) == 0 {
+		return REMOTE_ROLE_ADMIN
+	}
+	return remoteRole
+}
+
+// sameNamespaces tells if the sorted namespaces a and b are the same.
+func sameNamespaces(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,101 @@
+package cluster
+
+import (
+	"fmt"
+	"sync"
+
+	caller "github.com/tmax-cloud/hypercloud-api-server/util/caller"
+	clusterDataFactory "github.com/tmax-cloud/hypercloud-api-server/util/dataFactory/cluster"
+	clusterv1alpha1 "github.com/tmax-cloud/hypercloud-multi-operator/apis/cluster/v1alpha1"
+	"k8s.io/klog"
+)
+
+// step is one change of a member to the db, the hub cluster or the remote cluster.
+// undo reverts do, also after do failed halfway. A nil undo means do changes nothing when it fails.
+type step struct {
+	name string
+	do   func() error
+	undo func() error
+}
+
+// runSteps runs steps in order. When one fails, it and the steps before it are undone in reverse order.
+// A failed undo is logged and left for the member controller to repair.
+func runSteps(steps ...step) error {
+	for i, s := range steps {
+		err := s.do()
+		if err == nil {
+			continue
+		}
+		klog.Errorln("Step [" + s.name + "] failed: " + err.Error())
+		for j := i; j >= 0; j-- {
+			if steps[j].undo == nil {
+				continue
+			}
+			if undoErr := steps[j].undo(); undoErr != nil {
+				klog.Errorln("Undo of step [" + steps[j].name + "] failed: " + undoErr.Error())
+			} else {
+				klog.Infoln("Step [" + steps[j].name + "] is undone")
+			}
+		}
+		return fmt.Errorf("%s failed: %s", s.name, err.Error())
+	}
+	return nil
+}
+
+// undoIf returns undo when cond holds, for steps that have something to revert only in some cases.
+func undoIf(cond bool, undo func() error) func() error {
+	if !cond {
+		return nil
+	}
+	return undo
+}
+
+var (
+	clusterLocksMu sync.Mutex
+	clusterLocks   = map[string]*sync.Mutex{}
+)
+
+// lockCluster serializes the member changes of a cluster, so the reconciler does not repair a change running in a handler.
+// The in-process lock keeps the handlers of this replica from each holding a db connection while they wait,
+// and the db lock serializes them with the other replicas. It returns the unlock function.
+func lockCluster(namespace string, cluster string) (func(), error) {
+	clusterLocksMu.Lock()
+	lock, ok := clusterLocks[namespace+"/"+cluster]
+	if !ok {
+		lock = &sync.Mutex{}
+		clusterLocks[namespace+"/"+cluster] = lock
+	}
+	clusterLocksMu.Unlock()
+
+	lock.Lock()
+	unlock, err := clusterDataFactory.LockCluster(namespace, cluster)
+	if err != nil {
+		lock.Unlock()
+		return nil, err
+	}
+	return func() {
+		unlock()
+		lock.Unlock()
+	}, nil
+}
+
+// ensureRoleInRemote binds subject to remoteRole in remoteNamespaces of the remote cluster, or in the whole cluster without them.
+// It replaces the bindings of subject to another role or other namespaces.
+func ensureRoleInRemote(clm *clusterv1alpha1.ClusterManager, subject string, remoteRole string, attribute string, remoteNamespaces []string) error {
+	current, currentNamespaces, err := caller.GetRoleInRemote(clm, subject, attribute)
+	if err != nil {
+		return err
+	}
+	// 정규화 전에 저장된 cluster-admin도 admin과 같게 비교
+	remoteRole = normalizeRemoteRole(remoteRole, remoteNamespaces)
+	if current == remoteRole && sameNamespaces(currentNamespaces, remoteNamespaces) {
+		return nil
+	}
+	if current != "" {
+		// roleRef는 수정이 안되므로 삭제 후 재생성
+		if err := caller.RemoveRoleFromRemote(clm, subject, attribute); err != nil {
+			return err
+		}
+	}
+	return caller.CreateRoleInRemote(clm, subject, remoteRole, attribute, remoteNamespaces)
+}
@@ -7,6 +7,7 @@ require (
 	github.com/evanphx/json-patch v4.11.0+incompatible
 	github.com/go-sql-driver/mysql v1.5.0
 	github.com/golang-jwt/jwt v3.2.2+incompatible
+	github.com/golang/snappy v0.0.3
 	// github.com/google/uuid v1.1.1
 	github.com/google/uuid v1.2.0
 	// github.com/gorilla/mux v1.7.3
@@ -19,6 +20,7 @@ require (
 	github.com/tmax-cloud/efk-operator v0.0.0-20201207030412-fd9c02a3e1c2
 	github.com/tmax-cloud/hypercloud-multi-operator v0.5.0-b26f5
 	github.com/tmax-cloud/hypercloud-single-operator v0.0.0-20210222045913-0ace319d7c34
+	google.golang.org/protobuf v1.26.0
 	gopkg.in/gomail.v2 v2.0.0-20160411212932-81ebce5c23df
 	gopkg.in/yaml.v2 v2.4.0
 	k8s.io/api v0.22.2
@@ -25,11 +25,14 @@ import (
 	metering "github.com/tmax-cloud/hypercloud-api-server/metering"
 	"github.com/tmax-cloud/hypercloud-api-server/namespace"
 	"github.com/tmax-cloud/hypercloud-api-server/namespaceClaim"
+	"github.com/tmax-cloud/hypercloud-api-server/retention"
 	user "github.com/tmax-cloud/hypercloud-api-server/user"
 	util "github.com/tmax-cloud/hypercloud-api-server/util"
 	"github.com/tmax-cloud/hypercloud-api-server/util/caller"
 	kafkaConsumer "github.com/tmax-cloud/hypercloud-api-server/util/consumer"
 	"github.com/tmax-cloud/hypercloud-api-server/util/dataFactory"
+	auditDataFactory "github.com/tmax-cloud/hypercloud-api-server/util/dataFactory/audit"
+	clusterDataFactory "github.com/tmax-cloud/hypercloud-api-server/util/dataFactory/cluster"
 	version "github.com/tmax-cloud/hypercloud-api-server/version"
 
 	"k8s.io/api/admission/v1beta1"
@@ -56,9 +59,25 @@ func main() {
 	flag.StringVar(&util.SMTPPasswordPath, "smtpPassword", "/run/secrets/smtp/password", "SMTP Server Password")
 	flag.StringVar(&util.AccessSecretPath, "accessSecret", "/run/secrets/token/accessSecret", "Token Access Secret")
 	flag.StringVar(&util.HtmlHomePath, "htmlPath", "/run/configs/html/", "Invite html path")
+	flag.StringVar(&auditDataFactory.StoreBackend, "auditBackend", "postgres", "Audit storage backend (postgres or elasticsearch)")
+	flag.StringVar(&auditDataFactory.ElasticsearchURL, "auditElasticsearchUrl", "http://elasticsearch.kube-logging.svc.cluster.local:9200", "Elasticsearch URL for audit backend")
+	flag.StringVar(&auditDataFactory.ElasticsearchIndex, "auditElasticsearchIndex", "hypercloud-audit", "Elasticsearch index for audit backend")
+	flag.StringVar(&auditDataFactory.BodyResourceList, "auditBodyResources", "", "Comma separated resources whose audit request/response bodies are stored (secrets are never stored)")
+	flag.IntVar(&auditDataFactory.BodyMaxBytes, "auditBodyMaxBytes", 64*1024, "Max size of a stored audit request or response body")
+	flag.StringVar(&audit.AllowedOrigins, "auditWebsocketOrigins", "", "Comma separated origins allowed to open the audit websocket (empty allows same origin only)")
+	flag.StringVar(&retention.Policy, "retentionPolicy", retention.DEFAULT_POLICY, "Comma separated retention days per table, e.g. audit=90,metering_hour=30. Tables not listed are kept forever")
+	flag.StringVar(&retention.ArchivePath, "retentionArchivePath", "", "Directory to archive purged audit rows as gzip NDJSON (empty disables archiving)")
+	flag.StringVar(&metering.ConfigPath, "meteringConfig", "/run/configs/metering/config.yaml", "Metering config file with the metric source and PromQL queries")
+	flag.StringVar(&metering.MetricsTokenFile, "meteringMetricsTokenFile", "", "Bearer token file scrapers of /metering/metrics must present. Empty allows admins only")
+	flag.StringVar(&alert.WebhookTokenFile, "alertWebhookTokenFile", "/run/secrets/alert/webhook-token", "Bearer token file Alertmanager must present to /alert/webhook")
 	// flag.StringVar(&dataFactory.DBPassWordPath, "dbPassword", "/run/secrets/timescaledb/password", "Timescaledb Server Password")
 	// flag.StringVar(&util.TokenExpiredDate, "tokenExpiredDate", "24hours", "Token Expired Date")
 
+	// caller and alert skip their clients outside of a cluster so unit tests can load them; the server still needs them
+	if caller.Clientset == nil {
+		panic("hypercloud-api-server must run in a cluster, the in-cluster config is not loaded")
+	}
+
 	// Get Hypercloud Operating Mode!!!
 	hcMode := os.Getenv("HC_MODE")
 	dataFactory.CreateConnection()
@@ -83,6 +102,45 @@ func main() {
 		os.Mkdir("./logs", os.ModeDir)
 	}
 
+	if err := auditDataFactory.InitStore(); err != nil {
+		klog.Errorln(err)
+		return
+	}
+	// spooled audit events are replayed once the store they go to is connected
+	audit.StartReplay()
+	if err := retention.InitPolicy(); err != nil {
+		klog.Errorln(err)
+		return
+	}
+	if err := metering.InitMetricSource(); err != nil {
+		klog.Errorln(err)
+		return
+	}
+	if err := metering.InitRollup(); err != nil {
+		klog.Errorln(err)
+		return
+	}
+	if err := metering.InitPricing(); err != nil {
+		klog.Errorln(err)
+		return
+	}
+	if err := metering.InitBudget(); err != nil {
+		klog.Errorln(err)
+		return
+	}
+	if err := alert.InitNotification(); err != nil {
+		klog.Errorln(err)
+		return
+	}
+	if err := clusterDataFactory.InitInvitation(); err != nil {
+		klog.Errorln(err)
+		return
+	}
+	if err := clusterDataFactory.InitRemoteNamespace(); err != nil {
+		klog.Errorln(err)
+		return
+	}
+
 	file, err := os.OpenFile(
 		"./logs/api-server.log",
 		os.O_CREATE|os.O_RDWR|os.O_TRUNC,
@@ -117,6 +175,12 @@ func main() {
 
 	// Metering Cron Job
 	cronJob.AddFunc("0 */1 * ? * *", metering.MeteringJob)
+	// Budget Cron Job, after the hourly rollup
+	cronJob.AddFunc("0 5 * * * ?", metering.BudgetJob)
+	// Invitation Cron Job
+	cronJob.AddFunc("0 */5 * * * ?", cluster.ExpireInvitationJob)
+	// Retention Cron Job
+	cronJob.AddFunc("0 30 0 * * ?", retention.RetentionJob)
 	// cronJob.AddFunc("@hourly", audit.UpdateAuditResource)
 	cronJob.Start()
 
@@ -138,8 +202,19 @@ func main() {
 	// mux := http.NewServeMux()
 	mux.HandleFunc("/user", serveUser)
 	mux.HandleFunc("/metering", serveMetering)
+	mux.HandleFunc("/metering/rollup", serveMeteringRollup)
+	mux.HandleFunc("/metering/cost", serveMeteringCost)
+	mux.HandleFunc("/metering/pricebook", serveMeteringPriceBook)
+	mux.HandleFunc("/metering/budget", serveMeteringBudget)
+	mux.HandleFunc("/metering/forecast", serveMeteringForecast)
+	mux.HandleFunc("/metering/metrics", serveMeteringMetrics)
+	mux.HandleFunc("/retention", serveRetention)
 	mux.HandleFunc("/namespace", serveNamespace)
 	mux.HandleFunc("/alert", serveAlert)
+	mux.HandleFunc("/alert/webhook", serveAlertWebhook)
+	mux.HandleFunc("/alert/receiver", serveAlertReceiver)
+	// ack, silence or resolve
+	mux.HandleFunc("/alert/{action}", serveAlertAction)
 	mux.HandleFunc("/grafanaUser", serveGrafanaUser)
 	mux.HandleFunc("/grafanaDashboard", serveGrafanaDashboard)
 	mux.HandleFunc("/namespaceClaim", serveNamespaceClaim)
@@ -150,6 +225,9 @@ func main() {
 
 	if hcMode != "single" {
 		// for multi mode only
+		// Cluster Member Controller
+		go cluster.RunMemberController(make(chan struct{}))
+
 		// List all clusterclaim
 		mux.HandleFunc("/clusterclaims", serveClusterClaim)
 		// list all clusterclaim in a specific namespace
@@ -165,18 +243,19 @@ func main() {
 		// list all clustermanager in a specific namespace
 		mux.HandleFunc("/namespaces/{namespace}/clustermanagers", serveCluster)
 		// Insert or delete clustermanager to database
+		// delete는 member controller가 clustermanager 삭제 시 처리하므로 호환을 위해서만 남겨둠
 		mux.HandleFunc("/namespaces/{namespace}/clustermanagers/{clustermanager}", serveCluster)
 		// list all member
 		mux.HandleFunc("/namespaces/{namespace}/clustermanagers/{clustermanager}/member", serveClusterMember)
-		// list a pending status user
+		// list a pending status user, 여러 멤버 추가 요청 (POST, json or csv)
 		mux.HandleFunc("/namespaces/{namespace}/clustermanagers/{clustermanager}/member_invitation", serveClusterInvitation)
-		// 추가 요청 (db + token 발급)
+		// 추가 요청 (db + token 발급), 만료된 초대 재발송 (PUT)
 		mux.HandleFunc("/namespaces/{namespace}/clustermanagers/{clustermanager}/member_invitation/{attribute}/{member}", serveClusterInvitation)
 		// 추가 요청 승인, 추가 요청 거절
 		mux.HandleFunc("/namespaces/{namespace}/clustermanagers/{clustermanager}/member_invitation/{admit}", serveClusterInvitationAdmit)
 		// 멤버 삭제 (db)
 		mux.HandleFunc("/namespaces/{namespace}/clustermanagers/{clustermanager}/remove_member/{attribute}/{member}", serveClusterMember)
-		// 권한 변경 (db)
+		// 권한 변경 (db), remoteRole은 view, edit, admin 또는 custom ClusterRole. remoteNamespace를 주면 해당 namespace에만 적용
 		mux.HandleFunc("/namespaces/{namespace}/clustermanagers/{clustermanager}/update_role/{attribute}/{member}", serveClusterMember)
 		// list invited member id
 		mux.HandleFunc("/namespaces/{namespace}/clustermanagers/{clustermanager}/member/{member}", serveClusterMember)
@@ -189,7 +268,11 @@ func main() {
 	mux.HandleFunc("/audit/resources", serveAuditResources)
 	mux.HandleFunc("/audit/verb", serveAuditVerb)
 	mux.HandleFunc("/audit/websocket", serveAuditWss)
+	mux.HandleFunc("/audit/stream", serveAuditStream)
 	mux.HandleFunc("/audit/json", serveAuditJson)
+	mux.HandleFunc("/audit/spool", serveAuditSpool)
+	mux.HandleFunc("/audit/export", serveAuditExport)
+	mux.HandleFunc("/audit/stats", serveAuditStats)
 	mux.HandleFunc("/inject/pod", serveSidecarInjectionForPod)
 	mux.HandleFunc("/inject/deployment", serveSidecarInjectionForDeploy)
 	mux.HandleFunc("/inject/replicaset", serveSidecarInjectionForRs)
@@ -357,6 +440,17 @@ func serveUser(res http.ResponseWriter, req *http.Request) {
 	}
 }
 
+func serveRetention(res http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		retention.Get(res, req)
+	case http.MethodPost:
+		retention.Post(res, req)
+	default:
+		klog.Errorf("method not acceptable")
+	}
+}
+
 func serveMetering(res http.ResponseWriter, req *http.Request) {
 	switch req.Method {
 	case http.MethodGet:
@@ -368,6 +462,70 @@ func serveMetering(res http.ResponseWriter, req *http.Request) {
 	}
 }
 
+func serveMeteringRollup(res http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		metering.GetRollup(res, req)
+	case http.MethodPost:
+		metering.PostRollup(res, req)
+	default:
+		klog.Errorf("method not acceptable")
+	}
+}
+
+func serveMeteringCost(res http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		metering.GetCost(res, req)
+	default:
+		klog.Errorf("method not acceptable")
+	}
+}
+
+func serveMeteringPriceBook(res http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		metering.GetPriceBook(res, req)
+	case http.MethodPost:
+		metering.PostPriceBook(res, req)
+	default:
+		klog.Errorf("method not acceptable")
+	}
+}
+
+func serveMeteringBudget(res http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		metering.GetBudget(res, req)
+	case http.MethodPost:
+		metering.PostBudget(res, req)
+	case http.MethodPut:
+		metering.PutBudget(res, req)
+	case http.MethodDelete:
+		metering.DeleteBudget(res, req)
+	default:
+		klog.Errorf("method not acceptable")
+	}
+}
+
+func serveMeteringForecast(res http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		metering.GetForecast(res, req)
+	default:
+		klog.Errorf("method not acceptable")
+	}
+}
+
+func serveMeteringMetrics(res http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		metering.GetMetrics(res, req)
+	default:
+		klog.Errorf("method not acceptable")
+	}
+}
+
 func serveAlert(res http.ResponseWriter, req *http.Request) {
 	switch req.Method {
 	case http.MethodPost:
@@ -378,6 +536,39 @@ func serveAlert(res http.ResponseWriter, req *http.Request) {
 		klog.Errorf("method not acceptable")
 	}
 }
+
+func serveAlertWebhook(res http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPost:
+		alert.PostWebhook(res, req)
+	default:
+		klog.Errorf("method not acceptable")
+	}
+}
+
+func serveAlertAction(res http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPost:
+		alert.PostAction(res, req)
+	default:
+		klog.Errorf("method not acceptable")
+	}
+}
+
+func serveAlertReceiver(res http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		alert.GetReceiver(res, req)
+	case http.MethodPost:
+		alert.PostReceiver(res, req)
+	case http.MethodPut:
+		alert.PutReceiver(res, req)
+	case http.MethodDelete:
+		alert.DeleteReceiver(res, req)
+	default:
+		klog.Errorf("method not acceptable")
+	}
+}
 func serveGrafanaUser(res http.ResponseWriter, req *http.Request) {
 	klog.Infof("Http request: method=%s, uri=%s", req.Method, req.URL.Path)
 	switch req.Method {
@@ -474,6 +665,14 @@ func serveClusterInvitation(res http.ResponseWriter, req *http.Request) {
 			cluster.InviteUser(res, req)
 		} else if vars["attribute"] == "group" {
 			cluster.InviteGroup(res, req)
+		} else if vars["attribute"] == "" {
+			cluster.BulkInvite(res, req)
+		} else {
+			klog.Errorf("Http request error: some url params not found")
+		}
+	case http.MethodPut:
+		if vars["attribute"] == "user" {
+			cluster.ResendInvitation(res, req)
 		} else {
 			klog.Errorf("Http request error: some url params not found")
 		}
@@ -600,6 +799,16 @@ func serveAuditWss(w http.ResponseWriter, r *http.Request) {
 	audit.ServeWss(w, r)
 }
 
+func serveAuditStream(w http.ResponseWriter, r *http.Request) {
+	klog.Infof("Http request: method=%s, uri=%s", r.Method, r.URL.Path)
+	switch r.Method {
+	case http.MethodGet:
+		audit.ServeStream(w, r)
+	default:
+		klog.Errorf("method not acceptable")
+	}
+}
+
 func serveAuditJson(w http.ResponseWriter, r *http.Request) {
 	klog.Infof("Http request: method=%s, uri=%s", r.Method, r.URL.Path)
 	switch r.Method {
@@ -610,6 +819,36 @@ func serveAuditJson(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func serveAuditStats(w http.ResponseWriter, r *http.Request) {
+	klog.Infof("Http request: method=%s, uri=%s", r.Method, r.URL.Path)
+	switch r.Method {
+	case http.MethodGet:
+		audit.GetAuditStats(w, r)
+	default:
+		klog.Errorf("method not acceptable")
+	}
+}
+
+func serveAuditExport(w http.ResponseWriter, r *http.Request) {
+	klog.Infof("Http request: method=%s, uri=%s", r.Method, r.URL.Path)
+	switch r.Method {
+	case http.MethodGet:
+		audit.ExportAudit(w, r)
+	default:
+		klog.Errorf("method not acceptable")
+	}
+}
+
+func serveAuditSpool(w http.ResponseWriter, r *http.Request) {
+	klog.Infof("Http request: method=%s, uri=%s", r.Method, r.URL.Path)
+	switch r.Method {
+	case http.MethodGet:
+		audit.GetSpoolStatus(w, r)
+	default:
+		klog.Errorf("method not acceptable")
+	}
+}
+
 func serve(w http.ResponseWriter, r *http.Request, admit admitFunc) {
 	var body []byte
 	if r.Body != nil {
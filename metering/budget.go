@@ -0,0 +1,329 @@
+package metering
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/tmax-cloud/hypercloud-api-server/alert"
+	alertModel "github.com/tmax-cloud/hypercloud-api-server/alert/model"
+	"github.com/tmax-cloud/hypercloud-api-server/audit"
+	meteringModel "github.com/tmax-cloud/hypercloud-api-server/metering/model"
+	"github.com/tmax-cloud/hypercloud-api-server/util"
+	"github.com/tmax-cloud/hypercloud-api-server/util/caller"
+	db "github.com/tmax-cloud/hypercloud-api-server/util/dataFactory"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	auditApi "k8s.io/apiserver/pkg/apis/audit"
+	"k8s.io/klog"
+)
+
+const (
+	BUDGET_METRIC_COST = "cost"
+
+	BUDGET_STATE_OK       = "ok"
+	BUDGET_STATE_WARNING  = "warning"
+	BUDGET_STATE_CRITICAL = "critical"
+
+	BUDGET_CREATE_QUERY = "create table if not exists metering_budget (namespace varchar(253) not null, name varchar(63) not null, " +
+		"metric varchar(32) not null, period varchar(16) not null, amount double precision not null, warning_percent double precision not null, " +
+		"critical_percent double precision not null, created_by varchar(255), created_at timestamp not null default now(), " +
+		"updated_at timestamp not null default now(), state varchar(16) not null default 'ok', state_period timestamp, primary key (namespace, name))"
+	BUDGET_SELECT_QUERY = "select namespace, name, metric, period, amount, warning_percent, critical_percent, created_by, created_at, updated_at, " +
+		"state, state_period from metering_budget"
+	BUDGET_INSERT_QUERY = "insert into metering_budget (namespace, name, metric, period, amount, warning_percent, critical_percent, created_by) " +
+		"values ($1, $2, $3, $4, $5, $6, $7, $8)"
+	// thresholds are evaluated again after an update
+	BUDGET_UPDATE_QUERY = "update metering_budget set metric = $3, period = $4, amount = $5, warning_percent = $6, critical_percent = $7, " +
+		"updated_at = now(), state = 'ok', state_period = null where namespace = $1 and name = $2"
+	BUDGET_DELETE_QUERY = "delete from metering_budget where namespace = $1 and name = $2"
+	// the state is changed only if no other replica changed it first, so an alert is raised once
+	BUDGET_STATE_QUERY = "update metering_budget set state = $3, state_period = $4 where namespace = $1 and name = $2 " +
+		"and state is not distinct from $5 and state_period is not distinct from $6"
+)
+
+var errBudgetNotFound = errors.New("Budget is not found")
+
+var budgetStateLevel = map[string]int{BUDGET_STATE_OK: 0, BUDGET_STATE_WARNING: 1, BUDGET_STATE_CRITICAL: 2}
+
+func InitBudget() error {
+	_, err := db.Dbpool.Exec(context.TODO(), BUDGET_CREATE_QUERY)
+	return err
+}
+
+func validateBudget(budget meteringModel.Budget) error {
+	if errs := validation.IsDNS1123Label(budget.Name); len(errs) > 0 {
+		return errors.New("Budget name [" + budget.Name + "] is invalid: " + strings.Join(errs, ", "))
+	}
+	if budget.Namespace == "" {
+		return errors.New("Namespace is empty")
+	}
+	if _, ok := priceUnits[budget.Metric]; !ok && budget.Metric != BUDGET_METRIC_COST {
+		return errors.New("Budget metric [" + budget.Metric + "] is not supported")
+	}
+	if budget.Period != UNIT_DAY && budget.Period != UNIT_MONTH {
+		return errors.New("Budget period must be day or month")
+	}
+	if budget.Amount <= 0 {
+		return errors.New("Budget amount must be positive")
+	}
+	if budget.WarningPercent <= 0 || budget.CriticalPercent < budget.WarningPercent {
+		return errors.New("Budget percents must satisfy 0 < warningPercent <= criticalPercent")
+	}
+	return nil
+}
+
+func scanBudget(scan func(dest ...interface{}) error) (meteringModel.Budget, error) {
+	var budget meteringModel.Budget
+	var createdBy *string
+	var statePeriod *time.Time
+	err := scan(&budget.Namespace, &budget.Name, &budget.Metric, &budget.Period, &budget.Amount, &budget.WarningPercent,
+		&budget.CriticalPercent, &createdBy, &budget.CreatedAt, &budget.UpdatedAt, &budget.State, &statePeriod)
+	if err != nil {
+		return budget, err
+	}
+	if createdBy != nil {
+		budget.CreatedBy = *createdBy
+	}
+	if statePeriod != nil {
+		budget.StatePeriod = util.WallClock(*statePeriod)
+	}
+	budget.CreatedAt = util.WallClock(budget.CreatedAt)
+	budget.UpdatedAt = util.WallClock(budget.UpdatedAt)
+	return budget, nil
+}
+
+// listBudgets returns the budgets of namespace, or of every namespace when namespace is empty.
+func listBudgets(namespace string) ([]meteringModel.Budget, error) {
+	q, args := BUDGET_SELECT_QUERY+" order by namespace, name", []interface{}{}
+	if namespace != "" {
+		q, args = BUDGET_SELECT_QUERY+" where namespace = $1 order by name", []interface{}{namespace}
+	}
+	rows, err := db.Dbpool.Query(context.TODO(), q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	budgets := []meteringModel.Budget{}
+	for rows.Next() {
+		budget, err := scanBudget(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		budgets = append(budgets, budget)
+	}
+	return budgets, rows.Err()
+}
+
+func getBudget(namespace string, name string) (meteringModel.Budget, error) {
+	budget, err := scanBudget(db.Dbpool.QueryRow(context.TODO(), BUDGET_SELECT_QUERY+" where namespace = $1 and name = $2", namespace, name).Scan)
+	if err == pgx.ErrNoRows {
+		return budget, errBudgetNotFound
+	}
+	return budget, err
+}
+
+func insertBudget(budget meteringModel.Budget) error {
+	_, err := db.Dbpool.Exec(context.TODO(), BUDGET_INSERT_QUERY, budget.Namespace, budget.Name, budget.Metric, budget.Period,
+		budget.Amount, budget.WarningPercent, budget.CriticalPercent, budget.CreatedBy)
+	return err
+}
+
+func updateBudget(budget meteringModel.Budget) error {
+	tag, err := db.Dbpool.Exec(context.TODO(), BUDGET_UPDATE_QUERY, budget.Namespace, budget.Name, budget.Metric, budget.Period,
+		budget.Amount, budget.WarningPercent, budget.CriticalPercent)
+	if err == nil && tag.RowsAffected() == 0 {
+		return errBudgetNotFound
+	}
+	return err
+}
+
+func deleteBudget(namespace string, name string) error {
+	tag, err := db.Dbpool.Exec(context.TODO(), BUDGET_DELETE_QUERY, namespace, name)
+	if err == nil && tag.RowsAffected() == 0 {
+		return errBudgetNotFound
+	}
+	return err
+}
+
+// budgetRanges returns the completed days of the current period of budget, read from metering_day, and today up to now,
+// read from metering_hour. Hourly rows are kept only for a few days, so they can not cover a whole month.
+func budgetRanges(budget meteringModel.Budget, now time.Time) (from time.Time, today time.Time) {
+	return truncate(now, budget.Period), truncate(now, UNIT_DAY)
+}
+
+// budgetUsage sums the metering rows of the current period of budget, up to now.
+func budgetUsage(budget meteringModel.Budget, now time.Time) (float64, error) {
+	from, today := budgetRanges(budget, now)
+	dayRows := getMeteringDataFromDB(false, "select "+meteringColumns+" from metering_day where namespace = $1 "+
+		"and metering_time >= $2 and metering_time < $3", []interface{}{budget.Namespace, from, today})
+	hourRows := getMeteringDataFromDB(false, "select "+meteringColumns+" from metering_hour where namespace = $1 "+
+		"and metering_time >= $2 and metering_time < $3", []interface{}{budget.Namespace, today, now})
+
+	if budget.Metric == BUDGET_METRIC_COST {
+		book, err := getPriceBook(0, now)
+		if err != nil {
+			return 0, err
+		}
+		return periodCost(book, dayRows, hourRows, from, now), nil
+	}
+	return periodUsage(budget.Metric, dayRows, hourRows), nil
+}
+
+// periodUsage sums metric of daily and hourly rows in the unit of its price.
+func periodUsage(metric string, dayRows []meteringModel.Metering, hourRows []meteringModel.Metering) float64 {
+	var total float64
+	price := meteringModel.Price{Resource: metric, Per: UNIT_HOUR}
+	for _, row := range dayRows {
+		total += usage(row, UNIT_DAY, price)
+	}
+	for _, row := range hourRows {
+		total += usage(row, UNIT_HOUR, price)
+	}
+	return total
+}
+
+// periodCost prices daily and hourly rows of one namespace together, so tiers apply to the whole period.
+func periodCost(book meteringModel.PriceBook, dayRows []meteringModel.Metering, hourRows []meteringModel.Metering, from time.Time, to time.Time) float64 {
+	quantities := map[string]map[string]float64{}
+	addQuantities(quantities, book, dayRows, UNIT_DAY)
+	addQuantities(quantities, book, hourRows, UNIT_HOUR)
+	for _, invoice := range invoicesOf(book, quantities, from, to) {
+		return invoice.Total
+	}
+	return 0
+}
+
+func budgetState(budget meteringModel.Budget, percent float64) string {
+	switch {
+	case percent >= budget.CriticalPercent:
+		return BUDGET_STATE_CRITICAL
+	case percent >= budget.WarningPercent:
+		return BUDGET_STATE_WARNING
+	default:
+		return BUDGET_STATE_OK
+	}
+}
+
+// fillUsage sets the usage of the current period on budgets.
+func fillUsage(budgets []meteringModel.Budget, now time.Time) {
+	for i := range budgets {
+		used, err := budgetUsage(budgets[i], now)
+		if err != nil {
+			klog.Errorln("Usage of budget ", budgets[i].Namespace, "/", budgets[i].Name, " is unknown: ", err)
+			continue
+		}
+		budgets[i].Usage = round(used, 4)
+		budgets[i].UsagePercent = round(used/budgets[i].Amount*100, 2)
+	}
+}
+
+// BudgetJob raises an alert when a budget crosses a threshold higher than the one already alerted in the period.
+func BudgetJob() {
+	budgets, err := listBudgets("")
+	if err != nil {
+		klog.Errorln(err)
+		return
+	}
+	now := time.Now()
+	for _, budget := range budgets {
+		used, err := budgetUsage(budget, now)
+		if err != nil {
+			klog.Errorln("Usage of budget ", budget.Namespace, "/", budget.Name, " is unknown: ", err)
+			continue
+		}
+		budget.Usage = round(used, 4)
+		budget.UsagePercent = round(used/budget.Amount*100, 2)
+
+		period := truncate(now, budget.Period)
+		state := budgetState(budget, budget.UsagePercent)
+		alerted := budget.State
+		if !budget.StatePeriod.Equal(period) {
+			alerted = BUDGET_STATE_OK
+		}
+		if budgetStateLevel[state] <= budgetStateLevel[alerted] {
+			if !budget.StatePeriod.Equal(period) && budget.State != BUDGET_STATE_OK {
+				// a new period starts without an alert
+				setBudgetState(budget, BUDGET_STATE_OK, period)
+			}
+			continue
+		}
+		if !setBudgetState(budget, state, period) {
+			continue
+		}
+		raiseBudgetAlert(budget, state, now)
+	}
+}
+
+func setBudgetState(budget meteringModel.Budget, state string, period time.Time) bool {
+	var statePeriod *time.Time
+	if !budget.StatePeriod.IsZero() {
+		statePeriod = &budget.StatePeriod
+	}
+	tag, err := db.Dbpool.Exec(context.TODO(), BUDGET_STATE_QUERY, budget.Namespace, budget.Name, state, period, budget.State, statePeriod)
+	if err != nil {
+		klog.Errorln(err)
+		return false
+	}
+	return tag.RowsAffected() == 1
+}
+
+func raiseBudgetAlert(budget meteringModel.Budget, state string, now time.Time) {
+	name := fmt.Sprintf("budget-%s-%d", budget.Name, now.Unix())
+	threshold := budget.WarningPercent
+	if state == BUDGET_STATE_CRITICAL {
+		threshold = budget.CriticalPercent
+	}
+	message := fmt.Sprintf("Budget %s of namespace %s reached %s%% of %s %s per %s (%s threshold %s%%)",
+		budget.Name, budget.Namespace, formatFloat(budget.UsagePercent), formatFloat(budget.Amount),
+		budget.Metric, budget.Period, state, formatFloat(threshold))
+	klog.Infoln(message)
+
+	budgetAlert := alertModel.Alert{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "Alert",
+			APIVersion: "tmax.io/v1",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: budget.Namespace,
+		},
+		Spec: alertModel.AlertSpec{
+			Name:     "budget_" + state,
+			Message:  message,
+			Resource: "budget",
+			Kind:     state,
+		},
+	}
+	if err := caller.CreateAlert(budgetAlert, budget.Namespace); err != nil {
+		klog.Errorln("Alert of budget ", budget.Namespace, "/", budget.Name, " is not created: ", err)
+	} else {
+		alert.Notify(budgetAlert, alert.STATE_FIRING)
+	}
+
+	audit.Enqueue(auditApi.Event{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "Event",
+			APIVersion: "audit.k8s.io/v1",
+		},
+		AuditID:        types.UID(uuid.New().String()),
+		Stage:          auditApi.StageResponseComplete,
+		Verb:           "alert",
+		StageTimestamp: metav1.NewMicroTime(now),
+		ObjectRef: &auditApi.ObjectReference{
+			Resource:  "budget",
+			Namespace: budget.Namespace,
+			Name:      budget.Name,
+		},
+		ResponseStatus: &metav1.Status{
+			Status:  state,
+			Message: message,
+		},
+	})
+}
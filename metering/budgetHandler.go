@@ -0,0 +1,158 @@
+package metering
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	meteringModel "github.com/tmax-cloud/hypercloud-api-server/metering/model"
+	"github.com/tmax-cloud/hypercloud-api-server/util"
+	"github.com/tmax-cloud/hypercloud-api-server/util/caller"
+	"k8s.io/klog"
+)
+
+// GetBudget returns the budgets of namespace with the usage of the current period, or one budget with name.
+func GetBudget(res http.ResponseWriter, req *http.Request) {
+	klog.Infoln("**** GET /metering/budget")
+	queryParams := req.URL.Query()
+	namespace := queryParams.Get(util.QUERY_PARAMETER_NAMESPACE)
+	name := queryParams.Get(util.QUERY_PARAMETER_NAME)
+	if !canAccessBudget(res, req, namespace, "get") {
+		return
+	}
+
+	var budgets []meteringModel.Budget
+	if name != "" {
+		budget, err := getBudget(namespace, name)
+		if err != nil {
+			setBudgetError(res, err)
+			return
+		}
+		budgets = []meteringModel.Budget{budget}
+	} else {
+		var err error
+		if budgets, err = listBudgets(namespace); err != nil {
+			setBudgetError(res, err)
+			return
+		}
+	}
+	fillUsage(budgets, time.Now())
+
+	if name != "" {
+		util.SetResponse(res, "", budgets[0], http.StatusOK)
+		return
+	}
+	util.SetResponse(res, "", budgets, http.StatusOK)
+}
+
+// PostBudget creates the budget in the body.
+func PostBudget(res http.ResponseWriter, req *http.Request) {
+	klog.Infoln("**** POST /metering/budget")
+	budget, ok := readBudget(res, req)
+	if !ok || !canAccessBudget(res, req, budget.Namespace, "update") {
+		return
+	}
+	budget.CreatedBy = req.URL.Query().Get(util.QUERY_PARAMETER_USER_ID)
+
+	if _, err := getBudget(budget.Namespace, budget.Name); err == nil {
+		util.SetResponse(res, "Budget ["+budget.Name+"] already exists", nil, http.StatusConflict)
+		return
+	}
+	if err := insertBudget(budget); err != nil {
+		setBudgetError(res, err)
+		return
+	}
+	util.SetResponse(res, "", budget, http.StatusCreated)
+}
+
+// PutBudget replaces the budget with the name and namespace in the body. Its alert state is reset.
+func PutBudget(res http.ResponseWriter, req *http.Request) {
+	klog.Infoln("**** PUT /metering/budget")
+	budget, ok := readBudget(res, req)
+	if !ok || !canAccessBudget(res, req, budget.Namespace, "update") {
+		return
+	}
+	if err := updateBudget(budget); err != nil {
+		setBudgetError(res, err)
+		return
+	}
+	util.SetResponse(res, "", budget, http.StatusOK)
+}
+
+func DeleteBudget(res http.ResponseWriter, req *http.Request) {
+	klog.Infoln("**** DELETE /metering/budget")
+	queryParams := req.URL.Query()
+	namespace := queryParams.Get(util.QUERY_PARAMETER_NAMESPACE)
+	name := queryParams.Get(util.QUERY_PARAMETER_NAME)
+	if name == "" {
+		util.SetResponse(res, "Name is empty", nil, http.StatusBadRequest)
+		return
+	}
+	if !canAccessBudget(res, req, namespace, "update") {
+		return
+	}
+	if err := deleteBudget(namespace, name); err != nil {
+		setBudgetError(res, err)
+		return
+	}
+	util.SetResponse(res, "", nil, http.StatusOK)
+}
+
+func readBudget(res http.ResponseWriter, req *http.Request) (meteringModel.Budget, bool) {
+	var budget meteringModel.Budget
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		klog.Errorln(err)
+		util.SetResponse(res, err.Error(), nil, http.StatusBadRequest)
+		return budget, false
+	}
+	if err := json.Unmarshal(body, &budget); err != nil {
+		util.SetResponse(res, err.Error(), nil, http.StatusBadRequest)
+		return budget, false
+	}
+	if err := validateBudget(budget); err != nil {
+		util.SetResponse(res, err.Error(), nil, http.StatusBadRequest)
+		return budget, false
+	}
+	return budget, true
+}
+
+// canAccessBudget checks verb on the namespace itself, so users who own a namespace manage its budgets.
+func canAccessBudget(res http.ResponseWriter, req *http.Request, namespace string, verb string) bool {
+	queryParams := req.URL.Query()
+	userId := queryParams.Get(util.QUERY_PARAMETER_USER_ID)
+	userGroups := queryParams[util.QUERY_PARAMETER_USER_GROUP]
+
+	if userId == "" {
+		msg := "UserId is empty."
+		klog.Infoln(msg)
+		util.SetResponse(res, msg, nil, http.StatusBadRequest)
+		return false
+	}
+	if namespace == "" {
+		util.SetResponse(res, "Namespace is empty", nil, http.StatusBadRequest)
+		return false
+	}
+
+	sar, err := caller.CreateSubjectAccessReview(userId, userGroups, "", "namespaces", namespace, namespace, verb)
+	if err != nil {
+		klog.Errorln(err)
+		util.SetResponse(res, "", nil, http.StatusInternalServerError)
+		return false
+	}
+	if !sar.Status.Allowed {
+		util.SetResponse(res, "Not authorized", nil, http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func setBudgetError(res http.ResponseWriter, err error) {
+	if err == errBudgetNotFound {
+		util.SetResponse(res, err.Error(), nil, http.StatusNotFound)
+		return
+	}
+	klog.Errorln(err)
+	util.SetResponse(res, err.Error(), nil, http.StatusInternalServerError)
+}
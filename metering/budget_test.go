@@ -0,0 +1,62 @@
+package metering
+
+import (
+	"testing"
+	"time"
+
+	meteringModel "github.com/tmax-cloud/hypercloud-api-server/metering/model"
+)
+
+func TestBudgetRanges(t *testing.T) {
+	now := time.Date(2022, 4, 15, 10, 30, 0, 0, time.Local)
+	today := time.Date(2022, 4, 15, 0, 0, 0, 0, time.Local)
+
+	tests := []struct {
+		period   string
+		wantFrom time.Time
+	}{
+		// days before today come from metering_day, however long hourly rows are kept
+		{UNIT_MONTH, time.Date(2022, 4, 1, 0, 0, 0, 0, time.Local)},
+		{UNIT_DAY, today},
+	}
+	for _, tt := range tests {
+		from, gotToday := budgetRanges(meteringModel.Budget{Period: tt.period}, now)
+		if !from.Equal(tt.wantFrom) || !gotToday.Equal(today) {
+			t.Errorf("budgetRanges(%s) = %v, %v, want %v, %v", tt.period, from, gotToday, tt.wantFrom, today)
+		}
+	}
+}
+
+func TestPeriodUsage(t *testing.T) {
+	// metering_time is read as UTC and holds the local wall clock
+	dayRows := []meteringModel.Metering{
+		// twelve days before now, long after hourly rows are purged
+		{Namespace: "default", Cpu: 2, MeteringTime: time.Date(2022, 4, 3, 0, 0, 0, 0, time.UTC)},
+		{Namespace: "default", Cpu: 1, MeteringTime: time.Date(2022, 4, 14, 0, 0, 0, 0, time.UTC)},
+	}
+	hourRows := []meteringModel.Metering{
+		{Namespace: "default", Cpu: 4, MeteringTime: time.Date(2022, 4, 15, 9, 0, 0, 0, time.UTC)},
+	}
+
+	// 2 cores * 24 hours + 1 core * 24 hours + 4 cores * 1 hour
+	if got := periodUsage(METRIC_CPU, dayRows, hourRows); got != 76 {
+		t.Errorf("periodUsage() = %v, want 76", got)
+	}
+
+	book := meteringModel.PriceBook{
+		Prices: []meteringModel.Price{{Resource: METRIC_CPU, Per: UNIT_HOUR, Tiers: []meteringModel.Tier{
+			{UpTo: 50, UnitPrice: 1},
+			{UnitPrice: 0.5},
+		}}},
+		Discounts: []meteringModel.Discount{{Namespace: "default", Percent: 10}},
+	}
+	from := time.Date(2022, 4, 1, 0, 0, 0, 0, time.Local)
+	now := time.Date(2022, 4, 15, 10, 30, 0, 0, time.Local)
+	// tiers apply to the whole period: (50 * 1 + 26 * 0.5) * 0.9
+	if got := periodCost(book, dayRows, hourRows, from, now); got != 56.7 {
+		t.Errorf("periodCost() = %v, want 56.7", got)
+	}
+	if got := periodCost(book, nil, nil, from, now); got != 0 {
+		t.Errorf("periodCost() without rows = %v, want 0", got)
+	}
+}
@@ -0,0 +1,169 @@
+package metering
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	meteringModel "github.com/tmax-cloud/hypercloud-api-server/metering/model"
+	"github.com/tmax-cloud/hypercloud-api-server/util"
+	"github.com/tmax-cloud/hypercloud-api-server/util/caller"
+	"github.com/tmax-cloud/hypercloud-api-server/util/dataFactory/query"
+	"k8s.io/klog"
+)
+
+// GetCost prices metering_day or metering_month rows between startTime and endTime (unix timestamps) and
+// returns an invoice per namespace. The price book effective at endTime applies unless version is given.
+// Without startTime, the current month to date is priced. Namespaces are authorized like GET /metering.
+func GetCost(res http.ResponseWriter, req *http.Request) {
+	klog.Infoln("**** GET /metering/cost")
+	queryParams := req.URL.Query()
+	timeUnit := queryParams.Get(util.QUERY_PARAMETER_TIMEUNIT)
+	startTime := queryParams.Get(util.QUERY_PARAMETER_STARTTIME)
+	endTime := queryParams.Get(util.QUERY_PARAMETER_ENDTIME)
+	format := queryParams.Get("format")
+
+	if timeUnit == "" {
+		timeUnit = UNIT_DAY
+	}
+	if timeUnit != UNIT_DAY && timeUnit != UNIT_MONTH {
+		util.SetResponse(res, "TimeUnit must be day or month", nil, http.StatusBadRequest)
+		return
+	}
+	if format != "" && format != "json" && format != "csv" {
+		util.SetResponse(res, "Format must be json or csv", nil, http.StatusBadRequest)
+		return
+	}
+	version := 0
+	if v := queryParams.Get("version"); v != "" {
+		var err error
+		if version, err = strconv.Atoi(v); err != nil || version < 1 {
+			util.SetResponse(res, "Version must be a positive number", nil, http.StatusBadRequest)
+			return
+		}
+	}
+	namespaces, ok := authorizedNamespaces(res, req)
+	if !ok {
+		return
+	}
+	if startTime == "" {
+		startTime = strconv.FormatInt(truncate(time.Now(), UNIT_MONTH).Unix(), 10)
+	}
+
+	qb, err := makeTimeRange(timeUnit, startTime, endTime, false)
+	if err != nil {
+		util.SetResponse(res, err.Error(), nil, http.StatusBadRequest)
+		return
+	}
+	from, _ := strconv.ParseInt(startTime, 10, 64)
+	to := time.Now()
+	if endTime != "" {
+		end, _ := strconv.ParseInt(endTime, 10, 64)
+		to = time.Unix(end, 0)
+	}
+	if namespaces != nil {
+		qb.In("namespace", namespaces)
+	}
+	qb.OrderBy(nil, query.Order{Column: "metering_time"})
+
+	book, err := getPriceBook(version, to)
+	if err == pgx.ErrNoRows {
+		util.SetResponse(res, "No price book is effective", nil, http.StatusNotFound)
+		return
+	} else if err != nil {
+		klog.Errorln(err)
+		util.SetResponse(res, err.Error(), nil, http.StatusInternalServerError)
+		return
+	}
+
+	q, args := qb.Build()
+	invoices := makeInvoices(book, getMeteringDataFromDB(false, q, args), timeUnit, time.Unix(from, 0), to)
+
+	if format != "csv" {
+		util.SetResponse(res, "", invoices, http.StatusOK)
+		return
+	}
+	res.Header().Set("Content-Type", "text/csv")
+	res.Header().Set("Content-Disposition", "attachment; filename=\"cost-"+time.Now().Format("20060102150405")+".csv\"")
+	res.WriteHeader(http.StatusOK)
+	w := csv.NewWriter(res)
+	w.Write(invoiceCsvHeader)
+	for _, invoice := range invoices {
+		w.WriteAll(invoiceCsvRecords(invoice))
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		klog.Errorln(err)
+	}
+}
+
+// GetPriceBook returns the given version, or every version when version is not given.
+// Only admins can read it, since a price book has the discounts of every namespace.
+func GetPriceBook(res http.ResponseWriter, req *http.Request) {
+	if !caller.IsAdmin(res, req) {
+		return
+	}
+	v := req.URL.Query().Get("version")
+	if v == "" {
+		books, err := listPriceBooks()
+		if err != nil {
+			klog.Errorln(err)
+			util.SetResponse(res, err.Error(), nil, http.StatusInternalServerError)
+			return
+		}
+		util.SetResponse(res, "", books, http.StatusOK)
+		return
+	}
+
+	version, err := strconv.Atoi(v)
+	if err != nil || version < 1 {
+		util.SetResponse(res, "Version must be a positive number", nil, http.StatusBadRequest)
+		return
+	}
+	book, err := getPriceBook(version, time.Time{})
+	if err == pgx.ErrNoRows {
+		util.SetResponse(res, "Price book version ["+v+"] is not found", nil, http.StatusNotFound)
+		return
+	} else if err != nil {
+		klog.Errorln(err)
+		util.SetResponse(res, err.Error(), nil, http.StatusInternalServerError)
+		return
+	}
+	util.SetResponse(res, "", book, http.StatusOK)
+}
+
+// PostPriceBook saves the price book in the body as a new version. Existing versions are never changed.
+func PostPriceBook(res http.ResponseWriter, req *http.Request) {
+	klog.Infoln("**** POST /metering/pricebook")
+	if !caller.IsAdmin(res, req) {
+		return
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		klog.Errorln(err)
+		util.SetResponse(res, err.Error(), nil, http.StatusBadRequest)
+		return
+	}
+	var book meteringModel.PriceBook
+	if err := json.Unmarshal(body, &book); err != nil {
+		util.SetResponse(res, err.Error(), nil, http.StatusBadRequest)
+		return
+	}
+	if err := validatePriceBook(book); err != nil {
+		util.SetResponse(res, err.Error(), nil, http.StatusBadRequest)
+		return
+	}
+
+	book, err = savePriceBook(book, req.URL.Query().Get(util.QUERY_PARAMETER_USER_ID))
+	if err != nil {
+		klog.Errorln(err)
+		util.SetResponse(res, err.Error(), nil, http.StatusInternalServerError)
+		return
+	}
+	klog.Infof("Price book version %d is created by %s", book.Version, book.CreatedBy)
+	util.SetResponse(res, "", book, http.StatusCreated)
+}
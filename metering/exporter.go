@@ -0,0 +1,144 @@
+package metering
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	meteringModel "github.com/tmax-cloud/hypercloud-api-server/metering/model"
+	"github.com/tmax-cloud/hypercloud-api-server/util"
+	"github.com/tmax-cloud/hypercloud-api-server/util/caller"
+	db "github.com/tmax-cloud/hypercloud-api-server/util/dataFactory"
+	"k8s.io/klog"
+)
+
+const (
+	CONTENT_TYPE_TEXT        = "text/plain; version=0.0.4; charset=utf-8"
+	CONTENT_TYPE_OPENMETRICS = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+// MetricsTokenFile holds the bearer token scrapers must send to /metering/metrics. Empty allows admins only.
+var MetricsTokenFile string
+
+type exportedMetric struct {
+	name  string
+	help  string
+	value func(row meteringModel.Metering) float64
+}
+
+// exportedMetrics are the gauges of a metering row, shared by /metering/metrics and the remote write
+var exportedMetrics = []exportedMetric{
+	{"hypercloud_metering_cpu_cores", "Average cpu requested in the rollup, in cores.",
+		func(row meteringModel.Metering) float64 { return row.Cpu }},
+	{"hypercloud_metering_memory_bytes", "Average memory requested in the rollup, in bytes.",
+		func(row meteringModel.Metering) float64 { return float64(row.Memory) }},
+	{"hypercloud_metering_storage_bytes", "Average storage requested in the rollup, in bytes.",
+		func(row meteringModel.Metering) float64 { return float64(row.Storage) }},
+	{"hypercloud_metering_gpu", "Average gpus requested in the rollup.",
+		func(row meteringModel.Metering) float64 { return row.Gpu }},
+	{"hypercloud_metering_public_ip", "Average public ips in the rollup.",
+		func(row meteringModel.Metering) float64 { return float64(row.PublicIp) }},
+	{"hypercloud_metering_private_ip", "Average private ips in the rollup.",
+		func(row meteringModel.Metering) float64 { return float64(row.PrivateIp) }},
+	{"hypercloud_metering_traffic_in_bytes_per_second", "Average incoming traffic in the rollup, in bytes per second.",
+		func(row meteringModel.Metering) float64 { return float64(row.TrafficIn) }},
+	{"hypercloud_metering_traffic_out_bytes_per_second", "Average outgoing traffic in the rollup, in bytes per second.",
+		func(row meteringModel.Metering) float64 { return float64(row.TrafficOut) }},
+}
+
+// rollupTimestamp tells scrapers which bucket a value of /metering/metrics belongs to. The remote write sets it as the sample time instead.
+var rollupTimestamp = exportedMetric{"hypercloud_metering_timestamp_seconds", "Start of the rollup, in unix seconds.",
+	func(row meteringModel.Metering) float64 { return float64(util.WallClock(row.MeteringTime).Unix()) }}
+
+// GetMetrics serves the latest row of every namespace in each rollup table, labelled with the unit of the table.
+// OpenMetrics is served when the scraper accepts it, the Prometheus text format otherwise.
+func GetMetrics(res http.ResponseWriter, req *http.Request) {
+	if !canScrape(res, req) {
+		return
+	}
+
+	latest := map[string][]meteringModel.Metering{}
+	for _, unit := range []string{UNIT_HOUR, UNIT_DAY, UNIT_MONTH, UNIT_YEAR} {
+		rows, err := latestRollups(unit)
+		if err != nil {
+			klog.Errorln(err)
+			res.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		latest[unit] = rows
+	}
+
+	openMetrics := strings.Contains(req.Header.Get("Accept"), "application/openmetrics-text")
+	var buf bytes.Buffer
+	for _, m := range append(exportedMetrics, rollupTimestamp) {
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s gauge\n", m.name, m.help, m.name)
+		for _, unit := range []string{UNIT_HOUR, UNIT_DAY, UNIT_MONTH, UNIT_YEAR} {
+			for _, row := range latest[unit] {
+				fmt.Fprintf(&buf, "%s{namespace=\"%s\",unit=\"%s\"} %s\n", m.name, escapeLabelValue(row.Namespace), unit,
+					strconv.FormatFloat(m.value(row), 'g', -1, 64))
+			}
+		}
+	}
+
+	if openMetrics {
+		buf.WriteString("# EOF\n")
+		res.Header().Set("Content-Type", CONTENT_TYPE_OPENMETRICS)
+	} else {
+		res.Header().Set("Content-Type", CONTENT_TYPE_TEXT)
+	}
+	res.WriteHeader(http.StatusOK)
+	if _, err := res.Write(buf.Bytes()); err != nil {
+		klog.Errorln(err)
+	}
+}
+
+// latestRollups returns the latest row of every namespace in the table of unit.
+func latestRollups(unit string) ([]meteringModel.Metering, error) {
+	rows, err := db.Dbpool.Query(context.TODO(), "select distinct on (namespace) "+meteringColumns+" from metering_"+unit+
+		" order by namespace, metering_time desc")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var meteringList []meteringModel.Metering
+	for rows.Next() {
+		var row meteringModel.Metering
+		var status string
+		if err := rows.Scan(&row.Id, &row.Namespace, &row.Cpu, &row.Memory, &row.Storage, &row.Gpu, &row.PublicIp,
+			&row.PrivateIp, &row.TrafficIn, &row.TrafficOut, &row.MeteringTime, &status); err != nil {
+			return nil, err
+		}
+		meteringList = append(meteringList, row)
+	}
+	return meteringList, rows.Err()
+}
+
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// canScrape checks the bearer token of the scraper against MetricsTokenFile.
+// Without MetricsTokenFile, the scraper must be an admin like the other cluster wide metering apis.
+func canScrape(res http.ResponseWriter, req *http.Request) bool {
+	if MetricsTokenFile == "" {
+		return caller.IsAdmin(res, req)
+	}
+	token, err := ioutil.ReadFile(MetricsTokenFile)
+	if err != nil {
+		klog.Errorln(err)
+		res.WriteHeader(http.StatusInternalServerError)
+		return false
+	}
+	expected := "Bearer " + strings.TrimSpace(string(token))
+	if subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), []byte(expected)) != 1 {
+		res.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,210 @@
+package metering
+
+import (
+	"errors"
+	"math"
+	"time"
+
+	meteringModel "github.com/tmax-cloud/hypercloud-api-server/metering/model"
+	"github.com/tmax-cloud/hypercloud-api-server/util"
+)
+
+const (
+	FORECAST_MODEL_LINEAR       = "linear"
+	FORECAST_MODEL_HOLT_WINTERS = "holtwinters"
+
+	// z of the two sided 95% band
+	forecastZ          = 1.96
+	forecastConfidence = 0.95
+
+	// Holt-Winters uses a weekly season and fixed smoothing factors, so the same history always gives the same forecast
+	seasonLength = 7
+	hwAlpha      = 0.3
+	hwBeta       = 0.1
+	hwGamma      = 0.1
+)
+
+var errNoHistory = errors.New("No metering history")
+
+// linearForecast fits a least squares line to series and returns the next h values
+// with the standard error of prediction of each.
+func linearForecast(series []float64, h int) ([]float64, []float64) {
+	n := float64(len(series))
+	var sumX, sumY float64
+	for i, y := range series {
+		sumX += float64(i)
+		sumY += y
+	}
+	meanX, meanY := sumX/n, sumY/n
+
+	var sxx, sxy float64
+	for i, y := range series {
+		dx := float64(i) - meanX
+		sxx += dx * dx
+		sxy += dx * (y - meanY)
+	}
+	slope := 0.0
+	if sxx > 0 {
+		slope = sxy / sxx
+	}
+	intercept := meanY - slope*meanX
+
+	// residual standard error, zero while the line fits exactly
+	s := 0.0
+	if len(series) > 2 {
+		var sse float64
+		for i, y := range series {
+			r := y - (intercept + slope*float64(i))
+			sse += r * r
+		}
+		s = math.Sqrt(sse / (n - 2))
+	}
+
+	values := make([]float64, h)
+	errs := make([]float64, h)
+	for k := 1; k <= h; k++ {
+		x := n - 1 + float64(k)
+		values[k-1] = intercept + slope*x
+		se := s * math.Sqrt(1+1/n)
+		if sxx > 0 {
+			se = s * math.Sqrt(1+1/n+(x-meanX)*(x-meanX)/sxx)
+		}
+		errs[k-1] = se
+	}
+	return values, errs
+}
+
+// holtWintersForecast runs additive Holt-Winters with a weekly season over series, which needs two seasons.
+// The error of step k is approximated by the one step error growing with sqrt(k).
+func holtWintersForecast(series []float64, h int) ([]float64, []float64) {
+	m := seasonLength
+	var first, second float64
+	for i := 0; i < m; i++ {
+		first += series[i]
+		second += series[m+i]
+	}
+	level := first / float64(m)
+	trend := (second - first) / float64(m*m)
+	seasonal := make([]float64, m)
+	for i := 0; i < m; i++ {
+		seasonal[i] = series[i] - level
+	}
+
+	var sse float64
+	var count int
+	for t, y := range series {
+		s := seasonal[t%m]
+		if t >= m {
+			e := y - (level + trend + s)
+			sse += e * e
+			count++
+		}
+		newLevel := hwAlpha*(y-s) + (1-hwAlpha)*(level+trend)
+		trend = hwBeta*(newLevel-level) + (1-hwBeta)*trend
+		seasonal[t%m] = hwGamma*(y-newLevel) + (1-hwGamma)*s
+		level = newLevel
+	}
+	sigma := 0.0
+	if count > 0 {
+		sigma = math.Sqrt(sse / float64(count))
+	}
+
+	n := len(series)
+	values := make([]float64, h)
+	errs := make([]float64, h)
+	for k := 1; k <= h; k++ {
+		values[k-1] = level + float64(k)*trend + seasonal[(n+k-1)%m]
+		errs[k-1] = sigma * math.Sqrt(float64(k))
+	}
+	return values, errs
+}
+
+// dailySeries turns metering_day rows into one value per day from the first row to the day before until,
+// with days without a row as zero. The first day of the series is returned with it.
+func dailySeries(rows []meteringModel.Metering, metric string, until time.Time) ([]float64, time.Time) {
+	if len(rows) == 0 {
+		return nil, time.Time{}
+	}
+	price := meteringModel.Price{Resource: metric, Per: UNIT_DAY}
+	byDay := map[time.Time]float64{}
+	first := until
+	for _, row := range rows {
+		day := truncate(util.WallClock(row.MeteringTime), UNIT_DAY)
+		if !day.Before(until) {
+			continue
+		}
+		byDay[day] += usage(row, UNIT_DAY, price)
+		if day.Before(first) {
+			first = day
+		}
+	}
+
+	var series []float64
+	for day := first; day.Before(until); day = day.AddDate(0, 0, 1) {
+		series = append(series, byDay[day])
+	}
+	return series, first
+}
+
+// makeForecast forecasts every day from until to the end of the month horizon months after the month of until,
+// and sums the months. Lower bounds are clipped at zero since usage is never negative.
+func makeForecast(rows []meteringModel.Metering, metric string, model string, until time.Time, horizon int) (meteringModel.Forecast, error) {
+	forecast := meteringModel.Forecast{Metric: metric, Unit: priceUnits[metric], Model: model, Confidence: forecastConfidence}
+	if isTraffic(metric) {
+		forecast.Unit = "GiB/day"
+	}
+	series, first := dailySeries(rows, metric, until)
+	if len(series) == 0 {
+		return forecast, errNoHistory
+	}
+	forecast.History = len(series)
+
+	monthStart := truncate(until, UNIT_MONTH)
+	end := monthStart.AddDate(0, horizon+1, 0)
+	h := 0
+	for day := until; day.Before(end); day = day.AddDate(0, 0, 1) {
+		h++
+	}
+
+	var values, errs []float64
+	if model == FORECAST_MODEL_HOLT_WINTERS && len(series) >= 2*seasonLength {
+		values, errs = holtWintersForecast(series, h)
+	} else {
+		// too short for a season
+		forecast.Model = FORECAST_MODEL_LINEAR
+		values, errs = linearForecast(series, h)
+	}
+
+	forecast.Points = make([]meteringModel.ForecastPoint, h)
+	for k := 0; k < h; k++ {
+		value := math.Max(values[k], 0)
+		forecast.Points[k] = meteringModel.ForecastPoint{
+			Time:  until.AddDate(0, 0, k),
+			Value: round(value, 4),
+			Lower: round(math.Max(values[k]-forecastZ*errs[k], 0), 4),
+			Upper: round(math.Max(values[k]+forecastZ*errs[k], 0), 4),
+		}
+	}
+
+	for i := 0; i <= horizon; i++ {
+		period := meteringModel.ForecastPeriod{From: monthStart.AddDate(0, i, 0), To: monthStart.AddDate(0, i+1, 0)}
+		for d, value := range series {
+			day := first.AddDate(0, 0, d)
+			if !day.Before(period.From) && day.Before(period.To) {
+				period.Actual += value
+			}
+		}
+		period.Value, period.Lower, period.Upper = period.Actual, period.Actual, period.Actual
+		for _, point := range forecast.Points {
+			if !point.Time.Before(period.From) && point.Time.Before(period.To) {
+				period.Value += point.Value
+				period.Lower += point.Lower
+				period.Upper += point.Upper
+			}
+		}
+		period.Actual, period.Value = round(period.Actual, 4), round(period.Value, 4)
+		period.Lower, period.Upper = round(period.Lower, 4), round(period.Upper, 4)
+		forecast.Periods = append(forecast.Periods, period)
+	}
+	return forecast, nil
+}
@@ -0,0 +1,94 @@
+package metering
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/tmax-cloud/hypercloud-api-server/retention"
+	"github.com/tmax-cloud/hypercloud-api-server/util"
+	"k8s.io/klog"
+)
+
+const (
+	DEFAULT_FORECAST_HISTORY = 90
+	MAX_FORECAST_HISTORY     = 730
+	MAX_FORECAST_HORIZON     = 12
+)
+
+// GetForecast projects the daily usage of metric in namespace for the rest of the month and the next horizon months,
+// from the last history days of metering_day. model is linear (default) or holtwinters.
+// history is capped at the retention of metering_day, and the response reports the days actually fitted.
+func GetForecast(res http.ResponseWriter, req *http.Request) {
+	klog.Infoln("**** GET /metering/forecast")
+	queryParams := req.URL.Query()
+	metric := queryParams.Get("metric")
+	model := queryParams.Get("model")
+
+	if metric == "" {
+		metric = METRIC_CPU
+	}
+	if _, ok := priceUnits[metric]; !ok {
+		util.SetResponse(res, "Metric ["+metric+"] is not supported", nil, http.StatusBadRequest)
+		return
+	}
+	if model == "" {
+		model = FORECAST_MODEL_LINEAR
+	}
+	if model != FORECAST_MODEL_LINEAR && model != FORECAST_MODEL_HOLT_WINTERS {
+		util.SetResponse(res, "Model must be linear or holtwinters", nil, http.StatusBadRequest)
+		return
+	}
+	horizon, err := parseBoundedInt(queryParams.Get("horizon"), 1, 0, MAX_FORECAST_HORIZON)
+	if err != nil {
+		util.SetResponse(res, "Horizon must be a number between 0 and "+strconv.Itoa(MAX_FORECAST_HORIZON), nil, http.StatusBadRequest)
+		return
+	}
+	history, err := parseBoundedInt(queryParams.Get("history"), DEFAULT_FORECAST_HISTORY, 1, MAX_FORECAST_HISTORY)
+	if err != nil {
+		util.SetResponse(res, "History must be a number between 1 and "+strconv.Itoa(MAX_FORECAST_HISTORY), nil, http.StatusBadRequest)
+		return
+	}
+
+	namespaces, ok := authorizedNamespaces(res, req)
+	if !ok {
+		return
+	}
+	if len(namespaces) != 1 {
+		util.SetResponse(res, "Select one namespace", nil, http.StatusBadRequest)
+		return
+	}
+
+	// metering_day keeps days-1 complete days before today, older ones are purged by retention
+	if days := retention.Days("metering_day"); days > 1 && history > days-1 {
+		history = days - 1
+	}
+
+	// the forecast starts today, metering_day has complete days only
+	today := truncate(time.Now(), UNIT_DAY)
+	rows := getMeteringDataFromDB(false, "select "+meteringColumns+" from metering_day where namespace = $1 "+
+		"and metering_time >= $2 and metering_time < $3 order by metering_time", []interface{}{namespaces[0], today.AddDate(0, 0, -history), today})
+
+	forecast, err := makeForecast(rows, metric, model, today, horizon)
+	if err == errNoHistory {
+		util.SetResponse(res, err.Error(), nil, http.StatusNotFound)
+		return
+	} else if err != nil {
+		klog.Errorln(err)
+		util.SetResponse(res, err.Error(), nil, http.StatusInternalServerError)
+		return
+	}
+	forecast.Namespace = namespaces[0]
+	util.SetResponse(res, "", forecast, http.StatusOK)
+}
+
+func parseBoundedInt(value string, defaultValue int, min int, max int) (int, error) {
+	if value == "" {
+		return defaultValue, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < min || n > max {
+		return 0, strconv.ErrRange
+	}
+	return n, nil
+}
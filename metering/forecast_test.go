@@ -0,0 +1,134 @@
+package metering
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	meteringModel "github.com/tmax-cloud/hypercloud-api-server/metering/model"
+)
+
+func assertFloats(t *testing.T, name string, got []float64, want []float64) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("%s = %v, want %v", name, got, want)
+	}
+	for i := range want {
+		if math.Abs(got[i]-want[i]) > 1e-9 {
+			t.Errorf("%s = %v, want %v", name, got, want)
+			return
+		}
+	}
+}
+
+func TestForecastModels(t *testing.T) {
+	week := []float64{1, 2, 3, 4, 5, 6, 7}
+
+	tests := []struct {
+		name       string
+		forecast   func([]float64, int) ([]float64, []float64)
+		series     []float64
+		h          int
+		wantValues []float64
+		wantErrs   []float64
+	}{
+		{
+			name:       "linear fits a line exactly",
+			forecast:   linearForecast,
+			series:     []float64{1, 2, 3, 4, 5},
+			h:          2,
+			wantValues: []float64{6, 7},
+			wantErrs:   []float64{0, 0},
+		},
+		{
+			// slope 0.8, intercept 1.3, residual standard error sqrt(0.9)
+			name:       "linear error grows away from the mean",
+			forecast:   linearForecast,
+			series:     []float64{1, 3, 2, 4},
+			h:          2,
+			wantValues: []float64{4.5, 5.3},
+			wantErrs:   []float64{1.5, math.Sqrt(0.9 * (1 + 1.0/4 + 3.5*3.5/5))},
+		},
+		{
+			name:       "linear of one day is flat",
+			forecast:   linearForecast,
+			series:     []float64{3},
+			h:          2,
+			wantValues: []float64{3, 3},
+			wantErrs:   []float64{0, 0},
+		},
+		{
+			name:       "holt-winters repeats a weekly season",
+			forecast:   holtWintersForecast,
+			series:     append(append([]float64{}, week...), week...),
+			h:          9,
+			wantValues: []float64{1, 2, 3, 4, 5, 6, 7, 1, 2},
+			wantErrs:   []float64{0, 0, 0, 0, 0, 0, 0, 0, 0},
+		},
+		{
+			// starts at level 4 and trend 1/7 with the first week as season; the season still holds the trend,
+			// so the second week is fitted with a one step error of about 0.33
+			name:       "holt-winters adds the trend to the season",
+			forecast:   holtWintersForecast,
+			series:     []float64{1, 2, 3, 4, 5, 6, 7, 2, 3, 4, 5, 6, 7, 8},
+			h:          2,
+			wantValues: []float64{2.3395082605638478, 3.4136687312457665},
+			wantErrs:   []float64{0.3338989439638077, 0.3338989439638077 * math.Sqrt(2)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values, errs := tt.forecast(tt.series, tt.h)
+			assertFloats(t, "values", values, tt.wantValues)
+			assertFloats(t, "errs", errs, tt.wantErrs)
+		})
+	}
+}
+
+func TestMakeForecast(t *testing.T) {
+	until := time.Date(2022, 4, 15, 0, 0, 0, 0, time.Local)
+	// metering_time is read as UTC and holds the local wall clock
+	var rows []meteringModel.Metering
+	for i, cpu := range []float64{1, 3, 2, 4} {
+		rows = append(rows, meteringModel.Metering{Namespace: "default", Cpu: cpu, MeteringTime: time.Date(2022, 4, 11+i, 0, 0, 0, 0, time.UTC)})
+	}
+
+	forecast, err := makeForecast(rows, METRIC_CPU, FORECAST_MODEL_HOLT_WINTERS, until, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// four days are too short for a weekly season
+	if forecast.Model != FORECAST_MODEL_LINEAR || forecast.History != 4 {
+		t.Errorf("model %s of %d days, want linear of 4 days", forecast.Model, forecast.History)
+	}
+	// the rest of april and may
+	if len(forecast.Points) != 16+31 {
+		t.Fatalf("%d points, want %d", len(forecast.Points), 16+31)
+	}
+	first := forecast.Points[0]
+	want := meteringModel.ForecastPoint{Time: until, Value: 4.5, Lower: round(4.5-forecastZ*1.5, 4), Upper: round(4.5+forecastZ*1.5, 4)}
+	if first != want {
+		t.Errorf("first point = %+v, want %+v", first, want)
+	}
+	for _, point := range forecast.Points {
+		if point.Lower < 0 || point.Lower > point.Value || point.Upper < point.Value {
+			t.Errorf("point %+v is outside its band", point)
+		}
+	}
+
+	if len(forecast.Periods) != 2 {
+		t.Fatalf("%d periods, want 2", len(forecast.Periods))
+	}
+	april := forecast.Periods[0]
+	// 10 metered, then 1.3 + 0.8x for x from 4 to 19
+	if april.Actual != 10 || april.Value != 178 {
+		t.Errorf("april = %+v, want actual 10 and value 178", april)
+	}
+	if may := forecast.Periods[1]; may.Actual != 0 || may.Lower > may.Value || may.Upper < may.Value {
+		t.Errorf("may = %+v", may)
+	}
+
+	if _, err := makeForecast(nil, METRIC_CPU, FORECAST_MODEL_LINEAR, until, 0); err != errNoHistory {
+		t.Errorf("makeForecast() without rows error = %v, want %v", err, errNoHistory)
+	}
+}
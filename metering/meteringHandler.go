@@ -2,13 +2,17 @@ package metering
 
 import (
 	"context"
+	"errors"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	meteringModel "github.com/tmax-cloud/hypercloud-api-server/metering/model"
 	"github.com/tmax-cloud/hypercloud-api-server/util"
+	"github.com/tmax-cloud/hypercloud-api-server/util/caller"
 	db "github.com/tmax-cloud/hypercloud-api-server/util/dataFactory"
+	"github.com/tmax-cloud/hypercloud-api-server/util/dataFactory/query"
 
 	"k8s.io/klog"
 )
@@ -18,58 +22,148 @@ func Get(res http.ResponseWriter, req *http.Request) {
 	queryParams := req.URL.Query()
 	offset := queryParams.Get(util.QUERY_PARAMETER_OFFSET)
 	limit := queryParams.Get(util.QUERY_PARAMETER_LIMIT)
-	namespace := queryParams.Get(util.QUERY_PARAMETER_NAMESPACE)
 	timeUnit := queryParams.Get(util.QUERY_PARAMETER_TIMEUNIT)
 	startTime := queryParams.Get(util.QUERY_PARAMETER_STARTTIME)
 	endTime := queryParams.Get(util.QUERY_PARAMETER_ENDTIME)
 	sorts := queryParams[util.QUERY_PARAMETER_SORT]
+	// breakdown=true returns rows by namespace and the configured dimension, dimension=<value> selects one of them
+	dimensionValues, filterDimension := queryParams["dimension"]
+	breakdown := queryParams.Get("breakdown") == "true" || filterDimension
+	if breakdown && dimension == nil {
+		util.SetResponse(res, "Metering dimension is not configured", nil, http.StatusBadRequest)
+		return
+	}
+
+	// total=true appends a row summing the visible namespaces for every metering time in the page
+	total := queryParams.Get("total") == "true"
 
 	if timeUnit == "" || !(timeUnit == "hour" || timeUnit == "day" || timeUnit == "month" || timeUnit == "year") {
 		timeUnit = "day" // default time unit
 	}
-	var query string
-	query = makeTimeRange(timeUnit, startTime, endTime, query)
+	namespaces, ok := authorizedNamespaces(res, req)
+	if !ok {
+		return
+	}
+	qb, err := makeTimeRange(timeUnit, startTime, endTime, breakdown)
+	if err != nil {
+		util.SetResponse(res, err.Error(), nil, http.StatusBadRequest)
+		return
+	}
 
-	if namespace != "" {
-		query += " and namespace='" + namespace + "'"
+	if namespaces != nil {
+		qb.In("namespace", namespaces)
+	}
+	if filterDimension {
+		qb.In("dimension", dimensionValues)
 	}
 
-	if len(sorts) > 0 {
-		query += " order by "
-		for _, sort := range sorts {
-			order := " asc, "
-			if sort[0] == '-' {
-				order = " desc, "
-				sort = sort[1:]
-			}
-			query += sort
-			query += order
+	sortColumns := meteringSortColumns
+	if breakdown {
+		sortColumns = append(append([]string{}, meteringSortColumns...), "dimension")
+	}
+	orders, err := query.ParseSort(sorts, sortColumns)
+	if err != nil {
+		util.SetResponse(res, err.Error(), nil, http.StatusBadRequest)
+		return
+	}
+	limitNum, offsetNum, err := query.ParsePage(limit, offset)
+	if err != nil {
+		util.SetResponse(res, err.Error(), nil, http.StatusBadRequest)
+		return
+	}
+	qb.OrderBy(orders, query.Order{Column: "metering_time", Desc: true}).Page(limitNum, offsetNum)
+
+	q, args := qb.Build()
+	meteringDataList := getMeteringDataFromDB(breakdown, q, args)
+	if total && len(meteringDataList) > 0 {
+		meteringDataList = append(meteringDataList, getMeteringTotal(timeUnit, namespaces, meteringDataList)...)
+	}
+	util.SetResponse(res, "", meteringDataList, http.StatusOK)
+}
+
+// getMeteringTotal sums the namespace rows of timeUnit at each metering time of rows.
+// Breakdown rows are not used, so totals never count a namespace twice.
+func getMeteringTotal(timeUnit string, namespaces []string, rows []meteringModel.Metering) []meteringModel.Metering {
+	times := []time.Time{}
+	seen := map[time.Time]bool{}
+	for _, row := range rows {
+		if !seen[row.MeteringTime] {
+			seen[row.MeteringTime] = true
+			times = append(times, row.MeteringTime)
 		}
-		query += "metering_time desc"
-	} else {
-		query += " order by metering_time desc"
 	}
 
-	if limit != "" {
-		query += " limit " + limit
-	} else {
-		query += " limit 100"
+	qb := query.New("select '' as id, '' as namespace, sum(cpu)::float8, sum(memory)::bigint, sum(storage)::bigint, sum(gpu)::float8, " +
+		"sum(public_ip)::bigint, sum(private_ip)::bigint, sum(traffic_in)::bigint, sum(traffic_out)::bigint, metering_time, 'Success' " +
+		"from metering_" + timeUnit)
+	qb.Where("metering_time = any(?)", times)
+	if namespaces != nil {
+		qb.In("namespace", namespaces)
 	}
+	qb.GroupBy("metering_time").OrderBy(nil, query.Order{Column: "metering_time", Desc: true})
 
-	if offset != "" {
-		query += " offset " + offset
-	} else {
-		query += " offset 0"
+	q, args := qb.Build()
+	totals := getMeteringDataFromDB(false, q, args)
+	for i := range totals {
+		totals[i].Total = true
 	}
+	return totals
+}
 
-	meteringDataList := getMeteringDataFromDB(query)
-	util.SetResponse(res, "", meteringDataList, http.StatusOK)
+// authorizedNamespaces returns the namespaces a request may read, from the namespace parameter (repeated or
+// comma separated). Users who can list namespaces read any namespace, and every namespace when none is given (nil).
+// Other users read only namespaces from GetAccessibleNS. If it returns false, the response has already been written.
+func authorizedNamespaces(res http.ResponseWriter, req *http.Request) ([]string, bool) {
+	queryParams := req.URL.Query()
+	userId := queryParams.Get(util.QUERY_PARAMETER_USER_ID)
+	userGroups := queryParams[util.QUERY_PARAMETER_USER_GROUP]
+
+	if userId == "" {
+		msg := "UserId is empty."
+		klog.Infoln(msg)
+		util.SetResponse(res, msg, nil, http.StatusBadRequest)
+		return nil, false
+	}
+
+	var requested []string
+	for _, value := range queryParams[util.QUERY_PARAMETER_NAMESPACE] {
+		for _, ns := range strings.Split(value, ",") {
+			if ns = strings.TrimSpace(ns); ns != "" && !util.Contains(requested, ns) {
+				requested = append(requested, ns)
+			}
+		}
+	}
+
+	nsListSAR, err := caller.CreateSubjectAccessReview(userId, userGroups, "", "namespaces", "", "", "list")
+	if err != nil {
+		klog.Errorln(err)
+		util.SetResponse(res, "", nil, http.StatusInternalServerError)
+		return nil, false
+	}
+	if nsListSAR.Status.Allowed {
+		return requested, true
+	}
+
+	accessible := []string{}
+	for _, item := range caller.GetAccessibleNS(userId, "", userGroups).Items {
+		accessible = append(accessible, item.Name)
+	}
+	if len(requested) == 0 {
+		return accessible, true
+	}
+	for _, ns := range requested {
+		if !util.Contains(accessible, ns) {
+			util.SetResponse(res, "Not authorized to read metering of namespace ["+ns+"]", nil, http.StatusForbidden)
+			return nil, false
+		}
+	}
+	return requested, true
 }
 
-func getMeteringDataFromDB(query string) []meteringModel.Metering {
+func getMeteringDataFromDB(breakdown bool, query string, args []interface{}) []meteringModel.Metering {
 	klog.Infoln("=== query ===")
 	klog.Infoln(query)
-	rows, err := db.Dbpool.Query(context.TODO(), query)
+	rows, err := db.Dbpool.Query(context.TODO(), query, args...)
 	if err != nil {
 		klog.Error(err)
 		return nil
@@ -81,7 +175,7 @@ func getMeteringDataFromDB(query string) []meteringModel.Metering {
 	var status string
 	for rows.Next() {
 		var meteringData meteringModel.Metering
-		err := rows.Scan(
+		dest := []interface{}{
 			&meteringData.Id,
 			&meteringData.Namespace,
 			&meteringData.Cpu,
@@ -93,7 +187,11 @@ func getMeteringDataFromDB(query string) []meteringModel.Metering {
 			&meteringData.TrafficIn,
 			&meteringData.TrafficOut,
 			&meteringData.MeteringTime,
-			&status)
+			&status}
+		if breakdown {
+			dest = append(dest, &meteringData.Dimension)
+		}
+		err := rows.Scan(dest...)
 		if err != nil {
 			klog.Error(err)
 			return nil
@@ -103,29 +201,36 @@ func getMeteringDataFromDB(query string) []meteringModel.Metering {
 	return meteringList
 }
 
-func makeTimeRange(timeUnit string, startTime string, endTime string, query string) string {
+var meteringSortColumns = []string{"id", "namespace", "cpu", "memory", "storage", "gpu", "public_ip", "private_ip",
+	"traffic_in", "traffic_out", "metering_time"}
+
+const meteringColumns = "id, namespace, cpu, memory, storage, gpu, public_ip, private_ip, traffic_in, traffic_out, metering_time, status"
+
+func makeTimeRange(timeUnit string, startTime string, endTime string, breakdown bool) (*query.Builder, error) {
 	var start int64
+	var err error
 	end := time.Now().Unix()
 
 	if startTime != "" {
-		start, _ = strconv.ParseInt(startTime, 10, 64)
+		if start, err = strconv.ParseInt(startTime, 10, 64); err != nil {
+			return nil, errors.New("StartTime must be a unix timestamp")
+		}
 	}
 	if endTime != "" {
-		end, _ = strconv.ParseInt(endTime, 10, 64)
+		if end, err = strconv.ParseInt(endTime, 10, 64); err != nil {
+			return nil, errors.New("EndTime must be a unix timestamp")
+		}
 	}
 
-	switch timeUnit {
-	case "hour":
-		query += "select * from metering_hour"
-	case "day":
-		query += "select * from metering_day"
-	case "month":
-		query += "select * from metering_month"
-	case "year":
-		query += "select * from metering_year"
+	if !isSupportedUnit(timeUnit) {
+		return nil, errors.New("TimeUnit [" + timeUnit + "] is not supported")
+	}
+	qb := query.New("select " + meteringColumns + " from metering_" + timeUnit)
+	if breakdown {
+		qb = query.New("select " + meteringColumns + ", dimension from metering_dimension_" + timeUnit)
 	}
-	query += " where metering_time between '" + time.Unix(start, 0).Format("2006-01-02 15:04:05") + "' and '" + time.Unix(end, 0).Format("2006-01-02 15:04:05") + "'"
-	return query
+	qb.Between("metering_time", time.Unix(start, 0), time.Unix(end, 0))
+	return qb, nil
 }
 
 func Options(res http.ResponseWriter, req *http.Request) {
@@ -133,3 +238,75 @@ func Options(res http.ResponseWriter, req *http.Request) {
 	out := "**** OPTIONS/metering"
 	util.SetResponse(res, out, nil, http.StatusOK)
 }
+
+// GetRollup shows the watermark of every rollup unit.
+func GetRollup(res http.ResponseWriter, req *http.Request) {
+	if !caller.IsAdmin(res, req) {
+		return
+	}
+	watermarks, err := getWatermarks()
+	if err != nil {
+		klog.Errorln(err)
+		util.SetResponse(res, err.Error(), nil, http.StatusInternalServerError)
+		return
+	}
+	util.SetResponse(res, "", watermarks, http.StatusOK)
+}
+
+// PostRollup recomputes the buckets of unit between from and to (unix timestamps).
+// Without unit, every unit from hour upward is recomputed. Without from and to, missing buckets are caught up.
+func PostRollup(res http.ResponseWriter, req *http.Request) {
+	klog.Infoln("**** POST /metering/rollup")
+	if !caller.IsAdmin(res, req) {
+		return
+	}
+	queryParams := req.URL.Query()
+	unit := queryParams.Get("unit")
+	from := queryParams.Get("from")
+	to := queryParams.Get("to")
+
+	if from == "" && to == "" {
+		if unit != "" {
+			util.SetResponse(res, "Unit needs from and to", nil, http.StatusBadRequest)
+			return
+		}
+		util.SetResponse(res, "", RollupJob(), http.StatusOK)
+		return
+	}
+
+	fromTime, err := parseUnixTime(from, "From")
+	if err != nil {
+		util.SetResponse(res, err.Error(), nil, http.StatusBadRequest)
+		return
+	}
+	toTime := time.Now()
+	if to != "" {
+		if toTime, err = parseUnixTime(to, "To"); err != nil {
+			util.SetResponse(res, err.Error(), nil, http.StatusBadRequest)
+			return
+		}
+	}
+	if unit != "" && !isSupportedUnit(unit) {
+		util.SetResponse(res, "Unit ["+unit+"] is not supported", nil, http.StatusBadRequest)
+		return
+	}
+	if !fromTime.Before(toTime) {
+		util.SetResponse(res, "From must be before to", nil, http.StatusBadRequest)
+		return
+	}
+
+	results, err := Backfill(unit, fromTime, toTime)
+	if err != nil {
+		util.SetResponse(res, err.Error(), results, http.StatusInternalServerError)
+		return
+	}
+	util.SetResponse(res, "", results, http.StatusOK)
+}
+
+func parseUnixTime(value string, name string) (time.Time, error) {
+	sec, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, errors.New(name + " must be a unix timestamp")
+	}
+	return time.Unix(sec, 0), nil
+}
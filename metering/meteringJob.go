@@ -2,18 +2,15 @@ package metering
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"net/http"
 	"os"
 	"strconv"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
 	meteringModel "github.com/tmax-cloud/hypercloud-api-server/metering/model"
-	"github.com/tmax-cloud/hypercloud-api-server/util"
 	db "github.com/tmax-cloud/hypercloud-api-server/util/dataFactory"
 	"k8s.io/klog"
 )
@@ -23,54 +20,8 @@ const (
 
 	METERING_INSERT_QUERY = "insert into metering (id,namespace,cpu,memory,storage,gpu,public_ip,private_ip, traffic_in, traffic_out, metering_time, status) " +
 		"values ($1,$2,trunc($3,2),$4, $5,trunc($6,2),$7,$8,$9,$10,$11,$12)"
-	METERING_DELETE_QUERY = "truncate metering"
-
-	METERING_HOUR_INSERT_QUERY = "insert into metering_hour values ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12)"
-	METERING_HOUR_SELECT_QUERY = "SELECT namespace, TRUNC(CAST(SUM(cpu)/COUNT(*) as numeric) ,2) as cpu, " +
-		"TRUNC(CAST(SUM(memory)/COUNT(*) as numeric) ,0) as memory, TRUNC(CAST(SUM(storage)/COUNT(*) as numeric) ,0) as storage, " +
-		"TRUNC(CAST(SUM(gpu)/COUNT(*) as numeric) ,2) as gpu, SUM(public_ip)/COUNT(*) as public_ip, SUM(private_ip)/COUNT(*) as private_ip, " +
-		"TRUNC(CAST(SUM(traffic_in)/COUNT(*) as numeric) ,0) as traffic_in, TRUNC(CAST(SUM(traffic_out)/COUNT(*) as numeric) ,0) as traffic_out, " +
-		"DATE_TRUNC('hour', metering_time) as metering_time, status FROM metering GROUP BY DATE_TRUNC('hour', metering_time), namespace, status"
-	METERING_HOUR_UPDATE_QUERY = "update metering_hour set status = 'Merged' where status = 'Success'"
-	METERING_HOUR_DELETE_QUERY = "delete from metering_hour where status = 'Merged'"
-
-	METERING_DAY_INSERT_QUERY = "insert into metering_day values ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12)"
-	METERING_DAY_SELECT_QUERY = "SELECT namespace, TRUNC(CAST(SUM(cpu)/COUNT(*) as numeric) ,2) as cpu, " +
-		"TRUNC(CAST(SUM(memory)/COUNT(*) as numeric) ,0) as memory, TRUNC(CAST(SUM(storage)/COUNT(*) as numeric) ,0) as storage, " +
-		"TRUNC(CAST(SUM(gpu)/COUNT(*) as numeric) ,2) as gpu, SUM(public_ip)/COUNT(*) as public_ip, SUM(private_ip)/COUNT(*) as private_ip, " +
-		"TRUNC(CAST(SUM(traffic_in)/COUNT(*) as numeric) ,0) as traffic_in, TRUNC(CAST(SUM(traffic_out)/COUNT(*) as numeric) ,0) as traffic_out, " +
-		"DATE_TRUNC('day', metering_time) as metering_time, status FROM metering_hour WHERE status='Success' GROUP BY DATE_TRUNC('day', metering_time), namespace, status"
-	METERING_DAY_UPDATE_QUERY = "update metering_day set status = 'Merged' where status = 'Success'"
-	METERING_DAY_DELETE_QUERY = "delete from metering_day where status = 'Merged'"
-
-	METERING_MONTH_INSERT_QUERY = "insert into metering_month values ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12)"
-	METERING_MONTH_SELECT_QUERY = "SELECT namespace, TRUNC(CAST(SUM(cpu)/COUNT(*) as numeric) ,2) as cpu, " +
-		"TRUNC(CAST(SUM(memory)/COUNT(*) as numeric) ,0) as memory, TRUNC(CAST(SUM(storage)/COUNT(*) as numeric) ,0) as storage, " +
-		"TRUNC(CAST(SUM(gpu)/COUNT(*) as numeric) ,2) as gpu, SUM(public_ip)/COUNT(*) as public_ip, SUM(private_ip)/COUNT(*) as private_ip, " +
-		"TRUNC(CAST(SUM(traffic_in)/COUNT(*) as numeric) ,0) as traffic_in, TRUNC(CAST(SUM(traffic_out)/COUNT(*) as numeric) ,0) as traffic_out, " +
-		"DATE_TRUNC('month', metering_time) as metering_time, status FROM metering_day WHERE status='Success' GROUP BY DATE_TRUNC('month', metering_time), namespace, status"
-	METERING_MONTH_UPDATE_QUERY = "update metering_month set status = 'Merged' where status = 'Success'"
-	METERING_MONTH_DELETE_QUERY = "delete from metering_month where status = 'Merged'"
-
-	METERING_YEAR_INSERT_QUERY = "insert into metering_year values ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12)"
-	METERING_YEAR_SELECT_QUERY = "SELECT namespace, TRUNC(CAST(SUM(cpu)/COUNT(*) as numeric) ,2) as cpu, " +
-		"TRUNC(CAST(SUM(memory)/COUNT(*) as numeric) ,0) as memory, TRUNC(CAST(SUM(storage)/COUNT(*) as numeric) ,0) as storage, " +
-		"TRUNC(CAST(SUM(gpu)/COUNT(*) as numeric) ,2) as gpu, SUM(public_ip)/COUNT(*) as public_ip, SUM(private_ip)/COUNT(*) as private_ip, " +
-		"TRUNC(CAST(SUM(traffic_in)/COUNT(*) as numeric) ,0) as traffic_in, TRUNC(CAST(SUM(traffic_out)/COUNT(*) as numeric) ,0) as traffic_out, " +
-		"DATE_TRUNC('year', metering_time) as metering_time, status FROM metering_month WHERE status='Success' GROUP BY DATE_TRUNC('year', metering_time), namespace, status"
-
-	PROMETHEUS_URI = "http://prometheus-k8s.monitoring:9090/api/v1/query"
-	//PROMETHEUS_GET_CPU_QUERY         = "namespace:container_cpu_usage_seconds_total:sum_rate"
-	//PROMETHEUS_GET_MEMORY_QUERY      = "namespace:container_memory_usage_bytes:sum"
-	PROMETHEUS_GET_CPU_QUERY         = "sum(kube_pod_container_resource_requests{resource=\"cpu\"})by(namespace)"
-	PROMETHEUS_GET_MEMORY_QUERY      = "sum(kube_pod_container_resource_requests{resource=\"memory\"})by(namespace)"
-	PROMETHEUS_GET_STORAGE_QUERY     = "sum(kube_persistentvolumeclaim_resource_requests_storage_bytes)by(namespace)"
-	PROMETHEUS_GET_PUBLIC_IP_QUERY   = "count(kube_service_spec_type{type=\"LoadBalancer\"})by(namespace)"
-	PROMETHEUS_GET_TRAFFIC_IN_QUERY  = "sum(rate(container_network_receive_bytes_total[1m]))by(namespace)"
-	PROMETHEUS_GET_TRAFFIC_OUT_QUERY = "sum(rate(container_network_transmit_bytes_total[1m]))by(namespace)"
-	//PROMETHEUS_GET_TRAFFIC_IN_QUERY  = "sum(istio_request_bytes_sum)by(destination_service, namespace)"
-	//PROMETHEUS_GET_TRAFFIC_OUT_QUERY = "sum(istio_response_bytes_sum)by(destination_service, namespace)"
-	//PROMETHEUS_GET_GPU_QUERY = "sum(nvidia_gpu_memory_used_bytes)by(namespace)"
+	METERING_DIMENSION_INSERT_QUERY = "insert into metering_dimension (id,namespace,cpu,memory,storage,gpu,public_ip,private_ip, traffic_in, traffic_out, metering_time, status, dimension) " +
+		"values ($1,$2,trunc($3,2),$4, $5,trunc($6,2),$7,$8,$9,$10,$11,$12,$13)"
 )
 
 var t time.Time
@@ -101,35 +52,50 @@ func MeteringJob() {
 			"day of year 	: %d\n",
 		t.Minute(), t.Hour(), t.Day(), t.YearDay())
 
-	// Merge into upper table every fixed time
-	if t.Minute() == 0 {
-		insertMeteringHour()
-	}
-	if t.Hour() == 0 && t.Minute() == 0 {
-		insertMeteringDay()
-	}
-	if t.Day() == 1 && t.Hour() == 0 && t.Minute() == 0 {
-		insertMeteringMonth()
-	}
-	if t.YearDay() == 1 && t.Day() == 1 && t.Hour() == 0 && t.Minute() == 0 {
-		insertMeteringYear()
+	// Merge every bucket completed since the last rollup into upper tables
+	for _, result := range RollupJob() {
+		if result.Error != "" {
+			fmt.Fprintf(file, "Rollup into %s failed : %s\n", result.Unit, result.Error)
+			continue
+		}
+		fmt.Fprintf(file, "Rollup into %s [%s, %s) : %d rows\n", result.Unit,
+			result.From.Format("2006-01-02 15:04:05"), result.To.Format("2006-01-02 15:04:05"), result.Rows)
 	}
+	// Push completed hourly rollups to the remote write receiver, if any
+	RemoteWriteJob()
 
-	// Get data from Prometheus
-	meteringData := makeMeteringMap()
+	// Get data from the metric source
+	meteringData, err := makeMeteringMap(queries, "", "")
+	if err != nil {
+		klog.Errorln("Metering data is not collected: ", err)
+		fmt.Fprintf(file, "%v\n", err)
+		return
+	}
 
 	fmt.Fprintf(file, "============= Metering Data =============\n")
 	for key, value := range meteringData {
 		fmt.Fprintf(file, "%-35s : %f\n", key+"/cpu", value.Cpu)
 		fmt.Fprintf(file, "%-35s : %d\n", key+"/memory", value.Memory)
 		fmt.Fprintf(file, "%-35s : %d\n", key+"/storage", value.Storage)
+		fmt.Fprintf(file, "%-35s : %f\n", key+"/gpu", value.Gpu)
 		fmt.Fprintf(file, "%-35s : %d\n", key+"/publicIp", value.PublicIp)
+		fmt.Fprintf(file, "%-35s : %d\n", key+"/privateIp", value.PrivateIp)
 		fmt.Fprintf(file, "%-35s : %d\n", key+"/trafficIn", value.TrafficIn)
 		fmt.Fprintf(file, "%-35s : %d\n", key+"/trafficOut", value.TrafficOut)
 		fmt.Fprintf(file, "-----------------------------------------\n")
 	}
 	//Insert into metering (new data)
 	insertMeteringData(meteringData)
+
+	if dimension != nil {
+		dimensionData, err := makeMeteringMap(dimension.Queries, dimension.Label, "dimension_")
+		if err != nil {
+			klog.Errorln("Metering dimension data is not collected: ", err)
+			fmt.Fprintf(file, "%v\n", err)
+			return
+		}
+		insertMeteringDimensionData(dimensionData)
+	}
 }
 
 func insertMeteringData(meteringData map[string]*meteringModel.Metering) {
@@ -137,10 +103,10 @@ func insertMeteringData(meteringData map[string]*meteringModel.Metering) {
 		"Insert into METERING Start!!\n"+
 			"Current Time	: "+t.Format("2006-01-02 15:04:00")+"\n")
 
-	for key, data := range meteringData {
+	for _, data := range meteringData {
 		_, err = db.Dbpool.Exec(context.TODO(), METERING_INSERT_QUERY,
 			uuid.New(),
-			key,
+			data.Namespace,
 			data.Cpu,
 			data.Memory,
 			data.Storage,
@@ -164,436 +130,106 @@ func insertMeteringData(meteringData map[string]*meteringModel.Metering) {
 	}
 }
 
-func makeMeteringMap() map[string]*meteringModel.Metering {
-	var meteringData = make(map[string]*meteringModel.Metering)
-	cpu := getMeteringData(PROMETHEUS_GET_CPU_QUERY)
-	for _, metric := range cpu.Result {
-		var keys []string
-		for k := range meteringData {
-			keys = append(keys, k)
-		}
-		if util.Contains(keys, metric.Metric["namespace"]) {
-			meteringData[metric.Metric["namespace"]].Cpu, _ = strconv.ParseFloat(metric.Value[1].(string), 64)
-		} else {
-			metering := new(meteringModel.Metering)
-			metering.Namespace = metric.Metric["namespace"]
-			metering.Cpu, _ = strconv.ParseFloat(metric.Value[1].(string), 64)
-			meteringData[metric.Metric["namespace"]] = metering
-		}
-	}
-
-	memory := getMeteringData(PROMETHEUS_GET_MEMORY_QUERY)
-	for _, metric := range memory.Result {
-		var keys []string
-		for k := range meteringData {
-			keys = append(keys, k)
-		}
-		if util.Contains(keys, metric.Metric["namespace"]) {
-			meteringData[metric.Metric["namespace"]].Memory, _ = strconv.ParseUint(metric.Value[1].(string), 10, 64)
-		} else {
-			metering := new(meteringModel.Metering)
-			metering.Namespace = metric.Metric["namespace"]
-			metering.Memory, _ = strconv.ParseUint(metric.Value[1].(string), 10, 64)
-			meteringData[metric.Metric["namespace"]] = metering
-		}
-	}
-
-	storage := getMeteringData(PROMETHEUS_GET_STORAGE_QUERY)
-	for _, metric := range storage.Result {
-		var keys []string
-		for k := range meteringData {
-			keys = append(keys, k)
-		}
-		if util.Contains(keys, metric.Metric["namespace"]) {
-			meteringData[metric.Metric["namespace"]].Storage, _ = strconv.ParseUint(metric.Value[1].(string), 10, 64)
-		} else {
-			metering := new(meteringModel.Metering)
-			metering.Namespace = metric.Metric["namespace"]
-			metering.Storage, _ = strconv.ParseUint(metric.Value[1].(string), 10, 64)
-			meteringData[metric.Metric["namespace"]] = metering
-		}
-	}
-
-	publicIp := getMeteringData(PROMETHEUS_GET_PUBLIC_IP_QUERY)
-	for _, metric := range publicIp.Result {
-		var keys []string
-		for k := range meteringData {
-			keys = append(keys, k)
-		}
-		if util.Contains(keys, metric.Metric["namespace"]) {
-			meteringData[metric.Metric["namespace"]].PublicIp, _ = strconv.ParseUint(metric.Value[1].(string), 10, 64)
-		} else {
-			metering := new(meteringModel.Metering)
-			metering.Namespace = metric.Metric["namespace"]
-			metering.PublicIp, _ = strconv.ParseUint(metric.Value[1].(string), 10, 64)
-			meteringData[metric.Metric["namespace"]] = metering
-		}
-	}
-
-	trafficIn := getMeteringData(PROMETHEUS_GET_TRAFFIC_IN_QUERY)
-	for _, metric := range trafficIn.Result {
-		var keys []string
-		for k := range meteringData {
-			keys = append(keys, k)
-		}
-		//if strings.Contains(metric.Metric["destination_service"], "."+metric.Metric["namespace"]+".") {
-		if util.Contains(keys, metric.Metric["namespace"]) {
-			meteringData[metric.Metric["namespace"]].TrafficIn, _ = strconv.ParseUint(metric.Value[1].(string), 10, 64)
-		} else {
-			metering := new(meteringModel.Metering)
-			metering.Namespace = metric.Metric["namespace"]
-			metering.TrafficIn, _ = strconv.ParseUint(metric.Value[1].(string), 10, 64)
-			meteringData[metric.Metric["namespace"]] = metering
-		}
-	}
+func insertMeteringDimensionData(meteringData map[string]*meteringModel.Metering) {
+	fmt.Fprintf(file, "Insert into METERING_DIMENSION Start!!\n")
 
-	trafficOut := getMeteringData(PROMETHEUS_GET_TRAFFIC_OUT_QUERY)
-	for _, metric := range trafficOut.Result {
-		var keys []string
-		for k := range meteringData {
-			keys = append(keys, k)
-		}
-		//if strings.Contains(metric.Metric["destination_service"], "."+metric.Metric["namespace"]+".") {
-		if util.Contains(keys, metric.Metric["namespace"]) {
-			meteringData[metric.Metric["namespace"]].TrafficOut, _ = strconv.ParseUint(metric.Value[1].(string), 10, 64)
-		} else {
-			metering := new(meteringModel.Metering)
-			metering.Namespace = metric.Metric["namespace"]
-			metering.TrafficOut, _ = strconv.ParseUint(metric.Value[1].(string), 10, 64)
-			meteringData[metric.Metric["namespace"]] = metering
-		}
-	}
-
-	return meteringData
-}
-
-func getMeteringData(query string) meteringModel.MetricDataList {
-	var metricResponse meteringModel.MetricResponse
-	// Make Request Object
-	req, err := http.NewRequest("GET", PROMETHEUS_URI, nil)
-	if err != nil {
-		fmt.Fprintf(file, "%v\n", err)
-		panic(err)
-	}
-
-	// Add QueryParameter
-	q := req.URL.Query()
-	q.Add("query", query)
-	req.URL.RawQuery = q.Encode()
-
-	// Request with Client Object
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		fmt.Fprintf(file, "Prometheus Connection Failed.\n")
-		for i := 0; i < 10; i++ {
-			time.Sleep(time.Second * 5)
-			resp, err = client.Do(req)
-			if err == nil {
-				break
-			}
-		}
-		if err != nil {
-			fmt.Fprintf(file, "%v\n", err)
-			panic(err)
-		}
-	}
-	defer resp.Body.Close()
-
-	// Result
-	bytes, _ := ioutil.ReadAll(resp.Body)
-
-	if err := json.Unmarshal(bytes, &metricResponse); err != nil {
-		klog.Error(err)
-	}
-	return metricResponse.Data
-}
-
-func insertMeteringYear() {
-	fmt.Fprintf(file,
-		"Insert into METERING_YEAR Start!!\n"+
-			"Current Time	: "+t.Format("2006-01-02 15:04:00")+"\n")
-
-	rows, err := db.Dbpool.Query(context.TODO(), METERING_YEAR_SELECT_QUERY)
-	defer rows.Close()
-	if err != nil {
-		fmt.Fprintf(file, "%v\n", err)
-		return
-	}
-
-	var meteringData meteringModel.Metering
-	var status string
-	for rows.Next() {
-		err := rows.Scan(
-			//&meteringData.Id,
-			&meteringData.Namespace,
-			&meteringData.Cpu,
-			&meteringData.Memory,
-			&meteringData.Storage,
-			&meteringData.Gpu,
-			&meteringData.PublicIp,
-			&meteringData.PrivateIp,
-			&meteringData.TrafficIn,
-			&meteringData.TrafficOut,
-			&meteringData.MeteringTime,
-			&status)
-		if err != nil {
-			fmt.Fprintf(file, "%v\n", err)
-			return
-		}
-
-		_, err = db.Dbpool.Exec(context.TODO(), METERING_YEAR_INSERT_QUERY,
+	batch := &pgx.Batch{}
+	for _, data := range meteringData {
+		batch.Queue(METERING_DIMENSION_INSERT_QUERY,
 			uuid.New(),
-			meteringData.Namespace,
-			meteringData.Cpu,
-			meteringData.Memory,
-			meteringData.Storage,
-			meteringData.Gpu,
-			meteringData.PublicIp,
-			meteringData.PrivateIp,
-			meteringData.TrafficIn,
-			meteringData.TrafficOut,
-			meteringData.MeteringTime.AddDate(0, -(util.MonthToInt(meteringData.MeteringTime.Month())-1),
-				-(meteringData.MeteringTime.Day()-1)).Format("2006-01-02 00:00:00"),
-			//date_format(metering_time,'%Y-01-01 00:00:00'),
-			status)
-		if err != nil {
-			fmt.Fprintf(file, "%v\n", err)
-			return
-		}
-	}
-	fmt.Fprintf(file,
-		"Insert into METERING_YEAR Success!!\n"+
-			"--------------------------------------\n"+
-			"Update METERING_MONTH Past data to 'Merged' Start!!\n")
-	_, err = db.Dbpool.Exec(context.TODO(), METERING_MONTH_UPDATE_QUERY)
-	if err != nil {
-		fmt.Fprintf(file, "%v\n", err)
-		return
-	}
-	fmt.Fprintf(file, "Update METERING_MONTH Past data to 'Merged' Success!!\n")
-	/*
-		klog.Infoln("--------------------------------------")
-		klog.Infoln("Delete METERING for past 1 year Start!!")
-		_, err = db.Exec(METERING_MONTH_DELETE_QUERY)
-		if err != nil {
-			fmt.Fprintf(file, "%v\n", err)
-			return
-		}
-		klog.Infoln("Delete METERING for past 1 year Success!!")
-	*/
-}
-
-func insertMeteringMonth() {
-	fmt.Fprintf(file,
-		"Insert into METERING_MONTH Start!!\n"+
-			"Current Time	: "+t.Format("2006-01-02 15:04:00")+"\n")
-
-	rows, err := db.Dbpool.Query(context.TODO(), METERING_MONTH_SELECT_QUERY)
-	defer rows.Close()
-
-	if err != nil {
-		fmt.Fprintf(file, "%v\n", err)
-		return
+			data.Namespace,
+			data.Cpu,
+			data.Memory,
+			data.Storage,
+			data.Gpu,
+			data.PublicIp,
+			data.PrivateIp,
+			data.TrafficIn,
+			data.TrafficOut,
+			t.Format("2006-01-02 15:04:00"), "Success",
+			data.Dimension)
 	}
-
-	var meteringData meteringModel.Metering
-	var status string
-	for rows.Next() {
-		err := rows.Scan(
-			//&meteringData.Id,
-			&meteringData.Namespace,
-			&meteringData.Cpu,
-			&meteringData.Memory,
-			&meteringData.Storage,
-			&meteringData.Gpu,
-			&meteringData.PublicIp,
-			&meteringData.PrivateIp,
-			&meteringData.TrafficIn,
-			&meteringData.TrafficOut,
-			&meteringData.MeteringTime,
-			&status)
-		if err != nil {
-			fmt.Fprintf(file, "%v\n", err)
-			return
-		}
-
-		_, err = db.Dbpool.Exec(context.TODO(), METERING_MONTH_INSERT_QUERY,
-			uuid.New(),
-			meteringData.Namespace,
-			meteringData.Cpu,
-			meteringData.Memory,
-			meteringData.Storage,
-			meteringData.Gpu,
-			meteringData.PublicIp,
-			meteringData.PrivateIp,
-			meteringData.TrafficIn,
-			meteringData.TrafficOut,
-			meteringData.MeteringTime.AddDate(0, 0,
-				-(meteringData.MeteringTime.Day()-1)).Format("2006-01-02 00:00:00"),
-			//date_format(metering_time,'%Y-%m-01 00:00:00'),
-			status)
-		if err != nil {
+	br := db.Dbpool.SendBatch(context.TODO(), batch)
+	for range meteringData {
+		if _, err := br.Exec(); err != nil {
 			fmt.Fprintf(file, "%v\n", err)
+			fmt.Fprintf(file, "Insert into METERING_DIMENSION failed..\n")
+			br.Close()
 			return
 		}
 	}
-	fmt.Fprintf(file,
-		"Insert into METERING_MONTH Success!!\n"+
-			"--------------------------------------\n"+
-			"Update METERING_DAY Past data to 'Merged' Start!!\n")
-	_, err = db.Dbpool.Exec(context.TODO(), METERING_DAY_UPDATE_QUERY)
-	if err != nil {
+	if err := br.Close(); err != nil {
 		fmt.Fprintf(file, "%v\n", err)
 		return
 	}
-	fmt.Fprintf(file, "Update METERING_DAY Past data to 'Merged' Success!!\n")
-	/*
-		klog.Infoln("--------------------------------------")
-		klog.Infoln("Delete METERING for past 1 month Start!!")
-		_, err = db.Exec(METERING_DAY_DELETE_QUERY)
-		if err != nil {
-			fmt.Fprintf(file, "%v\n", err)
-			return
-		}
-		klog.Infoln("Delete METERING for past 1 month Success!!")
-	*/
+	fmt.Fprintf(file, "Insert into METERING_DIMENSION Success!! (%d rows)\n", len(meteringData))
 }
 
-func insertMeteringDay() {
-	fmt.Fprintf(file,
-		"Insert into METERING_DAY Start!!\n"+
-			"Current Time	: "+t.Format("2006-01-02 15:04:00")+"\n")
-
-	rows, err := db.Dbpool.Query(context.TODO(), METERING_DAY_SELECT_QUERY)
-	defer rows.Close()
-
-	if err != nil {
-		fmt.Fprintf(file, "%v\n", err)
-		return
-	}
+// meteringSetters are applied in order; a metric missing from a namespace stays zero.
+var meteringSetters = []struct {
+	metric string
+	set    func(*meteringModel.Metering, string)
+}{
+	{METRIC_CPU, func(m *meteringModel.Metering, v string) { m.Cpu, _ = strconv.ParseFloat(v, 64) }},
+	{METRIC_MEMORY, func(m *meteringModel.Metering, v string) { m.Memory = parseUint(v) }},
+	{METRIC_STORAGE, func(m *meteringModel.Metering, v string) { m.Storage = parseUint(v) }},
+	{METRIC_GPU, func(m *meteringModel.Metering, v string) { m.Gpu, _ = strconv.ParseFloat(v, 64) }},
+	{METRIC_PUBLIC_IP, func(m *meteringModel.Metering, v string) { m.PublicIp = parseUint(v) }},
+	{METRIC_PRIVATE_IP, func(m *meteringModel.Metering, v string) { m.PrivateIp = parseUint(v) }},
+	{METRIC_TRAFFIC_IN, func(m *meteringModel.Metering, v string) { m.TrafficIn = parseUint(v) }},
+	{METRIC_TRAFFIC_OUT, func(m *meteringModel.Metering, v string) { m.TrafficOut = parseUint(v) }},
+}
 
-	var meteringData meteringModel.Metering
-	var status string
-	for rows.Next() {
-		err := rows.Scan(
-			//&meteringData.Id,
-			&meteringData.Namespace,
-			&meteringData.Cpu,
-			&meteringData.Memory,
-			&meteringData.Storage,
-			&meteringData.Gpu,
-			&meteringData.PublicIp,
-			&meteringData.PrivateIp,
-			&meteringData.TrafficIn,
-			&meteringData.TrafficOut,
-			&meteringData.MeteringTime,
-			&status)
-		if err != nil {
-			fmt.Fprintf(file, "%v\n", err)
-			return
+// makeMeteringMap runs queries and merges the results by namespace, or by namespace and the label
+// dimensionLabel when it is given. The file source reads the response of a metric from <prefix><metric>.json.
+func makeMeteringMap(queries map[string]string, dimensionLabel string, prefix string) (map[string]*meteringModel.Metering, error) {
+	var meteringData = make(map[string]*meteringModel.Metering)
+	for _, setter := range meteringSetters {
+		query, ok := queries[setter.metric]
+		if !ok || query == "" {
+			continue
 		}
-
-		_, err = db.Dbpool.Exec(context.TODO(), METERING_DAY_INSERT_QUERY,
-			uuid.New(),
-			meteringData.Namespace,
-			meteringData.Cpu,
-			meteringData.Memory,
-			meteringData.Storage,
-			meteringData.Gpu,
-			meteringData.PublicIp,
-			meteringData.PrivateIp,
-			meteringData.TrafficIn,
-			meteringData.TrafficOut,
-			meteringData.MeteringTime.Format("2006-01-02 00:00:00"), //date_format(metering_time,'%Y-%m-%d 00:00:00')
-			status)
+		data, err := source.Query(prefix+setter.metric, query)
 		if err != nil {
-			fmt.Fprintf(file, "%v\n", err)
-			return
+			return nil, fmt.Errorf("query %s: %v", prefix+setter.metric, err)
 		}
-	}
-	fmt.Fprintf(file,
-		"Insert into METERING_DAY Success!!\n"+
-			"--------------------------------------\n"+
-			"Update METERING_HOUR Past data to 'Merged' Start!!\n")
-	_, err = db.Dbpool.Exec(context.TODO(), METERING_HOUR_UPDATE_QUERY)
-	if err != nil {
-		fmt.Fprintf(file, "%v\n", err)
-		return
-	}
-	fmt.Fprintf(file, "Update METERING_HOUR Past data to 'Merged' Success!!\n")
-	/*
-		klog.Infoln("--------------------------------------")
-		klog.Infoln("Delete METERING for past 1 day Start!!")
-		_, err = db.Exec(METERING_HOUR_DELETE_QUERY)
-		if err != nil {
-			fmt.Fprintf(file, "%v\n", err)
-			return
+		for _, metric := range data.Result {
+			namespace := metric.Metric["namespace"]
+			value, ok := sampleValue(metric.Value)
+			if namespace == "" || !ok {
+				continue
+			}
+			key := namespace
+			if dimensionLabel != "" {
+				// workloads without the label are grouped under an empty dimension
+				key = namespace + "/" + metric.Metric[dimensionLabel]
+			}
+			if _, exist := meteringData[key]; !exist {
+				meteringData[key] = &meteringModel.Metering{Namespace: namespace}
+				if dimensionLabel != "" {
+					meteringData[key].Dimension = metric.Metric[dimensionLabel]
+				}
+			}
+			setter.set(meteringData[key], value)
 		}
-		klog.Infoln("Delete METERING for past 1 day Success!!")
-	*/
+	}
+	return meteringData, nil
 }
 
-func insertMeteringHour() {
-	fmt.Fprintf(file,
-		"Insert into METERING_HOUR Start!!\n"+
-			"Current Time	: "+t.Format("2006-01-02 15:04:00")+"\n")
-
-	rows, err := db.Dbpool.Query(context.TODO(), METERING_HOUR_SELECT_QUERY)
-	defer rows.Close()
-
-	if err != nil {
-		fmt.Fprintf(file, "%v\n", err)
-		return
+// sampleValue returns the value of an instant vector sample, [ <unix time>, "<value>" ].
+func sampleValue(value []interface{}) (string, bool) {
+	if len(value) != 2 {
+		return "", false
 	}
+	v, ok := value[1].(string)
+	return v, ok
+}
 
-	var meteringData meteringModel.Metering
-	var status string
-	for rows.Next() {
-		err := rows.Scan(
-			//&meteringData.Id,
-			&meteringData.Namespace,
-			&meteringData.Cpu,
-			&meteringData.Memory,
-			&meteringData.Storage,
-			&meteringData.Gpu,
-			&meteringData.PublicIp,
-			&meteringData.PrivateIp,
-			&meteringData.TrafficIn,
-			&meteringData.TrafficOut,
-			&meteringData.MeteringTime,
-			&status)
-		if err != nil {
-			fmt.Fprintf(file, "%v\n", err)
-			return
-		}
-
-		_, err = db.Dbpool.Exec(context.TODO(), METERING_HOUR_INSERT_QUERY,
-			uuid.New(),
-			meteringData.Namespace,
-			meteringData.Cpu,
-			meteringData.Memory,
-			meteringData.Storage,
-			meteringData.Gpu,
-			meteringData.PublicIp,
-			meteringData.PrivateIp,
-			meteringData.TrafficIn,
-			meteringData.TrafficOut,
-			meteringData.MeteringTime.Format("2006-01-02 15:00:00"),
-			status)
-		if err != nil {
-			fmt.Fprintf(file, "%v\n", err)
-			return
-		}
-	}
-	fmt.Fprintf(file,
-		"Insert into METERING_HOUR Success!!\n"+
-			"--------------------------------------\n"+
-			"Update METERING Past data to 'Merged' Start!!\n")
-	_, err = db.Dbpool.Exec(context.TODO(), METERING_DELETE_QUERY)
-	if err != nil {
-		fmt.Fprintf(file, "%v\n", err)
-		return
+// parseUint truncates values such as "1.5e+06" that Prometheus returns for rates and averages.
+func parseUint(value string) uint64 {
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || f < 0 {
+		return 0
 	}
-	fmt.Fprintf(file, "Update METERING Past data to 'Merged' Success!!\n")
+	return uint64(f)
 }
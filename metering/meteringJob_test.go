@@ -0,0 +1,131 @@
+package metering
+
+import (
+	"reflect"
+	"testing"
+
+	meteringModel "github.com/tmax-cloud/hypercloud-api-server/metering/model"
+)
+
+// withoutMetric returns defaultQueries without the given metrics.
+func withoutMetric(metrics ...string) map[string]string {
+	q := map[string]string{}
+	for metric, query := range defaultQueries {
+		q[metric] = query
+	}
+	for _, metric := range metrics {
+		delete(q, metric)
+	}
+	return q
+}
+
+func TestMakeMeteringMap(t *testing.T) {
+	source = &fileSource{dir: "testdata/namespace"}
+
+	tests := []struct {
+		name    string
+		queries map[string]string
+		want    map[string]*meteringModel.Metering
+		wantErr bool
+	}{
+		{
+			name:    "merges metrics by namespace",
+			queries: withoutMetric(METRIC_TRAFFIC_OUT),
+			want: map[string]*meteringModel.Metering{
+				"default": {Namespace: "default", Cpu: 1.5, Memory: 1073741824, Storage: 10737418240, PublicIp: 2, TrafficIn: 1536},
+				// exponents are parsed, a negative value counts as zero and a sample without namespace is skipped
+				"kube-system": {Namespace: "kube-system", Cpu: 0.25, Memory: 524288000},
+			},
+		},
+		{
+			name:    "skips empty queries",
+			queries: map[string]string{METRIC_CPU: "cpu", METRIC_MEMORY: ""},
+			want: map[string]*meteringModel.Metering{
+				"default":     {Namespace: "default", Cpu: 1.5},
+				"kube-system": {Namespace: "kube-system", Cpu: 0.25},
+			},
+		},
+		{
+			name:    "metric without recorded response is empty",
+			queries: map[string]string{METRIC_GPU: "gpu"},
+			want:    map[string]*meteringModel.Metering{},
+		},
+		{
+			name:    "failed query fails the run",
+			queries: defaultQueries,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := makeMeteringMap(tt.queries, "", "")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("makeMeteringMap() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				for key, value := range got {
+					t.Logf("got %s: %+v", key, *value)
+				}
+				t.Errorf("makeMeteringMap() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMakeMeteringMapDimension(t *testing.T) {
+	source = &fileSource{dir: "testdata/dimension"}
+
+	tests := []struct {
+		name           string
+		queries        map[string]string
+		dimensionLabel string
+		prefix         string
+		want           map[string]*meteringModel.Metering
+	}{
+		{
+			name:    "gpu and private ip by namespace",
+			queries: map[string]string{METRIC_GPU: "gpu", METRIC_PRIVATE_IP: "private_ip"},
+			want: map[string]*meteringModel.Metering{
+				"ml": {Namespace: "ml", Gpu: 2, PrivateIp: 3},
+			},
+		},
+		{
+			name:           "breakdown by dimension label",
+			queries:        map[string]string{METRIC_CPU: "cpu", METRIC_GPU: "gpu", METRIC_PRIVATE_IP: "private_ip"},
+			dimensionLabel: "app",
+			prefix:         "dimension_",
+			want: map[string]*meteringModel.Metering{
+				"ml/trainer":  {Namespace: "ml", Dimension: "trainer", Cpu: 4, Gpu: 2, PrivateIp: 1},
+				"ml/notebook": {Namespace: "ml", Dimension: "notebook", Cpu: 0.5, PrivateIp: 2},
+				// workloads without the label
+				"ml/": {Namespace: "ml", Cpu: 0.1},
+			},
+		},
+		{
+			name:           "other label puts every workload in the empty dimension",
+			queries:        map[string]string{METRIC_GPU: "gpu"},
+			dimensionLabel: "team",
+			prefix:         "dimension_",
+			want: map[string]*meteringModel.Metering{
+				"ml/": {Namespace: "ml", Gpu: 2},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := makeMeteringMap(tt.queries, tt.dimensionLabel, tt.prefix)
+			if err != nil {
+				t.Fatalf("makeMeteringMap() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				for key, value := range got {
+					t.Logf("got %s: %+v", key, *value)
+				}
+				t.Errorf("makeMeteringMap() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
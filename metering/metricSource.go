@@ -0,0 +1,265 @@
+package metering
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	meteringModel "github.com/tmax-cloud/hypercloud-api-server/metering/model"
+	yaml "gopkg.in/yaml.v2"
+	"k8s.io/klog"
+)
+
+const (
+	SOURCE_TYPE_PROMETHEUS = "prometheus"
+	SOURCE_TYPE_FILE       = "file"
+
+	DEFAULT_PROMETHEUS_URL = "http://prometheus-k8s.monitoring:9090"
+
+	METRIC_CPU         = "cpu"
+	METRIC_MEMORY      = "memory"
+	METRIC_STORAGE     = "storage"
+	METRIC_GPU         = "gpu"
+	METRIC_PUBLIC_IP   = "public_ip"
+	METRIC_PRIVATE_IP  = "private_ip"
+	METRIC_TRAFFIC_IN  = "traffic_in"
+	METRIC_TRAFFIC_OUT = "traffic_out"
+
+	queryRetry     = 3
+	queryRetryWait = 5 * time.Second
+)
+
+var (
+	// Set by flags in main.go
+	ConfigPath string
+
+	source  MetricSource
+	queries map[string]string
+	// dimension is nil unless the config file defines one
+	dimension *meteringModel.DimensionConfig
+)
+
+// defaultQueries are used for metrics the config file does not define.
+// kube-state-metrics exports extended resources with sanitized names, e.g. nvidia.com/gpu as nvidia_com_gpu.
+var defaultQueries = map[string]string{
+	METRIC_CPU:         "sum(kube_pod_container_resource_requests{resource=\"cpu\"})by(namespace)",
+	METRIC_MEMORY:      "sum(kube_pod_container_resource_requests{resource=\"memory\"})by(namespace)",
+	METRIC_STORAGE:     "sum(kube_persistentvolumeclaim_resource_requests_storage_bytes)by(namespace)",
+	METRIC_GPU:         "sum(kube_pod_container_resource_requests{resource=~\"nvidia_com_gpu|amd_com_gpu\"})by(namespace)",
+	METRIC_PUBLIC_IP:   "count(kube_service_spec_type{type=\"LoadBalancer\"})by(namespace)",
+	METRIC_PRIVATE_IP:  "count(kube_service_spec_type{type=~\"ClusterIP|NodePort\"})by(namespace)",
+	METRIC_TRAFFIC_IN:  "sum(rate(container_network_receive_bytes_total[1m]))by(namespace)",
+	METRIC_TRAFFIC_OUT: "sum(rate(container_network_transmit_bytes_total[1m]))by(namespace)",
+}
+
+// MetricSource answers instant PromQL queries.
+type MetricSource interface {
+	// Query returns the instant vector of query. metric is the name of the metering metric it measures.
+	Query(metric string, query string) (meteringModel.MetricDataList, error)
+}
+
+// InitMetricSource reads ConfigPath. Without a config file, the in-cluster Prometheus and default queries are used.
+func InitMetricSource() error {
+	config := meteringModel.MeteringConfig{}
+	if ConfigPath != "" {
+		content, err := ioutil.ReadFile(ConfigPath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err == nil {
+			if err := yaml.Unmarshal(content, &config); err != nil {
+				return err
+			}
+		} else {
+			klog.Infoln("Metering config [" + ConfigPath + "] does not exist, use defaults")
+		}
+	}
+
+	queries = map[string]string{}
+	for metric, query := range defaultQueries {
+		queries[metric] = query
+	}
+	for metric, query := range config.Queries {
+		queries[metric] = query
+	}
+
+	dimension = nil
+	if config.Dimension != nil {
+		if config.Dimension.Label == "" {
+			return errors.New("Metering dimension label is empty")
+		}
+		dimension = config.Dimension
+		klog.Infoln("Metering dimension : ", dimension.Label)
+	}
+
+	s, err := NewMetricSource(config.Source)
+	if err != nil {
+		return err
+	}
+	source = s
+
+	remoteWrite = nil
+	if config.RemoteWrite != nil {
+		if remoteWrite, err = newRemoteWriter(*config.RemoteWrite); err != nil {
+			return err
+		}
+		klog.Infoln("Metering remote write : ", config.RemoteWrite.Url)
+	}
+	return nil
+}
+
+func NewMetricSource(config meteringModel.MetricSourceConfig) (MetricSource, error) {
+	switch config.Type {
+	case "", SOURCE_TYPE_PROMETHEUS:
+		return newPrometheusSource(config)
+	case SOURCE_TYPE_FILE:
+		if config.Dir == "" {
+			return nil, errors.New("Metric source dir is empty")
+		}
+		return &fileSource{dir: config.Dir}, nil
+	default:
+		return nil, errors.New("Metric source type [" + config.Type + "] is not supported")
+	}
+}
+
+// prometheusSource queries the http api of Prometheus or Thanos querier.
+type prometheusSource struct {
+	url    string
+	config meteringModel.HttpClientConfig
+	client *http.Client
+}
+
+func newPrometheusSource(config meteringModel.MetricSourceConfig) (*prometheusSource, error) {
+	url := config.Url
+	if url == "" {
+		url = DEFAULT_PROMETHEUS_URL
+	}
+	client, err := newHttpClient(config.HttpClientConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &prometheusSource{
+		url:    strings.TrimSuffix(url, "/"),
+		config: config.HttpClientConfig,
+		client: client,
+	}, nil
+}
+
+func newHttpClient(config meteringModel.HttpClientConfig) (*http.Client, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.Tls.InsecureSkipVerify}
+	if config.Tls.CaFile != "" {
+		ca, err := ioutil.ReadFile(config.Tls.CaFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, errors.New("No certificate in [" + config.Tls.CaFile + "]")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if config.Tls.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.Tls.CertFile, config.Tls.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment},
+	}, nil
+}
+
+// authorize sets the credentials of config on req. They are read on every request so rotated secrets are picked up.
+func authorize(req *http.Request, config meteringModel.HttpClientConfig) error {
+	if config.BearerTokenFile != "" {
+		token, err := ioutil.ReadFile(config.BearerTokenFile)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	} else if config.Username != "" {
+		password, err := ioutil.ReadFile(config.PasswordFile)
+		if err != nil {
+			return err
+		}
+		req.SetBasicAuth(config.Username, strings.TrimSpace(string(password)))
+	}
+	return nil
+}
+
+func (s *prometheusSource) Query(metric string, query string) (meteringModel.MetricDataList, error) {
+	var metricResponse meteringModel.MetricResponse
+
+	req, err := http.NewRequest(http.MethodGet, s.url+"/api/v1/query", nil)
+	if err != nil {
+		return metricResponse.Data, err
+	}
+	q := req.URL.Query()
+	q.Add("query", query)
+	req.URL.RawQuery = q.Encode()
+
+	if err := authorize(req, s.config); err != nil {
+		return metricResponse.Data, err
+	}
+
+	var resp *http.Response
+	for i := 0; i < queryRetry; i++ {
+		if resp, err = s.client.Do(req); err == nil {
+			break
+		}
+		klog.Errorln("Prometheus connection failed: ", err)
+		time.Sleep(queryRetryWait)
+	}
+	if err != nil {
+		return metricResponse.Data, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return metricResponse.Data, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return metricResponse.Data, fmt.Errorf("query %s failed with status %d: %s", metric, resp.StatusCode, string(body))
+	}
+	return decodeMetricResponse(body)
+}
+
+// fileSource reads recorded /api/v1/query responses from <dir>/<metric>.json.
+// It is meant for tests and for clusters whose metrics are exported by other means.
+type fileSource struct {
+	dir string
+}
+
+func (s *fileSource) Query(metric string, query string) (meteringModel.MetricDataList, error) {
+	body, err := ioutil.ReadFile(filepath.Join(s.dir, metric+".json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			// a metric without a recorded response is empty
+			return meteringModel.MetricDataList{}, nil
+		}
+		return meteringModel.MetricDataList{}, err
+	}
+	return decodeMetricResponse(body)
+}
+
+func decodeMetricResponse(body []byte) (meteringModel.MetricDataList, error) {
+	var metricResponse meteringModel.MetricResponse
+	if err := json.Unmarshal(body, &metricResponse); err != nil {
+		return metricResponse.Data, err
+	}
+	if metricResponse.Status != "success" {
+		return metricResponse.Data, errors.New("Prometheus response status is " + metricResponse.Status)
+	}
+	return metricResponse.Data, nil
+}
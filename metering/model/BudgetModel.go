@@ -0,0 +1,27 @@
+package model
+
+import "time"
+
+// Budget limits the usage of a metric, or the cost, of a namespace in a period.
+type Budget struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	// Metric is a metering metric (cpu, memory, ...) measured in unit-hours, or cost priced by the effective price book
+	Metric string `json:"metric"`
+	// Period is day or month
+	Period          string  `json:"period"`
+	Amount          float64 `json:"amount"`
+	WarningPercent  float64 `json:"warningPercent"`
+	CriticalPercent float64 `json:"criticalPercent"`
+
+	CreatedBy string    `json:"createdBy,omitempty"`
+	CreatedAt time.Time `json:"createdAt,omitempty"`
+	UpdatedAt time.Time `json:"updatedAt,omitempty"`
+
+	// State is the highest threshold alerted in the current period: ok, warning or critical
+	State       string    `json:"state"`
+	StatePeriod time.Time `json:"statePeriod,omitempty"`
+	// Usage and UsagePercent are filled in when budgets are read
+	Usage        float64 `json:"usage"`
+	UsagePercent float64 `json:"usagePercent"`
+}
@@ -0,0 +1,35 @@
+package model
+
+import "time"
+
+// Forecast projects the daily usage of one metric of a namespace.
+type Forecast struct {
+	Namespace string `json:"namespace"`
+	Metric    string `json:"metric"`
+	// Unit of daily values; traffic is GiB per day, other metrics are daily averages
+	Unit  string `json:"unit"`
+	Model string `json:"model"`
+	// Confidence of the bands, e.g. 0.95
+	Confidence float64 `json:"confidence"`
+	// History is the number of days the model was fitted on
+	History int              `json:"history"`
+	Points  []ForecastPoint  `json:"points"`
+	Periods []ForecastPeriod `json:"periods"`
+}
+
+type ForecastPoint struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+	Lower float64   `json:"lower"`
+	Upper float64   `json:"upper"`
+}
+
+// ForecastPeriod sums daily values of a month, in unit-days (GiB for traffic). Actual is the part already metered.
+type ForecastPeriod struct {
+	From   time.Time `json:"from"`
+	To     time.Time `json:"to"`
+	Actual float64   `json:"actual"`
+	Value  float64   `json:"value"`
+	Lower  float64   `json:"lower"`
+	Upper  float64   `json:"upper"`
+}
@@ -14,6 +14,10 @@ type Metering struct {
 	TrafficIn    uint64    `json:"trafficIn"`
 	TrafficOut   uint64    `json:"trafficOut"`
 	MeteringTime time.Time `json:"meteringTime"`
+	// Dimension is the value of the secondary dimension label, set only on breakdown rows
+	Dimension string `json:"dimension,omitempty"`
+	// Total is set on rows that sum every namespace visible to the caller at MeteringTime
+	Total bool `json:"total,omitempty"`
 }
 
 type Metric struct {
@@ -30,3 +34,53 @@ type MetricResponse struct {
 	Status string         `json:"status"`
 	Data   MetricDataList `json:"data"`
 }
+
+// MeteringConfig is read from the metering config file.
+type MeteringConfig struct {
+	Source MetricSourceConfig `yaml:"source"`
+	// Queries maps a metering metric (cpu, memory, ...) to the PromQL that measures it by namespace
+	Queries map[string]string `yaml:"queries"`
+	// Dimension breaks namespaces down further. Nil disables the breakdown.
+	Dimension *DimensionConfig `yaml:"dimension"`
+	// RemoteWrite is nil unless hourly rollups are pushed
+	RemoteWrite *RemoteWriteConfig `yaml:"remoteWrite"`
+}
+
+// DimensionConfig measures metrics by namespace and one more label, such as app, workload owner or node pool.
+type DimensionConfig struct {
+	// Label holds the dimension in the query results, e.g. label_app, owner_name or label_node_pool
+	Label string `yaml:"label"`
+	// Queries maps a metering metric to PromQL aggregated by(namespace, <label>). Metrics without a query are zero.
+	Queries map[string]string `yaml:"queries"`
+}
+
+type MetricSourceConfig struct {
+	// Type is prometheus (also for Thanos querier) or file
+	Type string `yaml:"type"`
+	// HttpClientConfig.Url is the base url of the Prometheus api, e.g. http://prometheus-k8s.monitoring:9090
+	HttpClientConfig `yaml:",inline"`
+	// Dir holds recorded responses named <metric>.json for the file source
+	Dir string `yaml:"dir"`
+}
+
+// RemoteWriteConfig pushes hourly rollups to a Prometheus remote write receiver, e.g. Thanos receive.
+// Url is the full receive url, e.g. http://thanos-receive.monitoring:19291/api/v1/receive
+type RemoteWriteConfig struct {
+	HttpClientConfig `yaml:",inline"`
+	// ExternalLabels are added to every pushed series, e.g. cluster: prod
+	ExternalLabels map[string]string `yaml:"externalLabels"`
+}
+
+// HttpClientConfig is the url, credentials and TLS of an http endpoint. Secrets are read from files.
+type HttpClientConfig struct {
+	Url             string `yaml:"url"`
+	BearerTokenFile string `yaml:"bearerTokenFile"`
+	Username        string `yaml:"username"`
+	PasswordFile    string `yaml:"passwordFile"`
+	Tls             struct {
+		CaFile             string `yaml:"caFile"`
+		CertFile           string `yaml:"certFile"`
+		KeyFile            string `yaml:"keyFile"`
+		InsecureSkipVerify bool   `yaml:"insecureSkipVerify"`
+	} `yaml:"tls"`
+}
@@ -0,0 +1,61 @@
+package model
+
+import "time"
+
+// PriceBook holds unit prices for metered resources. A price book is never modified;
+// every change is saved as a new version so invoices of the past can be reproduced.
+type PriceBook struct {
+	Version  int    `json:"version"`
+	Currency string `json:"currency"`
+	// EffectiveFrom is the first time this version prices. The latest version effective at the end of a period applies.
+	EffectiveFrom time.Time  `json:"effectiveFrom"`
+	CreatedBy     string     `json:"createdBy,omitempty"`
+	CreatedAt     time.Time  `json:"createdAt,omitempty"`
+	Prices        []Price    `json:"prices"`
+	Discounts     []Discount `json:"discounts,omitempty"`
+}
+
+// Price is the price of one unit of Resource for one Per time unit.
+// Units are core for cpu, GiB for memory and storage, device for gpu, address for ips and
+// GiB transferred for traffic, which is not multiplied by time.
+type Price struct {
+	Resource  string  `json:"resource"`
+	Per       string  `json:"per"`
+	UnitPrice float64 `json:"unitPrice"`
+	// Tiers are graduated; each tier prices the quantity up to UpTo, the last tier may leave UpTo 0 for no limit
+	Tiers []Tier `json:"tiers,omitempty"`
+}
+
+type Tier struct {
+	UpTo      float64 `json:"upTo"`
+	UnitPrice float64 `json:"unitPrice"`
+}
+
+// Discount reduces the subtotal of a namespace by Percent.
+type Discount struct {
+	Namespace string  `json:"namespace"`
+	Percent   float64 `json:"percent"`
+}
+
+type Invoice struct {
+	Namespace        string     `json:"namespace"`
+	From             time.Time  `json:"from"`
+	To               time.Time  `json:"to"`
+	Currency         string     `json:"currency"`
+	PriceBookVersion int        `json:"priceBookVersion"`
+	LineItems        []LineItem `json:"lineItems"`
+	Subtotal         float64    `json:"subtotal"`
+	DiscountPercent  float64    `json:"discountPercent,omitempty"`
+	Discount         float64    `json:"discount"`
+	Total            float64    `json:"total"`
+}
+
+type LineItem struct {
+	Resource string `json:"resource"`
+	Unit     string `json:"unit"`
+	// Tier is 1-based, 0 when the price has no tiers
+	Tier      int     `json:"tier,omitempty"`
+	Quantity  float64 `json:"quantity"`
+	UnitPrice float64 `json:"unitPrice"`
+	Amount    float64 `json:"amount"`
+}
@@ -0,0 +1,332 @@
+package metering
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	meteringModel "github.com/tmax-cloud/hypercloud-api-server/metering/model"
+	"github.com/tmax-cloud/hypercloud-api-server/util"
+	db "github.com/tmax-cloud/hypercloud-api-server/util/dataFactory"
+)
+
+const (
+	PRICE_BOOK_CREATE_QUERY = "create table if not exists metering_price_book (version serial primary key, effective_from timestamp not null, " +
+		"created_by varchar(255), created_at timestamp not null default now(), book jsonb not null)"
+	PRICE_BOOK_INSERT_QUERY    = "insert into metering_price_book (effective_from, created_by, book) values ($1, $2, $3) returning version, created_at"
+	PRICE_BOOK_SELECT_QUERY    = "select version, effective_from, created_by, created_at, book from metering_price_book"
+	PRICE_BOOK_VERSION_QUERY   = PRICE_BOOK_SELECT_QUERY + " where version = $1"
+	PRICE_BOOK_EFFECTIVE_QUERY = PRICE_BOOK_SELECT_QUERY + " where effective_from <= $1 order by effective_from desc, version desc limit 1"
+
+	GiB = 1024 * 1024 * 1024
+)
+
+// priceUnits names the unit of each priced resource.
+var priceUnits = map[string]string{
+	METRIC_CPU:         "core",
+	METRIC_MEMORY:      "GiB",
+	METRIC_STORAGE:     "GiB",
+	METRIC_GPU:         "device",
+	METRIC_PUBLIC_IP:   "address",
+	METRIC_PRIVATE_IP:  "address",
+	METRIC_TRAFFIC_IN:  "GiB",
+	METRIC_TRAFFIC_OUT: "GiB",
+}
+
+// storedPriceBook is the part of a price book saved in the book column.
+type storedPriceBook struct {
+	Currency  string                   `json:"currency"`
+	Prices    []meteringModel.Price    `json:"prices"`
+	Discounts []meteringModel.Discount `json:"discounts,omitempty"`
+}
+
+func InitPricing() error {
+	_, err := db.Dbpool.Exec(context.TODO(), PRICE_BOOK_CREATE_QUERY)
+	return err
+}
+
+func isTraffic(resource string) bool {
+	return resource == METRIC_TRAFFIC_IN || resource == METRIC_TRAFFIC_OUT
+}
+
+func validatePriceBook(book meteringModel.PriceBook) error {
+	if book.Currency == "" {
+		return errors.New("Currency is empty")
+	}
+	if len(book.Prices) == 0 {
+		return errors.New("Price book has no price")
+	}
+	seen := map[string]bool{}
+	for _, price := range book.Prices {
+		if _, ok := priceUnits[price.Resource]; !ok {
+			return errors.New("Resource [" + price.Resource + "] can not be priced")
+		}
+		if seen[price.Resource] {
+			return errors.New("Resource [" + price.Resource + "] is priced twice")
+		}
+		seen[price.Resource] = true
+		if !isTraffic(price.Resource) && price.Per != UNIT_HOUR && price.Per != UNIT_DAY && price.Per != UNIT_MONTH {
+			return errors.New("Price of [" + price.Resource + "] must be per hour, day or month")
+		}
+		if price.UnitPrice < 0 {
+			return errors.New("Price of [" + price.Resource + "] is negative")
+		}
+		var upTo float64
+		for i, tier := range price.Tiers {
+			if tier.UnitPrice < 0 {
+				return errors.New("Tier price of [" + price.Resource + "] is negative")
+			}
+			if tier.UpTo == 0 && i != len(price.Tiers)-1 {
+				return errors.New("Only the last tier of [" + price.Resource + "] can be unlimited")
+			}
+			if tier.UpTo != 0 && tier.UpTo <= upTo {
+				return errors.New("Tiers of [" + price.Resource + "] must be in ascending order")
+			}
+			upTo = tier.UpTo
+		}
+	}
+	discounted := map[string]bool{}
+	for _, discount := range book.Discounts {
+		if discount.Namespace == "" {
+			return errors.New("Discount namespace is empty")
+		}
+		if discounted[discount.Namespace] {
+			return errors.New("Namespace [" + discount.Namespace + "] is discounted twice")
+		}
+		discounted[discount.Namespace] = true
+		if discount.Percent < 0 || discount.Percent > 100 {
+			return errors.New("Discount of [" + discount.Namespace + "] must be between 0 and 100 percent")
+		}
+	}
+	return nil
+}
+
+// savePriceBook stores book as a new version.
+func savePriceBook(book meteringModel.PriceBook, userId string) (meteringModel.PriceBook, error) {
+	if err := validatePriceBook(book); err != nil {
+		return book, err
+	}
+	if book.EffectiveFrom.IsZero() {
+		book.EffectiveFrom = time.Now()
+	}
+	content, err := json.Marshal(storedPriceBook{Currency: book.Currency, Prices: book.Prices, Discounts: book.Discounts})
+	if err != nil {
+		return book, err
+	}
+	book.CreatedBy = userId
+	err = db.Dbpool.QueryRow(context.TODO(), PRICE_BOOK_INSERT_QUERY, book.EffectiveFrom.In(time.Local), userId, content).
+		Scan(&book.Version, &book.CreatedAt)
+	return book, err
+}
+
+func scanPriceBook(scan func(dest ...interface{}) error) (meteringModel.PriceBook, error) {
+	var book meteringModel.PriceBook
+	var createdBy *string
+	var content []byte
+	if err := scan(&book.Version, &book.EffectiveFrom, &createdBy, &book.CreatedAt, &content); err != nil {
+		return book, err
+	}
+	var stored storedPriceBook
+	if err := json.Unmarshal(content, &stored); err != nil {
+		return book, err
+	}
+	book.EffectiveFrom = util.WallClock(book.EffectiveFrom)
+	book.CreatedAt = util.WallClock(book.CreatedAt)
+	if createdBy != nil {
+		book.CreatedBy = *createdBy
+	}
+	book.Currency, book.Prices, book.Discounts = stored.Currency, stored.Prices, stored.Discounts
+	return book, nil
+}
+
+// getPriceBook returns the given version, or the version effective at when version is 0.
+func getPriceBook(version int, at time.Time) (meteringModel.PriceBook, error) {
+	row := db.Dbpool.QueryRow(context.TODO(), PRICE_BOOK_EFFECTIVE_QUERY, at.In(time.Local))
+	if version != 0 {
+		row = db.Dbpool.QueryRow(context.TODO(), PRICE_BOOK_VERSION_QUERY, version)
+	}
+	return scanPriceBook(row.Scan)
+}
+
+func listPriceBooks() ([]meteringModel.PriceBook, error) {
+	rows, err := db.Dbpool.Query(context.TODO(), PRICE_BOOK_SELECT_QUERY+" order by version desc")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	books := []meteringModel.PriceBook{}
+	for rows.Next() {
+		book, err := scanPriceBook(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		books = append(books, book)
+	}
+	return books, rows.Err()
+}
+
+// usage returns the quantity of resource a metering row of rowUnit accounts for, in units of price.
+// Rows hold averages over their bucket, so the average is multiplied by the bucket length in Per units.
+func usage(row meteringModel.Metering, rowUnit string, price meteringModel.Price) float64 {
+	start := util.WallClock(row.MeteringTime)
+	hours := nextBucket(start, rowUnit).Sub(start).Hours()
+
+	if isTraffic(price.Resource) {
+		// traffic is an average rate in bytes per second
+		rate := float64(row.TrafficIn)
+		if price.Resource == METRIC_TRAFFIC_OUT {
+			rate = float64(row.TrafficOut)
+		}
+		return rate * hours * 3600 / GiB
+	}
+
+	var value float64
+	switch price.Resource {
+	case METRIC_CPU:
+		value = row.Cpu
+	case METRIC_MEMORY:
+		value = float64(row.Memory) / GiB
+	case METRIC_STORAGE:
+		value = float64(row.Storage) / GiB
+	case METRIC_GPU:
+		value = row.Gpu
+	case METRIC_PUBLIC_IP:
+		value = float64(row.PublicIp)
+	case METRIC_PRIVATE_IP:
+		value = float64(row.PrivateIp)
+	}
+
+	switch price.Per {
+	case UNIT_HOUR:
+		return value * hours
+	case UNIT_DAY:
+		return value * hours / 24
+	default:
+		// a month is the calendar month of the row
+		monthStart := time.Date(start.Year(), start.Month(), 1, 0, 0, 0, 0, time.Local)
+		return value * hours / monthStart.AddDate(0, 1, 0).Sub(monthStart).Hours()
+	}
+}
+
+// charge prices quantity, splitting it over graduated tiers.
+func charge(price meteringModel.Price, quantity float64) []meteringModel.LineItem {
+	unit := priceUnits[price.Resource]
+	if len(price.Tiers) == 0 {
+		return []meteringModel.LineItem{{Resource: price.Resource, Unit: unit, Quantity: round(quantity, 4),
+			UnitPrice: price.UnitPrice, Amount: round(quantity*price.UnitPrice, 2)}}
+	}
+
+	var items []meteringModel.LineItem
+	var lower float64
+	for i, tier := range price.Tiers {
+		if quantity <= lower {
+			break
+		}
+		q := quantity - lower
+		if tier.UpTo != 0 && quantity > tier.UpTo {
+			q = tier.UpTo - lower
+		}
+		items = append(items, meteringModel.LineItem{Resource: price.Resource, Unit: unit, Tier: i + 1, Quantity: round(q, 4),
+			UnitPrice: tier.UnitPrice, Amount: round(q*tier.UnitPrice, 2)})
+		if tier.UpTo == 0 {
+			break
+		}
+		lower = tier.UpTo
+	}
+	return items
+}
+
+// makeInvoices applies book to metering rows of rowUnit and returns one invoice per namespace.
+func makeInvoices(book meteringModel.PriceBook, rows []meteringModel.Metering, rowUnit string, from time.Time, to time.Time) []meteringModel.Invoice {
+	quantities := map[string]map[string]float64{}
+	addQuantities(quantities, book, rows, rowUnit)
+	return invoicesOf(book, quantities, from, to)
+}
+
+// addQuantities adds the usage of metering rows of rowUnit to quantities by namespace and priced resource.
+func addQuantities(quantities map[string]map[string]float64, book meteringModel.PriceBook, rows []meteringModel.Metering, rowUnit string) {
+	for _, row := range rows {
+		if quantities[row.Namespace] == nil {
+			quantities[row.Namespace] = map[string]float64{}
+		}
+		for _, price := range book.Prices {
+			quantities[row.Namespace][price.Resource] += usage(row, rowUnit, price)
+		}
+	}
+}
+
+// invoicesOf charges quantities by book and returns one invoice per namespace.
+func invoicesOf(book meteringModel.PriceBook, quantities map[string]map[string]float64, from time.Time, to time.Time) []meteringModel.Invoice {
+	discounts := map[string]float64{}
+	for _, discount := range book.Discounts {
+		discounts[discount.Namespace] = discount.Percent
+	}
+
+	namespaces := make([]string, 0, len(quantities))
+	for namespace := range quantities {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+
+	invoices := []meteringModel.Invoice{}
+	for _, namespace := range namespaces {
+		invoice := meteringModel.Invoice{
+			Namespace:        namespace,
+			From:             from,
+			To:               to,
+			Currency:         book.Currency,
+			PriceBookVersion: book.Version,
+			LineItems:        []meteringModel.LineItem{},
+			DiscountPercent:  discounts[namespace],
+		}
+		for _, price := range book.Prices {
+			for _, item := range charge(price, quantities[namespace][price.Resource]) {
+				invoice.LineItems = append(invoice.LineItems, item)
+				invoice.Subtotal += item.Amount
+			}
+		}
+		invoice.Subtotal = round(invoice.Subtotal, 2)
+		invoice.Discount = round(invoice.Subtotal*invoice.DiscountPercent/100, 2)
+		invoice.Total = round(invoice.Subtotal-invoice.Discount, 2)
+		invoices = append(invoices, invoice)
+	}
+	return invoices
+}
+
+// invoiceCsvHeader has one row per line item, followed by a total row per namespace.
+var invoiceCsvHeader = []string{"namespace", "from", "to", "currency", "priceBookVersion", "resource", "unit", "tier", "quantity", "unitPrice", "amount"}
+
+func invoiceCsvRecords(invoice meteringModel.Invoice) [][]string {
+	prefix := []string{invoice.Namespace, invoice.From.Format(time.RFC3339), invoice.To.Format(time.RFC3339), invoice.Currency, strconv.Itoa(invoice.PriceBookVersion)}
+	record := func(values ...string) []string {
+		return append(append([]string{}, prefix...), values...)
+	}
+	var records [][]string
+	for _, item := range invoice.LineItems {
+		tier := ""
+		if item.Tier != 0 {
+			tier = strconv.Itoa(item.Tier)
+		}
+		records = append(records, record(item.Resource, item.Unit, tier, formatFloat(item.Quantity),
+			formatFloat(item.UnitPrice), formatFloat(item.Amount)))
+	}
+	if invoice.Discount != 0 {
+		records = append(records, record("discount", "percent", "", formatFloat(invoice.DiscountPercent), "", formatFloat(-invoice.Discount)))
+	}
+	records = append(records, record("total", "", "", "", "", formatFloat(invoice.Total)))
+	return records
+}
+
+func round(value float64, places int) float64 {
+	p := math.Pow(10, float64(places))
+	return math.Round(value*p) / p
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
@@ -0,0 +1,225 @@
+package metering
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/jackc/pgx/v4"
+	meteringModel "github.com/tmax-cloud/hypercloud-api-server/metering/model"
+	"github.com/tmax-cloud/hypercloud-api-server/util"
+	db "github.com/tmax-cloud/hypercloud-api-server/util/dataFactory"
+	"google.golang.org/protobuf/encoding/protowire"
+	"k8s.io/klog"
+)
+
+const (
+	// watermark of the remote write, kept with the rollup watermarks
+	REMOTE_WRITE_WATERMARK = "remote_write"
+
+	// hours of rollups sent in one request, and requests sent in one run while catching up
+	remoteWriteHours    = 24
+	remoteWriteMaxBatch = 30
+)
+
+// remoteWrite is nil unless the metering config has remoteWrite
+var remoteWrite *remoteWriter
+
+type remoteWriter struct {
+	config meteringModel.RemoteWriteConfig
+	client *http.Client
+}
+
+type label struct {
+	name  string
+	value string
+}
+
+type sample struct {
+	value     float64
+	timestamp int64
+}
+
+// timeSeries is prompb.TimeSeries. Labels must be sorted by name.
+type timeSeries struct {
+	labels  []label
+	samples []sample
+}
+
+// remoteWriteError is returned for responses that will never succeed, so the batch is skipped.
+type remoteWriteError struct {
+	status int
+	body   string
+}
+
+func (e *remoteWriteError) Error() string {
+	return fmt.Sprintf("remote write rejected with status %d: %s", e.status, e.body)
+}
+
+func newRemoteWriter(config meteringModel.RemoteWriteConfig) (*remoteWriter, error) {
+	if config.Url == "" {
+		return nil, errors.New("Metering remote write url is empty")
+	}
+	client, err := newHttpClient(config.HttpClientConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &remoteWriter{config: config, client: client}, nil
+}
+
+// encodeWriteRequest marshals prompb.WriteRequest:
+//
+//	WriteRequest { repeated TimeSeries timeseries = 1; }
+//	TimeSeries   { repeated Label labels = 1; repeated Sample samples = 2; }
+//	Label        { string name = 1; string value = 2; }
+//	Sample       { double value = 1; int64 timestamp = 2; }
+func encodeWriteRequest(series []timeSeries) []byte {
+	var out []byte
+	for _, ts := range series {
+		var tsBytes []byte
+		for _, l := range ts.labels {
+			var lBytes []byte
+			lBytes = protowire.AppendTag(lBytes, 1, protowire.BytesType)
+			lBytes = protowire.AppendString(lBytes, l.name)
+			lBytes = protowire.AppendTag(lBytes, 2, protowire.BytesType)
+			lBytes = protowire.AppendString(lBytes, l.value)
+			tsBytes = protowire.AppendTag(tsBytes, 1, protowire.BytesType)
+			tsBytes = protowire.AppendBytes(tsBytes, lBytes)
+		}
+		for _, s := range ts.samples {
+			var sBytes []byte
+			sBytes = protowire.AppendTag(sBytes, 1, protowire.Fixed64Type)
+			sBytes = protowire.AppendFixed64(sBytes, math.Float64bits(s.value))
+			sBytes = protowire.AppendTag(sBytes, 2, protowire.VarintType)
+			sBytes = protowire.AppendVarint(sBytes, uint64(s.timestamp))
+			tsBytes = protowire.AppendTag(tsBytes, 2, protowire.BytesType)
+			tsBytes = protowire.AppendBytes(tsBytes, sBytes)
+		}
+		out = protowire.AppendTag(out, 1, protowire.BytesType)
+		out = protowire.AppendBytes(out, tsBytes)
+	}
+	return out
+}
+
+// rollupSeries turns metering_hour rows into one series per metric and namespace, sampled at the start of each hour.
+func (w *remoteWriter) rollupSeries(rows []meteringModel.Metering) []timeSeries {
+	byKey := map[string]*timeSeries{}
+	var keys []string
+	for _, row := range rows {
+		timestamp := util.WallClock(row.MeteringTime).UnixNano() / int64(time.Millisecond)
+		for _, m := range exportedMetrics {
+			labels := []label{{"__name__", m.name}, {"namespace", row.Namespace}, {"unit", UNIT_HOUR}}
+			for name, value := range w.config.ExternalLabels {
+				labels = append(labels, label{name, value})
+			}
+			sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+
+			key := m.name + "/" + row.Namespace
+			if byKey[key] == nil {
+				byKey[key] = &timeSeries{labels: labels}
+				keys = append(keys, key)
+			}
+			byKey[key].samples = append(byKey[key].samples, sample{value: m.value(row), timestamp: timestamp})
+		}
+	}
+
+	series := make([]timeSeries, 0, len(keys))
+	for _, key := range keys {
+		// samples of a series must be in time order
+		ts := byKey[key]
+		sort.Slice(ts.samples, func(i, j int) bool { return ts.samples[i].timestamp < ts.samples[j].timestamp })
+		series = append(series, *ts)
+	}
+	return series
+}
+
+func (w *remoteWriter) send(series []timeSeries) error {
+	req, err := http.NewRequest(http.MethodPost, w.config.Url, bytes.NewReader(snappy.Encode(nil, encodeWriteRequest(series))))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "hypercloud-api-server")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if err := authorize(req, w.config.HttpClientConfig); err != nil {
+		return err
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	if resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusTooManyRequests {
+		return &remoteWriteError{status: resp.StatusCode, body: string(body)}
+	}
+	return fmt.Errorf("remote write failed with status %d: %s", resp.StatusCode, string(body))
+}
+
+// RemoteWriteJob pushes the hourly rollups completed since the last push. A push that fails is retried
+// on the next run, except batches the receiver rejects, which are logged and skipped.
+func RemoteWriteJob() {
+	if remoteWrite == nil {
+		return
+	}
+	rollupMu.Lock()
+	defer rollupMu.Unlock()
+
+	ctx := context.TODO()
+	var rolledUp time.Time
+	if err := db.Dbpool.QueryRow(ctx, "select watermark from metering_watermark where unit = $1", UNIT_HOUR).Scan(&rolledUp); err != nil {
+		if err != pgx.ErrNoRows {
+			klog.Errorln(err)
+		}
+		return
+	}
+	rolledUp = util.WallClock(rolledUp)
+
+	var from time.Time
+	err := db.Dbpool.QueryRow(ctx, "select watermark from metering_watermark where unit = $1", REMOTE_WRITE_WATERMARK).Scan(&from)
+	if err == pgx.ErrNoRows {
+		// history before the first push stays in the database only
+		from = rolledUp.Add(-time.Hour)
+	} else if err != nil {
+		klog.Errorln(err)
+		return
+	} else {
+		from = util.WallClock(from)
+	}
+
+	for i := 0; i < remoteWriteMaxBatch && from.Before(rolledUp); i++ {
+		to := from.Add(remoteWriteHours * time.Hour)
+		if to.After(rolledUp) {
+			to = rolledUp
+		}
+		rows := getMeteringDataFromDB(false, "select "+meteringColumns+" from metering_hour where metering_time >= $1 and metering_time < $2",
+			[]interface{}{from, to})
+		if len(rows) > 0 {
+			if err := remoteWrite.send(remoteWrite.rollupSeries(rows)); err != nil {
+				if _, rejected := err.(*remoteWriteError); !rejected {
+					klog.Errorln("Metering remote write of [", from.Format(time.RFC3339), ", ", to.Format(time.RFC3339), ") failed: ", err)
+					return
+				}
+				klog.Errorln("Metering remote write of [", from.Format(time.RFC3339), ", ", to.Format(time.RFC3339), ") is skipped: ", err)
+			}
+		}
+		if _, err := db.Dbpool.Exec(ctx, WATERMARK_UPSERT_QUERY, REMOTE_WRITE_WATERMARK, from, to); err != nil {
+			klog.Errorln(err)
+			return
+		}
+		klog.Infof("Metering remote write [%s, %s) : %d rows", from.Format(time.RFC3339), to.Format(time.RFC3339), len(rows))
+		from = to
+	}
+}
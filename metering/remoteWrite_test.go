@@ -0,0 +1,192 @@
+package metering
+
+import (
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	meteringModel "github.com/tmax-cloud/hypercloud-api-server/metering/model"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// decodeWriteRequest unmarshals prompb.WriteRequest, the reverse of encodeWriteRequest.
+func decodeWriteRequest(t *testing.T, b []byte) []timeSeries {
+	var series []timeSeries
+	forEachField(t, b, func(num protowire.Number, typ protowire.Type, field []byte) {
+		if num != 1 || typ != protowire.BytesType {
+			t.Fatalf("unexpected WriteRequest field %d", num)
+		}
+		var ts timeSeries
+		forEachField(t, field, func(num protowire.Number, typ protowire.Type, field []byte) {
+			switch num {
+			case 1:
+				var l label
+				forEachField(t, field, func(num protowire.Number, typ protowire.Type, field []byte) {
+					if num == 1 {
+						l.name = string(field)
+					} else {
+						l.value = string(field)
+					}
+				})
+				ts.labels = append(ts.labels, l)
+			case 2:
+				var s sample
+				forEachField(t, field, func(num protowire.Number, typ protowire.Type, field []byte) {
+					if num == 1 {
+						v, _ := protowire.ConsumeFixed64(field)
+						s.value = math.Float64frombits(v)
+					} else {
+						v, _ := protowire.ConsumeVarint(field)
+						s.timestamp = int64(v)
+					}
+				})
+				ts.samples = append(ts.samples, s)
+			default:
+				t.Fatalf("unexpected TimeSeries field %d", num)
+			}
+		})
+		series = append(series, ts)
+	})
+	return series
+}
+
+// forEachField calls fn with the contents of each length delimited field, or the raw bytes of a scalar field.
+func forEachField(t *testing.T, b []byte, fn func(protowire.Number, protowire.Type, []byte)) {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			t.Fatal(protowire.ParseError(n))
+		}
+		b = b[n:]
+		var field []byte
+		switch typ {
+		case protowire.BytesType:
+			v, m := protowire.ConsumeBytes(b)
+			if m < 0 {
+				t.Fatal(protowire.ParseError(m))
+			}
+			field, n = v, m
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				t.Fatal(protowire.ParseError(n))
+			}
+			field = b[:n]
+		}
+		fn(num, typ, field)
+		b = b[n:]
+	}
+}
+
+func TestRemoteWriteSend(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var received []timeSeries
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") != "snappy" || r.Header.Get("Content-Type") != "application/x-protobuf" ||
+			r.Header.Get("X-Prometheus-Remote-Write-Version") != "0.1.0" {
+			t.Errorf("unexpected headers %v", r.Header)
+		}
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			t.Errorf("Authorization = %q", r.Header.Get("Authorization"))
+		}
+		compressed, _ := ioutil.ReadAll(r.Body)
+		body, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			t.Errorf("snappy: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received = decodeWriteRequest(t, body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	config := meteringModel.RemoteWriteConfig{ExternalLabels: map[string]string{"cluster": "hub"}}
+	config.Url = server.URL
+	config.BearerTokenFile = tokenFile
+	w := &remoteWriter{config: config, client: server.Client()}
+
+	// metering_time is read as UTC and holds the local wall clock
+	nine := time.Date(2022, 4, 15, 9, 0, 0, 0, time.UTC)
+	ten := time.Date(2022, 4, 15, 10, 0, 0, 0, time.UTC)
+	rows := []meteringModel.Metering{
+		{Namespace: "default", Cpu: 2.5, Memory: 1024, MeteringTime: ten},
+		{Namespace: "default", Cpu: 1.5, Memory: 512, MeteringTime: nine},
+	}
+	if err := w.send(w.rollupSeries(rows)); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(received) != len(exportedMetrics) {
+		t.Fatalf("received %d series, want %d", len(received), len(exportedMetrics))
+	}
+	nineMs := time.Date(2022, 4, 15, 9, 0, 0, 0, time.Local).UnixNano() / int64(time.Millisecond)
+	tenMs := time.Date(2022, 4, 15, 10, 0, 0, 0, time.Local).UnixNano() / int64(time.Millisecond)
+	tests := []struct {
+		metric  string
+		samples []sample
+	}{
+		{"hypercloud_metering_cpu_cores", []sample{{1.5, nineMs}, {2.5, tenMs}}},
+		{"hypercloud_metering_memory_bytes", []sample{{512, nineMs}, {1024, tenMs}}},
+		{"hypercloud_metering_gpu", []sample{{0, nineMs}, {0, tenMs}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.metric, func(t *testing.T) {
+			wantLabels := []label{{"__name__", tt.metric}, {"cluster", "hub"}, {"namespace", "default"}, {"unit", UNIT_HOUR}}
+			for _, ts := range received {
+				if ts.labels[0].value != tt.metric {
+					continue
+				}
+				if !reflect.DeepEqual(ts.labels, wantLabels) {
+					t.Errorf("labels = %v, want %v", ts.labels, wantLabels)
+				}
+				if !reflect.DeepEqual(ts.samples, tt.samples) {
+					t.Errorf("samples = %v, want %v", ts.samples, tt.samples)
+				}
+				return
+			}
+			t.Errorf("series %s is not received", tt.metric)
+		})
+	}
+}
+
+func TestRemoteWriteSendError(t *testing.T) {
+	tests := []struct {
+		name         string
+		status       int
+		wantRejected bool
+	}{
+		{"bad request is rejected", http.StatusBadRequest, true},
+		{"too many requests is retried", http.StatusTooManyRequests, false},
+		{"server error is retried", http.StatusInternalServerError, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+			}))
+			defer server.Close()
+
+			config := meteringModel.RemoteWriteConfig{}
+			config.Url = server.URL
+			w := &remoteWriter{config: config, client: server.Client()}
+			err := w.send([]timeSeries{{labels: []label{{"__name__", "up"}}, samples: []sample{{1, 0}}}})
+			if err == nil {
+				t.Fatal("send() succeeded")
+			}
+			if _, rejected := err.(*remoteWriteError); rejected != tt.wantRejected {
+				t.Errorf("send() error = %v, rejected %v, want %v", err, rejected, tt.wantRejected)
+			}
+		})
+	}
+}
@@ -0,0 +1,324 @@
+package metering
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/tmax-cloud/hypercloud-api-server/util"
+	db "github.com/tmax-cloud/hypercloud-api-server/util/dataFactory"
+	"k8s.io/klog"
+)
+
+const (
+	UNIT_HOUR  = "hour"
+	UNIT_DAY   = "day"
+	UNIT_MONTH = "month"
+	UNIT_YEAR  = "year"
+
+	// any constant shared by every api server replica, so only one of them rolls up at a time
+	rollupLockKey = 7468297
+
+	WATERMARK_CREATE_QUERY = "create table if not exists metering_watermark (unit varchar(16) primary key, watermark timestamp not null, " +
+		"updated_at timestamp not null default now())"
+	WATERMARK_SELECT_QUERY = "select unit, watermark, updated_at from metering_watermark"
+	// a backfill moves the watermark forward only when it starts at or before the current watermark, so no gap is skipped
+	WATERMARK_UPSERT_QUERY = "insert into metering_watermark (unit, watermark, updated_at) values ($1, $3, now()) " +
+		"on conflict (unit) do update set watermark = case when metering_watermark.watermark >= $2 " +
+		"then greatest(metering_watermark.watermark, $3) else metering_watermark.watermark end, updated_at = now()"
+
+	ROLLUP_LOCK_QUERY = "select pg_advisory_xact_lock($1)"
+)
+
+// rollupLevel merges Source into Target by Unit. Levels of a chain are ordered from the finest unit.
+type rollupLevel struct {
+	// Name keys the watermark of the level
+	Name   string
+	Unit   string
+	Source string
+	Target string
+	// Dimension levels also group by the dimension column and run only when a dimension is configured
+	Dimension bool
+}
+
+var rollupLevels = []rollupLevel{
+	{Name: UNIT_HOUR, Unit: UNIT_HOUR, Source: "metering", Target: "metering_hour"},
+	{Name: UNIT_DAY, Unit: UNIT_DAY, Source: "metering_hour", Target: "metering_day"},
+	{Name: UNIT_MONTH, Unit: UNIT_MONTH, Source: "metering_day", Target: "metering_month"},
+	{Name: UNIT_YEAR, Unit: UNIT_YEAR, Source: "metering_month", Target: "metering_year"},
+	{Name: "dimension_" + UNIT_HOUR, Unit: UNIT_HOUR, Source: "metering_dimension", Target: "metering_dimension_hour", Dimension: true},
+	{Name: "dimension_" + UNIT_DAY, Unit: UNIT_DAY, Source: "metering_dimension_hour", Target: "metering_dimension_day", Dimension: true},
+	{Name: "dimension_" + UNIT_MONTH, Unit: UNIT_MONTH, Source: "metering_dimension_day", Target: "metering_dimension_month", Dimension: true},
+	{Name: "dimension_" + UNIT_YEAR, Unit: UNIT_YEAR, Source: "metering_dimension_month", Target: "metering_dimension_year", Dimension: true},
+}
+
+// dimensionTables mirror the namespace tables with one more column, created when a dimension is configured.
+var dimensionTables = [][2]string{
+	{"metering_dimension", "metering"},
+	{"metering_dimension_hour", "metering_hour"},
+	{"metering_dimension_day", "metering_day"},
+	{"metering_dimension_month", "metering_month"},
+	{"metering_dimension_year", "metering_year"},
+}
+
+// rollup of the in-process job and the admin api never overlap
+var rollupMu sync.Mutex
+
+type Watermark struct {
+	Unit string `json:"unit"`
+	// every bucket before Watermark has been rolled up
+	Watermark time.Time `json:"watermark"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+type RollupResult struct {
+	Unit  string    `json:"unit"`
+	From  time.Time `json:"from"`
+	To    time.Time `json:"to"`
+	Rows  int64     `json:"rows"`
+	Error string    `json:"error,omitempty"`
+}
+
+func InitRollup() error {
+	if _, err := db.Dbpool.Exec(context.TODO(), WATERMARK_CREATE_QUERY); err != nil {
+		return err
+	}
+	if dimension == nil {
+		return nil
+	}
+	for _, table := range dimensionTables {
+		if _, err := db.Dbpool.Exec(context.TODO(), "create table if not exists "+table[0]+
+			" (like "+table[1]+" including defaults, dimension varchar(256) not null default '')"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isSupportedUnit(unit string) bool {
+	return unit == UNIT_HOUR || unit == UNIT_DAY || unit == UNIT_MONTH || unit == UNIT_YEAR
+}
+
+// activeLevels returns the levels of unit, or every level when unit is empty, leaving out dimension levels
+// when no dimension is configured.
+func activeLevels(unit string) []rollupLevel {
+	var levels []rollupLevel
+	for _, level := range rollupLevels {
+		if level.Dimension && dimension == nil {
+			continue
+		}
+		if unit == "" || level.Unit == unit {
+			levels = append(levels, level)
+		}
+	}
+	return levels
+}
+
+// truncate returns the start of the bucket of unit containing t, in local time like metering_time.
+func truncate(t time.Time, unit string) time.Time {
+	t = t.In(time.Local)
+	switch unit {
+	case UNIT_HOUR:
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, time.Local)
+	case UNIT_DAY:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.Local)
+	case UNIT_MONTH:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.Local)
+	default:
+		return time.Date(t.Year(), 1, 1, 0, 0, 0, 0, time.Local)
+	}
+}
+
+// ceil returns the end of the bucket of unit containing t, or t itself if it is a bucket boundary.
+func ceil(t time.Time, unit string) time.Time {
+	start := truncate(t, unit)
+	if start.Equal(t) {
+		return start
+	}
+	return nextBucket(start, unit)
+}
+
+// nextBucket returns the start of the bucket of unit following the one starting at start.
+func nextBucket(start time.Time, unit string) time.Time {
+	switch unit {
+	case UNIT_HOUR:
+		return start.Add(time.Hour)
+	case UNIT_DAY:
+		return start.AddDate(0, 0, 1)
+	case UNIT_MONTH:
+		return start.AddDate(0, 1, 0)
+	default:
+		return start.AddDate(1, 0, 0)
+	}
+}
+
+// rollupQuery replaces the buckets of level in [$1, $2) with averages of its source.
+// Ids are derived from namespace and bucket, so recomputing a range produces the same rows.
+func rollupQuery(level rollupLevel) string {
+	column, key, group := "", "", ""
+	if level.Dimension {
+		column, key, group = ", dimension", " || '/' || dimension", ", dimension"
+	}
+	return "insert into " + level.Target + " (id, namespace, cpu, memory, storage, gpu, public_ip, private_ip, traffic_in, traffic_out, metering_time, status" + column + ") " +
+		"select md5(namespace || '/' || date_trunc('" + level.Unit + "', metering_time)::text" + key + ")::uuid, namespace, " +
+		"TRUNC(CAST(AVG(cpu) as numeric), 2), TRUNC(CAST(AVG(memory) as numeric), 0), TRUNC(CAST(AVG(storage) as numeric), 0), " +
+		"TRUNC(CAST(AVG(gpu) as numeric), 2), TRUNC(CAST(AVG(public_ip) as numeric), 0), TRUNC(CAST(AVG(private_ip) as numeric), 0), " +
+		"TRUNC(CAST(AVG(traffic_in) as numeric), 0), TRUNC(CAST(AVG(traffic_out) as numeric), 0), " +
+		"date_trunc('" + level.Unit + "', metering_time), 'Success'" + column + " " +
+		"from " + level.Source + " where metering_time >= $1 and metering_time < $2 " +
+		"group by date_trunc('" + level.Unit + "', metering_time), namespace" + group
+}
+
+// rollup recomputes every bucket of level in [from, to) in one transaction and advances its watermark.
+func rollup(ctx context.Context, level rollupLevel, from time.Time, to time.Time) (int64, error) {
+	tx, err := db.Dbpool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, ROLLUP_LOCK_QUERY, rollupLockKey); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(ctx, "delete from "+level.Target+" where metering_time >= $1 and metering_time < $2", from, to); err != nil {
+		return 0, err
+	}
+	tag, err := tx.Exec(ctx, rollupQuery(level), from, to)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(ctx, WATERMARK_UPSERT_QUERY, level.Name, from, to); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// nextRange returns the buckets of level that are complete at now but not rolled up yet.
+func nextRange(ctx context.Context, level rollupLevel, now time.Time) (time.Time, time.Time, bool, error) {
+	to := truncate(now, level.Unit)
+
+	var from time.Time
+	err := db.Dbpool.QueryRow(ctx, "select watermark from metering_watermark where unit = $1", level.Name).Scan(&from)
+	if err == pgx.ErrNoRows {
+		// first run starts at the oldest source row
+		var oldest *time.Time
+		if err := db.Dbpool.QueryRow(ctx, "select min(metering_time) from "+level.Source).Scan(&oldest); err != nil {
+			return from, to, false, err
+		}
+		if oldest == nil {
+			return from, to, false, nil
+		}
+		from = truncate(util.WallClock(*oldest), level.Unit)
+	} else if err != nil {
+		return from, to, false, err
+	} else {
+		from = util.WallClock(from)
+	}
+	return from, to, from.Before(to), nil
+}
+
+// RollupJob rolls up every bucket completed since the last successful run, so buckets missed while
+// the server was down are caught up. A failed level stops the levels above it in its chain until the next run.
+// Rolled up rows are kept, unlike the merge that deleted them, and are purged by retention (retention.DEFAULT_POLICY).
+// A server down for longer than the retention of a source table can not catch up the buckets already purged.
+func RollupJob() []RollupResult {
+	rollupMu.Lock()
+	defer rollupMu.Unlock()
+
+	ctx := context.TODO()
+	now := time.Now()
+	var results []RollupResult
+	failed := map[bool]bool{}
+	for _, level := range activeLevels("") {
+		if failed[level.Dimension] {
+			continue
+		}
+		from, to, ok, err := nextRange(ctx, level, now)
+		if err != nil {
+			klog.Errorln("Rollup of ", level.Target, " failed: ", err)
+			results = append(results, RollupResult{Unit: level.Name, Error: err.Error()})
+			failed[level.Dimension] = true
+			continue
+		}
+		if !ok {
+			continue
+		}
+		rows, err := rollup(ctx, level, from, to)
+		result := RollupResult{Unit: level.Name, From: from, To: to, Rows: rows}
+		if err != nil {
+			klog.Errorln("Rollup of ", level.Target, " failed: ", err)
+			result.Error = err.Error()
+			results = append(results, result)
+			failed[level.Dimension] = true
+			continue
+		}
+		klog.Infof("Rollup of %s [%s, %s) : %d rows", level.Target, from.Format(time.RFC3339), to.Format(time.RFC3339), rows)
+		results = append(results, result)
+	}
+	return results
+}
+
+// Backfill recomputes [from, to) of unit, or of every unit from hour upward when unit is empty.
+// The range is widened to whole buckets and buckets that are not complete yet are left out.
+func Backfill(unit string, from time.Time, to time.Time) ([]RollupResult, error) {
+	if unit != "" && !isSupportedUnit(unit) {
+		return nil, errors.New("Unit [" + unit + "] is not supported")
+	}
+	levels := activeLevels(unit)
+	if !from.Before(to) {
+		return nil, errors.New("From must be before to")
+	}
+
+	rollupMu.Lock()
+	defer rollupMu.Unlock()
+
+	ctx := context.TODO()
+	now := time.Now()
+	var results []RollupResult
+	for _, level := range levels {
+		start := truncate(from, level.Unit)
+		end := ceil(to, level.Unit)
+		if complete := truncate(now, level.Unit); end.After(complete) {
+			end = complete
+		}
+		if !start.Before(end) {
+			continue
+		}
+		rows, err := rollup(ctx, level, start, end)
+		result := RollupResult{Unit: level.Name, From: start, To: end, Rows: rows}
+		if err != nil {
+			klog.Errorln("Backfill of ", level.Target, " failed: ", err)
+			result.Error = err.Error()
+			results = append(results, result)
+			return results, err
+		}
+		klog.Infof("Backfill of %s [%s, %s) : %d rows", level.Target, start.Format(time.RFC3339), end.Format(time.RFC3339), rows)
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func getWatermarks() ([]Watermark, error) {
+	rows, err := db.Dbpool.Query(context.TODO(), WATERMARK_SELECT_QUERY)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	watermarks := []Watermark{}
+	for rows.Next() {
+		var w Watermark
+		if err := rows.Scan(&w.Unit, &w.Watermark, &w.UpdatedAt); err != nil {
+			return nil, err
+		}
+		w.Watermark = util.WallClock(w.Watermark)
+		w.UpdatedAt = util.WallClock(w.UpdatedAt)
+		watermarks = append(watermarks, w)
+	}
+	return watermarks, rows.Err()
+}
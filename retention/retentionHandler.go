@@ -0,0 +1,35 @@
+package retention
+
+import (
+	"net/http"
+
+	"github.com/tmax-cloud/hypercloud-api-server/util"
+	"github.com/tmax-cloud/hypercloud-api-server/util/caller"
+)
+
+// Get shows the retention policy, partitions and last purge result of every table.
+func Get(res http.ResponseWriter, req *http.Request) {
+	if !caller.IsAdmin(res, req) {
+		return
+	}
+	util.SetResponse(res, "", Status(), http.StatusOK)
+}
+
+// Post starts purging expired rows now and returns without waiting. With ?table=, only that table is purged.
+// GET shows the result once the purge is done.
+func Post(res http.ResponseWriter, req *http.Request) {
+	if !caller.IsAdmin(res, req) {
+		return
+	}
+	table := req.URL.Query().Get("table")
+	if table != "" && findPolicy(table) == nil {
+		util.SetResponse(res, "Retention of table ["+table+"] is not supported", nil, http.StatusBadRequest)
+		return
+	}
+
+	if err := start(table); err != nil {
+		util.SetResponse(res, err.Error(), nil, http.StatusConflict)
+		return
+	}
+	util.SetResponse(res, "Retention job is started", nil, http.StatusAccepted)
+}
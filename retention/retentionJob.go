@@ -0,0 +1,519 @@
+package retention
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	db "github.com/tmax-cloud/hypercloud-api-server/util/dataFactory"
+	auditDataFactory "github.com/tmax-cloud/hypercloud-api-server/util/dataFactory/audit"
+	"k8s.io/klog"
+)
+
+const (
+	INTERVAL_DAY   = "day"
+	INTERVAL_MONTH = "month"
+	INTERVAL_YEAR  = "year"
+
+	// partitions are created this many intervals ahead of now
+	partitionsAhead = 2
+	// rows deleted per statement on tables that are not partitioned
+	deleteBatchSize = 10000
+
+	// DEFAULT_POLICY purges metering rows once the next unit has rolled them up, since the rollup keeps its source rows.
+	// Readers set the lower bounds: metering_hour covers hourly invoices of the last month (32 days), and
+	// metering_day covers metering.MAX_FORECAST_HISTORY (730 days) of forecasts and the completed days of budgets.
+	// A shorter policy makes those reads return less than they ask for.
+	DEFAULT_POLICY = "metering=2,metering_hour=32,metering_day=731,metering_month=731," +
+		"metering_dimension=2,metering_dimension_hour=32,metering_dimension_day=731,metering_dimension_month=731"
+
+	EXISTS_QUERY         = "select to_regclass($1) is not null"
+	PARTITIONED_QUERY    = "select exists (select 1 from pg_partitioned_table p join pg_class c on c.oid = p.partrelid where c.relname = $1)"
+	PARTITION_LIST_QUERY = "select c.relname from pg_inherits i join pg_class c on c.oid = i.inhrelid " +
+		"join pg_class p on p.oid = i.inhparent where p.relname = $1 order by c.relname"
+)
+
+var (
+	// Set by flags in main.go
+	// Policy is a comma separated list of <table>=<days>, e.g. audit=90,metering_hour=30
+	Policy string
+	// ArchivePath is where purged audit rows are written as gzip compressed NDJSON. Empty disables archiving.
+	ArchivePath string
+
+	running int32
+	mu      sync.Mutex
+)
+
+type policy struct {
+	Table      string
+	TimeColumn string
+	// Interval is the range of one partition
+	Interval string
+	Days     int
+}
+
+// policies lists every table retention can manage. Days 0 keeps rows forever.
+//
+// The api server creates these tables without partitions, and retention never converts a table, since that
+// rewrites every row. Expired rows of such a table are deleted in batches. To drop whole partitions instead,
+// recreate the table while the api server is stopped, e.g. for metering_hour:
+//
+//	alter table metering_hour rename to metering_hour_old;
+//	create table metering_hour (like metering_hour_old including defaults) partition by range (metering_time);
+//	-- start the api server once to create the partitions, then
+//	insert into metering_hour select * from metering_hour_old;
+//
+// Rows older than the first partition need a partition created by hand before they are copied.
+var policies = []*policy{
+	{Table: "audit", TimeColumn: "stagetimestamp", Interval: INTERVAL_DAY},
+	{Table: "metering", TimeColumn: "metering_time", Interval: INTERVAL_DAY},
+	{Table: "metering_hour", TimeColumn: "metering_time", Interval: INTERVAL_DAY},
+	{Table: "metering_day", TimeColumn: "metering_time", Interval: INTERVAL_MONTH},
+	{Table: "metering_month", TimeColumn: "metering_time", Interval: INTERVAL_YEAR},
+	{Table: "metering_year", TimeColumn: "metering_time", Interval: INTERVAL_YEAR},
+	{Table: "metering_dimension", TimeColumn: "metering_time", Interval: INTERVAL_DAY},
+	{Table: "metering_dimension_hour", TimeColumn: "metering_time", Interval: INTERVAL_DAY},
+	{Table: "metering_dimension_day", TimeColumn: "metering_time", Interval: INTERVAL_MONTH},
+	{Table: "metering_dimension_month", TimeColumn: "metering_time", Interval: INTERVAL_YEAR},
+	{Table: "metering_dimension_year", TimeColumn: "metering_time", Interval: INTERVAL_YEAR},
+}
+
+type TableStatus struct {
+	Table             string    `json:"table"`
+	RetentionDays     int       `json:"retentionDays"`
+	Partitioned       bool      `json:"partitioned"`
+	Partitions        []string  `json:"partitions,omitempty"`
+	LastRun           time.Time `json:"lastRun,omitempty"`
+	Cutoff            time.Time `json:"cutoff,omitempty"`
+	DeletedRows       int64     `json:"deletedRows"`
+	DroppedPartitions []string  `json:"droppedPartitions,omitempty"`
+	Archives          []string  `json:"archives,omitempty"`
+	Message           string    `json:"message,omitempty"`
+	Error             string    `json:"error,omitempty"`
+}
+
+// last result of each table, guarded by mu
+var statuses = map[string]*TableStatus{}
+
+// InitPolicy parses Policy. Tables that are not listed keep their rows forever.
+func InitPolicy() error {
+	for _, p := range policies {
+		p.Days = 0
+	}
+	for _, item := range strings.Split(Policy, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			return errors.New("Retention policy [" + item + "] must be <table>=<days>")
+		}
+		p := findPolicy(strings.TrimSpace(kv[0]))
+		if p == nil {
+			return errors.New("Retention of table [" + kv[0] + "] is not supported")
+		}
+		days, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSpace(kv[1]), "d"))
+		if err != nil || days < 0 {
+			return errors.New("Retention days of [" + kv[0] + "] must be a non-negative number")
+		}
+		p.Days = days
+	}
+	for _, p := range policies {
+		klog.Infof("Retention of %s : %d days", p.Table, p.Days)
+	}
+	return nil
+}
+
+func findPolicy(table string) *policy {
+	for _, p := range policies {
+		if p.Table == table {
+			return p
+		}
+	}
+	return nil
+}
+
+// Days returns the retention days of table, 0 if its rows are kept forever.
+func Days(table string) int {
+	if p := findPolicy(table); p != nil {
+		return p.Days
+	}
+	return 0
+}
+
+// RetentionJob creates upcoming partitions and purges expired rows of every table.
+func RetentionJob() {
+	if err := run(""); err != nil {
+		klog.Errorln(err)
+	}
+}
+
+// run purges table, or every table if table is empty. Only one run is allowed at a time.
+func run(table string) error {
+	if !atomic.CompareAndSwapInt32(&running, 0, 1) {
+		return errAlreadyRunning
+	}
+	defer atomic.StoreInt32(&running, 0)
+
+	purgeTables(table)
+	return nil
+}
+
+// start runs the purge of table in the background, failing at once if a run is already going on.
+func start(table string) error {
+	if !atomic.CompareAndSwapInt32(&running, 0, 1) {
+		return errAlreadyRunning
+	}
+	go func() {
+		defer atomic.StoreInt32(&running, 0)
+		purgeTables(table)
+	}()
+	return nil
+}
+
+func purgeTables(table string) {
+	for _, p := range policies {
+		if table != "" && p.Table != table {
+			continue
+		}
+		status := purge(p)
+		if status.Error != "" {
+			klog.Errorln("Retention of "+p.Table+" failed: ", status.Error)
+		} else {
+			klog.Infof("Retention of %s: %d rows deleted, %d partitions dropped", p.Table, status.DeletedRows, len(status.DroppedPartitions))
+		}
+		mu.Lock()
+		statuses[p.Table] = status
+		mu.Unlock()
+	}
+}
+
+var errAlreadyRunning = errors.New("Retention job is already running")
+
+func purge(p *policy) *TableStatus {
+	status := &TableStatus{
+		Table:         p.Table,
+		RetentionDays: p.Days,
+		LastRun:       time.Now(),
+	}
+	if p.Table == "audit" && auditDataFactory.StoreBackend == auditDataFactory.BACKEND_ELASTICSEARCH {
+		status.Error = "audit is stored in elasticsearch, use an index lifecycle policy instead"
+		return status
+	}
+
+	ctx := context.TODO()
+	// dimension tables exist only when a dimension is configured
+	var exists bool
+	if err := db.Dbpool.QueryRow(ctx, EXISTS_QUERY, p.Table).Scan(&exists); err != nil {
+		status.Error = err.Error()
+		return status
+	} else if !exists {
+		return status
+	}
+	if err := db.Dbpool.QueryRow(ctx, PARTITIONED_QUERY, p.Table).Scan(&status.Partitioned); err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	if status.Partitioned {
+		if err := ensurePartitions(p); err != nil {
+			status.Error = err.Error()
+			return status
+		}
+	} else {
+		status.Message = "Table is not partitioned, expired rows are deleted in batches. Recreate it partitioned by " +
+			p.TimeColumn + " to drop partitions instead"
+	}
+	if p.Days == 0 {
+		return status
+	}
+	status.Cutoff = time.Now().AddDate(0, 0, -p.Days)
+
+	var err error
+	if status.Partitioned {
+		err = dropPartitions(p, status)
+	}
+	if err == nil {
+		err = deleteRows(p, status)
+	}
+	if err != nil {
+		status.Error = err.Error()
+	}
+	return status
+}
+
+func truncate(t time.Time, interval string) time.Time {
+	switch interval {
+	case INTERVAL_MONTH:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+	case INTERVAL_YEAR:
+		return time.Date(t.Year(), 1, 1, 0, 0, 0, 0, t.Location())
+	default:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	}
+}
+
+func next(t time.Time, interval string) time.Time {
+	switch interval {
+	case INTERVAL_MONTH:
+		return t.AddDate(0, 1, 0)
+	case INTERVAL_YEAR:
+		return t.AddDate(1, 0, 0)
+	default:
+		return t.AddDate(0, 0, 1)
+	}
+}
+
+func partitionName(table string, start time.Time) string {
+	return table + "_p" + start.Format("20060102")
+}
+
+// ensurePartitions creates the partitions for the current and upcoming intervals.
+// Table names come from policies and bounds are formatted dates, so the statement has no user input.
+func ensurePartitions(p *policy) error {
+	start := truncate(time.Now(), p.Interval)
+	for i := 0; i <= partitionsAhead; i++ {
+		end := next(start, p.Interval)
+		q := "create table if not exists " + partitionName(p.Table, start) + " partition of " + p.Table +
+			" for values from ('" + start.Format("2006-01-02 15:04:05") + "') to ('" + end.Format("2006-01-02 15:04:05") + "')"
+		if _, err := db.Dbpool.Exec(context.TODO(), q); err != nil {
+			return err
+		}
+		start = end
+	}
+	return nil
+}
+
+func listPartitions(table string) ([]string, error) {
+	rows, err := db.Dbpool.Query(context.TODO(), PARTITION_LIST_QUERY, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	partitions := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		partitions = append(partitions, name)
+	}
+	return partitions, rows.Err()
+}
+
+// dropPartitions detaches and drops partitions that end before the cutoff.
+// Only partitions named by ensurePartitions are considered.
+func dropPartitions(p *policy, status *TableStatus) error {
+	partitions, err := listPartitions(p.Table)
+	if err != nil {
+		return err
+	}
+	pattern := regexp.MustCompile("^" + p.Table + `_p(\d{8})$`)
+	for _, partition := range partitions {
+		match := pattern.FindStringSubmatch(partition)
+		if match == nil {
+			continue
+		}
+		start, err := time.ParseInLocation("20060102", match[1], time.Local)
+		if err != nil || next(start, p.Interval).After(status.Cutoff) {
+			continue
+		}
+
+		// the partition is archived, detached and dropped in one transaction
+		ctx := context.TODO()
+		var selectRows func(pgx.Tx) (pgx.Rows, error)
+		if p.Table == "audit" {
+			q := "select row_to_json(t)::text from (select a.*, b.body from " + partition + " a left join audit_body b on b.id = a.id) t"
+			selectRows = func(tx pgx.Tx) (pgx.Rows, error) {
+				return tx.Query(ctx, q)
+			}
+		}
+		if err := archive(p.Table, partition, status, selectRows, func(tx pgx.Tx) error {
+			if p.Table == "audit" {
+				// body rows are keyed by audit id and go away with their events
+				if _, err := tx.Exec(ctx, "delete from audit_body where id in (select id from "+partition+")"); err != nil {
+					return err
+				}
+			}
+			if _, err := tx.Exec(ctx, "alter table "+p.Table+" detach partition "+partition); err != nil {
+				return err
+			}
+			_, err := tx.Exec(ctx, "drop table "+partition)
+			return err
+		}); err != nil {
+			return err
+		}
+		status.DroppedPartitions = append(status.DroppedPartitions, partition)
+	}
+	return nil
+}
+
+// deleteRows deletes the remaining expired rows.
+// Tables that are not partitioned are deleted in batches to keep transactions short.
+func deleteRows(p *policy, status *TableStatus) error {
+	ctx := context.TODO()
+	var q string
+	if status.Partitioned {
+		// ctid is not unique across partitions, so rows of a partitioned table are deleted at once
+		q = "delete from " + p.Table + " where " + p.TimeColumn + " < $1"
+	} else {
+		q = "delete from " + p.Table + " where ctid = any(array(select ctid from " + p.Table +
+			" where " + p.TimeColumn + " < $1 limit " + strconv.Itoa(deleteBatchSize) + "))"
+	}
+
+	if p.Table != "audit" {
+		for {
+			tag, err := db.Dbpool.Exec(ctx, q, status.Cutoff)
+			if err != nil {
+				return err
+			}
+			status.DeletedRows += tag.RowsAffected()
+			if status.Partitioned || tag.RowsAffected() < deleteBatchSize {
+				return nil
+			}
+		}
+	}
+
+	// audit rows are deleted with their bodies and written to the archive in the same transaction
+	q = "with d as (" + q + " returning *), b as (delete from audit_body where id in (select id from d) returning id, body) " +
+		"select row_to_json(t)::text from (select d.*, b.body from d left join b on b.id = d.id) t"
+	for {
+		before := status.DeletedRows
+		if err := archive(p.Table, "", status, func(tx pgx.Tx) (pgx.Rows, error) {
+			return tx.Query(ctx, q, status.Cutoff)
+		}, nil); err != nil {
+			return err
+		}
+		if status.Partitioned || status.DeletedRows-before < deleteBatchSize {
+			return nil
+		}
+	}
+}
+
+// archive runs selectRows and then after in one transaction, writing every selected row to a gzip compressed
+// NDJSON file first when ArchivePath is set. The transaction is rolled back if the file can not be written.
+// selectRows and after may be nil.
+func archive(table string, partition string, status *TableStatus, selectRows func(pgx.Tx) (pgx.Rows, error), after func(pgx.Tx) error) error {
+	ctx := context.TODO()
+	tx, err := db.Dbpool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	// Rollback is a no-op after a successful Commit
+	defer tx.Rollback(ctx)
+
+	var file *os.File
+	var gz *gzip.Writer
+	var fileName string
+	if ArchivePath != "" && selectRows != nil {
+		if err := os.MkdirAll(ArchivePath, os.ModePerm); err != nil {
+			return err
+		}
+		name := partition
+		if name == "" {
+			name = table + "-" + time.Now().Format("20060102150405.000000")
+		}
+		fileName = filepath.Join(ArchivePath, name+".ndjson.gz")
+		if file, err = os.OpenFile(fileName, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644); err != nil {
+			return err
+		}
+		defer file.Close()
+		gz = gzip.NewWriter(file)
+	}
+
+	var count int64
+	if selectRows != nil {
+		rows, err := selectRows(tx)
+		if err != nil {
+			return removeArchive(fileName, err)
+		}
+		for rows.Next() {
+			var line string
+			if err := rows.Scan(&line); err != nil {
+				rows.Close()
+				return removeArchive(fileName, err)
+			}
+			if gz != nil {
+				if _, err := gz.Write([]byte(line + "\n")); err != nil {
+					rows.Close()
+					return removeArchive(fileName, err)
+				}
+			}
+			count++
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return removeArchive(fileName, err)
+		}
+	}
+
+	if after != nil {
+		if err := after(tx); err != nil {
+			return removeArchive(fileName, err)
+		}
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return removeArchive(fileName, err)
+		}
+		if err := file.Sync(); err != nil {
+			return removeArchive(fileName, err)
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return removeArchive(fileName, err)
+	}
+
+	if partition == "" {
+		status.DeletedRows += count
+	}
+	if fileName != "" {
+		if count == 0 {
+			os.Remove(fileName)
+		} else {
+			status.Archives = append(status.Archives, fileName)
+		}
+	}
+	return nil
+}
+
+func removeArchive(fileName string, err error) error {
+	if fileName != "" {
+		os.Remove(fileName)
+	}
+	return err
+}
+
+// Status returns the retention state of every table with its current partitions.
+// The last results are copied under mu and the partitions are listed without it, so a slow query does not hold up a purge.
+func Status() []TableStatus {
+	mu.Lock()
+	result := []TableStatus{}
+	for _, p := range policies {
+		status := TableStatus{Table: p.Table}
+		if last, ok := statuses[p.Table]; ok {
+			status = *last
+		}
+		status.RetentionDays = p.Days
+		result = append(result, status)
+	}
+	mu.Unlock()
+
+	for i := range result {
+		if partitions, err := listPartitions(result[i].Table); err == nil && len(partitions) > 0 {
+			result[i].Partitioned = true
+			result[i].Partitions = partitions
+		}
+	}
+	return result
+}
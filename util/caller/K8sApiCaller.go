@@ -5,10 +5,12 @@ import (
 	"context"
 	"encoding/json"
 	"io"
+	"net/http"
 	"os"
 	"reflect"
 	"strings"
 	"sync"
+	"time"
 
 	configv1alpha1 "github.com/tmax-cloud/efk-operator/api/v1alpha1"
 	alertModel "github.com/tmax-cloud/hypercloud-api-server/alert/model"
@@ -18,13 +20,17 @@ import (
 	claimsv1alpha1 "github.com/tmax-cloud/hypercloud-multi-operator/apis/claim/v1alpha1"
 	clusterv1alpha1 "github.com/tmax-cloud/hypercloud-multi-operator/apis/cluster/v1alpha1"
 	claim "github.com/tmax-cloud/hypercloud-single-operator/api/v1alpha1"
+	authnApi "k8s.io/api/authentication/v1"
 	authApi "k8s.io/api/authorization/v1"
 	corev1 "k8s.io/api/core/v1"
 	rbacApi "k8s.io/api/rbac/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 	restclient "k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/remotecommand"
 	"k8s.io/klog"
 	"k8s.io/kubectl/pkg/scheme"
@@ -62,6 +68,12 @@ func init() {
 	// creates the in-cluster config
 	var err error
 	config, err = restclient.InClusterConfig()
+	if err == restclient.ErrNotInCluster {
+		// only unit tests load this package outside of a cluster, and they do not call the api server.
+		// main stops when Clientset is nil, as this init used to
+		klog.Errorln(err)
+		return
+	}
 	if err != nil {
 		panic(err.Error())
 	}
@@ -558,17 +570,34 @@ func GetPodListByLabel(label string, namespace string) (corev1.PodList, bool) {
 
 	return *podList, true
 }
-func CreateAlert(body alertModel.Alert, ns string) {
-	bodyByte, _ := json.Marshal(body)
-	// data, err := Clientset.RESTClient().Get().AbsPath("/apis/claim.tmax.io/v1alpha1/namespaceclaims").Param(util.QUERY_PARAMETER_LABEL_SELECTOR, labelSelector).DoRaw(context.TODO())
+func CreateAlert(body alertModel.Alert, ns string) error {
+	bodyByte, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	return Clientset.RESTClient().Post().AbsPath("/apis/tmax.io/v1/namespaces/" + ns + "/alerts").Body(bodyByte).Do(context.TODO()).Error()
+}
 
-	data := Clientset.RESTClient().Post().AbsPath("/apis/tmax.io/v1/namespaces/" + ns + "/alerts").Body(bodyByte).Do(context.TODO())
-	klog.Infoln(data)
-	// if err != nil {
-	//    klog.Errorln(err)
-	//    panic(err)
-	// }
-	//return data
+// GetAlertByName returns the alert, or an error that errors.IsNotFound reports when there is none.
+func GetAlertByName(name string, ns string) (*alertModel.Alert, error) {
+	data, err := Clientset.RESTClient().Get().AbsPath("/apis/tmax.io/v1/namespaces/" + ns + "/alerts/" + name).DoRaw(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+	var alert alertModel.Alert
+	if err := json.Unmarshal(data, &alert); err != nil {
+		return nil, err
+	}
+	return &alert, nil
+}
+
+// UpdateAlert replaces the alert. body must carry the resourceVersion it was read with.
+func UpdateAlert(body alertModel.Alert, ns string) error {
+	bodyByte, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	return Clientset.RESTClient().Put().AbsPath("/apis/tmax.io/v1/namespaces/" + ns + "/alerts/" + body.Name).Body(bodyByte).Do(context.TODO()).Error()
 }
 
 func GetAlert(name string, ns string, label string) alertModel.Alert {
@@ -631,6 +660,54 @@ func CreateSubjectAccessReview(userId string, userGroups []string, group string,
 	return sarResult, nil
 }
 
+// IsAdmin allows users who can list namespaces, the same check used for cluster wide audit access.
+// It writes the error response itself, so the handler only returns when it is false.
+func IsAdmin(res http.ResponseWriter, req *http.Request) bool {
+	queryParams := req.URL.Query()
+	userId := queryParams.Get(util.QUERY_PARAMETER_USER_ID)
+	userGroups := queryParams[util.QUERY_PARAMETER_USER_GROUP]
+
+	if userId == "" {
+		msg := "UserId is empty."
+		klog.Infoln(msg)
+		util.SetResponse(res, msg, nil, http.StatusBadRequest)
+		return false
+	}
+
+	sar, err := CreateSubjectAccessReview(userId, userGroups, "", "namespaces", "", "", "list")
+	if err != nil {
+		klog.Errorln(err)
+		util.SetResponse(res, "", nil, http.StatusInternalServerError)
+		return false
+	}
+	if !sar.Status.Allowed {
+		util.SetResponse(res, "Not authorized", nil, http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// CreateTokenReview asks the api server who the bearer token belongs to.
+// An unauthenticated token is returned as an error.
+func CreateTokenReview(token string) (*authnApi.UserInfo, error) {
+	tr := &authnApi.TokenReview{
+		Spec: authnApi.TokenReviewSpec{
+			Token: token,
+		},
+	}
+
+	trResult, err := Clientset.AuthenticationV1().TokenReviews().Create(context.TODO(), tr, metav1.CreateOptions{})
+	if err != nil {
+		klog.Errorln(err)
+		return nil, err
+	}
+	if !trResult.Status.Authenticated {
+		return nil, errors.NewUnauthorized("token is not authenticated: " + trResult.Status.Error)
+	}
+
+	return &trResult.Status.User, nil
+}
+
 func AdmitClusterClaim(userId string, userGroups []string, clusterClaim *claimsv1alpha1.ClusterClaim, admit bool, reason string) (*claimsv1alpha1.ClusterClaim, error) {
 
 	clusterClaimStatusUpdateRuleResult, err := CreateSubjectAccessReview(userId, userGroups, util.CLAIM_API_GROUP, "clusterclaims/status", clusterClaim.Namespace, clusterClaim.Name, "update")
@@ -959,6 +1036,7 @@ func CreateCLMRole(clusterManager *clusterv1alpha1.ClusterManager, subject strin
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      roleName,
 			Namespace: clusterManager.Namespace,
+			Labels:    map[string]string{util.CLUSTER_MEMBER_LABEL: clusterManager.Name},
 			OwnerReferences: []metav1.OwnerReference{
 				{
 					APIVersion:         util.CLUSTER_API_GROUP_VERSION,
@@ -978,7 +1056,8 @@ func CreateCLMRole(clusterManager *clusterv1alpha1.ClusterManager, subject strin
 		},
 	}
 
-	if _, err := Clientset.RbacV1().Roles(clusterManager.Namespace).Create(context.TODO(), role, metav1.CreateOptions{}); err != nil {
+	// 이전에 일부만 생성된 경우 남은 것만 생성
+	if _, err := Clientset.RbacV1().Roles(clusterManager.Namespace).Create(context.TODO(), role, metav1.CreateOptions{}); err != nil && !errors.IsAlreadyExists(err) {
 		klog.Errorln(err)
 		return err
 	}
@@ -986,6 +1065,7 @@ func CreateCLMRole(clusterManager *clusterv1alpha1.ClusterManager, subject strin
 	roleBinding.ObjectMeta = metav1.ObjectMeta{
 		Name:      roleBindingName,
 		Namespace: clusterManager.Namespace,
+		Labels:    map[string]string{util.CLUSTER_MEMBER_LABEL: clusterManager.Name},
 		OwnerReferences: []metav1.OwnerReference{
 			{
 				APIVersion:         util.CLUSTER_API_GROUP_VERSION,
@@ -1003,7 +1083,7 @@ func CreateCLMRole(clusterManager *clusterv1alpha1.ClusterManager, subject strin
 		Name:     roleName,
 	}
 
-	if _, err := Clientset.RbacV1().RoleBindings(clusterManager.Namespace).Create(context.TODO(), roleBinding, metav1.CreateOptions{}); err != nil {
+	if _, err := Clientset.RbacV1().RoleBindings(clusterManager.Namespace).Create(context.TODO(), roleBinding, metav1.CreateOptions{}); err != nil && !errors.IsAlreadyExists(err) {
 		klog.Errorln(err)
 		return err
 	}
@@ -1028,7 +1108,6 @@ func DeleteCLMRole(clusterManager *clusterv1alpha1.ClusterManager, subject strin
 	if _, err := Clientset.RbacV1().Roles(clusterManager.Namespace).Get(context.TODO(), roleName, metav1.GetOptions{}); err != nil {
 		if errors.IsNotFound(err) {
 			klog.Infoln("Role [" + roleName + "] is already deleted. pass")
-			return nil
 		} else {
 			klog.Errorln("Error: Get clusterrole [" + roleName + "] is failed")
 			return err
@@ -1059,6 +1138,36 @@ func DeleteCLMRole(clusterManager *clusterv1alpha1.ClusterManager, subject strin
 
 }
 
+// ExistCLMRole tells if subject has the clustermanager rolebinding of clusterManager.
+func ExistCLMRole(clusterManager *clusterv1alpha1.ClusterManager, subject string, attribute string) (bool, error) {
+	var roleBindingName string
+	if attribute == "user" {
+		roleBindingName = subject + "-user-" + clusterManager.Name + "-clm-rolebinding"
+	} else {
+		roleBindingName = subject + "-group-" + clusterManager.Name + "-clm-rolebinding"
+	}
+	if _, err := Clientset.RbacV1().RoleBindings(clusterManager.Namespace).Get(context.TODO(), roleBindingName, metav1.GetOptions{}); err != nil {
+		if errors.IsNotFound(err) {
+			return false, nil
+		}
+		klog.Errorln(err)
+		return false, err
+	}
+	return true, nil
+}
+
+// ListCLMRoleBindings returns the clustermanager rolebindings created for the members of clusterManager.
+func ListCLMRoleBindings(clusterManager *clusterv1alpha1.ClusterManager) ([]rbacApi.RoleBinding, error) {
+	roleBindingList, err := Clientset.RbacV1().RoleBindings(clusterManager.Namespace).List(context.TODO(), metav1.ListOptions{
+		LabelSelector: util.CLUSTER_MEMBER_LABEL + "=" + clusterManager.Name,
+	})
+	if err != nil {
+		klog.Errorln(err)
+		return nil, err
+	}
+	return roleBindingList.Items, nil
+}
+
 // defunct
 // func GetConsoleService(namespace string, name string) (*corev1.Service, error) {
 // 	result, err := Clientset.CoreV1().Services(namespace).Get(context.TODO(), name, metav1.GetOptions{})
@@ -1169,6 +1278,51 @@ func DeleteNSGetRole(clusterManager *clusterv1alpha1.ClusterManager, subject str
 	return nil
 }
 
+// ExistNSGetRole tells if subject has the namespace get rolebinding in the namespace of clusterManager.
+func ExistNSGetRole(clusterManager *clusterv1alpha1.ClusterManager, subject string, attribute string) (bool, error) {
+	var roleBindingName string
+	if attribute == "user" {
+		roleBindingName = subject + "-user-ns-get-rolebinding"
+	} else {
+		roleBindingName = subject + "-group-ns-get-rolebinding"
+	}
+	if _, err := Clientset.RbacV1().RoleBindings(clusterManager.Namespace).Get(context.TODO(), roleBindingName, metav1.GetOptions{}); err != nil {
+		if errors.IsNotFound(err) {
+			return false, nil
+		}
+		klog.Errorln(err)
+		return false, err
+	}
+	return true, nil
+}
+
+// ListAllClusterManagers returns the clustermanagers of every namespace, without access review.
+func ListAllClusterManagers() ([]clusterv1alpha1.ClusterManager, error) {
+	clmList, err := customClientset.ClusterV1alpha1().ClusterManagers("").List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		klog.Errorln(err)
+		return nil, err
+	}
+	return clmList.Items, nil
+}
+
+// NewClusterManagerInformer returns an informer on the clustermanagers of every namespace.
+func NewClusterManagerInformer(resyncPeriod time.Duration) cache.SharedIndexInformer {
+	return cache.NewSharedIndexInformer(
+		&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return customClientset.ClusterV1alpha1().ClusterManagers("").List(context.TODO(), options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				return customClientset.ClusterV1alpha1().ClusterManagers("").Watch(context.TODO(), options)
+			},
+		},
+		&clusterv1alpha1.ClusterManager{},
+		resyncPeriod,
+		cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc},
+	)
+}
+
 func CreateClusterManager(clusterClaim *claimsv1alpha1.ClusterClaim) (*clusterv1alpha1.ClusterManager, error) {
 	clm := &clusterv1alpha1.ClusterManager{
 		ObjectMeta: metav1.ObjectMeta{
@@ -2,23 +2,26 @@ package caller
 
 import (
 	"context"
+	"fmt"
+	"sort"
+	"strings"
 
 	"k8s.io/apimachinery/pkg/api/errors"
 
+	"github.com/tmax-cloud/hypercloud-api-server/util"
 	clusterv1alpha1 "github.com/tmax-cloud/hypercloud-multi-operator/apis/cluster/v1alpha1"
 	rbacv1 "k8s.io/api/rbac/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
-	restclient "k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/klog"
 )
 
-var remoteClientset *kubernetes.Clientset
-var remoteRestConfig *restclient.Config
-
-func CreateRoleInRemote(clusterManager *clusterv1alpha1.ClusterManager, subject string, remoteRole string, attribute string) error {
-	if remoteRole == "admin" {
+// CreateRoleInRemote binds subject to the ClusterRole remoteRole in the remote cluster.
+// With remoteNamespaces the role is bound by a RoleBinding in each of them, otherwise by a ClusterRoleBinding.
+func CreateRoleInRemote(clusterManager *clusterv1alpha1.ClusterManager, subject string, remoteRole string, attribute string, remoteNamespaces []string) error {
+	// namespace 단위의 admin은 기본 ClusterRole admin, 클러스터 전체의 admin은 cluster-admin
+	if remoteRole == "admin" && len(remoteNamespaces) == 0 {
 		remoteRole = "cluster-admin"
 	}
 	remoteClientset, err := getRemoteK8sClient(clusterManager)
@@ -26,13 +29,11 @@ func CreateRoleInRemote(clusterManager *clusterv1alpha1.ClusterManager, subject
 		return err
 	}
 
-	// var clusterRoleName string
 	var clusterRoleBindingName string
-	clusterRoleBinding := &rbacv1.ClusterRoleBinding{}
+	var subjects []rbacv1.Subject
 	if attribute == "user" {
-		// clusterRoleName = subject + "-user-" + clusterManager.Name + "-clm-role"
 		clusterRoleBindingName = subject + "-user-rolebinding"
-		clusterRoleBinding.Subjects = []rbacv1.Subject{
+		subjects = []rbacv1.Subject{
 			{
 				APIGroup: "rbac.authorization.k8s.io",
 				Kind:     "User",
@@ -40,9 +41,8 @@ func CreateRoleInRemote(clusterManager *clusterv1alpha1.ClusterManager, subject
 			},
 		}
 	} else {
-		// clusterRoleName = subject + "-group-" + clusterManager.Name + "-clm-role"
 		clusterRoleBindingName = subject + "-group-rolebinding"
-		clusterRoleBinding.Subjects = []rbacv1.Subject{
+		subjects = []rbacv1.Subject{
 			{
 				APIGroup: "rbac.authorization.k8s.io",
 				Kind:     "Group",
@@ -50,25 +50,51 @@ func CreateRoleInRemote(clusterManager *clusterv1alpha1.ClusterManager, subject
 			},
 		}
 	}
-
-	clusterRoleBinding.ObjectMeta = metav1.ObjectMeta{
-		Name: clusterRoleBindingName,
-	}
-	clusterRoleBinding.RoleRef = rbacv1.RoleRef{
+	roleRef := rbacv1.RoleRef{
 		APIGroup: "rbac.authorization.k8s.io",
 		Kind:     "ClusterRole",
 		Name:     remoteRole,
 	}
 
-	if _, err := remoteClientset.RbacV1().ClusterRoleBindings().Create(context.TODO(), clusterRoleBinding, metav1.CreateOptions{}); err != nil {
-		klog.Errorln(err)
-		return err
+	if len(remoteNamespaces) == 0 {
+		clusterRoleBinding := &rbacv1.ClusterRoleBinding{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   clusterRoleBindingName,
+				Labels: map[string]string{util.CLUSTER_MEMBER_LABEL: clusterManager.Name},
+			},
+			Subjects: subjects,
+			RoleRef:  roleRef,
+		}
+		if _, err := remoteClientset.RbacV1().ClusterRoleBindings().Create(context.TODO(), clusterRoleBinding, metav1.CreateOptions{}); err != nil {
+			klog.Errorln(err)
+			return err
+		}
+		msg := "Create clusterrole [" + remoteRole + "] to remote cluster [" + clusterManager.Name + "] for subject [" + subject + "] "
+		klog.Infoln(msg)
+		return nil
+	}
+
+	for _, remoteNamespace := range remoteNamespaces {
+		roleBinding := &rbacv1.RoleBinding{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      clusterRoleBindingName,
+				Namespace: remoteNamespace,
+				Labels:    map[string]string{util.CLUSTER_MEMBER_LABEL: clusterManager.Name},
+			},
+			Subjects: subjects,
+			RoleRef:  roleRef,
+		}
+		if _, err := remoteClientset.RbacV1().RoleBindings(remoteNamespace).Create(context.TODO(), roleBinding, metav1.CreateOptions{}); err != nil {
+			klog.Errorln(err)
+			return err
+		}
 	}
-	msg := "Create clusterrole [" + remoteRole + "] to remote cluster [" + clusterManager.Name + "] for subject [" + subject + "] "
+	msg := "Create clusterrole [" + remoteRole + "] to namespaces [" + strings.Join(remoteNamespaces, ", ") + "] of remote cluster [" + clusterManager.Name + "] for subject [" + subject + "] "
 	klog.Infoln(msg)
 	return nil
 }
 
+// RemoveRoleFromRemote removes the ClusterRoleBinding and the RoleBindings of subject from the remote cluster.
 func RemoveRoleFromRemote(clusterManager *clusterv1alpha1.ClusterManager, subject string, attribute string) error {
 	remoteClientset, err := getRemoteK8sClient(clusterManager)
 	if err != nil {
@@ -86,13 +112,23 @@ func RemoveRoleFromRemote(clusterManager *clusterv1alpha1.ClusterManager, subjec
 	if _, err := remoteClientset.RbacV1().ClusterRoleBindings().Get(context.TODO(), clusterRoleBindingName, metav1.GetOptions{}); err != nil {
 		if errors.IsNotFound(err) {
 			klog.Infoln("Rolebinding [" + clusterRoleBindingName + "] is already deleted")
-			return nil
 		} else {
 			klog.Errorln(err)
 			return err
 		}
 	} else {
-		if err := remoteClientset.RbacV1().ClusterRoleBindings().Delete(context.TODO(), clusterRoleBindingName, metav1.DeleteOptions{}); err != nil {
+		if err := remoteClientset.RbacV1().ClusterRoleBindings().Delete(context.TODO(), clusterRoleBindingName, metav1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+			klog.Errorln(err)
+			return err
+		}
+	}
+
+	roleBindings, err := listRoleBindingsInRemote(remoteClientset, clusterManager, clusterRoleBindingName)
+	if err != nil {
+		return err
+	}
+	for _, roleBinding := range roleBindings {
+		if err := remoteClientset.RbacV1().RoleBindings(roleBinding.Namespace).Delete(context.TODO(), roleBinding.Name, metav1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
 			klog.Errorln(err)
 			return err
 		}
@@ -103,21 +139,110 @@ func RemoveRoleFromRemote(clusterManager *clusterv1alpha1.ClusterManager, subjec
 	return nil
 }
 
+// GetRoleInRemote returns the remote role of subject and the namespaces it is bound in, as CreateRoleInRemote takes them.
+// The role is empty when subject has no role, and the namespaces are empty when the role is cluster-wide.
+func GetRoleInRemote(clusterManager *clusterv1alpha1.ClusterManager, subject string, attribute string) (string, []string, error) {
+	remoteClientset, err := getRemoteK8sClient(clusterManager)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var clusterRoleBindingName string
+	if attribute == "user" {
+		clusterRoleBindingName = subject + "-user-rolebinding"
+	} else {
+		clusterRoleBindingName = subject + "-group-rolebinding"
+	}
+
+	clusterRoleBinding, err := remoteClientset.RbacV1().ClusterRoleBindings().Get(context.TODO(), clusterRoleBindingName, metav1.GetOptions{})
+	if err == nil {
+		if clusterRoleBinding.RoleRef.Name == "cluster-admin" {
+			return "admin", nil, nil
+		}
+		return clusterRoleBinding.RoleRef.Name, nil, nil
+	} else if !errors.IsNotFound(err) {
+		klog.Errorln(err)
+		return "", nil, err
+	}
+
+	roleBindings, err := listRoleBindingsInRemote(remoteClientset, clusterManager, clusterRoleBindingName)
+	if err != nil {
+		return "", nil, err
+	}
+	var remoteRole string
+	remoteNamespaces := []string{}
+	for _, roleBinding := range roleBindings {
+		// namespace마다 role이 다르면 어느 role과도 같지 않도록 합쳐서 반환
+		if remoteRole != "" && remoteRole != roleBinding.RoleRef.Name {
+			return roleBinding.RoleRef.Name + "," + remoteRole, nil, nil
+		}
+		remoteRole = roleBinding.RoleRef.Name
+		remoteNamespaces = append(remoteNamespaces, roleBinding.Namespace)
+	}
+	if remoteRole == "" {
+		return "", nil, nil
+	}
+	sort.Strings(remoteNamespaces)
+	return remoteRole, remoteNamespaces, nil
+}
+
+// ListRoleBindingsInRemote returns the ClusterRoleBindings and the RoleBindings created in the remote cluster for the members of clusterManager.
+func ListRoleBindingsInRemote(clusterManager *clusterv1alpha1.ClusterManager) ([]rbacv1.ClusterRoleBinding, []rbacv1.RoleBinding, error) {
+	remoteClientset, err := getRemoteK8sClient(clusterManager)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	clusterRoleBindingList, err := remoteClientset.RbacV1().ClusterRoleBindings().List(context.TODO(), metav1.ListOptions{
+		LabelSelector: util.CLUSTER_MEMBER_LABEL + "=" + clusterManager.Name,
+	})
+	if err != nil {
+		klog.Errorln(err)
+		return nil, nil, err
+	}
+	roleBindings, err := listRoleBindingsInRemote(remoteClientset, clusterManager, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	return clusterRoleBindingList.Items, roleBindings, nil
+}
+
+// listRoleBindingsInRemote returns the RoleBindings of every namespace created for the members of clusterManager, only those named name if it is not empty.
+func listRoleBindingsInRemote(remoteClientset *kubernetes.Clientset, clusterManager *clusterv1alpha1.ClusterManager, name string) ([]rbacv1.RoleBinding, error) {
+	listOptions := metav1.ListOptions{
+		LabelSelector: util.CLUSTER_MEMBER_LABEL + "=" + clusterManager.Name,
+	}
+	if name != "" {
+		listOptions.FieldSelector = "metadata.name=" + name
+	}
+	roleBindingList, err := remoteClientset.RbacV1().RoleBindings("").List(context.TODO(), listOptions)
+	if err != nil {
+		klog.Errorln(err)
+		return nil, err
+	}
+	return roleBindingList.Items, nil
+}
+
 func getRemoteK8sClient(clusterManager *clusterv1alpha1.ClusterManager) (*kubernetes.Clientset, error) {
 	if remoteKubeconfig, err := Clientset.CoreV1().Secrets(clusterManager.Namespace).Get(context.TODO(), clusterManager.Name+"-kubeconfig", metav1.GetOptions{}); err == nil {
-		if value, ok := remoteKubeconfig.Data["value"]; ok {
-			remoteClientConfig, err := clientcmd.NewClientConfigFromBytes(value)
-			if err != nil {
-				klog.Errorln(err)
-				return nil, err
-			}
-			remoteRestConfig, err = remoteClientConfig.ClientConfig()
-			if err != nil {
-				klog.Errorln(err)
-				return nil, err
-			}
+		// 여러 worker와 handler가 동시에 부르므로 clientset은 호출마다 따로 만듦
+		value, ok := remoteKubeconfig.Data["value"]
+		if !ok {
+			err := fmt.Errorf("kubeconfig secret of cluster [%s] has no value", clusterManager.Name)
+			klog.Errorln(err)
+			return nil, err
+		}
+		remoteClientConfig, err := clientcmd.NewClientConfigFromBytes(value)
+		if err != nil {
+			klog.Errorln(err)
+			return nil, err
+		}
+		remoteRestConfig, err := remoteClientConfig.ClientConfig()
+		if err != nil {
+			klog.Errorln(err)
+			return nil, err
 		}
-		remoteClientset, err = kubernetes.NewForConfig(remoteRestConfig)
+		remoteClientset, err := kubernetes.NewForConfig(remoteRestConfig)
 		if err != nil {
 			klog.Errorln(err)
 			return nil, err
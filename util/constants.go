@@ -41,6 +41,8 @@ const (
 	CLUSTER_API_Kind            = "clustermanagers"
 	CLUSTER_API_GROUP_VERSION   = "cluster.tmax.io/v1alpha1"
 	HYPERCLOUD_SYSTEM_NAMESPACE = "hypercloud5-system"
+	// rolebindings created for cluster members are labeled with the name of their clustermanager
+	CLUSTER_MEMBER_LABEL = "cluster.tmax.io/member-of"
 
 	GRAFANA_URI = "grafana.monitoring.svc.cluster.local:3000/"
 	TEST        = "<!DOCTYPE html>\r\n" +
@@ -105,7 +105,7 @@ func HyperauthConsumer() {
 
 	client, err := sarama.NewConsumerGroup([]string{kafka1_addr}, consumerGroupId, consumerConfig)
 	if err != nil {
-		klog.Errorln("Error creating consumer group client: %v", err)
+		klog.Errorln("Error creating consumer group client: ", err)
 		time.Sleep(time.Minute * 1)
 		panic("Try Reconnection to Kafka...")
 	}
@@ -120,7 +120,7 @@ func HyperauthConsumer() {
 			// server-side rebalance happens, the consumer session will need to be
 			// recreated to get the new claims
 			if err := client.Consume(ctx, []string{topic}, &consumer); err != nil {
-				klog.Error("Error from consumer: %v", err)
+				klog.Errorln("Error from consumer: ", err)
 			}
 			// check if context was cancelled, signaling that the consumer should stop
 			if ctx.Err() != nil {
@@ -258,13 +258,7 @@ func (consumer *Consumer) ConsumeClaim(session sarama.ConsumerGroupSession, clai
 					Time: time.Unix(int64(topicEvent.Time/1000), 0),
 				},
 			}
-			if len(haudit.EventBuffer.Buffer) < haudit.BufferSize {
-				if len(haudit.EventBuffer.Buffer) < haudit.BufferSize {
-					haudit.EventBuffer.Buffer <- event
-				} else {
-					klog.Error("###########   event is dropped.     ############")
-				}
-			}
+			haudit.Enqueue(event)
 
 		case "LOGOUT":
 			klog.Info("LOGOUT")
@@ -290,13 +284,7 @@ func (consumer *Consumer) ConsumeClaim(session sarama.ConsumerGroupSession, clai
 					Time: time.Unix(int64(topicEvent.Time/1000), 0),
 				},
 			}
-			if len(haudit.EventBuffer.Buffer) < haudit.BufferSize {
-				if len(haudit.EventBuffer.Buffer) < haudit.BufferSize {
-					haudit.EventBuffer.Buffer <- event
-				} else {
-					klog.Error("###########   event is dropped.     ############")
-				}
-			}
+			haudit.Enqueue(event)
 
 		case "LOGIN_ERROR":
 			klog.Info("LOGIN_ERROR")
@@ -324,13 +312,7 @@ func (consumer *Consumer) ConsumeClaim(session sarama.ConsumerGroupSession, clai
 					Time: time.Unix(int64(topicEvent.Time/1000), 0),
 				},
 			}
-			if len(haudit.EventBuffer.Buffer) < haudit.BufferSize {
-				if len(haudit.EventBuffer.Buffer) < haudit.BufferSize {
-					haudit.EventBuffer.Buffer <- event
-				} else {
-					klog.Error("###########   event is dropped.     ############")
-				}
-			}
+			haudit.Enqueue(event)
 
 		default:
 			// klog.Info("Unknown Event Published from Hyperauth, Do nothing!")
@@ -0,0 +1,114 @@
+package audit
+
+import (
+	"encoding/json"
+	"strings"
+
+	"k8s.io/apiserver/pkg/apis/audit"
+	"k8s.io/klog"
+)
+
+const (
+	BODY_SIDE_REQUEST  = "request"
+	BODY_SIDE_RESPONSE = "response"
+
+	JSON_OP_EQUAL     = "="
+	JSON_OP_NOT_EQUAL = "!="
+	JSON_OP_EXISTS    = "exists"
+)
+
+var (
+	// Set by flags in main.go
+	// BodyResourceList is a comma separated list of resources whose request/response bodies are stored.
+	// Bodies are not stored at all unless a resource is listed here.
+	BodyResourceList string
+	BodyMaxBytes     int
+
+	bodyResources = map[string]bool{}
+)
+
+// Bodies of these resources (or subresources) are never stored, even if they are listed in BodyResourceList.
+var bodyDeniedResources = []string{"secrets", "tokenreviews", "token", "subjectaccessreviews", "selfsubjectaccessreviews", "localsubjectaccessreviews"}
+
+// JsonCondition compares the value at Path in the request or response body.
+// Path segments are validated by the caller and passed to the backend as query arguments.
+type JsonCondition struct {
+	Side  string
+	Path  []string
+	Op    string
+	Value string
+}
+
+// JsonFilter selects stored bodies. A nil Namespaces means all namespaces.
+type JsonFilter struct {
+	Conditions []JsonCondition
+	Namespaces []string
+	Limit      int
+	Offset     int
+}
+
+// storedBody is the document saved in audit_body.body.
+type storedBody struct {
+	Request  json.RawMessage `json:"request,omitempty"`
+	Response json.RawMessage `json:"response,omitempty"`
+	// Omitted lists the sides that were dropped because they exceeded BodyMaxBytes.
+	Omitted []string `json:"omitted,omitempty"`
+}
+
+func initBodyResources() {
+	bodyResources = map[string]bool{}
+	for _, resource := range strings.Split(BodyResourceList, ",") {
+		resource = strings.TrimSpace(resource)
+		if resource == "" {
+			continue
+		}
+		if isBodyDenied(resource) {
+			klog.Infoln("Audit body of [" + resource + "] is never stored")
+			continue
+		}
+		bodyResources[resource] = true
+	}
+	klog.Infoln("Audit body resources : ", BodyResourceList)
+}
+
+func isBodyDenied(resource string) bool {
+	for _, denied := range bodyDeniedResources {
+		if resource == denied {
+			return true
+		}
+	}
+	return false
+}
+
+// bodyOf returns the body document to store for event, or nil if the event has none or its resource is not opted in.
+func bodyOf(event audit.Event) []byte {
+	if event.ObjectRef == nil || !bodyResources[event.ObjectRef.Resource] || isBodyDenied(event.ObjectRef.Subresource) {
+		return nil
+	}
+
+	body := storedBody{}
+	if event.RequestObject != nil && json.Valid(event.RequestObject.Raw) {
+		if BodyMaxBytes > 0 && len(event.RequestObject.Raw) > BodyMaxBytes {
+			body.Omitted = append(body.Omitted, BODY_SIDE_REQUEST)
+		} else {
+			body.Request = event.RequestObject.Raw
+		}
+	}
+	if event.ResponseObject != nil && json.Valid(event.ResponseObject.Raw) {
+		if BodyMaxBytes > 0 && len(event.ResponseObject.Raw) > BodyMaxBytes {
+			body.Omitted = append(body.Omitted, BODY_SIDE_RESPONSE)
+		} else {
+			body.Response = event.ResponseObject.Raw
+		}
+	}
+	if body.Request == nil && body.Response == nil && body.Omitted == nil {
+		return nil
+	}
+
+	b, err := json.Marshal(body)
+	if err != nil {
+		klog.Error(err)
+		return nil
+	}
+	return b
+}
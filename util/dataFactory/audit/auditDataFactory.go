@@ -3,10 +3,17 @@ package audit
 import (
 	"context"
 	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/jackc/pgx/v4"
+	"github.com/tmax-cloud/hypercloud-api-server/util"
 	//hypercloudAudit "github.com/tmax-cloud/hypercloud-api-server/audit"
 
 	db "github.com/tmax-cloud/hypercloud-api-server/util/dataFactory"
+	"github.com/tmax-cloud/hypercloud-api-server/util/dataFactory/query"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apiserver/pkg/apis/audit"
 	"k8s.io/klog"
@@ -19,16 +26,19 @@ type ClaimListResponse struct {
 }
 
 type Claim struct {
-	Id        string `json:"id"`
-	Namespace string `json:"namespace"`
-	Body      string `json:"body"`
+	Id             string    `json:"id"`
+	Namespace      string    `json:"namespace"`
+	Username       string    `json:"username"`
+	Verb           string    `json:"verb"`
+	Resource       string    `json:"resource"`
+	Name           string    `json:"name"`
+	StageTimestamp time.Time `json:"stageTimestamp"`
+	Body           string    `json:"body"`
 }
 
-var pg_con_info string
-
 const (
-	AUDIT_INSERT_QUERY = "INSERT INTO audit (ID, USERNAME, USERAGENT , NAMESPACE , APIGROUP , APIVERSION , RESOURCE , NAME , STAGE , STAGETIMESTAMP , VERB, CODE , STATUS , REASON , MESSAGE ) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)"
-	//AUDIT_BODY_INSERT_QUERY = "INSERT INTO audit_body (ID, NAMESPACE, BODY ) VALUES ($1, $2, $3)"
+	AUDIT_INSERT_QUERY      = "INSERT INTO audit (ID, USERNAME, USERAGENT , NAMESPACE , APIGROUP , APIVERSION , RESOURCE , NAME , STAGE , STAGETIMESTAMP , VERB, CODE , STATUS , REASON , MESSAGE ) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15) ON CONFLICT DO NOTHING"
+	AUDIT_BODY_INSERT_QUERY = "INSERT INTO audit_body (ID, NAMESPACE, BODY ) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING"
 )
 
 func NewNullString(s string) sql.NullString {
@@ -41,39 +51,35 @@ func NewNullString(s string) sql.NullString {
 	}
 }
 
-func Insert(items []audit.Event) {
+type postgresStore struct{}
+
+func (s *postgresStore) Insert(items []audit.Event) (err error) {
 	defer func() {
 		if v := recover(); v != nil {
 			klog.Errorln("capture a panic:", v)
+			err = fmt.Errorf("%v", v)
 		}
 	}()
 
-	// //create batch
-	// batch := &pgx.Batch{}
-	// numInserts := len(items)
-
-	// //load insert statements into batch queue
-	// for _, event := range items {
-	// 	batch.Queue(AUDIT_INSERT_QUERY,
-	// 		event.AuditID,
-	// 		event.User.Username,
-	// 		event.UserAgent,
-	// 		NewNullString(event.ObjectRef.Namespace),
-	// 		NewNullString(event.ObjectRef.APIGroup),
-	// 		NewNullString(event.ObjectRef.APIVersion),
-	// 		event.ObjectRef.Resource,
-	// 		event.ObjectRef.Name,
-	// 		event.Stage,
-	// 		event.StageTimestamp.Time,
-	// 		event.Verb,
-	// 		event.ResponseStatus.Code,
-	// 		event.ResponseStatus.Status,
-	// 		event.ResponseStatus.Reason,
-	// 		event.ResponseStatus.Message)
-	// }
+	ctx := context.TODO()
+	tx, err := db.Dbpool.Begin(ctx)
+	if err != nil {
+		klog.Error(err)
+		return err
+	}
+	// Rollback is a no-op after a successful Commit
+	defer tx.Rollback(ctx)
 
+	// load insert statements into batch queue
+	batch := &pgx.Batch{}
 	for _, event := range items {
-		_, err := db.Dbpool.Exec(context.TODO(), AUDIT_INSERT_QUERY,
+		if event.ObjectRef == nil {
+			event.ObjectRef = &audit.ObjectReference{}
+		}
+		if event.ResponseStatus == nil {
+			event.ResponseStatus = &metav1.Status{}
+		}
+		batch.Queue(AUDIT_INSERT_QUERY,
 			event.AuditID,
 			event.User.Username,
 			event.UserAgent,
@@ -90,135 +96,289 @@ func Insert(items []audit.Event) {
 			event.ResponseStatus.Reason,
 			event.ResponseStatus.Message)
 
-		if err != nil {
-			klog.Error(err)
+		if body := bodyOf(event); body != nil {
+			batch.Queue(AUDIT_BODY_INSERT_QUERY, event.AuditID, NewNullString(event.ObjectRef.Namespace), string(body))
 		}
 	}
 
-	// Insert Request Body
-	/*
-		for _, event := range items {
-			_, err = db.Dbpool.Exec(context.TODO(), AUDIT_BODY_INSERT_QUERY,
-				event.AuditID,
-				NewNullString(event.ObjectRef.Namespace),
-				event.RequestObject.Raw)
-
-			if err != nil {
-				klog.Error(err)
-			}
+	// send batch in the transaction and execute statements in batch queue
+	br := tx.SendBatch(ctx, batch)
+	for i := 0; i < batch.Len(); i++ {
+		if _, err = br.Exec(); err != nil {
+			klog.Error(err)
+			br.Close()
+			return err
 		}
-	*/
-
-	// //send batch to connection pool
-	// br := db.Dbpool.SendBatch(context.TODO(), batch)
-	// //execute statements in batch queue
-	// for i := 0; i < numInserts; i++ {
-	// 	_, err := br.Exec()
-	// 	if err != nil {
-	// 		klog.Errorln(err)
-	// 		// os.Exit(1)
-	// 	}
-	// }
-	// // klog.Infoln("Successfully batch inserted data n")
-
-	// //Compare length of results slice to size of table
-	// klog.Infof("size of results: %d\n", numInserts)
-	// //check size of table for number of rows inserted
-	// // result of last SELECT statement
-	// var rowsInserted int
-	// err := br.QueryRow().Scan(&rowsInserted)
-	// klog.Infof("size of table: %d\n", rowsInserted)
-
-	// err = br.Close()
-	// if err != nil {
-	// 	klog.Errorf("Unable to closer batch %v\n", err)
-	// }
+	}
+	if err = br.Close(); err != nil {
+		klog.Error(err)
+		return err
+	}
+	if err = tx.Commit(ctx); err != nil {
+		klog.Error(err)
+		return err
+	}
+
 	klog.Info("Affected rows: ", len(items))
+	return nil
+}
+
+func (s *postgresStore) buildQuery(selectClause string, filter Filter) *query.Builder {
+	qb := query.New(selectClause)
+
+	if !filter.StartTime.IsZero() && !filter.EndTime.IsZero() {
+		qb.Where("stagetimestamp between to_timestamp(?) and to_timestamp(?)", filter.StartTime.Unix(), filter.EndTime.Unix())
+	}
+	if filter.Namespace != "" {
+		qb.Eq("namespace", filter.Namespace)
+	}
+	if filter.Namespaces != nil {
+		qb.In("namespace", filter.Namespaces)
+	}
+	if filter.Resource != "" {
+		qb.Eq("resource", filter.Resource)
+	}
+	if filter.Status != "" {
+		qb.Eq("status", filter.Status)
+	}
+	if filter.Verb != "" {
+		qb.Eq("verb", filter.Verb)
+	}
+	if filter.Username != "" {
+		qb.Eq("username", filter.Username)
+	}
+	if filter.CodeClass != 0 {
+		qb.Between("code", filter.CodeClass, filter.CodeClass+99)
+	}
+	return qb
 }
 
-func Get(query string) (audit.EventList, int64) {
+func (s *postgresStore) Query(filter Filter) (eventList audit.EventList, err error) {
 	defer func() {
 		if v := recover(); v != nil {
 			klog.Errorln("capture a panic:", v)
+			err = fmt.Errorf("%v", v)
 		}
 	}()
 
-	rows, err := db.Dbpool.Query(context.TODO(), query)
+	eventList = audit.EventList{}
+	eventList.Kind = "EventList"
+	eventList.APIVersion = "audit.k8s.io/v1"
+
+	qb := s.buildQuery("select * from audit", filter)
+	qb.OrderBy(filter.Sort, query.Order{Column: "stagetimestamp", Desc: true}).Page(filter.Limit, filter.Offset)
+	q, args := qb.Build()
+	klog.Info("query: ", q)
+
+	rows, err := db.Dbpool.Query(context.TODO(), q, args...)
 	if err != nil {
 		klog.Error(err)
+		return eventList, err
 	}
 	defer rows.Close()
 
-	eventList := audit.EventList{}
-	var row_count int64
 	for rows.Next() {
-		var temp_namespace, temp_apigroup, temp_apiversion sql.NullString
-		event := audit.Event{
-			ObjectRef:      &audit.ObjectReference{},
-			ResponseStatus: &metav1.Status{},
+		event, err := scanEvent(rows)
+		if err != nil {
+			klog.Error(err)
+			return eventList, err
 		}
-		err := rows.Scan(
-			&event.AuditID,
-			&event.User.Username,
-			&event.UserAgent,
-			&temp_namespace,  //&event.ObjectRef.Namespace,
-			&temp_apigroup,   //&event.ObjectRef.APIGroup,
-			&temp_apiversion, //&event.ObjectRef.APIVersion,
-			&event.ObjectRef.Resource,
-			&event.ObjectRef.Name,
-			&event.Stage,
-			&event.StageTimestamp.Time,
-			&event.Verb,
-			&event.ResponseStatus.Code,
-			&event.ResponseStatus.Status,
-			&event.ResponseStatus.Reason,
-			&event.ResponseStatus.Message,
-			&row_count)
+		eventList.Items = append(eventList.Items, event)
+	}
+
+	return eventList, rows.Err()
+}
+
+// scanEvent reads a row of "select * from audit".
+func scanEvent(rows pgx.Rows) (audit.Event, error) {
+	var temp_namespace, temp_apigroup, temp_apiversion sql.NullString
+	event := audit.Event{
+		ObjectRef:      &audit.ObjectReference{},
+		ResponseStatus: &metav1.Status{},
+	}
+	err := rows.Scan(
+		&event.AuditID,
+		&event.User.Username,
+		&event.UserAgent,
+		&temp_namespace,  //&event.ObjectRef.Namespace,
+		&temp_apigroup,   //&event.ObjectRef.APIGroup,
+		&temp_apiversion, //&event.ObjectRef.APIVersion,
+		&event.ObjectRef.Resource,
+		&event.ObjectRef.Name,
+		&event.Stage,
+		&event.StageTimestamp.Time,
+		&event.Verb,
+		&event.ResponseStatus.Code,
+		&event.ResponseStatus.Status,
+		&event.ResponseStatus.Reason,
+		&event.ResponseStatus.Message)
+	event.ObjectRef.Namespace = temp_namespace.String
+	event.ObjectRef.APIGroup = temp_apigroup.String
+	event.ObjectRef.APIVersion = temp_apiversion.String
+	return event, err
+}
+
+// Stream reads the result through a server side cursor, STREAM_FETCH_SIZE rows at a time.
+func (s *postgresStore) Stream(filter Filter, fn func(audit.Event) error) error {
+	ctx := context.TODO()
+	tx, err := db.Dbpool.BeginTx(ctx, pgx.TxOptions{AccessMode: pgx.ReadOnly})
+	if err != nil {
+		klog.Error(err)
+		return err
+	}
+	// the cursor is closed with the transaction
+	defer tx.Rollback(ctx)
+
+	qb := s.buildQuery("select * from audit", filter)
+	qb.OrderBy(filter.Sort, query.Order{Column: "stagetimestamp", Desc: true})
+	q, args := qb.Build()
+	klog.Info("query: ", q)
+
+	if _, err := tx.Exec(ctx, "declare audit_stream no scroll cursor for "+q, args...); err != nil {
+		klog.Error(err)
+		return err
+	}
+	for {
+		rows, err := tx.Query(ctx, "fetch "+strconv.Itoa(STREAM_FETCH_SIZE)+" from audit_stream")
 		if err != nil {
-			rows.Close()
 			klog.Error(err)
+			return err
 		}
-		if temp_namespace.Valid {
-			event.ObjectRef.Namespace = temp_namespace.String
-		} else {
-			event.ObjectRef.Namespace = ""
+		fetched := 0
+		for rows.Next() {
+			event, err := scanEvent(rows)
+			if err == nil {
+				err = fn(event)
+			}
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			fetched++
 		}
-
-		if temp_apigroup.Valid {
-			event.ObjectRef.APIGroup = temp_apigroup.String
-		} else {
-			event.ObjectRef.APIGroup = ""
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			klog.Error(err)
+			return err
 		}
-
-		if temp_apiversion.Valid {
-			event.ObjectRef.APIVersion = temp_apiversion.String
-		} else {
-			event.ObjectRef.APIVersion = ""
+		if fetched < STREAM_FETCH_SIZE {
+			return nil
 		}
-		eventList.Items = append(eventList.Items, event)
 	}
-	eventList.Kind = "EventList"
-	eventList.APIVersion = "audit.k8s.io/v1"
+}
 
-	return eventList, row_count
+func (s *postgresStore) Count(filter Filter) (int64, error) {
+	var count int64
+	q, args := s.buildQuery("select count(*) from audit", filter).Build()
+	if err := db.Dbpool.QueryRow(context.TODO(), q, args...).Scan(&count); err != nil {
+		klog.Error(err)
+		return 0, err
+	}
+	return count, nil
 }
 
-func GetByJson(jquery string) ClaimListResponse {
-	defer func() {
-		if v := recover(); v != nil {
-			klog.Errorln("capture a panic:", v)
+func (s *postgresStore) Stats(filter Filter, groupBy []string, interval string) ([]StatBucket, error) {
+	buckets := []StatBucket{}
+
+	// expressions come from this switch only, interval is checked against StatIntervals by the caller
+	columns := []string{}
+	for _, group := range groupBy {
+		switch group {
+		case STAT_GROUP_CODE:
+			columns = append(columns, "(code / 100) * 100")
+		case STAT_GROUP_TIME:
+			columns = append(columns, "date_trunc('"+interval+"', stagetimestamp)")
+		default:
+			columns = append(columns, group)
 		}
-	}()
+	}
 
-	klog.Infoln("query =", jquery)
+	qb := s.buildQuery("select "+strings.Join(append(append([]string{}, columns...), "count(*)"), ", ")+" from audit", filter)
+	qb.GroupBy(columns...)
+	if util.Contains(groupBy, STAT_GROUP_TIME) {
+		qb.OrderBy([]query.Order{{Column: "date_trunc('" + interval + "', stagetimestamp)"}}, query.Order{Column: "count(*)", Desc: true})
+	} else {
+		qb.OrderBy(nil, query.Order{Column: "count(*)", Desc: true})
+	}
+	qb.Page(filter.Limit, filter.Offset)
+	q, args := qb.Build()
+	klog.Info("query: ", q)
 
-	rows, err := db.Dbpool.Query(context.TODO(), jquery)
+	rows, err := db.Dbpool.Query(context.TODO(), q, args...)
 	if err != nil {
 		klog.Error(err)
+		return buckets, err
 	}
 	defer rows.Close()
 
+	for rows.Next() {
+		var bucket StatBucket
+		var namespace sql.NullString
+		var timestamp time.Time
+		dest := []interface{}{}
+		for _, group := range groupBy {
+			switch group {
+			case STAT_GROUP_VERB:
+				dest = append(dest, &bucket.Verb)
+			case STAT_GROUP_RESOURCE:
+				dest = append(dest, &bucket.Resource)
+			case STAT_GROUP_USERNAME:
+				dest = append(dest, &bucket.Username)
+			case STAT_GROUP_NAMESPACE:
+				dest = append(dest, &namespace)
+			case STAT_GROUP_CODE:
+				dest = append(dest, &bucket.CodeClass)
+			case STAT_GROUP_TIME:
+				dest = append(dest, &timestamp)
+			}
+		}
+		dest = append(dest, &bucket.Count)
+		if err := rows.Scan(dest...); err != nil {
+			klog.Error(err)
+			return buckets, err
+		}
+		bucket.Namespace = namespace.String
+		if util.Contains(groupBy, STAT_GROUP_TIME) {
+			bucket.Time = &timestamp
+		}
+		buckets = append(buckets, bucket)
+	}
+	return buckets, rows.Err()
+}
+
+func (s *postgresStore) BodyByJson(filter JsonFilter) (ClaimListResponse, error) {
 	var claimList ClaimListResponse
+
+	qb := query.New("select b.id, b.namespace, a.username, a.verb, a.resource, a.name, a.stagetimestamp, b.body " +
+		"from audit_body b join audit a on a.id = b.id")
+	if filter.Namespaces != nil {
+		qb.In("b.namespace", filter.Namespaces)
+	}
+	for _, cond := range filter.Conditions {
+		// body #>> '{a,b,c}' is equivalent to body -> 'a' -> 'b' ->> 'c'
+		path := append([]string{cond.Side}, cond.Path...)
+		switch cond.Op {
+		case JSON_OP_EQUAL:
+			qb.Where("b.body #>> ? = ?", path, cond.Value)
+		case JSON_OP_NOT_EQUAL:
+			qb.Where("b.body #>> ? is distinct from ?", path, cond.Value)
+		case JSON_OP_EXISTS:
+			qb.Where("b.body #> ? is not null", path)
+		default:
+			return claimList, fmt.Errorf("unknown operator [%s]", cond.Op)
+		}
+	}
+	qb.OrderBy(nil, query.Order{Column: "a.stagetimestamp", Desc: true}).Page(filter.Limit, filter.Offset)
+	q, args := qb.Build()
+	klog.Infoln("query =", q)
+
+	rows, err := db.Dbpool.Query(context.TODO(), q, args...)
+	if err != nil {
+		klog.Error(err)
+		return claimList, err
+	}
+	defer rows.Close()
+
 	for rows.Next() {
 		var claim Claim
 		var namespace sql.NullString
@@ -226,57 +386,50 @@ func GetByJson(jquery string) ClaimListResponse {
 		err := rows.Scan(
 			&claim.Id,
 			&namespace,
+			&claim.Username,
+			&claim.Verb,
+			&claim.Resource,
+			&claim.Name,
+			&claim.StageTimestamp,
 			&claim.Body)
 		if err != nil {
-			rows.Close()
 			klog.Error(err)
+			return claimList, err
 		}
-		if namespace.Valid {
-			claim.Namespace = namespace.String
-		} else {
-			claim.Namespace = ""
-		}
-		//claim.Body = strings.Replace(claim.Body, "\\", "", -1)
+		claim.Namespace = namespace.String
 
 		claimList.Claims = append(claimList.Claims, claim)
 	}
-	return claimList
+	claimList.RowsCount = int64(len(claimList.Claims))
+	return claimList, rows.Err()
 }
 
-func GetMemberList(query string) ([]string, int64) {
-	defer func() {
-		if v := recover(); v != nil {
-			klog.Errorln("capture a panic:", v)
-		}
-	}()
+func (s *postgresStore) MemberSuggestions(search string, username string) ([]string, error) {
+	memberList := []string{}
 
-	db, err := sql.Open("postgres", pg_con_info)
-	if err != nil {
-		klog.Error(err)
+	qb := query.New("select username, count(*) from audit")
+	if username != "" {
+		qb.Eq("username", username)
 	}
-	defer db.Close()
+	qb.Like("username", search).GroupBy("username").OrderBy(nil, query.Order{Column: "count", Desc: true}).Page(5, 0)
+	q, args := qb.Build()
+	klog.Info("query: ", q)
 
-	rows, err := db.Query(query)
+	rows, err := db.Dbpool.Query(context.TODO(), q, args...)
 	if err != nil {
 		klog.Error(err)
+		return memberList, err
 	}
 	defer rows.Close()
 
-	// var memberList []string
-	memberList := []string{}
-	var row_count int64
-
 	for rows.Next() {
 		var member string
-		err := rows.Scan(
-			&member,
-			&row_count)
-		if err != nil {
-			rows.Close()
+		var count int64
+		if err := rows.Scan(&member, &count); err != nil {
 			klog.Error(err)
+			return memberList, err
 		}
 		memberList = append(memberList, member)
 	}
-
-	return memberList, row_count
+	return memberList, rows.Err()
 }
@@ -0,0 +1,125 @@
+package audit
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/tmax-cloud/hypercloud-api-server/util/dataFactory/query"
+	"k8s.io/apiserver/pkg/apis/audit"
+	"k8s.io/klog"
+)
+
+const (
+	BACKEND_POSTGRES      = "postgres"
+	BACKEND_ELASTICSEARCH = "elasticsearch"
+
+	// STREAM_FETCH_SIZE is the number of events Stream reads from a backend at a time
+	STREAM_FETCH_SIZE = 1000
+
+	// ES_MAX_RESULT_WINDOW is the default index.max_result_window. Elasticsearch fails pages past it.
+	ES_MAX_RESULT_WINDOW = 10000
+)
+
+var (
+	// Set by flags in main.go
+	StoreBackend       string
+	ElasticsearchURL   string
+	ElasticsearchIndex string
+
+	Store AuditStore = &postgresStore{}
+)
+
+// Filter is the backend independent form of the audit list query parameters.
+// Zero values mean "no condition".
+type Filter struct {
+	Namespace string
+	// Namespaces restricts events to these namespaces if not nil
+	Namespaces []string
+	Resource   string
+	Status     string
+	Verb       string
+	Username   string
+	// CodeClass is the lower bound of a status code class (e.g. 400 matches 400~499)
+	CodeClass int32
+	StartTime time.Time
+	EndTime   time.Time
+	Sort      []query.Order
+	Limit     int
+	Offset    int
+}
+
+// AuditStore persists audit events and answers the queries behind the /audit APIs.
+type AuditStore interface {
+	Insert(items []audit.Event) error
+	Query(filter Filter) (audit.EventList, error)
+	Count(filter Filter) (int64, error)
+	// Stream calls fn for every event matching filter in sort order. Limit and Offset are ignored.
+	// Streaming stops at the first error returned by fn.
+	Stream(filter Filter, fn func(audit.Event) error) error
+	// Stats counts events matching filter grouped by groupBy (StatGroups). Time is bucketed by interval (StatIntervals).
+	// Buckets are ordered by time if grouped by time, by count otherwise.
+	Stats(filter Filter, groupBy []string, interval string) ([]StatBucket, error)
+	// MemberSuggestions returns the 5 most active usernames starting with search.
+	// If username is not empty, only that user is considered.
+	MemberSuggestions(search string, username string) ([]string, error)
+	// BodyByJson returns stored request/response bodies with the event they belong to, newest first.
+	BodyByJson(filter JsonFilter) (ClaimListResponse, error)
+}
+
+// SortColumns lists the fields every backend can sort on. message is a text field in elasticsearch, which can not be sorted.
+var SortColumns = []string{"id", "username", "useragent", "namespace", "apigroup", "apiversion", "resource", "name",
+	"stage", "stagetimestamp", "verb", "code", "status", "reason"}
+
+const (
+	STAT_GROUP_VERB      = "verb"
+	STAT_GROUP_RESOURCE  = "resource"
+	STAT_GROUP_USERNAME  = "username"
+	STAT_GROUP_NAMESPACE = "namespace"
+	STAT_GROUP_CODE      = "code"
+	STAT_GROUP_TIME      = "time"
+)
+
+var (
+	StatGroups    = []string{STAT_GROUP_VERB, STAT_GROUP_RESOURCE, STAT_GROUP_USERNAME, STAT_GROUP_NAMESPACE, STAT_GROUP_CODE, STAT_GROUP_TIME}
+	StatIntervals = []string{"minute", "hour", "day", "week", "month"}
+)
+
+// StatBucket is a count of events. Only the fields of the requested groups are set.
+type StatBucket struct {
+	Time      *time.Time `json:"time,omitempty"`
+	Verb      string     `json:"verb,omitempty"`
+	Resource  string     `json:"resource,omitempty"`
+	Username  string     `json:"username,omitempty"`
+	Namespace string     `json:"namespace,omitempty"`
+	// CodeClass is the lower bound of the status code class, e.g. 400 for 4xx
+	CodeClass int32 `json:"codeClass,omitempty"`
+	Count     int64 `json:"count"`
+}
+
+// CheckPage tells if the backend can return the page of filter. Elasticsearch can not page past
+// ES_MAX_RESULT_WINDOW events, narrower conditions or Stream have to be used instead.
+func CheckPage(filter Filter) error {
+	if StoreBackend == BACKEND_ELASTICSEARCH && filter.Offset+filter.Limit > ES_MAX_RESULT_WINDOW {
+		return errors.New("Offset + limit must not be greater than " + strconv.Itoa(ES_MAX_RESULT_WINDOW))
+	}
+	return nil
+}
+
+func InitStore() error {
+	initBodyResources()
+	switch StoreBackend {
+	case "", BACKEND_POSTGRES:
+		Store = &postgresStore{}
+	case BACKEND_ELASTICSEARCH:
+		es := newElasticsearchStore(ElasticsearchURL, ElasticsearchIndex)
+		if err := es.ensureIndex(); err != nil {
+			klog.Errorln("Failed to prepare elasticsearch index: ", err)
+		}
+		Store = es
+	default:
+		return errors.New("Audit backend [" + StoreBackend + "] is not supported")
+	}
+	klog.Infoln("Audit backend : ", StoreBackend)
+	return nil
+}
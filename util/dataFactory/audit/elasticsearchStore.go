@@ -0,0 +1,634 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	authv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apiserver/pkg/apis/audit"
+	"k8s.io/klog"
+)
+
+// elasticsearchStore keeps audit events in an index whose fields are named after the columns of the audit table,
+// so query.Order columns can be used as sort fields as they are.
+type elasticsearchStore struct {
+	url    string
+	index  string
+	client *http.Client
+}
+
+type esDocument struct {
+	Id             string    `json:"id"`
+	Username       string    `json:"username"`
+	UserAgent      string    `json:"useragent"`
+	Namespace      string    `json:"namespace,omitempty"`
+	APIGroup       string    `json:"apigroup,omitempty"`
+	APIVersion     string    `json:"apiversion,omitempty"`
+	Resource       string    `json:"resource"`
+	Name           string    `json:"name"`
+	Stage          string    `json:"stage"`
+	StageTimestamp time.Time `json:"stagetimestamp"`
+	Verb           string    `json:"verb"`
+	Code           int32     `json:"code"`
+	Status         string    `json:"status"`
+	Reason         string    `json:"reason"`
+	Message        string    `json:"message"`
+}
+
+// esBodyDocument repeats a few fields of the event, since the body index can not be joined with the audit index.
+type esBodyDocument struct {
+	Id             string          `json:"id"`
+	Namespace      string          `json:"namespace,omitempty"`
+	Username       string          `json:"username"`
+	Verb           string          `json:"verb"`
+	Resource       string          `json:"resource"`
+	Name           string          `json:"name"`
+	StageTimestamp time.Time       `json:"stagetimestamp"`
+	Body           json.RawMessage `json:"body"`
+	Raw            string          `json:"raw"`
+}
+
+type esSearchResponse struct {
+	ScrollID string `json:"_scroll_id"`
+	Hits     struct {
+		Total struct {
+			Value int64 `json:"value"`
+		} `json:"total"`
+		Hits []struct {
+			Source json.RawMessage `json:"_source"`
+		} `json:"hits"`
+	} `json:"hits"`
+	Aggregations struct {
+		Stats struct {
+			AfterKey map[string]interface{} `json:"after_key"`
+			Buckets  []struct {
+				Key      map[string]interface{} `json:"key"`
+				DocCount int64                  `json:"doc_count"`
+			} `json:"buckets"`
+		} `json:"stats"`
+		Members struct {
+			Buckets []struct {
+				Key      string `json:"key"`
+				DocCount int64  `json:"doc_count"`
+			} `json:"buckets"`
+		} `json:"members"`
+	} `json:"aggregations"`
+}
+
+const esAuditMapping = `{
+	"mappings": {
+		"properties": {
+			"id":             {"type": "keyword"},
+			"username":       {"type": "keyword"},
+			"useragent":      {"type": "keyword"},
+			"namespace":      {"type": "keyword"},
+			"apigroup":       {"type": "keyword"},
+			"apiversion":     {"type": "keyword"},
+			"resource":       {"type": "keyword"},
+			"name":           {"type": "keyword"},
+			"stage":          {"type": "keyword"},
+			"stagetimestamp": {"type": "date"},
+			"verb":           {"type": "keyword"},
+			"code":           {"type": "integer"},
+			"status":         {"type": "keyword"},
+			"reason":         {"type": "keyword"},
+			"message":        {"type": "text"}
+		}
+	}
+}`
+
+const esAuditBodyMapping = `{
+	"mappings": {
+		"properties": {
+			"id":             {"type": "keyword"},
+			"namespace":      {"type": "keyword"},
+			"username":       {"type": "keyword"},
+			"verb":           {"type": "keyword"},
+			"resource":       {"type": "keyword"},
+			"name":           {"type": "keyword"},
+			"stagetimestamp": {"type": "date"},
+			"body":           {"type": "flattened"},
+			"raw":            {"type": "keyword", "index": false, "doc_values": false}
+		}
+	}
+}`
+
+func newElasticsearchStore(url string, index string) *elasticsearchStore {
+	return &elasticsearchStore{
+		url:    strings.TrimSuffix(url, "/"),
+		index:  index,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (s *elasticsearchStore) bodyIndex() string {
+	return s.index + "-body"
+}
+
+// ensureIndex creates the audit indices with keyword mappings if they do not exist yet.
+func (s *elasticsearchStore) ensureIndex() error {
+	for index, mapping := range map[string]string{s.index: esAuditMapping, s.bodyIndex(): esAuditBodyMapping} {
+		resp, err := s.client.Head(s.url + "/" + index)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			continue
+		}
+		if _, err := s.do(http.MethodPut, "/"+index, "application/json", []byte(mapping)); err != nil {
+			return err
+		}
+		klog.Infoln("Elasticsearch index [" + index + "] is created")
+	}
+	return nil
+}
+
+func (s *elasticsearchStore) do(method string, path string, contentType string, body []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, s.url+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("elasticsearch %s %s failed with status %d: %s", method, path, resp.StatusCode, string(respBody))
+	}
+	return respBody, nil
+}
+
+func toDocument(event audit.Event) esDocument {
+	doc := esDocument{
+		Id:             string(event.AuditID),
+		Username:       event.User.Username,
+		UserAgent:      event.UserAgent,
+		Stage:          string(event.Stage),
+		StageTimestamp: event.StageTimestamp.Time,
+		Verb:           event.Verb,
+	}
+	if event.ObjectRef != nil {
+		doc.Namespace = NewNullString(event.ObjectRef.Namespace).String
+		doc.APIGroup = NewNullString(event.ObjectRef.APIGroup).String
+		doc.APIVersion = NewNullString(event.ObjectRef.APIVersion).String
+		doc.Resource = event.ObjectRef.Resource
+		doc.Name = event.ObjectRef.Name
+	}
+	if event.ResponseStatus != nil {
+		doc.Code = event.ResponseStatus.Code
+		doc.Status = event.ResponseStatus.Status
+		doc.Reason = string(event.ResponseStatus.Reason)
+		doc.Message = event.ResponseStatus.Message
+	}
+	return doc
+}
+
+func (doc esDocument) toEvent() audit.Event {
+	return audit.Event{
+		AuditID:   types.UID(doc.Id),
+		UserAgent: doc.UserAgent,
+		Stage:     audit.Stage(doc.Stage),
+		Verb:      doc.Verb,
+		StageTimestamp: metav1.MicroTime{
+			Time: doc.StageTimestamp,
+		},
+		ObjectRef: &audit.ObjectReference{
+			Namespace:  doc.Namespace,
+			APIGroup:   doc.APIGroup,
+			APIVersion: doc.APIVersion,
+			Resource:   doc.Resource,
+			Name:       doc.Name,
+		},
+		ResponseStatus: &metav1.Status{
+			Code:    doc.Code,
+			Status:  doc.Status,
+			Reason:  metav1.StatusReason(doc.Reason),
+			Message: doc.Message,
+		},
+		User: authv1.UserInfo{
+			Username: doc.Username,
+		},
+	}
+}
+
+func (s *elasticsearchStore) Insert(items []audit.Event) error {
+	if len(items) == 0 {
+		return nil
+	}
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	for _, event := range items {
+		action := map[string]interface{}{
+			"index": map[string]string{"_index": s.index, "_id": string(event.AuditID)},
+		}
+		if err := enc.Encode(action); err != nil {
+			return err
+		}
+		doc := toDocument(event)
+		if err := enc.Encode(doc); err != nil {
+			return err
+		}
+
+		if body := bodyOf(event); body != nil {
+			bodyAction := map[string]interface{}{
+				"index": map[string]string{"_index": s.bodyIndex(), "_id": string(event.AuditID)},
+			}
+			bodyDoc := esBodyDocument{
+				Id:             doc.Id,
+				Namespace:      doc.Namespace,
+				Username:       doc.Username,
+				Verb:           doc.Verb,
+				Resource:       doc.Resource,
+				Name:           doc.Name,
+				StageTimestamp: doc.StageTimestamp,
+				Body:           body,
+				Raw:            string(body),
+			}
+			if err := enc.Encode(bodyAction); err != nil {
+				return err
+			}
+			if err := enc.Encode(bodyDoc); err != nil {
+				return err
+			}
+		}
+	}
+
+	respBody, err := s.do(http.MethodPost, "/_bulk", "application/x-ndjson", b.Bytes())
+	if err != nil {
+		klog.Error(err)
+		return err
+	}
+	var bulkResp struct {
+		Errors bool `json:"errors"`
+	}
+	if err := json.Unmarshal(respBody, &bulkResp); err != nil {
+		return err
+	}
+	if bulkResp.Errors {
+		err := errors.New("elasticsearch bulk insert has failed items: " + string(respBody))
+		klog.Error(err)
+		return err
+	}
+	klog.Info("Affected rows: ", len(items))
+	return nil
+}
+
+func (s *elasticsearchStore) buildQuery(filter Filter) map[string]interface{} {
+	conds := []interface{}{}
+	term := func(field string, value interface{}) {
+		conds = append(conds, map[string]interface{}{"term": map[string]interface{}{field: value}})
+	}
+
+	if !filter.StartTime.IsZero() && !filter.EndTime.IsZero() {
+		conds = append(conds, map[string]interface{}{"range": map[string]interface{}{
+			"stagetimestamp": map[string]interface{}{"gte": filter.StartTime, "lte": filter.EndTime},
+		}})
+	}
+	if filter.Namespace != "" {
+		term("namespace", filter.Namespace)
+	}
+	if filter.Namespaces != nil {
+		conds = append(conds, map[string]interface{}{"terms": map[string]interface{}{"namespace": filter.Namespaces}})
+	}
+	if filter.Resource != "" {
+		term("resource", filter.Resource)
+	}
+	if filter.Status != "" {
+		term("status", filter.Status)
+	}
+	if filter.Verb != "" {
+		term("verb", filter.Verb)
+	}
+	if filter.Username != "" {
+		term("username", filter.Username)
+	}
+	if filter.CodeClass != 0 {
+		conds = append(conds, map[string]interface{}{"range": map[string]interface{}{
+			"code": map[string]interface{}{"gte": filter.CodeClass, "lte": filter.CodeClass + 99},
+		}})
+	}
+	return map[string]interface{}{"bool": map[string]interface{}{"filter": conds}}
+}
+
+func (s *elasticsearchStore) search(index string, body map[string]interface{}) (*esSearchResponse, error) {
+	reqBody, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	respBody, err := s.do(http.MethodPost, "/"+index+"/_search", "application/json", reqBody)
+	if err != nil {
+		klog.Error(err)
+		return nil, err
+	}
+	result := &esSearchResponse{}
+	if err := json.Unmarshal(respBody, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (s *elasticsearchStore) Query(filter Filter) (audit.EventList, error) {
+	eventList := audit.EventList{}
+	eventList.Kind = "EventList"
+	eventList.APIVersion = "audit.k8s.io/v1"
+
+	result, err := s.search(s.index, map[string]interface{}{
+		"query": s.buildQuery(filter),
+		"sort":  s.buildSort(filter),
+		"from":  filter.Offset,
+		"size":  filter.Limit,
+	})
+	if err != nil {
+		return eventList, err
+	}
+	for _, hit := range result.Hits.Hits {
+		var doc esDocument
+		if err := json.Unmarshal(hit.Source, &doc); err != nil {
+			return eventList, err
+		}
+		eventList.Items = append(eventList.Items, doc.toEvent())
+	}
+	return eventList, nil
+}
+
+func (s *elasticsearchStore) buildSort(filter Filter) []interface{} {
+	orders := []interface{}{}
+	sorted := false
+	for _, o := range filter.Sort {
+		order := "asc"
+		if o.Desc {
+			order = "desc"
+		}
+		orders = append(orders, map[string]string{o.Column: order})
+		sorted = sorted || o.Column == "stagetimestamp"
+	}
+	if !sorted {
+		orders = append(orders, map[string]string{"stagetimestamp": "desc"})
+	}
+	return orders
+}
+
+// Stream pages through the result with the scroll API, STREAM_FETCH_SIZE documents at a time.
+func (s *elasticsearchStore) Stream(filter Filter, fn func(audit.Event) error) error {
+	const keepAlive = "1m"
+
+	reqBody, err := json.Marshal(map[string]interface{}{
+		"query": s.buildQuery(filter),
+		"sort":  s.buildSort(filter),
+		"size":  STREAM_FETCH_SIZE,
+	})
+	if err != nil {
+		return err
+	}
+	respBody, err := s.do(http.MethodPost, "/"+s.index+"/_search?scroll="+keepAlive, "application/json", reqBody)
+	if err != nil {
+		klog.Error(err)
+		return err
+	}
+	result := &esSearchResponse{}
+	if err := json.Unmarshal(respBody, result); err != nil {
+		return err
+	}
+	defer func() {
+		if result.ScrollID == "" {
+			return
+		}
+		reqBody, _ := json.Marshal(map[string]string{"scroll_id": result.ScrollID})
+		if _, err := s.do(http.MethodDelete, "/_search/scroll", "application/json", reqBody); err != nil {
+			klog.Error(err)
+		}
+	}()
+
+	for len(result.Hits.Hits) > 0 {
+		for _, hit := range result.Hits.Hits {
+			var doc esDocument
+			if err := json.Unmarshal(hit.Source, &doc); err != nil {
+				return err
+			}
+			if err := fn(doc.toEvent()); err != nil {
+				return err
+			}
+		}
+
+		reqBody, err := json.Marshal(map[string]string{"scroll": keepAlive, "scroll_id": result.ScrollID})
+		if err != nil {
+			return err
+		}
+		respBody, err := s.do(http.MethodPost, "/_search/scroll", "application/json", reqBody)
+		if err != nil {
+			klog.Error(err)
+			return err
+		}
+		next := &esSearchResponse{}
+		if err := json.Unmarshal(respBody, next); err != nil {
+			return err
+		}
+		if next.ScrollID == "" {
+			next.ScrollID = result.ScrollID
+		}
+		result = next
+	}
+	return nil
+}
+
+func (s *elasticsearchStore) Count(filter Filter) (int64, error) {
+	reqBody, err := json.Marshal(map[string]interface{}{"query": s.buildQuery(filter)})
+	if err != nil {
+		return 0, err
+	}
+	respBody, err := s.do(http.MethodPost, "/"+s.index+"/_count", "application/json", reqBody)
+	if err != nil {
+		klog.Error(err)
+		return 0, err
+	}
+	var countResp struct {
+		Count int64 `json:"count"`
+	}
+	if err := json.Unmarshal(respBody, &countResp); err != nil {
+		return 0, err
+	}
+	return countResp.Count, nil
+}
+
+func (s *elasticsearchStore) MemberSuggestions(search string, username string) ([]string, error) {
+	memberList := []string{}
+
+	conds := []interface{}{
+		map[string]interface{}{"prefix": map[string]interface{}{"username": search}},
+	}
+	if username != "" {
+		conds = append(conds, map[string]interface{}{"term": map[string]interface{}{"username": username}})
+	}
+	result, err := s.search(s.index, map[string]interface{}{
+		"size":  0,
+		"query": map[string]interface{}{"bool": map[string]interface{}{"filter": conds}},
+		"aggs": map[string]interface{}{
+			"members": map[string]interface{}{
+				"terms": map[string]interface{}{"field": "username", "size": 5, "order": map[string]string{"_count": "desc"}},
+			},
+		},
+	})
+	if err != nil {
+		return memberList, err
+	}
+	for _, bucket := range result.Aggregations.Members.Buckets {
+		memberList = append(memberList, bucket.Key)
+	}
+	return memberList, nil
+}
+
+// maxStatBuckets bounds the composite aggregation pages read by Stats
+const maxStatBuckets = 10000
+
+func (s *elasticsearchStore) Stats(filter Filter, groupBy []string, interval string) ([]StatBucket, error) {
+	buckets := []StatBucket{}
+
+	sources := []interface{}{}
+	for _, group := range groupBy {
+		var source map[string]interface{}
+		switch group {
+		case STAT_GROUP_CODE:
+			source = map[string]interface{}{"histogram": map[string]interface{}{"field": "code", "interval": 100}}
+		case STAT_GROUP_TIME:
+			source = map[string]interface{}{"date_histogram": map[string]interface{}{"field": "stagetimestamp", "calendar_interval": interval}}
+		default:
+			source = map[string]interface{}{"terms": map[string]interface{}{"field": group}}
+		}
+		sources = append(sources, map[string]interface{}{group: source})
+	}
+
+	// composite aggregation pages through every bucket ordered by key, so the time order comes for free
+	var after map[string]interface{}
+	for len(buckets) < maxStatBuckets {
+		composite := map[string]interface{}{"sources": sources, "size": STREAM_FETCH_SIZE}
+		if after != nil {
+			composite["after"] = after
+		}
+		result, err := s.search(s.index, map[string]interface{}{
+			"query": s.buildQuery(filter),
+			"size":  0,
+			"aggs":  map[string]interface{}{"stats": map[string]interface{}{"composite": composite}},
+		})
+		if err != nil {
+			return buckets, err
+		}
+		for _, b := range result.Aggregations.Stats.Buckets {
+			bucket := StatBucket{Count: b.DocCount}
+			for group, value := range b.Key {
+				switch group {
+				case STAT_GROUP_VERB:
+					bucket.Verb, _ = value.(string)
+				case STAT_GROUP_RESOURCE:
+					bucket.Resource, _ = value.(string)
+				case STAT_GROUP_USERNAME:
+					bucket.Username, _ = value.(string)
+				case STAT_GROUP_NAMESPACE:
+					bucket.Namespace, _ = value.(string)
+				case STAT_GROUP_CODE:
+					if code, ok := value.(float64); ok {
+						bucket.CodeClass = int32(code)
+					}
+				case STAT_GROUP_TIME:
+					if millis, ok := value.(float64); ok {
+						t := time.Unix(0, int64(millis)*int64(time.Millisecond))
+						bucket.Time = &t
+					}
+				}
+			}
+			buckets = append(buckets, bucket)
+		}
+		if len(result.Aggregations.Stats.Buckets) == 0 || result.Aggregations.Stats.AfterKey == nil {
+			break
+		}
+		after = result.Aggregations.Stats.AfterKey
+	}
+
+	byTime := false
+	for _, group := range groupBy {
+		byTime = byTime || group == STAT_GROUP_TIME
+	}
+	if !byTime {
+		sort.SliceStable(buckets, func(i, j int) bool {
+			return buckets[i].Count > buckets[j].Count
+		})
+	}
+
+	if filter.Offset >= len(buckets) {
+		return []StatBucket{}, nil
+	}
+	buckets = buckets[filter.Offset:]
+	if filter.Limit > 0 && filter.Limit < len(buckets) {
+		buckets = buckets[:filter.Limit]
+	}
+	return buckets, nil
+}
+
+func (s *elasticsearchStore) BodyByJson(filter JsonFilter) (ClaimListResponse, error) {
+	var claimList ClaimListResponse
+
+	conds := []interface{}{}
+	mustNot := []interface{}{}
+	if filter.Namespaces != nil {
+		conds = append(conds, map[string]interface{}{"terms": map[string]interface{}{"namespace": filter.Namespaces}})
+	}
+	for _, cond := range filter.Conditions {
+		// flattened fields are addressed with dotted keys
+		field := "body." + cond.Side + "." + strings.Join(cond.Path, ".")
+		switch cond.Op {
+		case JSON_OP_EQUAL:
+			conds = append(conds, map[string]interface{}{"term": map[string]interface{}{field: cond.Value}})
+		case JSON_OP_NOT_EQUAL:
+			mustNot = append(mustNot, map[string]interface{}{"term": map[string]interface{}{field: cond.Value}})
+		case JSON_OP_EXISTS:
+			conds = append(conds, map[string]interface{}{"exists": map[string]interface{}{"field": field}})
+		default:
+			return claimList, fmt.Errorf("unknown operator [%s]", cond.Op)
+		}
+	}
+
+	result, err := s.search(s.bodyIndex(), map[string]interface{}{
+		"query": map[string]interface{}{"bool": map[string]interface{}{"filter": conds, "must_not": mustNot}},
+		"sort":  []interface{}{map[string]interface{}{"stagetimestamp": "desc"}},
+		"from":  filter.Offset,
+		"size":  filter.Limit,
+	})
+	if err != nil {
+		return claimList, err
+	}
+	for _, hit := range result.Hits.Hits {
+		var doc esBodyDocument
+		if err := json.Unmarshal(hit.Source, &doc); err != nil {
+			return claimList, err
+		}
+		claimList.Claims = append(claimList.Claims, Claim{
+			Id:             doc.Id,
+			Namespace:      doc.Namespace,
+			Username:       doc.Username,
+			Verb:           doc.Verb,
+			Resource:       doc.Resource,
+			Name:           doc.Name,
+			StageTimestamp: doc.StageTimestamp,
+			Body:           doc.Raw,
+		})
+	}
+	claimList.RowsCount = int64(len(claimList.Claims))
+	return claimList, nil
+}
@@ -0,0 +1,294 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tmax-cloud/hypercloud-api-server/util/dataFactory/query"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apiserver/pkg/apis/audit"
+)
+
+type esRequest struct {
+	method string
+	path   string
+	body   string
+}
+
+// fakeElasticsearch records requests and answers them with the response registered for "<method> <path>".
+type fakeElasticsearch struct {
+	mu        sync.Mutex
+	requests  []esRequest
+	responses map[string][]string
+}
+
+func newFakeElasticsearch(t *testing.T, responses map[string][]string) (*elasticsearchStore, *fakeElasticsearch) {
+	fake := &fakeElasticsearch{responses: responses}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		key := r.Method + " " + r.URL.RequestURI()
+
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		fake.requests = append(fake.requests, esRequest{method: r.Method, path: r.URL.RequestURI(), body: string(body)})
+		queued := fake.responses[key]
+		if len(queued) == 0 {
+			t.Errorf("unexpected request %s", key)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		// the last response is repeated
+		if len(queued) > 1 {
+			fake.responses[key] = queued[1:]
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(queued[0]))
+	}))
+	t.Cleanup(server.Close)
+	return newElasticsearchStore(server.URL+"/", "audit"), fake
+}
+
+// assertJSON compares a request body with the expected JSON, ignoring formatting and key order.
+func assertJSON(t *testing.T, got string, want string) {
+	t.Helper()
+	var g, w interface{}
+	if err := json.Unmarshal([]byte(got), &g); err != nil {
+		t.Fatalf("request body %s: %v", got, err)
+	}
+	if err := json.Unmarshal([]byte(want), &w); err != nil {
+		t.Fatalf("expected body %s: %v", want, err)
+	}
+	if !reflect.DeepEqual(g, w) {
+		t.Errorf("request body = %s\nwant %s", got, want)
+	}
+}
+
+const esHit = `{"_source": {"id": "a1", "username": "alice", "namespace": "default", "resource": "pods", "name": "web",
+	"stagetimestamp": "2022-04-15T01:02:03Z", "verb": "create", "code": 201, "status": "Success"}}`
+
+func TestElasticsearchQuery(t *testing.T) {
+	start := time.Date(2022, 4, 15, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2022, 4, 16, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		filter Filter
+		want   string
+	}{
+		{
+			name:   "default sort and first page",
+			filter: Filter{Limit: 100},
+			want:   `{"query": {"bool": {"filter": []}}, "sort": [{"stagetimestamp": "desc"}], "from": 0, "size": 100}`,
+		},
+		{
+			name: "conditions, sort and paging",
+			filter: Filter{
+				Namespace: "default",
+				Resource:  "pods",
+				Verb:      "create",
+				Username:  "alice",
+				CodeClass: 400,
+				StartTime: start,
+				EndTime:   end,
+				Sort:      []query.Order{{Column: "username"}, {Column: "code", Desc: true}},
+				Limit:     20,
+				Offset:    40,
+			},
+			want: `{"query": {"bool": {"filter": [
+				{"range": {"stagetimestamp": {"gte": "2022-04-15T00:00:00Z", "lte": "2022-04-16T00:00:00Z"}}},
+				{"term": {"namespace": "default"}},
+				{"term": {"resource": "pods"}},
+				{"term": {"verb": "create"}},
+				{"term": {"username": "alice"}},
+				{"range": {"code": {"gte": 400, "lte": 499}}}
+			]}}, "sort": [{"username": "asc"}, {"code": "desc"}, {"stagetimestamp": "desc"}], "from": 40, "size": 20}`,
+		},
+		{
+			name:   "visible namespaces and time sort",
+			filter: Filter{Namespaces: []string{"a", "b"}, Sort: []query.Order{{Column: "stagetimestamp"}}, Limit: 10},
+			want: `{"query": {"bool": {"filter": [{"terms": {"namespace": ["a", "b"]}}]}},
+				"sort": [{"stagetimestamp": "asc"}], "from": 0, "size": 10}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, fake := newFakeElasticsearch(t, map[string][]string{
+				"POST /audit/_search": {`{"hits": {"total": {"value": 1}, "hits": [` + esHit + `]}}`},
+			})
+			eventList, err := store.Query(tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertJSON(t, fake.requests[0].body, tt.want)
+
+			if len(eventList.Items) != 1 {
+				t.Fatalf("got %d events, want 1", len(eventList.Items))
+			}
+			event := eventList.Items[0]
+			if event.AuditID != "a1" || event.User.Username != "alice" || event.ObjectRef.Namespace != "default" ||
+				event.ResponseStatus.Code != 201 || !event.StageTimestamp.Time.Equal(time.Date(2022, 4, 15, 1, 2, 3, 0, time.UTC)) {
+				t.Errorf("unexpected event %+v", event)
+			}
+		})
+	}
+}
+
+func TestElasticsearchCount(t *testing.T) {
+	store, fake := newFakeElasticsearch(t, map[string][]string{
+		"POST /audit/_count": {`{"count": 42}`},
+	})
+	count, err := store.Count(Filter{Status: "Failure", Limit: 10, Offset: 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 42 {
+		t.Errorf("Count() = %d, want 42", count)
+	}
+	// paging and sort do not apply to counts
+	assertJSON(t, fake.requests[0].body, `{"query": {"bool": {"filter": [{"term": {"status": "Failure"}}]}}}`)
+}
+
+func TestElasticsearchStream(t *testing.T) {
+	store, fake := newFakeElasticsearch(t, map[string][]string{
+		"POST /audit/_search?scroll=1m": {`{"_scroll_id": "s1", "hits": {"hits": [` + esHit + `, ` + esHit + `]}}`},
+		"POST /_search/scroll": {
+			`{"_scroll_id": "s2", "hits": {"hits": [` + esHit + `]}}`,
+			`{"hits": {"hits": []}}`,
+		},
+		"DELETE /_search/scroll": {`{"succeeded": true}`},
+	})
+
+	count := 0
+	err := store.Stream(Filter{Limit: 10, Offset: 20}, func(event audit.Event) error {
+		count++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Errorf("streamed %d events, want 3", count)
+	}
+
+	want := []struct {
+		path string
+		body string
+	}{
+		{"/audit/_search?scroll=1m", `{"query": {"bool": {"filter": []}}, "sort": [{"stagetimestamp": "desc"}], "size": 1000}`},
+		{"/_search/scroll", `{"scroll": "1m", "scroll_id": "s1"}`},
+		{"/_search/scroll", `{"scroll": "1m", "scroll_id": "s2"}`},
+		// the last response has no scroll id, the one before it is cleared
+		{"/_search/scroll", `{"scroll_id": "s2"}`},
+	}
+	if len(fake.requests) != len(want) {
+		t.Fatalf("got %d requests, want %d: %v", len(fake.requests), len(want), fake.requests)
+	}
+	for i, w := range want {
+		if fake.requests[i].path != w.path {
+			t.Errorf("request %d path = %s, want %s", i, fake.requests[i].path, w.path)
+		}
+		assertJSON(t, fake.requests[i].body, w.body)
+	}
+	if fake.requests[3].method != http.MethodDelete {
+		t.Errorf("scroll is cleared with %s", fake.requests[3].method)
+	}
+}
+
+func TestElasticsearchInsert(t *testing.T) {
+	bodyResources = map[string]bool{"configmaps": true}
+	defer func() { bodyResources = map[string]bool{} }()
+
+	store, fake := newFakeElasticsearch(t, map[string][]string{
+		"POST /_bulk": {`{"errors": false}`},
+	})
+	stageTimestamp := metav1.NewMicroTime(time.Date(2022, 4, 15, 1, 2, 3, 0, time.UTC))
+	events := []audit.Event{
+		{
+			AuditID:        "a1",
+			Verb:           "create",
+			StageTimestamp: stageTimestamp,
+			ObjectRef:      &audit.ObjectReference{Namespace: "default", Resource: "configmaps", Name: "cm"},
+			ResponseStatus: &metav1.Status{Code: 201},
+			RequestObject:  &runtime.Unknown{Raw: []byte(`{"data": {"k": "v"}}`)},
+		},
+		{
+			AuditID:        "a2",
+			Verb:           "delete",
+			StageTimestamp: stageTimestamp,
+			ObjectRef:      &audit.ObjectReference{Namespace: "default", Resource: "pods", Name: "web"},
+			RequestObject:  &runtime.Unknown{Raw: []byte(`{"kind": "DeleteOptions"}`)},
+		},
+	}
+	if err := store.Insert(events); err != nil {
+		t.Fatal(err)
+	}
+
+	if fake.requests[0].method != http.MethodPost || fake.requests[0].path != "/_bulk" {
+		t.Fatalf("unexpected request %s %s", fake.requests[0].method, fake.requests[0].path)
+	}
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewBufferString(fake.requests[0].body))
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	// configmaps are opted in, so a1 has a body document. pods are not.
+	want := []string{
+		`{"index": {"_index": "audit", "_id": "a1"}}`,
+		`{"id": "a1", "username": "", "useragent": "", "namespace": "default", "resource": "configmaps", "name": "cm", "stage": "",
+			"stagetimestamp": "2022-04-15T01:02:03Z", "verb": "create", "code": 201, "status": "", "reason": "", "message": ""}`,
+		`{"index": {"_index": "audit-body", "_id": "a1"}}`,
+		`{"id": "a1", "namespace": "default", "username": "", "verb": "create", "resource": "configmaps", "name": "cm",
+			"stagetimestamp": "2022-04-15T01:02:03Z", "body": {"request": {"data": {"k": "v"}}}, "raw": "{\"request\":{\"data\":{\"k\":\"v\"}}}"}`,
+		`{"index": {"_index": "audit", "_id": "a2"}}`,
+		`{"id": "a2", "username": "", "useragent": "", "namespace": "default", "resource": "pods", "name": "web", "stage": "",
+			"stagetimestamp": "2022-04-15T01:02:03Z", "verb": "delete", "code": 0, "status": "", "reason": "", "message": ""}`,
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("bulk body has %d lines, want %d:\n%s", len(lines), len(want), strings.Join(lines, "\n"))
+	}
+	for i := range want {
+		assertJSON(t, lines[i], want[i])
+	}
+}
+
+func TestElasticsearchInsertFailedItems(t *testing.T) {
+	store, _ := newFakeElasticsearch(t, map[string][]string{
+		"POST /_bulk": {`{"errors": true, "items": [{"index": {"status": 400}}]}`},
+	})
+	err := store.Insert([]audit.Event{{AuditID: "a1", StageTimestamp: metav1.NewMicroTime(time.Now())}})
+	if err == nil {
+		t.Error("Insert() succeeded with failed items")
+	}
+}
+
+func TestCheckPage(t *testing.T) {
+	defer func(backend string) { StoreBackend = backend }(StoreBackend)
+
+	tests := []struct {
+		backend string
+		limit   int
+		offset  int
+		wantErr bool
+	}{
+		{BACKEND_ELASTICSEARCH, 100, 9900, false},
+		{BACKEND_ELASTICSEARCH, 100, 9901, true},
+		{BACKEND_POSTGRES, 100, 9901, false},
+	}
+	for _, tt := range tests {
+		StoreBackend = tt.backend
+		err := CheckPage(Filter{Limit: tt.limit, Offset: tt.offset})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("CheckPage(%s, limit %d, offset %d) error = %v, wantErr %v", tt.backend, tt.limit, tt.offset, err, tt.wantErr)
+		}
+	}
+}
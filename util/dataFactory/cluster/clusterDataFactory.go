@@ -5,6 +5,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/jackc/pgx/v4"
 	util "github.com/tmax-cloud/hypercloud-api-server/util"
 	db "github.com/tmax-cloud/hypercloud-api-server/util/dataFactory"
 	"k8s.io/apimachinery/pkg/types"
@@ -23,21 +24,114 @@ const (
 	DELETE_QUERY        = "DELETE FROM CLUSTER_MEMBER WHERE namespace = $1 and cluster = $2 and member_id = $3 and attribute = $4"
 	DELETE_ALL_QUERY    = "DELETE FROM CLUSTER_MEMBER WHERE namespace = $1 and cluster = $2"
 	UPDATE_STATUS_QUERY = "UPDATE CLUSTER_MEMBER SET STATUS = 'invited', updatedTime = $1 WHERE namespace = $2 and cluster = $3 and member_id = $4 and attribute = $5 "
-	UPDATE_ROLE_QUERY   = "UPDATE CLUSTER_MEMBER SET ROLE = '@@ROLE@@', updatedTime = $1  WHERE namespace = $2 and cluster = $3 and member_id = $4 and attribute = $5 "
+	UPDATE_ROLE_QUERY   = "UPDATE CLUSTER_MEMBER SET ROLE = $1, updatedTime = $2 WHERE namespace = $3 and cluster = $4 and member_id = $5 and attribute = $6 "
+
+	// the token id of the invitation mail sent last. A token is used by deleting its row, so it is accepted once.
+	INVITATION_CREATE_QUERY = "CREATE TABLE IF NOT EXISTS CLUSTER_MEMBER_INVITATION (namespace varchar(253) not null, cluster varchar(253) not null, " +
+		"member_id varchar(255) not null, token_id varchar(64) not null, expiredTime timestamp not null, PRIMARY KEY (namespace, cluster, member_id))"
+	INVITATION_UPSERT_QUERY = "INSERT INTO CLUSTER_MEMBER_INVITATION (namespace, cluster, member_id, token_id, expiredTime) VALUES ($1, $2, $3, $4, $5) " +
+		"ON CONFLICT (namespace, cluster, member_id) DO UPDATE SET token_id = excluded.token_id, expiredTime = excluded.expiredTime"
+	INVITATION_USE_QUERY    = "DELETE FROM CLUSTER_MEMBER_INVITATION WHERE namespace = $1 and cluster = $2 and member_id = $3 and token_id = $4 and expiredTime > $5"
+	INVITATION_EXPIRE_QUERY = "DELETE FROM CLUSTER_MEMBER_INVITATION WHERE expiredTime <= $1"
+	EXPIRE_PENDING_QUERY    = "UPDATE CLUSTER_MEMBER SET STATUS = 'expired', updatedTime = $1 WHERE attribute = 'user' and status = 'pending' and updatedTime <= $2"
+	RESEND_QUERY            = "UPDATE CLUSTER_MEMBER SET STATUS = 'pending', updatedTime = $1 WHERE namespace = $2 and cluster = $3 and member_id = $4 and attribute = 'user' " +
+		"and status in ('pending', 'expired')"
+	DELETE_ALL_INVITATION_QUERY = "DELETE FROM CLUSTER_MEMBER_INVITATION WHERE namespace = $1 and cluster = $2"
+	SELECT_CLUSTERS_QUERY       = "select namespace, cluster from CLUSTER_MEMBER group by namespace, cluster"
+	// the remote namespaces a member's role is bound in. A member without rows has its role in the whole remote cluster.
+	REMOTE_NAMESPACE_CREATE_QUERY = "CREATE TABLE IF NOT EXISTS CLUSTER_MEMBER_REMOTE_NAMESPACE (namespace varchar(253) not null, cluster varchar(253) not null, " +
+		"member_id varchar(255) not null, attribute varchar(16) not null, remote_namespace varchar(63) not null, " +
+		"PRIMARY KEY (namespace, cluster, member_id, attribute, remote_namespace))"
+	REMOTE_NAMESPACE_INSERT_QUERY     = "INSERT INTO CLUSTER_MEMBER_REMOTE_NAMESPACE (namespace, cluster, member_id, attribute, remote_namespace) VALUES ($1, $2, $3, $4, $5)"
+	REMOTE_NAMESPACE_DELETE_QUERY     = "DELETE FROM CLUSTER_MEMBER_REMOTE_NAMESPACE WHERE namespace = $1 and cluster = $2 and member_id = $3 and attribute = $4"
+	REMOTE_NAMESPACE_DELETE_ALL_QUERY = "DELETE FROM CLUSTER_MEMBER_REMOTE_NAMESPACE WHERE namespace = $1 and cluster = $2"
+	REMOTE_NAMESPACE_SELECT_QUERY     = "SELECT member_id, attribute, remote_namespace FROM CLUSTER_MEMBER_REMOTE_NAMESPACE WHERE namespace = $1 and cluster = $2 " +
+		"ORDER BY remote_namespace"
+	SELECT_INVITATION_QUERY = "select * from CLUSTER_MEMBER where namespace = $1 and cluster = $2 and member_id = $3 and attribute = 'user' and status in ('pending', 'expired')"
+	SELECT_PENDING_QUERY    = "select * from CLUSTER_MEMBER where namespace = $1 and cluster = $2 and member_id = $3 and attribute = 'user' and status = 'pending'"
+
+	// any constant shared by every api server replica, with the cluster hashed into the second key.
+	// A hash collision only serializes two clusters.
+	clusterLockKey       = 7468298
+	CLUSTER_LOCK_QUERY   = "select pg_advisory_lock($1, hashtext($2))"
+	CLUSTER_UNLOCK_QUERY = "select pg_advisory_unlock($1, hashtext($2))"
 )
 
 var pg_con_info string
 
 func Insert(item util.ClusterMemberInfo) error {
-	_, err := db.Dbpool.Exec(context.TODO(), INSERT_QUERY, item.Namespace, item.Cluster, item.MemberId, item.MemberName, item.Attribute, item.Role, item.Status, time.Now(), time.Now())
+	ctx := context.TODO()
+	tx, err := db.Dbpool.Begin(ctx)
 	if err != nil {
 		klog.Error(err)
 		return err
 	}
+	// Rollback is a no-op after a successful Commit
+	defer tx.Rollback(ctx)
 
+	if _, err := tx.Exec(ctx, INSERT_QUERY, item.Namespace, item.Cluster, item.MemberId, item.MemberName, item.Attribute, item.Role, item.Status, time.Now(), time.Now()); err != nil {
+		klog.Error(err)
+		return err
+	}
+	if err := saveRemoteNamespaces(ctx, tx, item); err != nil {
+		klog.Error(err)
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// fillRemoteNamespaces sets the remote namespaces of clusterMemberList, the members of a cluster.
+func fillRemoteNamespaces(cluster string, namespace string, clusterMemberList []util.ClusterMemberInfo) error {
+	remoteNamespaces, err := ListRemoteNamespaces(cluster, namespace)
+	if err != nil {
+		return err
+	}
+	for i := range clusterMemberList {
+		clusterMemberList[i].RemoteNamespaces = remoteNamespaces[clusterMemberList[i].Attribute+"/"+clusterMemberList[i].MemberId]
+	}
+	return nil
+}
+
+// saveRemoteNamespaces replaces the remote namespaces of item with item.RemoteNamespaces.
+func saveRemoteNamespaces(ctx context.Context, tx pgx.Tx, item util.ClusterMemberInfo) error {
+	if _, err := tx.Exec(ctx, REMOTE_NAMESPACE_DELETE_QUERY, item.Namespace, item.Cluster, item.MemberId, item.Attribute); err != nil {
+		return err
+	}
+	for _, remoteNamespace := range item.RemoteNamespaces {
+		if _, err := tx.Exec(ctx, REMOTE_NAMESPACE_INSERT_QUERY, item.Namespace, item.Cluster, item.MemberId, item.Attribute, remoteNamespace); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+func InitRemoteNamespace() error {
+	_, err := db.Dbpool.Exec(context.TODO(), REMOTE_NAMESPACE_CREATE_QUERY)
+	return err
+}
+
+// ListRemoteNamespaces returns the remote namespaces of the members of a cluster, by attribute + "/" + member id.
+func ListRemoteNamespaces(cluster string, namespace string) (map[string][]string, error) {
+	rows, err := db.Dbpool.Query(context.TODO(), REMOTE_NAMESPACE_SELECT_QUERY, namespace, cluster)
+	if err != nil {
+		klog.Error(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	remoteNamespaces := map[string][]string{}
+	for rows.Next() {
+		var memberId, attribute, remoteNamespace string
+		if err := rows.Scan(&memberId, &attribute, &remoteNamespace); err != nil {
+			klog.Error(err)
+			return nil, err
+		}
+		remoteNamespaces[attribute+"/"+memberId] = append(remoteNamespaces[attribute+"/"+memberId], remoteNamespace)
+	}
+	return remoteNamespaces, rows.Err()
+}
+
 func ListClusterMemberWithOutPending(cluster string, namespace string) ([]util.ClusterMemberInfo, error) {
 	clusterMemberList := []util.ClusterMemberInfo{}
 	var b strings.Builder
@@ -52,7 +146,7 @@ func ListClusterMemberWithOutPending(cluster string, namespace string) ([]util.C
 	b.WriteString(cluster)
 	b.WriteString("' ")
 
-	b.WriteString("and status not in ('pending') ")
+	b.WriteString("and status not in ('pending', 'expired') ")
 
 	query := b.String()
 	klog.Infoln("Query: " + query)
@@ -79,6 +173,9 @@ func ListClusterMemberWithOutPending(cluster string, namespace string) ([]util.C
 		)
 		clusterMemberList = append(clusterMemberList, clusterMember)
 	}
+	if err := fillRemoteNamespaces(cluster, namespace, clusterMemberList); err != nil {
+		return nil, err
+	}
 	return clusterMemberList, nil
 }
 
@@ -121,6 +218,9 @@ func ListClusterMember(cluster string, namespace string) ([]util.ClusterMemberIn
 		)
 		clusterMemberList = append(clusterMemberList, clusterMember)
 	}
+	if err := fillRemoteNamespaces(cluster, namespace, clusterMemberList); err != nil {
+		return nil, err
+	}
 	return clusterMemberList, nil
 }
 
@@ -322,7 +422,7 @@ func ListClusterInNamespace(userId string, userGroups []string, namespace string
 		b.WriteString("' ")
 	}
 	b.WriteString(") ")
-	b.WriteString("and status not in ('pending') ")
+	b.WriteString("and status not in ('pending', 'expired') ")
 
 	b.WriteString("group by cluster")
 
@@ -362,7 +462,7 @@ func ListClusterAllNamespace(userId string, userGroups []string) ([]types.Namesp
 	}
 	b.WriteString(") ")
 
-	b.WriteString("and status not in ('pending') ")
+	b.WriteString("and status not in ('pending', 'expired') ")
 
 	b.WriteString("group by namespace, cluster")
 
@@ -389,30 +489,7 @@ func ListClusterAllNamespace(userId string, userGroups []string) ([]types.Namesp
 }
 
 func GetPendingUser(clusterMember util.ClusterMemberInfo) (*util.ClusterMemberInfo, error) {
-	// clusterMemberList := []util.ClusterMemberInfo{}
-	var b strings.Builder
-
-	b.WriteString("select * from CLUSTER_MEMBER where 1=1 ")
-
-	b.WriteString("and namespace = '")
-	b.WriteString(clusterMember.Namespace)
-	b.WriteString("' ")
-
-	b.WriteString("and cluster = '")
-	b.WriteString(clusterMember.Cluster)
-	b.WriteString("' ")
-
-	b.WriteString("and member_id = '")
-	b.WriteString(clusterMember.MemberId)
-	b.WriteString("' ")
-
-	b.WriteString("and attribute = 'user' ")
-
-	b.WriteString("and status = 'pending' ")
-
-	query := b.String()
-	klog.Infoln("Query: " + query)
-	rows, err := db.Dbpool.Query(context.TODO(), query)
+	rows, err := db.Dbpool.Query(context.TODO(), SELECT_PENDING_QUERY, clusterMember.Namespace, clusterMember.Cluster, clusterMember.MemberId)
 	if err != nil {
 		klog.Error(err)
 		return nil, err
@@ -433,6 +510,15 @@ func GetPendingUser(clusterMember util.ClusterMemberInfo) (*util.ClusterMemberIn
 			&ret.UpdatedTime,
 		)
 	}
+	rows.Close()
+
+	if ret.Status != "" {
+		remoteNamespaces, err := ListRemoteNamespaces(ret.Cluster, ret.Namespace)
+		if err != nil {
+			return nil, err
+		}
+		ret.RemoteNamespaces = remoteNamespaces[ret.Attribute+"/"+ret.MemberId]
+	}
 	return &ret, nil
 }
 
@@ -534,19 +620,31 @@ func UpdateStatus(item *util.ClusterMemberInfo) error {
 	return nil
 }
 
+// UpdateRole updates the role and the remote namespaces of item.
 func UpdateRole(item util.ClusterMemberInfo) error {
 
-	query := strings.Replace(UPDATE_ROLE_QUERY, "@@ROLE@@", item.Role, -1)
-	klog.Infoln("Query: " + query)
-	klog.Infoln("Paremeters: " + item.Namespace + ", " + item.Cluster + ", " + item.MemberId + ", " + item.Attribute)
+	klog.Infoln("Query: " + UPDATE_ROLE_QUERY)
+	klog.Infoln("Paremeters: " + item.Role + ", " + item.Namespace + ", " + item.Cluster + ", " + item.MemberId + ", " + item.Attribute + ", " + strings.Join(item.RemoteNamespaces, ","))
 
-	_, err := db.Dbpool.Exec(context.TODO(), query, time.Now(), item.Namespace, item.Cluster, item.MemberId, item.Attribute)
+	ctx := context.TODO()
+	tx, err := db.Dbpool.Begin(ctx)
 	if err != nil {
 		klog.Error(err)
 		return err
 	}
+	// Rollback is a no-op after a successful Commit
+	defer tx.Rollback(ctx)
 
-	return nil
+	if _, err := tx.Exec(ctx, UPDATE_ROLE_QUERY, item.Role, time.Now(), item.Namespace, item.Cluster, item.MemberId, item.Attribute); err != nil {
+		klog.Error(err)
+		return err
+	}
+	if err := saveRemoteNamespaces(ctx, tx, item); err != nil {
+		klog.Error(err)
+		return err
+	}
+
+	return tx.Commit(ctx)
 }
 
 func Delete(item util.ClusterMemberInfo) error {
@@ -559,6 +657,10 @@ func Delete(item util.ClusterMemberInfo) error {
 		klog.Error(err)
 		return err
 	}
+	if _, err := db.Dbpool.Exec(context.TODO(), REMOTE_NAMESPACE_DELETE_QUERY, item.Namespace, item.Cluster, item.MemberId, item.Attribute); err != nil {
+		klog.Error(err)
+		return err
+	}
 
 	return nil
 }
@@ -572,10 +674,39 @@ func DeleteALL(namespace, cluster string) error {
 		klog.Error(err)
 		return err
 	}
+	if _, err := db.Dbpool.Exec(context.TODO(), DELETE_ALL_INVITATION_QUERY, namespace, cluster); err != nil {
+		klog.Error(err)
+		return err
+	}
+	if _, err := db.Dbpool.Exec(context.TODO(), REMOTE_NAMESPACE_DELETE_ALL_QUERY, namespace, cluster); err != nil {
+		klog.Error(err)
+		return err
+	}
 
 	return nil
 }
 
+// ListAllClusters returns every cluster that has members in db.
+func ListAllClusters() ([]types.NamespacedName, error) {
+	rows, err := db.Dbpool.Query(context.TODO(), SELECT_CLUSTERS_QUERY)
+	if err != nil {
+		klog.Error(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	clusterManagerNamespacedNameList := []types.NamespacedName{}
+	for rows.Next() {
+		var clusterManagerNamespacedName types.NamespacedName
+		if err := rows.Scan(&clusterManagerNamespacedName.Namespace, &clusterManagerNamespacedName.Name); err != nil {
+			klog.Error(err)
+			return nil, err
+		}
+		clusterManagerNamespacedNameList = append(clusterManagerNamespacedNameList, clusterManagerNamespacedName)
+	}
+	return clusterManagerNamespacedNameList, rows.Err()
+}
+
 func GetRemainClusterForSubject(namespace, subject, attribute string) (int, error) {
 	var b strings.Builder
 	var result int
@@ -594,7 +725,7 @@ func GetRemainClusterForSubject(namespace, subject, attribute string) (int, erro
 	b.WriteString(attribute)
 	b.WriteString("' ")
 
-	b.WriteString("and status not in ('pending') ")
+	b.WriteString("and status not in ('pending', 'expired') ")
 
 	query := b.String()
 	klog.Infoln("Query: " + query)
@@ -613,3 +744,113 @@ func GetRemainClusterForSubject(namespace, subject, attribute string) (int, erro
 	}
 	return result, nil
 }
+
+func InitInvitation() error {
+	_, err := db.Dbpool.Exec(context.TODO(), INVITATION_CREATE_QUERY)
+	return err
+}
+
+// SaveInvitation keeps tokenId as the only token that accepts or declines the invitation of item, until expiredTime.
+func SaveInvitation(item util.ClusterMemberInfo, tokenId string, expiredTime time.Time) error {
+	_, err := db.Dbpool.Exec(context.TODO(), INVITATION_UPSERT_QUERY, item.Namespace, item.Cluster, item.MemberId, tokenId, expiredTime)
+	if err != nil {
+		klog.Error(err)
+		return err
+	}
+	return nil
+}
+
+// LockCluster takes the lock of the members of a cluster across api server replicas and returns the unlock function.
+// The lock belongs to the session of a connection held until unlock, so it is released when the connection is lost.
+func LockCluster(namespace string, cluster string) (func(), error) {
+	ctx := context.TODO()
+	conn, err := db.Dbpool.Acquire(ctx)
+	if err != nil {
+		klog.Error(err)
+		return nil, err
+	}
+	key := namespace + "/" + cluster
+	if _, err := conn.Exec(ctx, CLUSTER_LOCK_QUERY, clusterLockKey, key); err != nil {
+		klog.Error(err)
+		conn.Release()
+		return nil, err
+	}
+	return func() {
+		if _, err := conn.Exec(context.TODO(), CLUSTER_UNLOCK_QUERY, clusterLockKey, key); err != nil {
+			// closing the session releases the lock
+			klog.Error(err)
+			conn.Conn().Close(context.TODO())
+		}
+		conn.Release()
+	}, nil
+}
+
+// UseInvitation consumes tokenId. It returns false if the token is expired, used or replaced by a re-sent one.
+func UseInvitation(item util.ClusterMemberInfo, tokenId string) (bool, error) {
+	tag, err := db.Dbpool.Exec(context.TODO(), INVITATION_USE_QUERY, item.Namespace, item.Cluster, item.MemberId, tokenId, time.Now())
+	if err != nil {
+		klog.Error(err)
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// ExpireInvitations marks invitations pending since before deadline as expired and drops their tokens.
+func ExpireInvitations(deadline time.Time) (int64, error) {
+	now := time.Now()
+	tag, err := db.Dbpool.Exec(context.TODO(), EXPIRE_PENDING_QUERY, now, deadline)
+	if err != nil {
+		klog.Error(err)
+		return 0, err
+	}
+	if _, err := db.Dbpool.Exec(context.TODO(), INVITATION_EXPIRE_QUERY, now); err != nil {
+		klog.Error(err)
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// GetInvitation returns the pending or expired invitation of the user in item. Status is empty if there is none.
+func GetInvitation(item util.ClusterMemberInfo) (*util.ClusterMemberInfo, error) {
+	rows, err := db.Dbpool.Query(context.TODO(), SELECT_INVITATION_QUERY, item.Namespace, item.Cluster, item.MemberId)
+	if err != nil {
+		klog.Error(err)
+		return nil, err
+	}
+	defer rows.Close()
+	ret := util.ClusterMemberInfo{}
+	if rows.Next() {
+		rows.Scan(
+			&ret.Id,
+			&ret.Namespace,
+			&ret.Cluster,
+			&ret.MemberId,
+			&ret.MemberName,
+			&ret.Attribute,
+			&ret.Role,
+			&ret.Status,
+			&ret.CreatedTime,
+			&ret.UpdatedTime,
+		)
+	}
+	rows.Close()
+
+	if ret.Status != "" {
+		remoteNamespaces, err := ListRemoteNamespaces(ret.Cluster, ret.Namespace)
+		if err != nil {
+			return nil, err
+		}
+		ret.RemoteNamespaces = remoteNamespaces[ret.Attribute+"/"+ret.MemberId]
+	}
+	return &ret, nil
+}
+
+// Resend makes the invitation of the user in item pending again from now.
+func Resend(item util.ClusterMemberInfo) error {
+	_, err := db.Dbpool.Exec(context.TODO(), RESEND_QUERY, time.Now(), item.Namespace, item.Cluster, item.MemberId)
+	if err != nil {
+		klog.Error(err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package query
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	util "github.com/tmax-cloud/hypercloud-api-server/util"
+)
+
+const (
+	DEFAULT_LIMIT = 100
+	MAX_LIMIT     = 1000
+)
+
+// Order is a sort key that has been checked against a column whitelist.
+type Order struct {
+	Column string `json:"column"`
+	Desc   bool   `json:"desc"`
+}
+
+// ParseSort converts sort query parameters ("column" or "-column") into Orders.
+// Columns that are not in allowed are rejected, so user input never reaches the ORDER BY clause.
+func ParseSort(sorts []string, allowed []string) ([]Order, error) {
+	orders := []Order{}
+	for _, s := range sorts {
+		order := Order{Column: s}
+		if strings.HasPrefix(s, "-") {
+			order.Column = s[1:]
+			order.Desc = true
+		}
+		if !util.Contains(allowed, order.Column) {
+			return nil, errors.New("Sort column [" + order.Column + "] is not allowed")
+		}
+		orders = append(orders, order)
+	}
+	return orders, nil
+}
+
+// ParsePage validates limit and offset query parameters.
+// An empty limit falls back to DEFAULT_LIMIT and an empty offset to 0.
+func ParsePage(limit string, offset string) (int, int, error) {
+	l, o := DEFAULT_LIMIT, 0
+	var err error
+	if limit != "" {
+		if l, err = strconv.Atoi(limit); err != nil || l < 1 || l > MAX_LIMIT {
+			return 0, 0, errors.New("Limit must be a number between 1 and " + strconv.Itoa(MAX_LIMIT))
+		}
+	}
+	if offset != "" {
+		if o, err = strconv.Atoi(offset); err != nil || o < 0 {
+			return 0, 0, errors.New("Offset must be a non-negative number")
+		}
+	}
+	return l, o, nil
+}
+
+// Builder assembles a select statement with $n placeholders.
+// Column names passed to Builder must come from code, never from request parameters.
+type Builder struct {
+	selectClause string
+	conds        []string
+	args         []interface{}
+	groupBy      []string
+	orders       []Order
+	limit        int
+	offset       int
+	paged        bool
+}
+
+func New(selectClause string) *Builder {
+	return &Builder{selectClause: selectClause}
+}
+
+// Arg registers a query argument and returns its placeholder.
+func (b *Builder) Arg(value interface{}) string {
+	b.args = append(b.args, value)
+	return "$" + strconv.Itoa(len(b.args))
+}
+
+// Where adds a condition in which every "?" is replaced by the placeholder of the matching argument.
+func (b *Builder) Where(cond string, args ...interface{}) *Builder {
+	var sb strings.Builder
+	i := 0
+	for _, c := range cond {
+		if c == '?' && i < len(args) {
+			sb.WriteString(b.Arg(args[i]))
+			i++
+		} else {
+			sb.WriteRune(c)
+		}
+	}
+	b.conds = append(b.conds, sb.String())
+	return b
+}
+
+func (b *Builder) Eq(column string, value interface{}) *Builder {
+	return b.Where(column+" = ?", value)
+}
+
+func (b *Builder) In(column string, values []string) *Builder {
+	return b.Where(column+" = any(?)", values)
+}
+
+func (b *Builder) Between(column string, from interface{}, to interface{}) *Builder {
+	return b.Where(column+" between ? and ?", from, to)
+}
+
+// Like adds a prefix match. LIKE wildcards in prefix are escaped.
+func (b *Builder) Like(column string, prefix string) *Builder {
+	escaped := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(prefix)
+	return b.Where(column+" like ?", escaped+"%")
+}
+
+func (b *Builder) GroupBy(columns ...string) *Builder {
+	b.groupBy = append(b.groupBy, columns...)
+	return b
+}
+
+// OrderBy appends orders and then fallback, unless fallback column is already ordered.
+func (b *Builder) OrderBy(orders []Order, fallback Order) *Builder {
+	b.orders = append(b.orders, orders...)
+	for _, o := range orders {
+		if o.Column == fallback.Column {
+			return b
+		}
+	}
+	if fallback.Column != "" {
+		b.orders = append(b.orders, fallback)
+	}
+	return b
+}
+
+func (b *Builder) Page(limit int, offset int) *Builder {
+	b.limit = limit
+	b.offset = offset
+	b.paged = true
+	return b
+}
+
+// Build returns the statement and its arguments, ready for Dbpool.Query.
+func (b *Builder) Build() (string, []interface{}) {
+	var sb strings.Builder
+	sb.WriteString(b.selectClause)
+	sb.WriteString(" where 1=1")
+	for _, cond := range b.conds {
+		sb.WriteString(" and ")
+		sb.WriteString(cond)
+	}
+	if len(b.groupBy) > 0 {
+		sb.WriteString(" group by ")
+		sb.WriteString(strings.Join(b.groupBy, ", "))
+	}
+	if len(b.orders) > 0 {
+		sb.WriteString(" order by ")
+		for i, o := range b.orders {
+			if i > 0 {
+				sb.WriteString(", ")
+			}
+			sb.WriteString(o.Column)
+			if o.Desc {
+				sb.WriteString(" desc")
+			} else {
+				sb.WriteString(" asc")
+			}
+		}
+	}
+	args := append([]interface{}{}, b.args...)
+	if b.paged {
+		args = append(args, b.limit, b.offset)
+		sb.WriteString(" limit $" + strconv.Itoa(len(args)-1))
+		sb.WriteString(" offset $" + strconv.Itoa(len(args)))
+	}
+	return sb.String(), args
+}
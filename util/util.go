@@ -37,6 +37,8 @@ type ClusterMemberInfo struct {
 	Status      string
 	CreatedTime time.Time
 	UpdatedTime time.Time
+	// remote cluster에서 Role이 적용되는 namespace. 없으면 cluster 전체
+	RemoteNamespaces []string
 }
 
 var (
@@ -48,7 +50,6 @@ var (
 	accessSecret           string
 	username               string
 	password               string
-	inviteMail             string
 	HtmlHomePath           string
 	TokenExpiredDate       string
 	ParsedTokenExpiredDate time.Duration
@@ -242,6 +243,11 @@ func MonthToInt(month time.Month) int {
 	}
 }
 
+// WallClock reads a timestamp column, which pgx returns as UTC, as the local time it was written in.
+func WallClock(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.Local)
+}
+
 func SendEmail(from string, to []string, subject string, bodyParameter map[string]string) error {
 	// func SendEmail(from string, to []string, subject string, body string, imgPath string, imgCid string) error {
 	content, err := ioutil.ReadFile(HtmlHomePath + "cluster-invitation.html")
@@ -249,20 +255,26 @@ func SendEmail(from string, to []string, subject string, bodyParameter map[strin
 		klog.Errorln(err)
 		return err
 	}
-	inviteMail = string(content)
+	// 메일마다 본문을 따로 만듦. 본문에는 초대 token이 있으므로 로그에는 받는 사람만 남김
+	inviteMail := string(content)
 
 	inviteMail = strings.Replace(inviteMail, "@@LINK@@", bodyParameter["@@LINK@@"], -1)
 	for k, v := range bodyParameter {
 		inviteMail = strings.Replace(inviteMail, k, v, -1)
 	}
 
-	klog.Infoln(inviteMail)
+	klog.Infoln("Send invitation mail of cluster [" + bodyParameter["@@CLUSTER_NAME@@"] + "] to " + strings.Join(to, ","))
+
+	return SendHtmlEmail(to, subject, inviteMail)
+}
 
+// SendHtmlEmail sends body to the addresses in to, from the SMTP account.
+func SendHtmlEmail(to []string, subject string, body string) error {
 	m := gomail.NewMessage()
 	m.SetHeader("From", username)
 	m.SetHeader("To", strings.Join(to[:], ","))
 	m.SetHeader("Subject", subject)
-	m.SetBody("text/html", inviteMail)
+	m.SetBody("text/html", body)
 	// m.Embed(imgPath)
 	d := gomail.NewDialer(SMTPHost, SMTPPort, username, password)
 
@@ -273,9 +285,12 @@ func SendEmail(from string, to []string, subject string, bodyParameter map[strin
 	return nil
 }
 
-func CreateToken(clusterMember ClusterMemberInfo) (string, error) {
+// CreateToken signs an invitation of clusterMember. tokenId makes it single use: only the latest id saved
+// for the invitation is accepted.
+func CreateToken(clusterMember ClusterMemberInfo, tokenId string) (string, error) {
 	atClaims := jwt.MapClaims{}
 	atClaims["authorized"] = true
+	atClaims["jti"] = tokenId
 	atClaims["namespace"] = clusterMember.Namespace
 	atClaims["cluster"] = clusterMember.Cluster
 	atClaims["user_id"] = clusterMember.MemberId
@@ -350,20 +365,24 @@ func VerifyToken(r *http.Request) (*jwt.Token, error) {
 // 	return nil
 // }
 
-func TokenValid(r *http.Request, clusterMember ClusterMemberInfo) ([]string, error) {
+// TokenValid verifies the signature and expiry of the token in the request, and that it invites clusterMember.
+// It returns the id of the token.
+func TokenValid(r *http.Request, clusterMember ClusterMemberInfo) (string, error) {
 	var memberId string
 	var cluster string
 	var namespace string
+	var tokenId string
 	// var groups []string
 	token, err := VerifyToken(r)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 	claims, ok := token.Claims.(jwt.MapClaims)
 	if ok && token.Valid {
-		memberId, ok = claims["user_id"].(string)
-		cluster, ok = claims["cluster"].(string)
-		namespace, ok = claims["namespace"].(string)
+		memberId, _ = claims["user_id"].(string)
+		cluster, _ = claims["cluster"].(string)
+		namespace, _ = claims["namespace"].(string)
+		tokenId, _ = claims["jti"].(string)
 		// tmp, ok = claims["user_groups"].([]interface{})
 		// groups = make([]string, len(tmp))
 		// for i, v := range tmp {
@@ -371,10 +390,10 @@ func TokenValid(r *http.Request, clusterMember ClusterMemberInfo) ([]string, err
 		// }
 	}
 
-	if clusterMember.MemberId == memberId && clusterMember.Cluster == cluster && clusterMember.Namespace == namespace {
-		return nil, nil
+	if tokenId != "" && clusterMember.MemberId == memberId && clusterMember.Cluster == cluster && clusterMember.Namespace == namespace {
+		return tokenId, nil
 	}
-	return nil, errors.New("Request user or target cluster does not match with token payload")
+	return "", errors.New("Request user or target cluster does not match with token payload")
 }
 
 func Search(NamespacedNameList []types.NamespacedName, clmList *clusterv1alpha1.ClusterManagerList) *clusterv1alpha1.ClusterManagerList {